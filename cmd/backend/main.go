@@ -0,0 +1,122 @@
+// cmd/backend/main.go
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kingoftowns/tf-go/internal/config"
+	"github.com/kingoftowns/tf-go/internal/constants"
+	"github.com/kingoftowns/tf-go/internal/terraform"
+)
+
+const usage = `Usage: backend <command> [flags]
+
+Commands:
+  bootstrap   Create the state bucket and lock table, harden them and report misconfiguration
+`
+
+func main() {
+	ctx := context.Background()
+
+	if err := run(ctx, os.Args[1:]); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		fmt.Print(usage)
+		return fmt.Errorf("a command is required")
+	}
+
+	switch args[0] {
+	case "bootstrap":
+		return runBootstrap(ctx, args[1:])
+	default:
+		fmt.Print(usage)
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+}
+
+// runBootstrap creates the backend resources for an environment and then audits
+// them. Buckets that already existed are only reported unless -fix is passed.
+func runBootstrap(ctx context.Context, args []string) error {
+	defaultEnv := os.Getenv("TF_ENV")
+	if defaultEnv == "" {
+		defaultEnv = constants.DefaultEnvironment
+	}
+
+	var (
+		envFlag   string
+		stackFlag string
+		fixFlag   bool
+	)
+
+	flags := flag.NewFlagSet("bootstrap", flag.ContinueOnError)
+	flags.StringVar(&envFlag, "env", defaultEnv, "Environment name")
+	flags.StringVar(&envFlag, "e", defaultEnv, "Environment name (shorthand)")
+	flags.StringVar(&stackFlag, "stack", "", "Stack name, used to resolve :STACK placeholders")
+	flags.StringVar(&stackFlag, "s", "", "Stack name (shorthand)")
+	flags.BoolVar(&fixFlag, "fix", false, "Apply hardening settings to an existing bucket that fails the audit")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := config.LoadConfig(envFlag)
+	if err != nil {
+		return fmt.Errorf("loading configuration: %w", err)
+	}
+
+	backendCfg := cfg.ResolveBackend(envFlag)
+	if backendCfg.Type != "s3" {
+		return fmt.Errorf("bootstrap only supports the s3 backend, %s uses %s", envFlag, backendCfg.Type)
+	}
+
+	// Only the bucket and lock table are bootstrapped, so the state key is not needed
+	s3Config := terraform.NewS3BackendConfig(backendCfg)
+	s3Config.Key = ""
+	s3Config, err = terraform.ResolveS3BackendConfig(ctx, s3Config, terraform.NewNaming(cfg, envFlag, stackFlag))
+	if err != nil {
+		return fmt.Errorf("resolving backend configuration: %w", err)
+	}
+
+	fmt.Printf("Bootstrapping S3 backend: s3://%s in %s\n", s3Config.Bucket, s3Config.Region)
+	if s3Config.DynamoDBTable != "" {
+		fmt.Printf("Lock table: %s\n", s3Config.DynamoDBTable)
+	}
+
+	if err := terraform.EnsureS3Backend(ctx, s3Config); err != nil {
+		return err
+	}
+
+	findings, err := terraform.AuditS3Backend(ctx, s3Config)
+	if err != nil {
+		return err
+	}
+
+	if len(findings) > 0 && fixFlag {
+		fmt.Printf("Fixing %d hardening issue(s)...\n", len(findings))
+		if err := terraform.HardenS3Backend(ctx, s3Config); err != nil {
+			return err
+		}
+		if findings, err = terraform.AuditS3Backend(ctx, s3Config); err != nil {
+			return err
+		}
+	}
+
+	if len(findings) == 0 {
+		fmt.Println("Backend is bootstrapped and passes all hardening checks.")
+		return nil
+	}
+
+	fmt.Println("\nBackend hardening issues:")
+	for _, finding := range findings {
+		fmt.Printf("  ✗ %s\n", finding)
+	}
+	return fmt.Errorf("backend has %d hardening issue(s); rerun with -fix to remediate", len(findings))
+}
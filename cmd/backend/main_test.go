@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/kingoftowns/tf-go/internal/testutil"
+)
+
+func setupBackendProject(t *testing.T) *testutil.AWSServer {
+	t.Helper()
+
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		"environments/dev.yaml": `backend:
+  type: s3
+  config:
+    bucket: "tfstate-:ACCOUNT"
+    region: "us-east-1"
+    dynamodb_table: "locks-:ENV"
+    kms_key_id: "alias/tfstate"
+`,
+	})
+	testutil.Chdir(t, root)
+
+	aws := testutil.NewAWSServer(t)
+	aws.SetEnv(t)
+	t.Setenv("AWS_ACCOUNT_ID", testutil.DefaultAWSAccountID)
+
+	return aws
+}
+
+func TestBootstrapCreatesBackend(t *testing.T) {
+	aws := setupBackendProject(t)
+
+	if err := run(context.Background(), []string{"bootstrap", "-e", "dev"}); err != nil {
+		t.Fatalf("bootstrap returned error: %v", err)
+	}
+
+	bucket := aws.Bucket("tfstate-" + testutil.DefaultAWSAccountID)
+	if bucket == nil {
+		t.Fatal("bucket was not created")
+	}
+	if !strings.Contains(string(bucket.Config["encryption"]), "alias/tfstate") {
+		t.Errorf("bucket encryption does not use configured key: %s", bucket.Config["encryption"])
+	}
+	if aws.Table("locks-dev") == nil {
+		t.Error("lock table was not created")
+	}
+}
+
+func TestBootstrapReportsAndFixesExistingBucket(t *testing.T) {
+	aws := setupBackendProject(t)
+	aws.CreateBucket("tfstate-" + testutil.DefaultAWSAccountID)
+
+	err := run(context.Background(), []string{"bootstrap", "-e", "dev"})
+	if err == nil || !strings.Contains(err.Error(), "5 hardening issue(s)") {
+		t.Fatalf("expected hardening issues to be reported, got %v", err)
+	}
+
+	if err := run(context.Background(), []string{"bootstrap", "-e", "dev", "-fix"}); err != nil {
+		t.Fatalf("bootstrap -fix returned error: %v", err)
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	if err := run(context.Background(), []string{"nuke"}); err == nil {
+		t.Fatal("expected error for unknown command")
+	}
+}
@@ -0,0 +1,239 @@
+// cmd/config/main.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/kingoftowns/tf-go/internal/config"
+	"github.com/kingoftowns/tf-go/internal/constants"
+	"github.com/kingoftowns/tf-go/internal/redact"
+	"gopkg.in/yaml.v3"
+)
+
+const usage = `Usage: config <command> [flags]
+
+Commands:
+  validate  Check config.yaml, .tf-go.yaml and every environments/*.yaml file
+  show      Print the configuration merged from every layer
+  tfvars    Explain which tfvars files a deploy uses and why others are skipped
+
+Flags:
+  -dir, -d    Directory to find the project root from (default: current directory)
+  -env, -e    Environment to merge in (show and tfvars, default: TF_ENV or dev)
+  -stack, -s  Stack to merge in (show and tfvars)
+  -resolved   Print every setting with the layer it came from (show only)
+`
+
+func main() {
+	ctx := context.Background()
+
+	if err := run(ctx, os.Args[1:]); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		fmt.Print(usage)
+		return fmt.Errorf("a command is required")
+	}
+
+	defaultEnv := os.Getenv("TF_ENV")
+	if defaultEnv == "" {
+		defaultEnv = constants.DefaultEnvironment
+	}
+
+	command := args[0]
+	var (
+		dir      string
+		env      string
+		stack    string
+		resolved bool
+	)
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.StringVar(&dir, "dir", ".", "Directory to find the project root from")
+	flags.StringVar(&dir, "d", ".", "Directory to find the project root from (shorthand)")
+
+	switch command {
+	case "validate":
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if root, found := config.FindProjectRoot(dir); found {
+			dir = root
+		}
+		return runValidate(dir)
+	case "show", "tfvars":
+		flags.StringVar(&env, "env", defaultEnv, "Environment name")
+		flags.StringVar(&env, "e", defaultEnv, "Environment name (shorthand)")
+		flags.StringVar(&stack, "stack", "", "Stack name")
+		flags.StringVar(&stack, "s", "", "Stack name (shorthand)")
+		if command == "show" {
+			flags.BoolVar(&resolved, "resolved", false, "Print every setting with the layer it came from")
+		}
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		opts := config.LoadOptions{Env: env, Stack: stack, Dir: dir}
+		if command == "tfvars" {
+			return runTfvars(opts)
+		}
+		return runShow(opts, resolved)
+	default:
+		fmt.Print(usage)
+		return fmt.Errorf("unknown command: %s", command)
+	}
+}
+
+// runValidate prints every problem in the project's config files
+func runValidate(dir string) error {
+	files, err := config.ValidateFiles(dir)
+
+	var invalid *config.ValidationError
+	if errors.As(err, &invalid) {
+		for _, problem := range invalid.Problems {
+			problem.File = relativePath(dir, problem.File)
+			fmt.Println(problem)
+		}
+		return fmt.Errorf("found %d problem(s) in %d file(s)", len(invalid.Problems), len(files))
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		fmt.Printf("No config.yaml or environments/*.yaml found in %s\n", dir)
+		return nil
+	}
+	for _, file := range files {
+		fmt.Printf("%s: ok\n", relativePath(dir, file))
+	}
+	return nil
+}
+
+// relativePath shortens a path under dir for display
+func relativePath(dir, path string) string {
+	if rel, err := filepath.Rel(dir, path); err == nil {
+		return rel
+	}
+	return path
+}
+
+// runShow prints the merged configuration. With resolved it prints one line
+// per setting along with the file, default or variable that set it.
+func runShow(opts config.LoadOptions, resolved bool) error {
+	result, err := config.Resolve(opts)
+	if err != nil {
+		return err
+	}
+	redact.RegisterConfig(result.Tree())
+	for _, value := range result.Values {
+		if s, ok := value.Value.(string); ok && isSecretSetting(value.Path) {
+			redact.Register(s)
+		}
+	}
+
+	fmt.Printf("# project root: %s\n", result.Root)
+	for _, file := range result.Files {
+		fmt.Printf("# read: %s\n", file)
+	}
+
+	if !resolved {
+		var out strings.Builder
+		encoder := yaml.NewEncoder(&out)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(maskSecrets(result.Tree(), "")); err != nil {
+			return err
+		}
+		fmt.Print(redact.String(out.String()))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, value := range result.Values {
+		fmt.Fprintf(w, "%s: %s\t# %s\n", value.Path, formatValue(value), value.Source)
+	}
+	return w.Flush()
+}
+
+// runTfvars prints every tfvars file considered for the environment and
+// stack, in the order the picked ones are applied
+func runTfvars(opts config.LoadOptions) error {
+	cfg, err := config.Load(opts)
+	if err != nil {
+		return err
+	}
+	basePath := cfg.BasePath()
+
+	fmt.Printf("# base path: %s\n", basePath)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LAYER\tFILE\tRESULT")
+	for _, candidate := range cfg.ExplainVarsPath(opts.Env, opts.Stack, basePath) {
+		result := "used"
+		if !candidate.Picked {
+			result = "skipped: " + candidate.Reason
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", candidate.Layer, relativePath(basePath, candidate.Path), result)
+	}
+	return w.Flush()
+}
+
+// secretSettings are settings that hold secrets whatever their key is called
+var secretSettings = map[string]bool{
+	"vault.secret_id": true,
+	"vault.token":     true,
+}
+
+// isSecretSetting reports whether the setting at the dotted path holds a
+// secret
+func isSecretSetting(path string) bool {
+	keys := strings.Split(path, ".")
+	return secretSettings[path] || redact.IsSecretKey(keys[len(keys)-1])
+}
+
+// maskSecrets returns a copy of tree with the value of every secret setting
+// replaced by redact.Placeholder. prefix is the dotted path of tree.
+func maskSecrets(tree map[string]interface{}, prefix string) map[string]interface{} {
+	masked := make(map[string]interface{}, len(tree))
+	for key, value := range tree {
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			masked[key] = maskSecrets(v, path)
+		default:
+			if isSecretSetting(path) {
+				masked[key] = redact.Placeholder
+			} else {
+				masked[key] = value
+			}
+		}
+	}
+	return masked
+}
+
+// formatValue shows a setting on one line, hiding secrets
+func formatValue(value config.ResolvedValue) string {
+	if isSecretSetting(value.Path) {
+		return redact.Placeholder
+	}
+	if s, ok := value.Value.(string); ok && s != "" {
+		return redact.String(s)
+	}
+	data, err := json.Marshal(value.Value)
+	if err != nil {
+		return fmt.Sprint(value.Value)
+	}
+	return redact.String(string(data))
+}
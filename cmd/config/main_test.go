@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kingoftowns/tf-go/internal/testutil"
+)
+
+// captureStdout returns what fn prints
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	fn()
+	w.Close()
+	out, _ := io.ReadAll(r)
+	return string(out)
+}
+
+func TestRunValidate(t *testing.T) {
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		"config.yaml":           "project: shop\nterraform:\n  backend_type: s3\n",
+		"environments/dev.yaml": "name: Development\nbackend:\n  type: local\n",
+	})
+
+	var err error
+	out := captureStdout(t, func() {
+		err = run(context.Background(), []string{"validate", "-dir", root})
+	})
+	if err != nil {
+		t.Fatalf("run returned error: %v", err)
+	}
+	if out != "config.yaml: ok\nenvironments/dev.yaml: ok\n" {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
+
+func TestRunValidateReportsProblems(t *testing.T) {
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		"config.yaml":            "project: shop\nvault:\n  adress: http://vault:8200\n",
+		"environments/dev.yaml":  "name: Development\n",
+		"environments/prod.yaml": "backend:\n  type: s3\n  auto_create: maybe\n",
+	})
+	testutil.Chdir(t, root)
+
+	var err error
+	out := captureStdout(t, func() {
+		err = run(context.Background(), []string{"validate"})
+	})
+	if err == nil || err.Error() != "found 2 problem(s) in 3 file(s)" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	want := "config.yaml:3:3: unknown field vault.adress (known fields: address, auth_method, role_name, secret_id)\n" +
+		"environments/prod.yaml:3:16: backend.auto_create must be true or false, got \"maybe\"\n"
+	if out != want {
+		t.Errorf("output:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestRunShowResolved(t *testing.T) {
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		"config.yaml":           "project: shop\nvault:\n  address: http://vault:8200\n",
+		"environments/dev.yaml": "settings:\n  db_password: hunter22\n  replicas: 2\n",
+	})
+	testutil.Chdir(t, filepath.Join(root, "environments"))
+	t.Setenv("TFGO_APP", "web")
+
+	var err error
+	out := captureStdout(t, func() {
+		err = run(context.Background(), []string{"show", "-e", "dev", "--resolved"})
+	})
+	if err != nil {
+		t.Fatalf("run returned error: %v", err)
+	}
+	for _, want := range []string{
+		"app: web",
+		"# env TFGO_APP",
+		"environments.dev.settings.db_password: (redacted)",
+		"environments.dev.settings.replicas: 2",
+		"# environments/dev.yaml:3",
+		"vault.address: http://vault:8200",
+		"# config.yaml:3",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output is missing %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "hunter22") {
+		t.Errorf("output leaks a secret:\n%s", out)
+	}
+}
+
+func TestRunTfvars(t *testing.T) {
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		"config.yaml":                           "project: shop\n",
+		"config/terraform/tfvars/base.tfvars":   "",
+		"config/terraform/tfvars/devops.tfvars": "",
+		"app/stacks/web/tfvars/dev.tfvars":      "",
+	})
+	testutil.Chdir(t, root)
+	t.Setenv("TF_PATH", "")
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+
+	var err error
+	out := captureStdout(t, func() {
+		err = run(context.Background(), []string{"tfvars", "-e", "dev", "-s", "web"})
+	})
+	if err != nil {
+		t.Fatalf("run returned error: %v", err)
+	}
+	var lines []string
+	for _, line := range strings.Split(out, "\n") {
+		if line != "" && !strings.HasPrefix(line, "# ") {
+			lines = append(lines, strings.Join(strings.Fields(line), " "))
+		}
+	}
+	want := []string{
+		"LAYER FILE RESULT",
+		"global_base config/terraform/tfvars/base.tfvars used",
+		"env_base config/terraform/tfvars/dev.tfvars skipped: not found",
+		"env_base config/terraform/tfvars/devops.tfvars skipped: not an exact match for dev.tfvars; earlier versions read it",
+		"stack_base app/stacks/web/tfvars/base.tfvars skipped: not found",
+		"stack_env app/stacks/web/tfvars/dev.tfvars used",
+		"region config/terraform/tfvars/regions/{{region}}.tfvars skipped: no region: AWS_REGION and AWS_DEFAULT_REGION are not set",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("output:\n%s\nwant:\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestRunUnknownCommand(t *testing.T) {
+	var err error
+	out := captureStdout(t, func() {
+		err = run(context.Background(), []string{"lint"})
+	})
+	if err == nil || !strings.Contains(err.Error(), "unknown command: lint") || !strings.Contains(out, "Usage: config") {
+		t.Errorf("expected usage and unknown command error, got %v:\n%s", err, out)
+	}
+}
+
+func TestRunShowMasksSecrets(t *testing.T) {
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		"config.yaml":           "project: shop\nvault:\n  secret_id: s3cr3t-value-123\n",
+		"environments/dev.yaml": "settings:\n  db_pass: pa55-word-456\n  replicas: 2\n",
+	})
+	testutil.Chdir(t, root)
+
+	for _, args := range [][]string{{"show", "-e", "dev"}, {"show", "-e", "dev", "--resolved"}} {
+		var err error
+		out := captureStdout(t, func() {
+			err = run(context.Background(), args)
+		})
+		if err != nil {
+			t.Fatalf("run %v returned error: %v", args, err)
+		}
+		if strings.Contains(out, "s3cr3t-value-123") || strings.Contains(out, "pa55-word-456") {
+			t.Errorf("run %v leaks a secret:\n%s", args, out)
+		}
+		if !strings.Contains(out, "secret_id: (redacted)") || !strings.Contains(out, "db_pass: (redacted)") {
+			t.Errorf("run %v should show the secrets as redacted:\n%s", args, out)
+		}
+	}
+}
@@ -41,37 +41,37 @@ func main() {
 	fmt.Printf("\n")
 
 	// Load config
-	cfg, err := config.LoadConfig(envFlag)
+	cfg, err := config.Load(config.LoadOptions{Env: envFlag, Stack: stackFlag})
 	if err != nil {
 		fmt.Printf("Error loading configuration: %v\n", err)
 		os.Exit(1)
 	}
 
 	// Show resolved backend config
-	s3Config := terraform.S3BackendConfig{}
-
-	// Check if environment config overrides S3 settings
-	if envConfig, ok := cfg.Environments[envFlag]; ok && envConfig.Backend.Type == "s3" {
-		if bucket, ok := envConfig.Backend.Config["bucket"]; ok {
-			s3Config.Bucket = fmt.Sprintf("%v", bucket)
-		}
-		if key, ok := envConfig.Backend.Config["key"]; ok {
-			s3Config.Key = fmt.Sprintf("%v", key)
-		}
-		if region, ok := envConfig.Backend.Config["region"]; ok {
-			s3Config.Region = fmt.Sprintf("%v", region)
-		}
-		if dynamo, ok := envConfig.Backend.Config["dynamodb_table"]; ok {
-			s3Config.DynamoDBTable = fmt.Sprintf("%v", dynamo)
-		}
+	naming := terraform.NewNaming(cfg, envFlag, stackFlag)
+	backend, err := terraform.NewBackend(ctx, cfg.ResolveBackend(envFlag), naming)
+	if err != nil {
+		fmt.Printf("Error configuring backend: %v\n", err)
+		os.Exit(1)
+	}
+	workspace, err := terraform.ResolveWorkspace(ctx, cfg, envFlag, naming, backend)
+	if err != nil {
+		fmt.Printf("Error resolving workspace: %v\n", err)
+		os.Exit(1)
+	}
+	if workspace == "" {
+		workspace = terraform.DefaultWorkspace
 	}
 
-	// Apply backend.rb equivalent defaults and resolve placeholders
-	resolvedConfig := terraform.ResolveS3BackendConfig(ctx, s3Config, envFlag, stackFlag)
-
-	fmt.Printf("=== Resolved S3 Backend Configuration ===\n")
-	configJSON, _ := json.MarshalIndent(resolvedConfig, "", "  ")
-	fmt.Printf("%s\n\n", configJSON)
+	fmt.Printf("=== Resolved %s Backend Configuration ===\n", backend.Type())
+	fmt.Printf("Workspace: %s\n", workspace)
+	configJSON, _ := json.MarshalIndent(backend, "", "  ")
+	fmt.Printf("%s\n", configJSON)
+	if err := backend.Validate(); err != nil {
+		fmt.Printf("Validation: ✗ %v\n\n", err)
+	} else {
+		fmt.Printf("Validation: ✓\n\n")
+	}
 
 	// Show what the backend.tf file would contain
 	fmt.Printf("=== Generated backend.tf Content ===\n")
@@ -84,7 +84,7 @@ func main() {
 	}
 	defer executor.Clean()
 
-	err = executor.CreateBackendFile(resolvedConfig)
+	err = executor.CreateBackendFile(backend)
 	if err != nil {
 		fmt.Printf("Error creating backend file: %v\n", err)
 		os.Exit(1)
@@ -99,6 +99,12 @@ func main() {
 
 	fmt.Printf("%s\n", backendContent)
 
+	fmt.Printf("=== terraform init -backend-config Arguments ===\n")
+	for _, arg := range terraform.BackendConfigArgs(backend) {
+		fmt.Printf("  -backend-config=%s\n", arg)
+	}
+	fmt.Println()
+
 	// Show provider path resolution
 	fmt.Printf("=== Provider Configuration ===\n")
 	providerPath := cfg.ResolveProviderPath(envFlag)
@@ -106,26 +112,15 @@ func main() {
 
 	// Show vars file resolution
 	fmt.Printf("\n=== Vars File Resolution ===\n")
-	basePath := os.Getenv("TF_PATH")
-	if basePath == "" {
-		basePath = "."
-	}
-
-	terraformPath := basePath
-	if stackFlag != "" {
-		stackPath := cfg.ResolveStackPath(stackFlag)
-		terraformPath = fmt.Sprintf("%s/%s", basePath, stackPath)
-	}
-
-	varsFilePaths := cfg.ResolveVarsPath(envFlag, stackFlag, terraformPath)
-	fmt.Printf("Terraform path: %s\n", terraformPath)
-	fmt.Printf("Vars file paths:\n")
-	for i, path := range varsFilePaths {
-		exists := "✗"
-		if _, err := os.Stat(path); err == nil {
-			exists = "✓"
+	basePath := cfg.BasePath()
+	fmt.Printf("Base path: %s\n", basePath)
+	fmt.Printf("Vars files considered:\n")
+	for _, candidate := range cfg.ExplainVarsPath(envFlag, stackFlag, basePath) {
+		result := "✓"
+		if !candidate.Picked {
+			result = "✗ " + candidate.Reason
 		}
-		fmt.Printf("  [%d] %s %s\n", i+1, exists, path)
+		fmt.Printf("  [%s] %s %s\n", candidate.Layer, candidate.Path, result)
 	}
 
 	// Check if we're in GitLab environment
@@ -141,8 +136,14 @@ func main() {
 
 	// Show state file information if accessible
 	fmt.Printf("\n=== State File Analysis ===\n")
-	stateKey := resolvedConfig.Key
-	stateBucket := resolvedConfig.Bucket
+	s3Backend, ok := backend.(*terraform.S3Backend)
+	if !ok {
+		fmt.Printf("State location: %s\n", backend.Describe())
+		fmt.Printf("State file analysis is only available for the s3 backend.\n")
+		return
+	}
+	stateKey := s3Backend.Config.StateKey()
+	stateBucket := s3Backend.Config.Bucket
 
 	fmt.Printf("Expected state location: s3://%s/%s\n", stateBucket, stateKey)
 
@@ -150,29 +151,12 @@ func main() {
 	fmt.Printf("\nTo check if the state file exists, run:\n")
 	fmt.Printf("  aws s3 ls s3://%s/%s\n", stateBucket, stateKey)
 	fmt.Printf("\nTo download and inspect the state file, run:\n")
-	fmt.Printf("  aws s3 cp s3://%s/%s ./terraform.tfstate\n", stateBucket, stateKey)
-	fmt.Printf("  terraform show -json ./terraform.tfstate | jq '.values.root_module.resources[] | .address'\n")
-
-	// Show potential Terraspace vs tf-go differences
-	fmt.Printf("\n=== Potential Terraspace Differences ===\n")
-	fmt.Printf("Terraspace typically uses state keys like:\n")
-	fmt.Printf("  - :ENV/:STACK/terraform.tfstate\n")
-	fmt.Printf("  - :ENV/:MOD_NAME/terraform.tfstate\n")
-	fmt.Printf("  - stacks/:STACK/:ENV/terraform.tfstate\n")
-	fmt.Printf("\nYour tf-go uses: %s\n", stateKey)
-
-	// Show commands to compare Terraspace vs tf-go state
-	fmt.Printf("\n=== Debugging Commands ===\n")
-	fmt.Printf("To see what Terraspace is using, check your Terraspace config:\n")
-	fmt.Printf("  grep -r \"bucket\\|key\" config/terraform/backend.rb\n")
-	fmt.Printf("  terraspace info %s --env %s\n", stackFlag, envFlag)
-	fmt.Printf("\nTo compare state files:\n")
-	fmt.Printf("  # Download Terraspace state\n")
-	fmt.Printf("  terraspace state pull %s --env %s\n", stackFlag, envFlag)
-	fmt.Printf("  # Download tf-go state  \n")
-	fmt.Printf("  aws s3 cp s3://%s/%s ./tf-go-state.json\n", stateBucket, stateKey)
-	fmt.Printf("  # Compare\n")
-	fmt.Printf("  diff terraform.tfstate tf-go-state.json\n")
-
-	fmt.Printf("\nIf Terraspace is using a different pattern, this could cause state drift.\n")
+	fmt.Printf("  go run ./cmd/state pull -s %s -e %s\n", stackFlag, envFlag)
+	fmt.Printf("  go run ./cmd/state list -s %s -e %s\n", stackFlag, envFlag)
+
+	// Point at migrate-state for projects moving off Terraspace key layouts
+	fmt.Printf("\n=== Migrating From Terraspace ===\n")
+	fmt.Printf("If state was written by Terraspace under a different key layout, preview the copy with:\n")
+	fmt.Printf("  go run ./cmd/migrate-state -e %s -from 'stacks/:STACK/:ENV/terraform.tfstate'\n", envFlag)
+	fmt.Printf("and rerun with -apply once the report looks right.\n")
 }
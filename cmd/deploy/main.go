@@ -12,6 +12,7 @@ import (
 
 	"github.com/kingoftowns/tf-go/internal/config"
 	"github.com/kingoftowns/tf-go/internal/constants"
+	"github.com/kingoftowns/tf-go/internal/redact"
 	"github.com/kingoftowns/tf-go/internal/terraform"
 	"github.com/kingoftowns/tf-go/internal/vault"
 )
@@ -31,6 +32,21 @@ func (v *VarFlags) Set(value string) error {
 func main() {
 	ctx := context.Background()
 
+	if err := run(ctx, os.Args[1:]); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run parses args and executes the requested Terraform action. It is split out
+// of main so the whole deploy flow can be driven from tests.
+func run(ctx context.Context, args []string) error {
+	// The exec block of generated kubernetes and helm providers runs deploy
+	// again to fetch a fresh EKS token
+	if len(args) > 0 && args[0] == terraform.EKSTokenCommand {
+		return terraform.RunEKSTokenCommand(ctx, args[1:])
+	}
+
 	defaultPath := os.Getenv("TF_PATH")
 	defaultEnv := os.Getenv("TF_ENV")
 	if defaultEnv == "" {
@@ -46,89 +62,92 @@ func main() {
 		pathFlag      string
 		stackFlag     string
 		envFlag       string
-		varsFileFlag  string
+		noAutoVars    bool
 		actionFlag    string
 		vaultAddrFlag string
 		saveWorkspace string
 		varsFlag      VarFlags
+		varsFileFlags VarFlags
 	)
 
-	flag.StringVar(&pathFlag, "path", defaultPath, "Path to Terraform code")
-	flag.StringVar(&pathFlag, "p", defaultPath, "Path to Terraform code (shorthand)")
-	flag.StringVar(&stackFlag, "stack", "", "Stack name (if using app/stacks structure)")
-	flag.StringVar(&stackFlag, "s", "", "Stack name (shorthand)")
-	flag.StringVar(&envFlag, "env", defaultEnv, "Environment name")
-	flag.StringVar(&envFlag, "e", defaultEnv, "Environment name (shorthand)")
-	flag.StringVar(&varsFileFlag, "vars-file", "", "Path to tfvars file")
-	flag.StringVar(&varsFileFlag, "v", "", "Path to tfvars file (shorthand)")
-	flag.StringVar(&actionFlag, "action", defaultAction, "Terraform action (plan, apply, destroy)")
-	flag.StringVar(&vaultAddrFlag, "vault-addr", defaultVaultAddr, "Vault server address")
-	flag.StringVar(&saveWorkspace, "save-workspace", "", "Save terraform workspace to this directory path")
-	flag.Var(&varsFlag, "var", "Set a variable in the Terraform configuration (can be used multiple times)")
-
-	flag.Parse()
+	flags := flag.NewFlagSet("deploy", flag.ContinueOnError)
+	flags.StringVar(&pathFlag, "path", defaultPath, "Path to Terraform code")
+	flags.StringVar(&pathFlag, "p", defaultPath, "Path to Terraform code (shorthand)")
+	flags.StringVar(&stackFlag, "stack", "", "Stack name (if using app/stacks structure)")
+	flags.StringVar(&stackFlag, "s", "", "Stack name (shorthand)")
+	flags.StringVar(&envFlag, "env", defaultEnv, "Environment name")
+	flags.StringVar(&envFlag, "e", defaultEnv, "Environment name (shorthand)")
+	flags.Var(&varsFileFlags, "vars-file", "Path to a .tfvars or .tfvars.json file applied after the discovered ones (can be used multiple times)")
+	flags.Var(&varsFileFlags, "v", "Path to a .tfvars or .tfvars.json file (shorthand)")
+	flags.BoolVar(&noAutoVars, "no-auto-vars", false, "Use only the -vars-file files, not the discovered tfvars files")
+	flags.StringVar(&actionFlag, "action", defaultAction, "Terraform action (plan, apply, destroy)")
+	flags.StringVar(&vaultAddrFlag, "vault-addr", defaultVaultAddr, "Vault server address")
+	flags.StringVar(&saveWorkspace, "save-workspace", "", "Save terraform workspace to this directory path")
+	flags.Var(&varsFlag, "var", "Set a variable in the Terraform configuration (can be used multiple times)")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
 
 	if pathFlag == "" && stackFlag == "" {
-		fmt.Println("Error: either --path or --stack flag is required")
-		flag.Usage()
-		os.Exit(1)
+		flags.Usage()
+		return fmt.Errorf("either --path or --stack flag is required")
 	}
 
-	cfg, err := config.LoadConfig(envFlag)
+	cfg, err := config.Load(config.LoadOptions{Env: envFlag, Stack: stackFlag})
 	if err != nil {
-		fmt.Printf("Error loading configuration: %v\n", err)
-		os.Exit(1)
+		return fmt.Errorf("loading configuration: %w", err)
 	}
 
 	var terraformPath string
 	var varsFilePaths []string
 
-	fmt.Printf("[DEBUG] pathFlag: %s, stackFlag: %s, TF_PATH: %s\n", pathFlag, stackFlag, os.Getenv("TF_PATH"))
+	redact.Printf("[DEBUG] pathFlag: %s, stackFlag: %s, TF_PATH: %s\n", pathFlag, stackFlag, os.Getenv("TF_PATH"))
 
 	if stackFlag != "" {
 		// Stack takes priority over path flag
-		// Resolve stack path relative to TF_PATH
-		basePath := os.Getenv("TF_PATH")
-		if basePath == "" {
-			basePath = "."
-		}
+		// Resolve stack path relative to TF_PATH or the project root
+		basePath := cfg.BasePath()
 
 		// Use the stack path directly - this points to app/stacks/{stack}
 		stackPath := cfg.ResolveStackPath(stackFlag)
 		terraformPath = filepath.Join(basePath, stackPath)
 		fmt.Printf("Using stack path: %s\n", terraformPath)
-		fmt.Printf("[DEBUG] basePath: %s, stackPath: %s, stackFlag: %s\n", basePath, stackPath, stackFlag)
+		redact.Printf("[DEBUG] basePath: %s, stackPath: %s, stackFlag: %s\n", basePath, stackPath, stackFlag)
 	} else if pathFlag != "" {
 		terraformPath = pathFlag
-		fmt.Printf("[DEBUG] Using pathFlag: %s\n", terraformPath)
+		redact.Printf("[DEBUG] Using pathFlag: %s\n", terraformPath)
 	} else {
 		terraformPath = os.Getenv("TF_PATH")
 		if terraformPath == "" {
 			terraformPath = "."
 		}
-		fmt.Printf("[DEBUG] Using TF_PATH fallback: %s\n", terraformPath)
+		redact.Printf("[DEBUG] Using TF_PATH fallback: %s\n", terraformPath)
 	}
 
-	if varsFileFlag != "" {
-		varsFilePaths = []string{varsFileFlag}
+	if !noAutoVars {
+		// For tfvars resolution, always use the base path, not the stack-specific path
+		varsFilePaths = cfg.ResolveVarsPath(envFlag, stackFlag, cfg.BasePath())
+		if stackFlag == "" {
+			// ResolveVarsPath only finds the auto tfvars files of a -stack
+			varsFilePaths = append(config.AutoVarsFiles(terraformPath), varsFilePaths...)
+		}
 	} else {
-		// For tfvars resolution, always use the base TF_PATH, not the stack-specific path
-		baseTerraformPath := os.Getenv("TF_PATH")
-		if baseTerraformPath == "" {
-			baseTerraformPath = "."
+		// Setup removes these from the working directory, so they are not loaded at all
+		for _, path := range config.AutoVarsFiles(terraformPath) {
+			redact.Printf("[WARNING] Not loading %s because of -no-auto-vars\n", path)
 		}
-		varsFilePaths = cfg.ResolveVarsPath(envFlag, stackFlag, baseTerraformPath)
 	}
+	// Explicit files go on top, in the order given
+	varsFilePaths = append(varsFilePaths, varsFileFlags...)
 
 	if _, err := os.Stat(terraformPath); os.IsNotExist(err) {
-		fmt.Printf("Error: Terraform path does not exist: %s\n", terraformPath)
-		os.Exit(1)
+		return fmt.Errorf("terraform path does not exist: %s", terraformPath)
 	}
 
 	for _, varsFilePath := range varsFilePaths {
 		if _, err := os.Stat(varsFilePath); os.IsNotExist(err) {
-			fmt.Printf("Error: Vars file does not exist: %s\n", varsFilePath)
-			os.Exit(1)
+			return fmt.Errorf("vars file does not exist: %s", varsFilePath)
 		}
 	}
 
@@ -139,77 +158,114 @@ func main() {
 
 	vaultClient, err := vault.NewClient(vaultAddr)
 	if err != nil {
-		fmt.Printf("Error initializing Vault client: %v\n", err)
-		os.Exit(1)
+		return fmt.Errorf("initializing Vault client: %w", err)
 	}
 
 	fmt.Println("Authenticating with Vault...")
 	err = vaultClient.Authenticate(ctx, cfg)
 	if err != nil {
-		fmt.Printf("Error authenticating with Vault: %v\n", err)
-		os.Exit(1)
+		return fmt.Errorf("authenticating with Vault: %w", err)
 	}
 
 	fmt.Println("Retrieving provider configuration...")
 	providerPath := cfg.ResolveProviderPath(envFlag)
 	providerConfig, err := vaultClient.GetProviderConfig(ctx, providerPath, envFlag)
 	if err != nil {
-		fmt.Printf("Error retrieving provider configuration: %v\n", err)
-		os.Exit(1)
+		return fmt.Errorf("retrieving provider configuration: %w", err)
 	}
 
-	// Set AWS_PROFILE from provider config for S3 backend
-	if awsConfig, ok := providerConfig["aws"].(map[string]interface{}); ok {
-		if profile, ok := awsConfig["profile"].(string); ok && profile != "" {
-			os.Setenv("AWS_PROFILE", profile)
-			fmt.Printf("Set AWS_PROFILE to: %s\n", profile)
+	// Set AWS_PROFILE from provider config for S3 backend, taking it from
+	// the aws instance without an alias when aws is a list of instances.
+	// An invalid list is reported when provider.tf is generated.
+	if awsConfig, ok := providerConfig["aws"]; ok {
+		instances, _ := terraform.ProviderInstances(map[string]interface{}{"aws": awsConfig})
+		for _, instance := range instances {
+			if instance.Alias != "" {
+				continue
+			}
+			if profile, ok := instance.Config["profile"].(string); ok && profile != "" {
+				os.Setenv("AWS_PROFILE", profile)
+				fmt.Printf("Set AWS_PROFILE to: %s\n", profile)
+			}
 		}
 	}
 
 	fmt.Println("Setting up Terraform workspace...")
 	executor, err := terraform.NewExecutor(ctx)
 	if err != nil {
-		fmt.Printf("Error creating Terraform executor: %v\n", err)
-		os.Exit(1)
+		return fmt.Errorf("creating Terraform executor: %w", err)
 	}
 	defer executor.Clean()
 
-	// Always use S3 backend (equivalent to backend.rb logic)
-	s3Config := terraform.S3BackendConfig{}
+	// Select the backend from the environment's backend.type (s3 by default)
+	backendCfg := cfg.ResolveBackend(envFlag)
+	naming := terraform.NewNaming(cfg, envFlag, stackFlag)
+	backend, err := terraform.NewBackend(ctx, backendCfg, naming)
+	if err != nil {
+		return fmt.Errorf("configuring backend: %w", err)
+	}
+	if err := backend.Validate(); err != nil {
+		return fmt.Errorf("invalid %s backend configuration: %w", backend.Type(), err)
+	}
+	workspace, err := terraform.ResolveWorkspace(ctx, cfg, envFlag, naming, backend)
+	if err != nil {
+		return err
+	}
+	executor.SetWorkspace(workspace)
+	eksCluster, err := terraform.ResolveEKSCluster(ctx, cfg, envFlag, naming)
+	if err != nil {
+		return err
+	}
+	executor.SetDynamicResolver(terraform.NewDynamicResolver(terraform.DefaultDynamicRegistry(), terraform.DynamicEnv{
+		Naming:   naming,
+		Root:     cfg.Root,
+		EKS:      eksCluster,
+		Commands: cfg.Dynamic.Commands,
+	}))
+	executor.SetProviderCredentials(terraform.ProviderCredentials{
+		VaultAddress: vaultClient.Address(),
+		VaultToken:   vaultClient.Token(),
+	})
+	settingsVariables, err := terraform.SettingsVariables(cfg, envFlag)
+	if err != nil {
+		return err
+	}
+	executor.SetTfvarsEnv(terraform.TfvarsEnv{Naming: naming, Settings: settingsVariables})
 
-	// Check if environment config overrides S3 settings
-	if envConfig, ok := cfg.Environments[envFlag]; ok && envConfig.Backend.Type == "s3" {
-		if bucket, ok := envConfig.Backend.Config["bucket"]; ok {
-			s3Config.Bucket = fmt.Sprintf("%v", bucket)
-		}
-		if key, ok := envConfig.Backend.Config["key"]; ok {
-			s3Config.Key = fmt.Sprintf("%v", key)
+	fmt.Printf("Using %s backend: %s\n", backend.Type(), backend.Describe())
+
+	if s3Backend, ok := backend.(*terraform.S3Backend); ok && backendCfg.AutoCreate {
+		fmt.Println("Ensuring S3 backend exists...")
+		if err := terraform.EnsureS3Backend(ctx, s3Backend.Config); err != nil {
+			return fmt.Errorf("bootstrapping S3 backend: %w", err)
 		}
-		if region, ok := envConfig.Backend.Config["region"]; ok {
-			s3Config.Region = fmt.Sprintf("%v", region)
+
+		findings, err := terraform.AuditS3Backend(ctx, s3Backend.Config)
+		if err != nil {
+			return fmt.Errorf("auditing S3 backend: %w", err)
 		}
-		if dynamo, ok := envConfig.Backend.Config["dynamodb_table"]; ok {
-			s3Config.DynamoDBTable = fmt.Sprintf("%v", dynamo)
+		for _, finding := range findings {
+			redact.Printf("[WARNING] Backend hardening: %s\n", finding)
 		}
 	}
 
-	// Apply backend.rb equivalent defaults and resolve placeholders
-	s3Config = terraform.ResolveS3BackendConfig(ctx, s3Config, envFlag, stackFlag)
-	backendConfig := &s3Config
-
-	fmt.Printf("Using S3 backend: %s/%s in %s\n", s3Config.Bucket, s3Config.Key, s3Config.Region)
-
-	err = executor.Setup(ctx, terraformPath, providerConfig, backendConfig)
+	err = executor.Setup(ctx, terraformPath, providerConfig, backend)
 	if err != nil {
-		fmt.Printf("Error setting up Terraform workspace: %v\n", err)
-		os.Exit(1)
+		return fmt.Errorf("setting up Terraform workspace: %w", err)
 	}
 
 	fmt.Println("Initializing Terraform...")
 	err = executor.Init(ctx)
 	if err != nil {
-		fmt.Printf("Error initializing Terraform: %v\n", err)
-		os.Exit(1)
+		return fmt.Errorf("initializing Terraform: %w", err)
+	}
+
+	activeWorkspace := terraform.DefaultWorkspace
+	if workspace != "" {
+		if activeWorkspace, err = executor.Workspace(ctx); err != nil {
+			return fmt.Errorf("reading Terraform workspace: %w", err)
+		}
+		fmt.Printf("Using workspace: %s\n", activeWorkspace)
 	}
 
 	fmt.Printf("Executing Terraform %s...\n", actionFlag)
@@ -218,8 +274,7 @@ func main() {
 		fmt.Println("Generating Terraform plan...")
 		plan, err := executor.Plan(ctx, varsFilePaths, varsFlag)
 		if err != nil {
-			fmt.Printf("Error running Terraform plan: %v\n", err)
-			os.Exit(1)
+			return fmt.Errorf("running Terraform plan: %w", err)
 		}
 
 		if plan.ResourceChanges != nil {
@@ -244,7 +299,8 @@ func main() {
 				}
 			}
 
-			fmt.Printf("\nPlan: %d to add, %d to change, %d to destroy.\n", toAdd, toChange, toDestroy)
+			fmt.Printf("\nWorkspace: %s\n", activeWorkspace)
+			fmt.Printf("Plan: %d to add, %d to change, %d to destroy.\n", toAdd, toChange, toDestroy)
 
 			if toAdd > 0 {
 				fmt.Println("\nResources to add:")
@@ -316,8 +372,7 @@ func main() {
 	case "apply":
 		err = executor.Apply(ctx, varsFilePaths, varsFlag)
 		if err != nil {
-			fmt.Printf("Error running Terraform apply: %v\n", err)
-			os.Exit(1)
+			return fmt.Errorf("running Terraform apply: %w", err)
 		}
 		fmt.Println("Apply complete!")
 
@@ -334,14 +389,12 @@ func main() {
 	case "destroy":
 		err = executor.Destroy(ctx, varsFilePaths, varsFlag)
 		if err != nil {
-			fmt.Printf("Error running Terraform destroy: %v\n", err)
-			os.Exit(1)
+			return fmt.Errorf("running Terraform destroy: %w", err)
 		}
 		fmt.Println("Destroy complete!")
 
 	default:
-		fmt.Printf("Unsupported action: %s\n", actionFlag)
-		os.Exit(1)
+		return fmt.Errorf("unsupported action: %s", actionFlag)
 	}
 
 	// Save workspace if requested
@@ -356,6 +409,7 @@ func main() {
 	}
 
 	fmt.Println("Operation completed successfully.")
+	return nil
 }
 
 // copyDir recursively copies a directory
@@ -375,6 +429,10 @@ func copyDir(src, dst string) error {
 	}
 
 	for _, item := range items {
+		// Provider secrets stay in the temporary workspace
+		if item.Name() == terraform.ProviderSecretsFile {
+			continue
+		}
 		srcPath := filepath.Join(src, item.Name())
 		dstPath := filepath.Join(dst, item.Name())
 
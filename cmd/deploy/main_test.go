@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kingoftowns/tf-go/internal/terraform"
+	"github.com/kingoftowns/tf-go/internal/testutil"
+)
+
+// setupProject builds a fixture Terraform project with a single "web" stack,
+// a fake Vault holding provider config for "dev" and a fake terraform binary
+func setupProject(t *testing.T) (string, *testutil.FakeTerraform) {
+	t.Helper()
+
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		"config.yaml": "project: shop\n",
+		"environments/dev.yaml": `name: Development
+backend:
+  type: s3
+  config:
+    bucket: "tfstate-:ACCOUNT"
+    key: ":ENV/:STACK/terraform.tfstate"
+    region: "us-east-1"
+    dynamodb_table: "locks-:ENV"
+`,
+		"app/stacks/web/main.tf": `resource "null_resource" "example" {}
+`,
+		"app/stacks/web/variables.tf": `variable "replicas" {
+  default = "1"
+}
+
+variable "tags" {
+  type    = map(string)
+  default = {}
+}
+`,
+		"config/terraform/tfvars/base.tfvars": `replicas = "2"
+tags = {
+  team = "platform"
+}
+`,
+		"config/terraform/tfvars/dev.tfvars": `replicas = "3"
+`,
+	})
+	testutil.Chdir(t, root)
+
+	vault := testutil.NewVaultServer(t)
+	vault.SetEnv(t)
+	vault.PutKV2("terraform", "providers", map[string]interface{}{
+		"dev": `{"aws": {"region": "us-east-1", "default_tags": {"team": "platform"}}}`,
+	})
+
+	t.Setenv("TF_PATH", root)
+	t.Setenv("TF_ENV", "")
+	t.Setenv("TF_ACTION", "")
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_ACCOUNT_ID", testutil.DefaultAWSAccountID)
+
+	return root, testutil.InstallFakeTerraform(t)
+}
+
+func TestRunPlanWithStack(t *testing.T) {
+	_, tf := setupProject(t)
+	saved := filepath.Join(t.TempDir(), "workspace")
+
+	err := run(context.Background(), []string{"-s", "web", "-e", "dev", "-save-workspace", saved})
+	if err != nil {
+		t.Fatalf("run returned error: %v", err)
+	}
+
+	got := strings.Join(tf.Subcommands(t), ",")
+	if got != "init,plan,show" {
+		t.Errorf("terraform subcommands = %s, want init,plan,show", got)
+	}
+
+	var planArgs []string
+	for _, call := range tf.Invocations(t) {
+		if call[0] == "plan" {
+			planArgs = call
+		}
+	}
+	if !containsArgPrefix(planArgs, "-var-file=") || !containsArgPrefix(planArgs, "-out=") {
+		t.Errorf("plan args missing -var-file or -out: %v", planArgs)
+	}
+
+	backend := readFile(t, filepath.Join(saved, "backend.tf"))
+	if !strings.Contains(backend, `backend "s3" {}`) {
+		t.Errorf("backend.tf should be an empty s3 block:\n%s", backend)
+	}
+
+	var initArgs []string
+	for _, call := range tf.Invocations(t) {
+		if call[0] == "init" {
+			initArgs = call
+		}
+	}
+	for _, want := range []string{
+		"-backend-config=bucket=tfstate-" + testutil.DefaultAWSAccountID,
+		"-backend-config=key=dev/web/terraform.tfstate",
+		"-backend-config=dynamodb_table=locks-dev",
+		"-backend-config=encrypt=true",
+	} {
+		if !containsArgPrefix(initArgs, want) {
+			t.Errorf("init args missing %q: %v", want, initArgs)
+		}
+	}
+
+	provider := readFile(t, filepath.Join(saved, "provider.tf"))
+	if !strings.Contains(provider, `region = "us-east-1"`) {
+		t.Errorf("provider.tf missing region:\n%s", provider)
+	}
+
+	compiled := readFile(t, filepath.Join(saved, "compiled.tfvars"))
+	if !strings.Contains(compiled, `replicas = "3"`) || !strings.Contains(compiled, `team = "platform"`) {
+		t.Errorf("compiled.tfvars did not layer base and env vars:\n%s", compiled)
+	}
+}
+
+func TestRunLayersVarsFiles(t *testing.T) {
+	root, _ := setupProject(t)
+	testutil.WriteFiles(t, root, map[string]string{
+		"app/stacks/web/web.auto.tfvars": "replicas = \"4\"\nsize = \"small\"\n",
+		"overrides/first.tfvars.json":    `{"replicas": "5", "tags": {"owner": "ops"}}`,
+		"overrides/second.tfvars":        "replicas = \"6\"\n",
+	})
+	first := filepath.Join(root, "overrides", "first.tfvars.json")
+	second := filepath.Join(root, "overrides", "second.tfvars")
+	saved := filepath.Join(t.TempDir(), "workspace")
+
+	err := run(context.Background(), []string{"-s", "web", "-e", "dev", "-vars-file", first, "-v", second, "-save-workspace", saved})
+	if err != nil {
+		t.Fatalf("run returned error: %v", err)
+	}
+	compiled := readFile(t, filepath.Join(saved, "compiled.tfvars"))
+	for _, want := range []string{
+		"# " + second + "\nreplicas = \"6\"",
+		"size = \"small\"",
+		`team = "platform"`,
+		`owner = "ops"`,
+	} {
+		if !strings.Contains(compiled, want) {
+			t.Errorf("compiled.tfvars is missing %q:\n%s", want, compiled)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(saved, "web.auto.tfvars")); !os.IsNotExist(err) {
+		t.Errorf("web.auto.tfvars should be compiled in, not left for terraform to load: %v", err)
+	}
+
+	saved = filepath.Join(t.TempDir(), "workspace")
+	out := captureStdout(t, func() {
+		err = run(context.Background(), []string{"-s", "web", "-e", "dev", "-no-auto-vars", "-vars-file", first, "-save-workspace", saved})
+	})
+	if err != nil {
+		t.Fatalf("run returned error: %v", err)
+	}
+	if want := "[WARNING] Not loading " + filepath.Join(root, "app", "stacks", "web", "web.auto.tfvars") + " because of -no-auto-vars"; !strings.Contains(out, want) {
+		t.Errorf("output is missing %q:\n%s", want, out)
+	}
+	compiled = readFile(t, filepath.Join(saved, "compiled.tfvars"))
+	if !strings.Contains(compiled, `replicas = "5"`) || strings.Contains(compiled, "team") || strings.Contains(compiled, "size") {
+		t.Errorf("-no-auto-vars should use only the -vars-file files:\n%s", compiled)
+	}
+}
+
+func TestRunApplyAndDestroy(t *testing.T) {
+	tests := []struct {
+		action string
+		want   string
+	}{
+		{action: "apply", want: "init,apply,output"},
+		{action: "destroy", want: "init,destroy"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			_, tf := setupProject(t)
+			tf.SetOutputs(t, `{"url": {"sensitive": false, "type": "string", "value": "https://example.com"}}`)
+
+			err := run(context.Background(), []string{"-s", "web", "-e", "dev", "-action", tt.action, "-var", "replicas=5"})
+			if err != nil {
+				t.Fatalf("run returned error: %v", err)
+			}
+
+			if got := strings.Join(tf.Subcommands(t), ","); got != tt.want {
+				t.Errorf("terraform subcommands = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunTerraformFailure(t *testing.T) {
+	_, tf := setupProject(t)
+	tf.Fail(t, "plan", "Error: boom")
+
+	err := run(context.Background(), []string{"-s", "web", "-e", "dev"})
+	if err == nil || !strings.Contains(err.Error(), "running Terraform plan") {
+		t.Fatalf("expected plan error, got %v", err)
+	}
+}
+
+func TestRunMissingProviderConfig(t *testing.T) {
+	setupProject(t)
+
+	err := run(context.Background(), []string{"-s", "web", "-e", "prod"})
+	if err == nil || !strings.Contains(err.Error(), "no configuration found for environment: prod") {
+		t.Fatalf("expected missing provider config error, got %v", err)
+	}
+}
+
+func TestRunSetsAWSProfileFromDefaultInstance(t *testing.T) {
+	root, _ := setupProject(t)
+	testutil.WriteFiles(t, root, map[string]string{
+		"aws/config": "[profile sso-dev]\nregion = us-east-1\n\n[profile sso-audit]\nregion = us-west-2\n",
+	})
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(root, "aws", "config"))
+	vault := testutil.NewVaultServer(t)
+	vault.SetEnv(t)
+	vault.PutKV2("terraform", "providers", map[string]interface{}{
+		"dev": `{"aws": [{"alias": "audit", "region": "us-west-2", "profile": "sso-audit"}, {"region": "us-east-1", "profile": "sso-dev"}]}`,
+	})
+
+	var err error
+	out := captureStdout(t, func() {
+		err = run(context.Background(), []string{"-s", "web", "-e", "dev"})
+	})
+	if err != nil {
+		t.Fatalf("run returned error: %v", err)
+	}
+	if got := os.Getenv("AWS_PROFILE"); got != "sso-dev" {
+		t.Errorf("AWS_PROFILE = %q, want the profile of the aws instance without an alias", got)
+	}
+	if !strings.Contains(out, "Set AWS_PROFILE to: sso-dev\n") || strings.Contains(out, "sso-audit\n") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
+
+func TestRunReportsUnresolvedEnvVars(t *testing.T) {
+	_, tf := setupProject(t)
+	vault := testutil.NewVaultServer(t)
+	vault.SetEnv(t)
+	vault.PutKV2("terraform", "providers", map[string]interface{}{
+		"dev": `{"aws": {"region": "${ENV:TFGO_TEST_REGION}", "profile": "${ENV:TFGO_TEST_PROFILE:?pick an SSO profile}"}}`,
+	})
+
+	err := run(context.Background(), []string{"-s", "web", "-e", "dev"})
+	if err == nil {
+		t.Fatal("expected unresolved environment variables to fail the run")
+	}
+	for _, want := range []string{
+		"aws.profile: ${ENV:TFGO_TEST_PROFILE:?pick an SSO profile} is required: pick an SSO profile",
+		"aws.region: ${ENV:TFGO_TEST_REGION} is not set",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not mention %q:\n%v", want, err)
+		}
+	}
+	if calls := tf.Invocations(t); len(calls) != 0 {
+		t.Errorf("terraform should not run, got %v", calls)
+	}
+}
+
+func TestRunRequiresPathOrStack(t *testing.T) {
+	t.Setenv("TF_PATH", "")
+
+	if err := run(context.Background(), nil); err == nil {
+		t.Fatal("expected error when neither path nor stack is set")
+	}
+}
+
+func TestRunPlanWithLocalBackend(t *testing.T) {
+	root, tf := setupProject(t)
+	testutil.WriteFiles(t, root, map[string]string{
+		"environments/sandbox.yaml": "backend:\n  type: local\n",
+	})
+	vault := testutil.NewVaultServer(t)
+	vault.SetEnv(t)
+	vault.PutKV2("terraform", "providers", map[string]interface{}{"sandbox": `{"aws": {"region": "us-east-1"}}`})
+	saved := filepath.Join(t.TempDir(), "workspace")
+
+	if err := run(context.Background(), []string{"-s", "web", "-e", "sandbox", "-save-workspace", saved}); err != nil {
+		t.Fatalf("run returned error: %v", err)
+	}
+
+	backend := readFile(t, filepath.Join(saved, "backend.tf"))
+	if !strings.Contains(backend, `backend "local" {}`) {
+		t.Errorf("expected local backend for sandbox:\n%s", backend)
+	}
+
+	var initArgs []string
+	for _, call := range tf.Invocations(t) {
+		if call[0] == "init" {
+			initArgs = call
+		}
+	}
+	if !containsArgPrefix(initArgs, "-backend-config=path="+filepath.Join(root, ".terraform-state", "sandbox", "web", "terraform.tfstate")) {
+		t.Errorf("init args missing local state path: %v", initArgs)
+	}
+}
+
+func TestRunSelectsWorkspace(t *testing.T) {
+	root, tf := setupProject(t)
+	testutil.WriteFiles(t, root, map[string]string{
+		"environments/dev.yaml": `backend:
+  type: s3
+  config:
+    bucket: "tfstate"
+    key: ":STACK/terraform.tfstate"
+    region: "us-east-1"
+workspace: ":ENV"
+`,
+	})
+
+	if err := run(context.Background(), []string{"-s", "web", "-e", "dev"}); err != nil {
+		t.Fatalf("run returned error: %v", err)
+	}
+	if got := tf.Workspace(t); got != "dev" {
+		t.Errorf("workspace = %q, want dev", got)
+	}
+
+	var created bool
+	for _, call := range tf.Invocations(t) {
+		if call[0] == "workspace" && call[1] == "new" && call[len(call)-1] == "dev" {
+			created = true
+		}
+	}
+	if !created {
+		t.Errorf("expected workspace dev to be created: %v", tf.Subcommands(t))
+	}
+
+	// A second run selects the existing workspace instead of creating it again
+	tf.SetWorkspaces(t, "dev")
+	if err := run(context.Background(), []string{"-s", "web", "-e", "dev"}); err != nil {
+		t.Fatalf("second run returned error: %v", err)
+	}
+	var selected bool
+	for _, call := range tf.Invocations(t) {
+		if call[0] == "workspace" && call[1] == "select" && call[len(call)-1] == "dev" {
+			selected = true
+		}
+	}
+	if !selected || tf.Workspace(t) != "dev" {
+		t.Errorf("expected workspace dev to be selected: %v", tf.Subcommands(t))
+	}
+}
+
+func containsArgPrefix(args []string, prefix string) bool {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	return string(data)
+}
+
+func TestRunKeepsProviderSecretsOutOfOutput(t *testing.T) {
+	setupProject(t)
+	vault := testutil.NewVaultServer(t)
+	vault.SetEnv(t)
+	vault.PutKV2("terraform", "providers", map[string]interface{}{
+		"dev": `{"aws": {"region": "us-east-1"}, "kubernetes": {"host": "https://k8s.example.com", "token": "k8s-token-value"}}`,
+	})
+	saved := filepath.Join(t.TempDir(), "workspace")
+
+	var err error
+	out := captureStdout(t, func() {
+		err = run(context.Background(), []string{"-s", "web", "-e", "dev", "-save-workspace", saved})
+	})
+	if err != nil {
+		t.Fatalf("run returned error: %v", err)
+	}
+	if strings.Contains(out, "k8s-token-value") {
+		t.Errorf("output contains the provider token:\n%s", out)
+	}
+	if !strings.Contains(out, "token = var.tfgo_kubernetes_token") {
+		t.Errorf("output should show the variable reference:\n%s", out)
+	}
+
+	provider := readFile(t, filepath.Join(saved, "provider.tf"))
+	if strings.Contains(provider, "k8s-token-value") {
+		t.Errorf("provider.tf contains the token:\n%s", provider)
+	}
+	if _, err := os.Stat(filepath.Join(saved, terraform.ProviderSecretsFile)); !os.IsNotExist(err) {
+		t.Errorf("saved workspace should not contain %s", terraform.ProviderSecretsFile)
+	}
+}
+
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	original := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = original }()
+
+	done := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- string(data)
+	}()
+
+	fn()
+	w.Close()
+	return <-done
+}
+
+func TestRunResolvesEKSProvider(t *testing.T) {
+	root, _ := setupProject(t)
+	testutil.WriteFiles(t, root, map[string]string{
+		"environments/dev.yaml": `backend:
+  type: local
+eks:
+  cluster: ":ENV-cluster"
+`,
+	})
+	aws := testutil.NewAWSServer(t)
+	aws.SetEnv(t)
+	aws.PutCluster(testutil.EKSCluster{Name: "dev-cluster", Endpoint: "https://eks.example.com", CAData: "Y2VydA=="})
+	vault := testutil.NewVaultServer(t)
+	vault.SetEnv(t)
+	vault.PutKV2("terraform", "providers", map[string]interface{}{
+		"dev": `{"kubernetes": {"host": "${DYNAMIC:EKS_CLUSTER_ENDPOINT}", "cluster_ca_certificate": "${DYNAMIC:EKS_CLUSTER_CA}", "token": "${DYNAMIC:EKS_CLUSTER_TOKEN}"}}`,
+	})
+	saved := filepath.Join(t.TempDir(), "workspace")
+
+	if err := run(context.Background(), []string{"-s", "web", "-e", "dev", "-save-workspace", saved}); err != nil {
+		t.Fatalf("run returned error: %v", err)
+	}
+
+	provider := readFile(t, filepath.Join(saved, "provider.tf"))
+	for _, want := range []string{
+		`host                   = "https://eks.example.com"`,
+		`cluster_ca_certificate = "cert"`,
+		`args        = ["eks-token", "-cluster", "dev-cluster"]`,
+	} {
+		if !strings.Contains(provider, want) {
+			t.Errorf("provider.tf missing %q:\n%s", want, provider)
+		}
+	}
+	if strings.Contains(provider, "token =") {
+		t.Errorf("provider.tf should not set a static token:\n%s", provider)
+	}
+}
+
+func TestRunEKSTokenCommand(t *testing.T) {
+	testutil.NewAWSServer(t).SetEnv(t)
+
+	var err error
+	out := captureStdout(t, func() {
+		err = run(context.Background(), []string{terraform.EKSTokenCommand, "-cluster", "dev-cluster"})
+	})
+	if err != nil {
+		t.Fatalf("eks-token failed: %v", err)
+	}
+
+	var credential struct {
+		Kind   string `json:"kind"`
+		Status struct {
+			ExpirationTimestamp string `json:"expirationTimestamp"`
+			Token               string `json:"token"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal([]byte(out), &credential); err != nil {
+		t.Fatalf("output is not an ExecCredential: %v\n%s", err, out)
+	}
+	if credential.Kind != "ExecCredential" || !strings.HasPrefix(credential.Status.Token, "k8s-aws-v1.") || credential.Status.ExpirationTimestamp == "" {
+		t.Errorf("unexpected credential: %+v", credential)
+	}
+}
@@ -0,0 +1,451 @@
+// cmd/list/main.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kingoftowns/tf-go/internal/config"
+	"github.com/kingoftowns/tf-go/internal/redact"
+	"github.com/kingoftowns/tf-go/internal/terraform"
+	"github.com/kingoftowns/tf-go/internal/vault"
+)
+
+const usage = `Usage: list <command> [flags]
+
+Commands:
+  envs    List environments from environments/*.yaml, config files and Vault provider documents
+  stacks  List stacks with their state location, tfvars files and last apply per environment
+
+Flags:
+  -dir, -d     Directory to find the project root from (default: current directory)
+  -env, -e     Only list stacks for this environment (stacks only)
+  -output, -o  Output format: table or json (default: table)
+  -offline     Do not read Vault provider documents or backend state
+`
+
+func main() {
+	ctx := context.Background()
+
+	if err := run(ctx, os.Args[1:]); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// listOptions holds the flags shared by both commands
+type listOptions struct {
+	dir     string
+	env     string
+	output  string
+	offline bool
+}
+
+// envInfo is one discovered environment
+type envInfo struct {
+	Name         string `json:"name"`
+	Title        string `json:"title,omitempty"`
+	Description  string `json:"description,omitempty"`
+	Extends      string `json:"extends,omitempty"`
+	Backend      string `json:"backend,omitempty"`
+	ProviderPath string `json:"provider_path,omitempty"`
+	// Sources are where the environment was found: file for
+	// environments/<env>.yaml, config for an entry in a config file and vault
+	// for a key of its provider document
+	Sources []string `json:"sources"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// stackInfo is one stack in one environment
+type stackInfo struct {
+	Stack       string   `json:"stack"`
+	Env         string   `json:"env"`
+	Path        string   `json:"path"`
+	Backend     string   `json:"backend,omitempty"`
+	State       string   `json:"state,omitempty"`
+	Workspace   string   `json:"workspace,omitempty"`
+	TfvarsFiles []string `json:"tfvars_files"`
+	// LastApplied is null when the state has not been written yet or was
+	// not read
+	LastApplied *terraform.StateSummary `json:"last_applied"`
+	StateError  string                  `json:"state_error,omitempty"`
+	Error       string                  `json:"error,omitempty"`
+}
+
+func run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		fmt.Print(usage)
+		return fmt.Errorf("a command is required")
+	}
+
+	command := args[0]
+	opts := &listOptions{}
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.StringVar(&opts.dir, "dir", ".", "Directory to find the project root from")
+	flags.StringVar(&opts.dir, "d", ".", "Directory to find the project root from (shorthand)")
+	flags.StringVar(&opts.output, "output", "table", "Output format: table or json")
+	flags.StringVar(&opts.output, "o", "table", "Output format: table or json (shorthand)")
+	flags.BoolVar(&opts.offline, "offline", false, "Do not read Vault provider documents or backend state")
+
+	switch command {
+	case "envs":
+	case "stacks":
+		flags.StringVar(&opts.env, "env", "", "Only list stacks for this environment")
+		flags.StringVar(&opts.env, "e", "", "Only list stacks for this environment (shorthand)")
+	default:
+		fmt.Print(usage)
+		return fmt.Errorf("unknown command: %s", command)
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if opts.output != "table" && opts.output != "json" {
+		return fmt.Errorf("-output must be table or json, got %q", opts.output)
+	}
+
+	// Debug and warning lines would break JSON output on stdout
+	redact.SetOutput(os.Stderr)
+	defer redact.SetOutput(nil)
+
+	envs, err := discoverEnvironments(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if command == "envs" {
+		return printEnvironments(opts, envs)
+	}
+
+	stacks, err := listStacks(ctx, opts, envs)
+	if err != nil {
+		return err
+	}
+	return printStacks(opts, stacks)
+}
+
+// discoverEnvironments finds environments in environments/*.yaml, in the
+// environments map of the config files and, unless offline, in the Vault
+// provider documents those environments point at
+func discoverEnvironments(ctx context.Context, opts *listOptions) ([]envInfo, error) {
+	base, err := config.Load(config.LoadOptions{Dir: opts.dir})
+	if err != nil {
+		return nil, fmt.Errorf("loading configuration: %w", err)
+	}
+
+	found := make(map[string]*envInfo)
+	add := func(name, source string) *envInfo {
+		env, ok := found[name]
+		if !ok {
+			env = &envInfo{Name: name}
+			found[name] = env
+		}
+		if !containsString(env.Sources, source) {
+			env.Sources = append(env.Sources, source)
+		}
+		return env
+	}
+
+	files, err := filepath.Glob(filepath.Join(base.Root, "environments", "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		add(strings.TrimSuffix(filepath.Base(file), ".yaml"), "file")
+	}
+	for name := range base.Environments {
+		add(name, "config")
+	}
+	for _, env := range found {
+		describeEnvironment(opts, env)
+	}
+
+	if !opts.offline {
+		addVaultEnvironments(ctx, base, found, add, opts)
+	}
+
+	envs := make([]envInfo, 0, len(found))
+	for _, env := range found {
+		envs = append(envs, *env)
+	}
+	sort.Slice(envs, func(i, j int) bool { return envs[i].Name < envs[j].Name })
+	return envs, nil
+}
+
+// describeEnvironment fills in an environment's settings from its merged
+// configuration
+func describeEnvironment(opts *listOptions, env *envInfo) {
+	cfg, err := config.Load(config.LoadOptions{Dir: opts.dir, Env: env.Name})
+	if err != nil {
+		env.Error = err.Error()
+		return
+	}
+	settings := cfg.Environments[env.Name]
+	env.Title = settings.Name
+	env.Description = settings.Description
+	env.Extends = settings.Extends
+	env.Backend = cfg.ResolveBackend(env.Name).Type
+	env.ProviderPath = cfg.ResolveProviderPath(env.Name)
+}
+
+// addVaultEnvironments reads every provider document the known environments
+// use, and the provider path template when it does not depend on the
+// environment. An environment counts as found in Vault when its own provider
+// document has an entry for it. Vault being unreachable is only a warning.
+func addVaultEnvironments(ctx context.Context, base *config.Config, found map[string]*envInfo, add func(name, source string) *envInfo, opts *listOptions) {
+	var paths []string
+	for _, env := range found {
+		if env.Error == "" && env.ProviderPath != "" && !containsString(paths, env.ProviderPath) {
+			paths = append(paths, env.ProviderPath)
+		}
+	}
+	if template := base.Defaults.ProviderPathTemplate; template != "" && !strings.Contains(template, "{{env}}") && !containsString(paths, template) {
+		paths = append(paths, template)
+	}
+	if len(paths) == 0 {
+		return
+	}
+	sort.Strings(paths)
+
+	// VAULT_ADDR wins over vault.address, as it does for deploy
+	address := os.Getenv("VAULT_ADDR")
+	if address == "" {
+		address = base.Vault.Address
+	}
+	client, err := vault.NewClient(address)
+	if err == nil {
+		err = client.Authenticate(ctx, base)
+	}
+	if err != nil {
+		redact.Printf("[WARNING] Skipping Vault provider documents: %v\n", err)
+		return
+	}
+
+	for _, path := range paths {
+		names, err := client.ProviderEnvironments(ctx, path)
+		if err != nil {
+			redact.Printf("[WARNING] Reading provider document %s: %v\n", path, err)
+			continue
+		}
+		for _, name := range names {
+			env, known := found[name]
+			if !known {
+				env = add(name, "vault")
+				describeEnvironment(opts, env)
+				continue
+			}
+			if env.ProviderPath == path {
+				add(name, "vault")
+			}
+		}
+	}
+}
+
+// listStacks describes every stack in every environment, or only in
+// opts.env when it is set
+func listStacks(ctx context.Context, opts *listOptions, envs []envInfo) ([]stackInfo, error) {
+	base, err := config.Load(config.LoadOptions{Dir: opts.dir})
+	if err != nil {
+		return nil, fmt.Errorf("loading configuration: %w", err)
+	}
+	names, err := discoverStacks(base)
+	if err != nil {
+		return nil, err
+	}
+
+	var envNames []string
+	for _, env := range envs {
+		if opts.env == "" || env.Name == opts.env {
+			envNames = append(envNames, env.Name)
+		}
+	}
+	if opts.env != "" && len(envNames) == 0 {
+		// The environment may be entirely defaulted
+		envNames = []string{opts.env}
+	}
+
+	stacks := make([]stackInfo, 0, len(names)*len(envNames))
+	for _, name := range names {
+		for _, env := range envNames {
+			stacks = append(stacks, describeStack(ctx, opts, base.BasePath(), name, env))
+		}
+	}
+	return stacks, nil
+}
+
+// discoverStacks returns the names of the directories matching
+// defaults.stack_path_template that contain Terraform files, sorted
+func discoverStacks(cfg *config.Config) ([]string, error) {
+	template := cfg.Defaults.StackPathTemplate
+	if !strings.Contains(template, "{{stack}}") {
+		return nil, fmt.Errorf("defaults.stack_path_template %q has no {{stack}} placeholder", template)
+	}
+
+	full := filepath.Join(cfg.BasePath(), template)
+	matches, err := filepath.Glob(strings.ReplaceAll(full, "{{stack}}", "*"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid defaults.stack_path_template %q: %w", template, err)
+	}
+	pattern := regexp.MustCompile("^" + strings.ReplaceAll(regexp.QuoteMeta(full), regexp.QuoteMeta("{{stack}}"), "([^/]+)") + "$")
+
+	var names []string
+	for _, match := range matches {
+		groups := pattern.FindStringSubmatch(match)
+		if groups == nil || strings.HasPrefix(groups[1], ".") || !hasTerraformFiles(match) {
+			continue
+		}
+		if !containsString(names, groups[1]) {
+			names = append(names, groups[1])
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// hasTerraformFiles reports whether dir is a directory holding .tf files
+func hasTerraformFiles(dir string) bool {
+	files, err := filepath.Glob(filepath.Join(dir, "*.tf"))
+	return err == nil && len(files) > 0
+}
+
+// describeStack resolves where a stack keeps its state in env, which tfvars
+// files it is deployed with and, unless offline, when its state was last
+// written
+func describeStack(ctx context.Context, opts *listOptions, basePath, stack, env string) stackInfo {
+	info := stackInfo{Stack: stack, Env: env, TfvarsFiles: []string{}}
+
+	cfg, err := config.Load(config.LoadOptions{Dir: opts.dir, Env: env, Stack: stack})
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.Path = relativePath(basePath, filepath.Join(cfg.BasePath(), cfg.ResolveStackPath(stack)))
+	for _, path := range cfg.ResolveVarsPath(env, stack, cfg.BasePath()) {
+		info.TfvarsFiles = append(info.TfvarsFiles, relativePath(basePath, path))
+	}
+
+	naming := terraform.NewNaming(cfg, env, stack)
+	backend, err := terraform.NewBackend(ctx, cfg.ResolveBackend(env), naming)
+	if err != nil {
+		info.Error = fmt.Sprintf("configuring backend: %v", err)
+		return info
+	}
+	if err := backend.Validate(); err != nil {
+		info.Error = fmt.Sprintf("invalid %s backend configuration: %v", backend.Type(), err)
+		return info
+	}
+	if info.Workspace, err = terraform.ResolveWorkspace(ctx, cfg, env, naming, backend); err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.Backend = backend.Type()
+	info.State = backend.Describe()
+
+	if !opts.offline {
+		if info.LastApplied, err = terraform.ReadStateSummary(ctx, backend); err != nil {
+			info.StateError = err.Error()
+		}
+	}
+	return info
+}
+
+func printEnvironments(opts *listOptions, envs []envInfo) error {
+	if opts.output == "json" {
+		return printJSON(envs)
+	}
+	if len(envs) == 0 {
+		fmt.Println("No environments found.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTITLE\tEXTENDS\tBACKEND\tPROVIDER PATH\tSOURCES")
+	for _, env := range envs {
+		if env.Error != "" {
+			fmt.Fprintf(w, "%s\terror: %s\t\t\t\t%s\n", env.Name, env.Error, strings.Join(env.Sources, ","))
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", env.Name, orDash(env.Title), orDash(env.Extends), orDash(env.Backend), orDash(env.ProviderPath), strings.Join(env.Sources, ","))
+	}
+	return w.Flush()
+}
+
+func printStacks(opts *listOptions, stacks []stackInfo) error {
+	if opts.output == "json" {
+		return printJSON(stacks)
+	}
+	if len(stacks) == 0 {
+		fmt.Println("No stacks found.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STACK\tENV\tSTATE\tTFVARS\tLAST APPLIED")
+	for _, stack := range stacks {
+		if stack.Error != "" {
+			fmt.Fprintf(w, "%s\t%s\terror: %s\t\t\n", stack.Stack, stack.Env, stack.Error)
+			continue
+		}
+		tfvars := "-"
+		if len(stack.TfvarsFiles) > 0 {
+			tfvars = strings.Join(stack.TfvarsFiles, ",")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", stack.Stack, stack.Env, stack.State, tfvars, lastApplied(opts, stack))
+	}
+	return w.Flush()
+}
+
+// lastApplied summarizes a stack's state for the table
+func lastApplied(opts *listOptions, stack stackInfo) string {
+	switch {
+	case opts.offline:
+		return "-"
+	case stack.StateError != "":
+		return "error: " + stack.StateError
+	case stack.LastApplied == nil:
+		return "never"
+	default:
+		s := stack.LastApplied
+		return fmt.Sprintf("%s (serial %d, %d resources)", s.LastModified.Format(time.RFC3339), s.Serial, s.Resources)
+	}
+}
+
+func printJSON(value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// relativePath shortens a path under dir for display
+func relativePath(dir, path string) string {
+	if rel, err := filepath.Rel(dir, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return path
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kingoftowns/tf-go/internal/testutil"
+)
+
+// captureStdout returns what fn prints
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	fn()
+	w.Close()
+	out, _ := io.ReadAll(r)
+	return string(out)
+}
+
+// setupListProject writes a project with dev and prod environments, a qa
+// environment only in config.yaml, and web and api stacks. dev keeps local
+// state, prod keeps it in a fake S3 bucket, and Vault has provider
+// configuration for dev, prod and sandbox.
+func setupListProject(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		"config.yaml": `project: shop
+terraform:
+  backend_type: local
+defaults:
+  provider_path_template: terraform/data/providers
+environments:
+  qa:
+    name: QA
+`,
+		"environments/dev.yaml": "name: Development\n",
+		"environments/prod.yaml": `extends: dev
+name: Production
+backend:
+  type: s3
+  config:
+    bucket: tfstate
+    key: ":ENV/:STACK/terraform.tfstate"
+    region: us-east-1
+`,
+		"app/stacks/web/main.tf":                     "",
+		"app/stacks/api/main.tf":                     "",
+		"app/stacks/docs/README.md":                  "not a stack\n",
+		"config/terraform/tfvars/base.tfvars":        "",
+		"config/terraform/tfvars/dev.tfvars":         "",
+		".terraform-state/dev/web/terraform.tfstate": `{"version": 4, "serial": 7, "terraform_version": "1.9.0", "resources": []}`,
+	})
+	testutil.Chdir(t, root)
+	t.Setenv("TF_PATH", "")
+
+	vault := testutil.NewVaultServer(t)
+	vault.SetEnv(t)
+	vault.PutKV2("terraform", "providers", map[string]interface{}{"dev": `{}`, "prod": `{}`, "sandbox": `{}`})
+
+	aws := testutil.NewAWSServer(t)
+	aws.SetEnv(t)
+	aws.CreateBucket("tfstate")
+	aws.PutObject("tfstate", "prod/api/terraform.tfstate", []byte(`{"version": 4, "serial": 3, "resources": [
+	  {"mode": "managed", "type": "null_resource", "name": "a", "instances": [{"attributes": {}}]}]}`))
+	return root
+}
+
+func TestRunListEnvs(t *testing.T) {
+	setupListProject(t)
+
+	var err error
+	out := captureStdout(t, func() {
+		err = run(context.Background(), []string{"envs", "-o", "json"})
+	})
+	if err != nil {
+		t.Fatalf("run returned error: %v", err)
+	}
+
+	var envs []envInfo
+	if err := json.Unmarshal([]byte(out), &envs); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, out)
+	}
+	var got []string
+	for _, env := range envs {
+		got = append(got, env.Name+" "+env.Title+" "+env.Extends+" "+env.Backend+" "+strings.Join(env.Sources, ","))
+	}
+	want := []string{
+		"dev Development  local file,vault",
+		"prod Production dev s3 file,vault",
+		"qa QA  local config",
+		"sandbox   local vault",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("environments:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestRunListEnvsOffline(t *testing.T) {
+	setupListProject(t)
+	t.Setenv("VAULT_ADDR", "http://127.0.0.1:1")
+
+	var err error
+	out := captureStdout(t, func() {
+		err = run(context.Background(), []string{"envs", "-offline"})
+	})
+	if err != nil {
+		t.Fatalf("run returned error: %v", err)
+	}
+	if !strings.HasPrefix(out, "NAME ") || !strings.Contains(out, "terraform/data/providers  file\n") || strings.Contains(out, "sandbox") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
+
+func TestRunListStacks(t *testing.T) {
+	setupListProject(t)
+
+	var err error
+	out := captureStdout(t, func() {
+		err = run(context.Background(), []string{"stacks", "-output", "json"})
+	})
+	if err != nil {
+		t.Fatalf("run returned error: %v", err)
+	}
+
+	var stacks []stackInfo
+	if err := json.Unmarshal([]byte(out), &stacks); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, out)
+	}
+	rows := make(map[string]stackInfo)
+	for _, stack := range stacks {
+		rows[stack.Stack+"/"+stack.Env] = stack
+	}
+	if len(stacks) != 8 || rows["docs/dev"].Stack != "" {
+		t.Fatalf("expected api and web in four environments, got %d rows:\n%s", len(stacks), out)
+	}
+
+	web := rows["web/dev"]
+	if web.Path != "app/stacks/web" || !strings.HasSuffix(web.State, ".terraform-state/dev/web/terraform.tfstate") {
+		t.Errorf("unexpected web/dev row: %+v", web)
+	}
+	if strings.Join(web.TfvarsFiles, ",") != "config/terraform/tfvars/base.tfvars,config/terraform/tfvars/dev.tfvars" {
+		t.Errorf("web/dev tfvars = %v", web.TfvarsFiles)
+	}
+	if web.LastApplied == nil || web.LastApplied.Serial != 7 || web.LastApplied.TerraformVersion != "1.9.0" {
+		t.Errorf("web/dev last applied = %+v", web.LastApplied)
+	}
+
+	api := rows["api/prod"]
+	if api.State != "s3://tfstate/prod/api/terraform.tfstate in us-east-1" || api.LastApplied == nil || api.LastApplied.Resources != 1 {
+		t.Errorf("unexpected api/prod row: %+v", api)
+	}
+	if api.LastApplied.LastModified.IsZero() {
+		t.Error("api/prod should report when its state was written")
+	}
+	if rows["web/prod"].LastApplied != nil || rows["web/prod"].StateError != "" {
+		t.Errorf("web/prod has never been applied, got %+v", rows["web/prod"])
+	}
+}
+
+func TestRunListStacksTable(t *testing.T) {
+	setupListProject(t)
+
+	var err error
+	out := captureStdout(t, func() {
+		err = run(context.Background(), []string{"stacks", "-e", "dev"})
+	})
+	if err != nil {
+		t.Fatalf("run returned error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "STACK ") {
+		t.Fatalf("expected a header and two rows:\n%s", out)
+	}
+	if !strings.HasPrefix(lines[1], "api ") || !strings.HasSuffix(lines[1], "never") {
+		t.Errorf("unexpected api row: %s", lines[1])
+	}
+	if !strings.HasPrefix(lines[2], "web ") || !strings.Contains(lines[2], "config/terraform/tfvars/base.tfvars,config/terraform/tfvars/dev.tfvars") ||
+		!strings.HasSuffix(lines[2], "(serial 7, 0 resources)") {
+		t.Errorf("unexpected web row: %s", lines[2])
+	}
+}
+
+func TestRunUnknownCommand(t *testing.T) {
+	var err error
+	out := captureStdout(t, func() {
+		err = run(context.Background(), []string{"modules"})
+	})
+	if err == nil || !strings.Contains(err.Error(), "unknown command: modules") || !strings.Contains(out, "Usage: list") {
+		t.Errorf("expected usage and unknown command error, got %v:\n%s", err, out)
+	}
+}
@@ -0,0 +1,346 @@
+// cmd/lock/main.go
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kingoftowns/tf-go/internal/config"
+	"github.com/kingoftowns/tf-go/internal/constants"
+	"github.com/kingoftowns/tf-go/internal/terraform"
+)
+
+const usage = `Usage: lock <command> [flags]
+
+Commands:
+  status    Show who holds the state lock and for how long
+  release   Force-unlock a stuck lock once it is old enough or its CI job has finished
+
+Common flags:
+  -env, -e      Environment name
+  -stack, -s    Stack name
+  -path, -p     Path to Terraform code (instead of -stack)
+
+Release flags:
+  -older-than   Minimum lock age before it may be released
+  -ci-job       GitLab CI job ID that took the lock; release is allowed once it has finished
+  -lock-id      Only release if the current lock has this ID
+  -reason       Why the lock is being released, recorded in the audit log
+  -audit-log    Local audit log file; every attempt is also stored in the state bucket
+  -yes          Skip the confirmation prompt
+`
+
+// stdin is where confirmation answers are read from
+var stdin io.Reader = os.Stdin
+
+// now is the clock lock ages are measured against
+var now = time.Now
+
+func main() {
+	ctx := context.Background()
+
+	if err := run(ctx, os.Args[1:]); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// lockOptions holds the flags of the lock commands
+type lockOptions struct {
+	env       string
+	stack     string
+	path      string
+	olderThan time.Duration
+	ciJob     string
+	lockID    string
+	reason    string
+	auditLog  string
+	yes       bool
+	workspace string
+}
+
+func run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		fmt.Print(usage)
+		return fmt.Errorf("a command is required")
+	}
+
+	command := args[0]
+	switch command {
+	case "status", "release":
+	default:
+		fmt.Print(usage)
+		return fmt.Errorf("unknown command: %s", command)
+	}
+
+	opts, err := parseFlags(command, args[1:])
+	if err != nil {
+		return err
+	}
+
+	cfg, err := config.Load(config.LoadOptions{Env: opts.env, Stack: opts.stack})
+	if err != nil {
+		return fmt.Errorf("loading configuration: %w", err)
+	}
+	// Keep one audit log wherever in the project the command runs
+	if !filepath.IsAbs(opts.auditLog) {
+		opts.auditLog = filepath.Join(cfg.Root, opts.auditLog)
+	}
+
+	naming := terraform.NewNaming(cfg, opts.env, opts.stack)
+	backend, err := terraform.NewBackend(ctx, cfg.ResolveBackend(opts.env), naming)
+	if err != nil {
+		return fmt.Errorf("configuring backend: %w", err)
+	}
+	if err := backend.Validate(); err != nil {
+		return fmt.Errorf("invalid %s backend configuration: %w", backend.Type(), err)
+	}
+	if opts.workspace, err = terraform.ResolveWorkspace(ctx, cfg, opts.env, naming, backend); err != nil {
+		return err
+	}
+	s3Backend, ok := backend.(*terraform.S3Backend)
+	if !ok {
+		return fmt.Errorf("lock %s needs the s3 backend, this environment uses %s", command, backend.Type())
+	}
+	if !s3Backend.Config.HasStateLocking() {
+		return fmt.Errorf("neither dynamodb_table nor use_lockfile is configured for %s, so there is no lock to inspect", opts.env)
+	}
+	fmt.Printf("Using %s backend: %s\n", backend.Type(), backend.Describe())
+
+	lock, err := terraform.GetStateLock(ctx, s3Backend.Config)
+	if err != nil {
+		return err
+	}
+
+	if command == "status" {
+		return runStatus(lock)
+	}
+
+	opts.path = stackPath(cfg, opts)
+	return runRelease(ctx, s3Backend, lock, opts)
+}
+
+func parseFlags(command string, args []string) (*lockOptions, error) {
+	defaultEnv := os.Getenv("TF_ENV")
+	if defaultEnv == "" {
+		defaultEnv = constants.DefaultEnvironment
+	}
+	defaultPath := os.Getenv("TF_PATH")
+
+	opts := &lockOptions{}
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.StringVar(&opts.env, "env", defaultEnv, "Environment name")
+	flags.StringVar(&opts.env, "e", defaultEnv, "Environment name (shorthand)")
+	flags.StringVar(&opts.stack, "stack", "", "Stack name (if using app/stacks structure)")
+	flags.StringVar(&opts.stack, "s", "", "Stack name (shorthand)")
+	flags.StringVar(&opts.path, "path", defaultPath, "Path to Terraform code")
+	flags.StringVar(&opts.path, "p", defaultPath, "Path to Terraform code (shorthand)")
+	flags.DurationVar(&opts.olderThan, "older-than", constants.DefaultLockReleaseAge, "Minimum lock age before release is allowed")
+	flags.StringVar(&opts.ciJob, "ci-job", "", "GitLab CI job ID that holds the lock")
+	flags.StringVar(&opts.lockID, "lock-id", "", "Expected ID of the lock to release")
+	flags.StringVar(&opts.reason, "reason", "", "Why the lock is being released")
+	flags.StringVar(&opts.auditLog, "audit-log", constants.DefaultLockAuditLog, "File every release attempt is recorded in, relative to the project root")
+	flags.BoolVar(&opts.yes, "yes", false, "Release without asking for confirmation")
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("%s takes no arguments, got %s", command, strings.Join(flags.Args(), " "))
+	}
+	if opts.path == "" && opts.stack == "" {
+		return nil, fmt.Errorf("either --path or --stack flag is required")
+	}
+
+	return opts, nil
+}
+
+// stackPath returns the Terraform code directory selected by -stack or -path
+func stackPath(cfg *config.Config, opts *lockOptions) string {
+	if opts.stack == "" {
+		return opts.path
+	}
+	return filepath.Join(cfg.BasePath(), cfg.ResolveStackPath(opts.stack))
+}
+
+func stackName(opts *lockOptions) string {
+	if opts.stack != "" {
+		return opts.stack
+	}
+	return filepath.Base(filepath.Clean(opts.path))
+}
+
+func runStatus(lock *terraform.StateLock) error {
+	if lock == nil {
+		fmt.Println("State is not locked.")
+		return nil
+	}
+
+	age := "unknown"
+	if created, err := lock.CreatedAt(); err == nil {
+		age = now().Sub(created).Round(time.Second).String()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Lock ID:\t%s\n", lock.ID)
+	fmt.Fprintf(w, "Operation:\t%s\n", lock.Operation)
+	fmt.Fprintf(w, "Who:\t%s\n", lock.Who)
+	fmt.Fprintf(w, "Created:\t%s\n", lock.Created)
+	fmt.Fprintf(w, "Age:\t%s\n", age)
+	fmt.Fprintf(w, "Terraform:\t%s\n", lock.Version)
+	fmt.Fprintf(w, "Path:\t%s\n", lock.Path)
+	if lock.Info != "" {
+		fmt.Fprintf(w, "Info:\t%s\n", lock.Info)
+	}
+	return w.Flush()
+}
+
+// runRelease force-unlocks the state, but only when the lock is older than
+// -older-than or the CI job passed with -ci-job has finished and could have
+// taken it. Every attempt, including refusals, is appended to the audit log
+// and stored in the state bucket.
+func runRelease(ctx context.Context, backend *terraform.S3Backend, lock *terraform.StateLock, opts *lockOptions) error {
+	if lock == nil {
+		fmt.Println("State is not locked, nothing to release.")
+		return nil
+	}
+
+	entry := terraform.LockAuditEntry{
+		Time:        now().UTC(),
+		Environment: opts.env,
+		Stack:       stackName(opts),
+		StateKey:    backend.Config.StateKey(),
+		Lock:        lock,
+		ReleasedBy:  releasedBy(),
+	}
+
+	reason, err := releaseGuard(ctx, lock, opts)
+	if err != nil {
+		return audit(ctx, backend, opts, entry, "refused", err)
+	}
+	entry.Reason = reason
+	if opts.reason != "" {
+		entry.Reason = opts.reason + " (" + reason + ")"
+	}
+
+	if !opts.yes {
+		if err := confirm(fmt.Sprintf("Release lock %s on %s/%s?", lock, opts.env, entry.Stack)); err != nil {
+			return audit(ctx, backend, opts, entry, "cancelled", err)
+		}
+	}
+
+	if _, err := os.Stat(opts.path); os.IsNotExist(err) {
+		return audit(ctx, backend, opts, entry, "failed", fmt.Errorf("terraform path does not exist: %s", opts.path))
+	}
+	executor, err := terraform.NewExecutor(ctx)
+	if err != nil {
+		return audit(ctx, backend, opts, entry, "failed", fmt.Errorf("creating Terraform executor: %w", err))
+	}
+	defer executor.Clean()
+
+	executor.SetWorkspace(opts.workspace)
+	if err := executor.Setup(ctx, opts.path, nil, backend); err != nil {
+		return audit(ctx, backend, opts, entry, "failed", fmt.Errorf("setting up Terraform workspace: %w", err))
+	}
+	if err := executor.Init(ctx); err != nil {
+		return audit(ctx, backend, opts, entry, "failed", fmt.Errorf("initializing Terraform: %w", err))
+	}
+	if err := executor.ForceUnlock(ctx, lock.ID); err != nil {
+		return audit(ctx, backend, opts, entry, "failed", fmt.Errorf("releasing lock %s: %w", lock.ID, err))
+	}
+
+	if err := audit(ctx, backend, opts, entry, "released", nil); err != nil {
+		return err
+	}
+	fmt.Printf("Released lock %s (%s). Recorded in %s and s3://%s/%s\n", lock.ID, entry.Reason, opts.auditLog,
+		backend.Config.Bucket, terraform.LockAuditKey(backend.Config, entry))
+	return nil
+}
+
+// releaseGuard returns why the lock may be released, or an error saying why not
+func releaseGuard(ctx context.Context, lock *terraform.StateLock, opts *lockOptions) (string, error) {
+	if opts.lockID != "" && opts.lockID != lock.ID {
+		return "", fmt.Errorf("state is now locked by %s, not %s", lock, opts.lockID)
+	}
+
+	if opts.ciJob != "" {
+		job, err := terraform.GetCIJob(ctx, opts.ciJob)
+		if err != nil {
+			return "", err
+		}
+		if !job.Finished {
+			return "", fmt.Errorf("CI job %s is still %s; it may still hold lock %s", opts.ciJob, job.Status, lock.ID)
+		}
+		if err := job.CheckHeldBy(lock); err != nil {
+			return "", fmt.Errorf("%w; release it by age instead", err)
+		}
+		return fmt.Sprintf("CI job %s %s", opts.ciJob, job.Status), nil
+	}
+
+	created, err := lock.CreatedAt()
+	if err != nil {
+		return "", fmt.Errorf("%w; pass -ci-job to release it once its job has finished", err)
+	}
+	age := now().Sub(created)
+	if age < opts.olderThan {
+		return "", fmt.Errorf("lock %s is only %s old (threshold %s); wait, lower -older-than, or pass -ci-job",
+			lock.ID, age.Round(time.Second), opts.olderThan)
+	}
+	return fmt.Sprintf("lock age %s exceeds %s", age.Round(time.Second), opts.olderThan), nil
+}
+
+// audit records the outcome of a release attempt in the audit log and the
+// state bucket, and returns cause, or the audit failure when the entry could
+// not be written
+func audit(ctx context.Context, backend *terraform.S3Backend, opts *lockOptions, entry terraform.LockAuditEntry, outcome string, cause error) error {
+	entry.Outcome = outcome
+	if cause != nil {
+		entry.Error = cause.Error()
+	}
+	err := terraform.AppendLockAudit(opts.auditLog, entry)
+	if bucketErr := terraform.PutLockAudit(ctx, backend.Config, entry); bucketErr != nil && err == nil {
+		err = bucketErr
+	}
+	if err != nil {
+		if cause != nil {
+			return fmt.Errorf("%v (and %w)", cause, err)
+		}
+		return err
+	}
+	return cause
+}
+
+// releasedBy identifies who is releasing the lock, in Terraform's user@host form
+func releasedBy() string {
+	user := os.Getenv("GITLAB_USER_LOGIN")
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	host, _ := os.Hostname()
+	who := user + "@" + host
+	if job := os.Getenv("CI_JOB_ID"); job != "" {
+		who += " (CI job " + job + ")"
+	}
+	return who
+}
+
+// confirm asks a yes/no question on stdin and fails unless the answer is yes
+func confirm(question string) error {
+	fmt.Printf("%s Type 'yes' to continue: ", question)
+	answer, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("reading confirmation: %w", err)
+	}
+	if strings.TrimSpace(answer) != "yes" {
+		return fmt.Errorf("release cancelled")
+	}
+	return nil
+}
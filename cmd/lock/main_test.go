@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kingoftowns/tf-go/internal/terraform"
+	"github.com/kingoftowns/tf-go/internal/testutil"
+)
+
+var lockTime = time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// setupLockedState builds a project whose s3 backend state is locked since
+// lockTime, with the clock set to lockTime plus elapsed
+func setupLockedState(t *testing.T, elapsed time.Duration) (string, *testutil.FakeTerraform, *testutil.AWSServer) {
+	t.Helper()
+
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		"environments/dev.yaml": `backend:
+  type: s3
+  config:
+    bucket: "tfstate"
+    key: ":ENV/:STACK/terraform.tfstate"
+    region: "us-east-1"
+    dynamodb_table: "locks"
+`,
+		"app/stacks/web/main.tf": "resource \"null_resource\" \"example\" {}\n",
+	})
+	testutil.Chdir(t, root)
+	t.Setenv("TF_PATH", root)
+	t.Setenv("TF_ENV", "")
+
+	aws := testutil.NewAWSServer(t)
+	aws.SetEnv(t)
+	t.Setenv("AWS_ACCOUNT_ID", testutil.DefaultAWSAccountID)
+	aws.CreateBucket("tfstate")
+	aws.PutItem("locks", map[string]interface{}{
+		"LockID": map[string]interface{}{"S": "tfstate/dev/web/terraform.tfstate"},
+		"Info": map[string]interface{}{"S": `{"ID": "lock-1", "Operation": "OperationTypeApply", "Who": "ci@runner",
+		  "Version": "1.6.0", "Created": "` + lockTime.Format(time.RFC3339Nano) + `", "Path": "tfstate/dev/web/terraform.tfstate"}`},
+	})
+
+	original := now
+	now = func() time.Time { return lockTime.Add(elapsed) }
+	t.Cleanup(func() { now = original })
+
+	return root, testutil.InstallFakeTerraform(t), aws
+}
+
+func auditEntries(t *testing.T, root string) []terraform.LockAuditEntry {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join(root, ".terraform-lock-audit.log"))
+	if err != nil {
+		t.Fatalf("failed to read audit log: %v", err)
+	}
+	var entries []terraform.LockAuditEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var entry terraform.LockAuditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid audit line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func forceUnlocks(t *testing.T, tf *testutil.FakeTerraform) [][]string {
+	t.Helper()
+
+	var calls [][]string
+	for _, call := range tf.Invocations(t) {
+		if call[0] == "force-unlock" {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+func TestStatusShowsHolder(t *testing.T) {
+	setupLockedState(t, 90*time.Minute)
+
+	var err error
+	out := captureStdout(t, func() {
+		err = run(context.Background(), []string{"status", "-e", "dev", "-s", "web"})
+	})
+	if err != nil {
+		t.Fatalf("status failed: %v", err)
+	}
+	for _, want := range []string{"lock-1", "OperationTypeApply", "ci@runner", "1h30m0s"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("status output missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestReleaseRefusesRecentLock(t *testing.T) {
+	root, tf, _ := setupLockedState(t, 10*time.Minute)
+
+	err := run(context.Background(), []string{"release", "-e", "dev", "-s", "web", "-yes"})
+	if err == nil || !strings.Contains(err.Error(), "only 10m0s old") {
+		t.Fatalf("expected age refusal, got %v", err)
+	}
+	if len(forceUnlocks(t, tf)) != 0 {
+		t.Error("force-unlock should not run for a recent lock")
+	}
+
+	entries := auditEntries(t, root)
+	if len(entries) != 1 || entries[0].Outcome != "refused" || entries[0].Lock.ID != "lock-1" {
+		t.Errorf("expected one refused audit entry, got %+v", entries)
+	}
+}
+
+func TestReleaseOldLock(t *testing.T) {
+	root, tf, aws := setupLockedState(t, 3*time.Hour)
+
+	err := run(context.Background(), []string{"release", "-e", "dev", "-s", "web", "-yes", "-reason", "runner died"})
+	if err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+
+	calls := forceUnlocks(t, tf)
+	if len(calls) != 1 || !containsArg(calls[0], "lock-1") {
+		t.Fatalf("expected force-unlock of lock-1, got %v", calls)
+	}
+
+	entries := auditEntries(t, root)
+	if len(entries) != 1 || entries[0].Outcome != "released" || !strings.HasPrefix(entries[0].Reason, "runner died (lock age 3h0m0s") {
+		t.Errorf("unexpected audit entries: %+v", entries)
+	}
+
+	// The entry is also kept in the state bucket, which outlives CI runners
+	var stored []string
+	for _, req := range aws.Requests() {
+		if strings.HasPrefix(req, "s3 PUT /tfstate/tf-go/lock-audit/dev/web/terraform.tfstate/") {
+			stored = append(stored, req)
+		}
+	}
+	if len(stored) != 1 || !strings.HasSuffix(stored[0], "-released.json") {
+		t.Errorf("expected the released entry in the state bucket, got %v", stored)
+	}
+}
+
+func TestReleaseRejectsDifferentLockID(t *testing.T) {
+	_, tf, _ := setupLockedState(t, 3*time.Hour)
+
+	err := run(context.Background(), []string{"release", "-e", "dev", "-s", "web", "-yes", "-lock-id", "lock-0"})
+	if err == nil || !strings.Contains(err.Error(), "not lock-0") {
+		t.Fatalf("expected lock ID mismatch, got %v", err)
+	}
+	if len(forceUnlocks(t, tf)) != 0 {
+		t.Error("force-unlock should not run for a different lock")
+	}
+}
+
+// fakeGitLab serves job 123 of project 7 with the given status, started a
+// minute before lockTime and finished at the given time
+func fakeGitLab(t *testing.T, status *string, finished *time.Time) {
+	t.Helper()
+	gitlab := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/projects/7/jobs/123" || r.Header.Get("PRIVATE-TOKEN") != "secret" {
+			http.NotFound(w, r)
+			return
+		}
+		job := map[string]interface{}{"id": 123, "status": *status, "started_at": lockTime.Add(-time.Minute)}
+		if !finished.IsZero() {
+			job["finished_at"] = *finished
+		}
+		json.NewEncoder(w).Encode(job)
+	}))
+	t.Cleanup(gitlab.Close)
+	t.Setenv("CI_API_V4_URL", gitlab.URL)
+	t.Setenv("CI_PROJECT_ID", "7")
+	t.Setenv("GITLAB_TOKEN", "secret")
+}
+
+func TestReleaseChecksCIJob(t *testing.T) {
+	status := "running"
+	var finished time.Time
+	root, tf, _ := setupLockedState(t, 5*time.Minute)
+	fakeGitLab(t, &status, &finished)
+	args := []string{"release", "-e", "dev", "-s", "web", "-yes", "-ci-job", "123"}
+	if err := run(context.Background(), args); err == nil || !strings.Contains(err.Error(), "still running") {
+		t.Fatalf("expected running job refusal, got %v", err)
+	}
+
+	status = "failed"
+	finished = lockTime.Add(2 * time.Minute)
+	if err := run(context.Background(), args); err != nil {
+		t.Fatalf("release after job finished failed: %v", err)
+	}
+	if len(forceUnlocks(t, tf)) != 1 {
+		t.Error("expected one force-unlock")
+	}
+
+	entries := auditEntries(t, root)
+	if len(entries) != 2 || entries[0].Outcome != "refused" || entries[1].Outcome != "released" || entries[1].Reason != "CI job 123 failed" {
+		t.Errorf("unexpected audit entries: %+v", entries)
+	}
+}
+
+func TestReleaseRefusesCIJobThatDidNotTakeTheLock(t *testing.T) {
+	status := "success"
+	finished := lockTime.Add(-30 * time.Second)
+	_, tf, _ := setupLockedState(t, 5*time.Minute)
+	fakeGitLab(t, &status, &finished)
+
+	args := []string{"release", "-e", "dev", "-s", "web", "-yes", "-ci-job", "123"}
+	err := run(context.Background(), args)
+	if err == nil || !strings.Contains(err.Error(), "outside CI job 123") {
+		t.Fatalf("expected a lock taken after the job finished to be refused, got %v", err)
+	}
+
+	finished = lockTime.Add(time.Minute)
+	aws := testutil.NewAWSServer(t)
+	aws.SetEnv(t)
+	aws.CreateBucket("tfstate")
+	aws.PutItem("locks", map[string]interface{}{
+		"LockID": map[string]interface{}{"S": "tfstate/dev/web/terraform.tfstate"},
+		"Info": map[string]interface{}{"S": `{"ID": "lock-2", "Who": "ci@runner (CI job 456)", "Created": "` +
+			lockTime.Format(time.RFC3339Nano) + `"}`},
+	})
+	err = run(context.Background(), args)
+	if err == nil || !strings.Contains(err.Error(), "names CI job 456, not 123") {
+		t.Fatalf("expected a lock naming another job to be refused, got %v", err)
+	}
+	if len(forceUnlocks(t, tf)) != 0 {
+		t.Error("force-unlock should not run for another job's lock")
+	}
+}
+
+func TestStatusAndReleaseWithLockfile(t *testing.T) {
+	root, tf, aws := setupLockedState(t, 3*time.Hour)
+	testutil.WriteFiles(t, root, map[string]string{
+		"environments/dev.yaml": `backend:
+  type: s3
+  config:
+    bucket: "tfstate"
+    key: ":ENV/:STACK/terraform.tfstate"
+    region: "us-east-1"
+    use_lockfile: true
+`,
+	})
+	aws.PutObject("tfstate", "dev/web/terraform.tfstate.tflock", []byte(`{"ID": "lock-3", "Operation": "OperationTypeApply",
+	  "Who": "ci@runner", "Created": "`+lockTime.Format(time.RFC3339Nano)+`"}`))
+
+	out := captureStdout(t, func() {
+		if err := run(context.Background(), []string{"status", "-e", "dev", "-s", "web"}); err != nil {
+			t.Fatalf("status failed: %v", err)
+		}
+	})
+	if !strings.Contains(out, "lock-3") {
+		t.Errorf("status should read the S3 lock file:\n%s", out)
+	}
+
+	if err := run(context.Background(), []string{"release", "-e", "dev", "-s", "web", "-yes"}); err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+	if calls := forceUnlocks(t, tf); len(calls) != 1 || !containsArg(calls[0], "lock-3") {
+		t.Errorf("expected force-unlock of lock-3, got %v", calls)
+	}
+}
+
+func TestReleaseRequiresConfirmation(t *testing.T) {
+	root, tf, _ := setupLockedState(t, 3*time.Hour)
+	stdin = strings.NewReader("no\n")
+	defer func() { stdin = os.Stdin }()
+
+	err := run(context.Background(), []string{"release", "-e", "dev", "-s", "web"})
+	if err == nil || !strings.Contains(err.Error(), "cancelled") {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+	if len(forceUnlocks(t, tf)) != 0 {
+		t.Error("force-unlock should not run without confirmation")
+	}
+	if entries := auditEntries(t, root); len(entries) != 1 || entries[0].Outcome != "cancelled" {
+		t.Errorf("expected cancelled audit entry, got %+v", entries)
+	}
+}
+
+func containsArg(args []string, want string) bool {
+	for _, arg := range args {
+		if arg == want {
+			return true
+		}
+	}
+	return false
+}
+
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	original := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = original }()
+
+	done := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- string(data)
+	}()
+
+	fn()
+	w.Close()
+	return <-done
+}
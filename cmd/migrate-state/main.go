@@ -0,0 +1,129 @@
+// cmd/migrate-state/main.go
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/kingoftowns/tf-go/internal/config"
+	"github.com/kingoftowns/tf-go/internal/constants"
+	"github.com/kingoftowns/tf-go/internal/terraform"
+)
+
+func main() {
+	ctx := context.Background()
+
+	if err := run(ctx, os.Args[1:]); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run copies state objects from one key layout to another, for example from
+// Terraspace's stacks/:STACK/:ENV layout to tf-go's :ENV/:STACK layout. It
+// only reports what it would do unless -apply is passed.
+func run(ctx context.Context, args []string) error {
+	defaultEnv := os.Getenv("TF_ENV")
+	if defaultEnv == "" {
+		defaultEnv = constants.DefaultEnvironment
+	}
+
+	var (
+		envFlag       string
+		fromFlag      string
+		toFlag        string
+		applyFlag     bool
+		overwriteFlag bool
+	)
+
+	flags := flag.NewFlagSet("migrate-state", flag.ContinueOnError)
+	flags.StringVar(&envFlag, "env", defaultEnv, "Environment whose backend bucket holds the state")
+	flags.StringVar(&envFlag, "e", defaultEnv, "Environment name (shorthand)")
+	flags.StringVar(&fromFlag, "from", "", "Source key pattern, e.g. stacks/:STACK/:ENV/terraform.tfstate")
+	flags.StringVar(&toFlag, "to", "", "Target key pattern (default: the environment's backend key)")
+	flags.BoolVar(&applyFlag, "apply", false, "Copy the state objects instead of only reporting")
+	flags.BoolVar(&overwriteFlag, "overwrite", false, "Replace state that already exists at a target key")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if fromFlag == "" {
+		flags.Usage()
+		return fmt.Errorf("-from is required")
+	}
+
+	cfg, err := config.LoadConfig(envFlag)
+	if err != nil {
+		return fmt.Errorf("loading configuration: %w", err)
+	}
+
+	backendCfg := cfg.ResolveBackend(envFlag)
+	if backendCfg.Type != "s3" {
+		return fmt.Errorf("migrate-state only supports the s3 backend, %s uses %s", envFlag, backendCfg.Type)
+	}
+
+	s3Config := terraform.NewS3BackendConfig(backendCfg)
+	if toFlag == "" {
+		toFlag = s3Config.Key
+	}
+	// The key is a pattern here and is resolved per state object
+	s3Config.Key = ""
+
+	naming := terraform.NewNaming(cfg, envFlag, "")
+	s3Config, err = terraform.ResolveS3BackendConfig(ctx, s3Config, naming)
+	if err != nil {
+		return fmt.Errorf("resolving backend configuration: %w", err)
+	}
+
+	fmt.Printf("Scanning s3://%s for %s -> %s\n\n", s3Config.Bucket, fromFlag, toFlag)
+	migrations, err := terraform.PlanStateMigration(ctx, s3Config, naming, fromFlag, toFlag)
+	if err != nil {
+		return err
+	}
+	if len(migrations) == 0 {
+		fmt.Println("No state objects match the source pattern.")
+		return nil
+	}
+
+	conflicts := printReport(migrations)
+
+	if !applyFlag {
+		fmt.Printf("\nDry run: rerun with -apply to copy %d state object(s).\n", len(migrations))
+		return nil
+	}
+	if conflicts > 0 && !overwriteFlag {
+		return fmt.Errorf("%d target key(s) already hold state; rerun with -overwrite to replace them", conflicts)
+	}
+
+	fmt.Println()
+	if err := terraform.MigrateState(ctx, s3Config, migrations); err != nil {
+		return err
+	}
+
+	fmt.Printf("\nMigrated %d state object(s). Source objects were left in place.\n", len(migrations))
+	return nil
+}
+
+// printReport writes the migration table and returns how many targets already exist
+func printReport(migrations []terraform.StateMigration) int {
+	conflicts := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tTARGET\tSERIAL\tLINEAGE\tRESOURCES\tDIGEST\tSTATUS")
+	for _, m := range migrations {
+		status := "ready"
+		if m.TargetExists {
+			status = "target exists"
+			conflicts++
+		}
+		digest := "-"
+		if m.Digest != "" {
+			digest = "copy"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\t%s\t%s\n", m.SourceKey, m.TargetKey, m.Serial, m.Lineage, m.Resources, digest, status)
+	}
+	w.Flush()
+	return conflicts
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/kingoftowns/tf-go/internal/testutil"
+)
+
+const bucket = "tfstate-" + testutil.DefaultAWSAccountID
+
+func stateJSON(serial, lineage string) []byte {
+	return []byte(`{"version": 4, "serial": ` + serial + `, "lineage": "` + lineage + `", "resources": []}`)
+}
+
+// setupMigration stores two Terraspace-layout states in the bucket, one with a
+// lock-table digest
+func setupMigration(t *testing.T) *testutil.AWSServer {
+	t.Helper()
+
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		"environments/dev.yaml": `backend:
+  type: s3
+  config:
+    bucket: "tfstate-:ACCOUNT"
+    key: ":ENV/:STACK/terraform.tfstate"
+    region: "us-east-1"
+    dynamodb_table: "locks"
+`,
+	})
+	testutil.Chdir(t, root)
+
+	aws := testutil.NewAWSServer(t)
+	aws.SetEnv(t)
+	t.Setenv("AWS_ACCOUNT_ID", testutil.DefaultAWSAccountID)
+
+	web := stateJSON("4", "web-lineage")
+	aws.PutObject(bucket, "stacks/web/dev/terraform.tfstate", web)
+	aws.PutObject(bucket, "stacks/api/dev/terraform.tfstate", stateJSON("9", "api-lineage"))
+	aws.PutObject(bucket, "unrelated/file.txt", []byte("x"))
+
+	sum := md5.Sum(web)
+	aws.PutItem("locks", map[string]interface{}{
+		"LockID": map[string]interface{}{"S": bucket + "/stacks/web/dev/terraform.tfstate-md5"},
+		"Digest": map[string]interface{}{"S": hex.EncodeToString(sum[:])},
+	})
+
+	return aws
+}
+
+func TestDryRunChangesNothing(t *testing.T) {
+	aws := setupMigration(t)
+
+	if err := run(context.Background(), []string{"-e", "dev", "-from", "stacks/:STACK/:ENV/terraform.tfstate"}); err != nil {
+		t.Fatalf("run returned error: %v", err)
+	}
+
+	if _, ok := aws.Object(bucket, "dev/web/terraform.tfstate"); ok {
+		t.Error("dry run copied state")
+	}
+}
+
+func TestApplyCopiesStateAndDigest(t *testing.T) {
+	aws := setupMigration(t)
+
+	err := run(context.Background(), []string{"-e", "dev", "-from", "stacks/:STACK/:ENV/terraform.tfstate", "-apply"})
+	if err != nil {
+		t.Fatalf("run returned error: %v", err)
+	}
+
+	for key, lineage := range map[string]string{
+		"dev/web/terraform.tfstate": "web-lineage",
+		"dev/api/terraform.tfstate": "api-lineage",
+	} {
+		data, ok := aws.Object(bucket, key)
+		if !ok || !strings.Contains(string(data), lineage) {
+			t.Errorf("%s not migrated: %s", key, data)
+		}
+	}
+	if _, ok := aws.Object(bucket, "stacks/web/dev/terraform.tfstate"); !ok {
+		t.Error("source state should be left in place")
+	}
+
+	items := aws.Table("locks").Items
+	if _, ok := items[bucket+"/dev/web/terraform.tfstate-md5"]; !ok {
+		t.Errorf("digest not copied, lock table has %v", items)
+	}
+	if _, ok := items[bucket+"/dev/api/terraform.tfstate-md5"]; ok {
+		t.Error("no digest should be written for a source without one")
+	}
+}
+
+func TestApplyRefusesExistingTarget(t *testing.T) {
+	aws := setupMigration(t)
+	aws.PutObject(bucket, "dev/web/terraform.tfstate", stateJSON("1", "new-lineage"))
+
+	err := run(context.Background(), []string{"-e", "dev", "-from", "stacks/:STACK/:ENV/terraform.tfstate", "-apply"})
+	if err == nil || !strings.Contains(err.Error(), "1 target key(s) already hold state") {
+		t.Fatalf("expected conflict error, got %v", err)
+	}
+
+	data, _ := aws.Object(bucket, "dev/web/terraform.tfstate")
+	if !strings.Contains(string(data), "new-lineage") {
+		t.Error("existing target state was overwritten")
+	}
+}
+
+func TestFromIsRequired(t *testing.T) {
+	setupMigration(t)
+
+	if err := run(context.Background(), []string{"-e", "dev"}); err == nil {
+		t.Fatal("expected error without -from")
+	}
+}
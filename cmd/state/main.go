@@ -0,0 +1,549 @@
+// cmd/state/main.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kingoftowns/tf-go/internal/config"
+	"github.com/kingoftowns/tf-go/internal/constants"
+	"github.com/kingoftowns/tf-go/internal/redact"
+	"github.com/kingoftowns/tf-go/internal/terraform"
+)
+
+const usage = `Usage: state <command> [flags] [args]
+
+Commands:
+  pull                  Download the current state to -out
+  push <file>           Upload a local state file
+  list                  List resource addresses in the state
+  show <address>        Print the attributes of one resource instance
+  mv <source> <dest>    Move a resource address
+  rm <address>...       Remove resource addresses
+  restore <backup|ver>  Make a local backup or an S3 object version the current state again
+  history               List S3 object versions of the state (s3 backend only)
+  diff <ver1> <ver2>    Show resources added and removed between two S3 versions
+
+Common flags:
+  -env, -e      Environment name
+  -stack, -s    Stack name
+  -path, -p     Path to Terraform code (instead of -stack)
+  -backup-dir   Where state is snapshotted before push, mv, rm and restore
+  -limit        How many of the newest versions to list (history only, 0 for all)
+  -yes          Skip the confirmation prompt (restore only)
+`
+
+// stdin is where confirmation answers are read from
+var stdin io.Reader = os.Stdin
+
+func main() {
+	ctx := context.Background()
+
+	if err := run(ctx, os.Args[1:]); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// stateOptions holds the flags shared by every state command
+type stateOptions struct {
+	env       string
+	stack     string
+	path      string
+	backupDir string
+	out       string
+	force     bool
+	dryRun    bool
+	yes       bool
+	limit     int
+	// workspace is the environment's Terraform workspace, "" for default
+	workspace string
+}
+
+func run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		fmt.Print(usage)
+		return fmt.Errorf("a command is required")
+	}
+
+	command := args[0]
+	switch command {
+	case "pull", "push", "list", "show", "mv", "rm", "restore", "history", "diff":
+	default:
+		fmt.Print(usage)
+		return fmt.Errorf("unknown command: %s", command)
+	}
+
+	opts, positional, err := parseFlags(command, args[1:])
+	if err != nil {
+		return err
+	}
+
+	if err := checkArgs(command, positional); err != nil {
+		return err
+	}
+
+	backend, err := resolveBackend(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "history":
+		return runHistory(ctx, backend, opts.limit)
+	case "diff":
+		return runDiff(ctx, backend, positional[0], positional[1])
+	}
+
+	executor, err := prepareWorkspace(ctx, opts, backend)
+	if err != nil {
+		return err
+	}
+	defer executor.Clean()
+
+	switch command {
+	case "pull":
+		return runPull(ctx, executor, opts)
+	case "push":
+		return runPush(ctx, executor, opts, positional[0])
+	case "list":
+		return runList(ctx, executor)
+	case "show":
+		return runShow(ctx, executor, positional[0])
+	case "mv":
+		return runMv(ctx, executor, opts, positional[0], positional[1])
+	case "rm":
+		return runRm(ctx, executor, opts, positional)
+	default:
+		return runRestore(ctx, executor, backend, opts, positional[0])
+	}
+}
+
+// parseFlags accepts flags before, between and after positional arguments
+func parseFlags(command string, args []string) (*stateOptions, []string, error) {
+	defaultEnv := os.Getenv("TF_ENV")
+	if defaultEnv == "" {
+		defaultEnv = constants.DefaultEnvironment
+	}
+	defaultPath := os.Getenv("TF_PATH")
+
+	opts := &stateOptions{}
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.StringVar(&opts.env, "env", defaultEnv, "Environment name")
+	flags.StringVar(&opts.env, "e", defaultEnv, "Environment name (shorthand)")
+	flags.StringVar(&opts.stack, "stack", "", "Stack name (if using app/stacks structure)")
+	flags.StringVar(&opts.stack, "s", "", "Stack name (shorthand)")
+	flags.StringVar(&opts.path, "path", defaultPath, "Path to Terraform code")
+	flags.StringVar(&opts.path, "p", defaultPath, "Path to Terraform code (shorthand)")
+	flags.StringVar(&opts.backupDir, "backup-dir", constants.DefaultStateBackupDir, "Directory for state backups taken before mutating commands, relative to the project root")
+	flags.StringVar(&opts.out, "out", "", "File to write pulled state to (pull only, default <env>-<stack>.tfstate)")
+	flags.BoolVar(&opts.force, "force", false, "Push even if the lineage or serial check fails (push only)")
+	flags.BoolVar(&opts.dryRun, "dry-run", false, "Show what would change without writing state (mv and rm only)")
+	flags.BoolVar(&opts.yes, "yes", false, "Restore without asking for confirmation")
+	flags.IntVar(&opts.limit, "limit", constants.DefaultStateHistoryLimit, "Number of the newest versions to list, 0 for all (history only)")
+
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+
+	if opts.path == "" && opts.stack == "" {
+		return nil, nil, fmt.Errorf("either --path or --stack flag is required")
+	}
+
+	return opts, positional, nil
+}
+
+func checkArgs(command string, positional []string) error {
+	want := map[string]int{"pull": 0, "list": 0, "history": 0, "push": 1, "show": 1, "restore": 1, "mv": 2, "diff": 2}
+	if command == "rm" {
+		if len(positional) == 0 {
+			return fmt.Errorf("rm requires at least one address")
+		}
+		return nil
+	}
+	if len(positional) != want[command] {
+		return fmt.Errorf("%s expects %d argument(s), got %d", command, want[command], len(positional))
+	}
+	return nil
+}
+
+// stackPath returns the Terraform code directory selected by -stack or -path
+func stackPath(cfg *config.Config, opts *stateOptions) string {
+	if opts.stack == "" {
+		return opts.path
+	}
+	return filepath.Join(cfg.BasePath(), cfg.ResolveStackPath(opts.stack))
+}
+
+// resolveBackend loads the environment's configuration and builds its backend
+func resolveBackend(ctx context.Context, opts *stateOptions) (terraform.Backend, error) {
+	cfg, err := config.Load(config.LoadOptions{Env: opts.env, Stack: opts.stack})
+	if err != nil {
+		return nil, fmt.Errorf("loading configuration: %w", err)
+	}
+	// Keep backups in one place wherever in the project the command runs
+	if !filepath.IsAbs(opts.backupDir) {
+		opts.backupDir = filepath.Join(cfg.Root, opts.backupDir)
+	}
+
+	naming := terraform.NewNaming(cfg, opts.env, opts.stack)
+	backend, err := terraform.NewBackend(ctx, cfg.ResolveBackend(opts.env), naming)
+	if err != nil {
+		return nil, fmt.Errorf("configuring backend: %w", err)
+	}
+	if err := backend.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s backend configuration: %w", backend.Type(), err)
+	}
+	if opts.workspace, err = terraform.ResolveWorkspace(ctx, cfg, opts.env, naming, backend); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Using %s backend: %s\n", backend.Type(), backend.Describe())
+	if opts.workspace != "" {
+		fmt.Printf("Using workspace: %s\n", opts.workspace)
+	}
+
+	opts.path = stackPath(cfg, opts)
+	return backend, nil
+}
+
+// prepareWorkspace copies the stack into a temporary workspace and runs
+// terraform init against the backend
+func prepareWorkspace(ctx context.Context, opts *stateOptions, backend terraform.Backend) (*terraform.Executor, error) {
+	if _, err := os.Stat(opts.path); os.IsNotExist(err) {
+		return nil, fmt.Errorf("terraform path does not exist: %s", opts.path)
+	}
+
+	executor, err := terraform.NewExecutor(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating Terraform executor: %w", err)
+	}
+
+	executor.SetWorkspace(opts.workspace)
+
+	// State commands never touch providers, so no provider config is generated
+	if err := executor.Setup(ctx, opts.path, nil, backend); err != nil {
+		executor.Clean()
+		return nil, fmt.Errorf("setting up Terraform workspace: %w", err)
+	}
+	if err := executor.Init(ctx); err != nil {
+		executor.Clean()
+		return nil, fmt.Errorf("initializing Terraform: %w", err)
+	}
+
+	return executor, nil
+}
+
+// backup snapshots the current state before a mutating command
+func backup(ctx context.Context, executor *terraform.Executor, opts *stateOptions) error {
+	dir := filepath.Join(opts.backupDir, opts.env, stackName(opts))
+	path, err := executor.BackupState(ctx, dir)
+	if err != nil {
+		return err
+	}
+	if path == "" {
+		fmt.Println("No existing state to back up.")
+	} else {
+		fmt.Printf("Backed up current state to %s\n", path)
+	}
+	return nil
+}
+
+func stackName(opts *stateOptions) string {
+	if opts.stack != "" {
+		return opts.stack
+	}
+	return filepath.Base(filepath.Clean(opts.path))
+}
+
+func pullState(ctx context.Context, executor *terraform.Executor) (*terraform.RawState, error) {
+	data, err := executor.StatePull(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("pulling state: %w", err)
+	}
+	if data == nil {
+		return &terraform.RawState{}, nil
+	}
+	return terraform.ParseState(data)
+}
+
+func runPull(ctx context.Context, executor *terraform.Executor, opts *stateOptions) error {
+	data, err := executor.StatePull(ctx)
+	if err != nil {
+		return fmt.Errorf("pulling state: %w", err)
+	}
+	if data == nil {
+		return fmt.Errorf("no state found for %s/%s", opts.env, stackName(opts))
+	}
+
+	out := opts.out
+	if out == "" {
+		out = fmt.Sprintf("%s-%s.tfstate", opts.env, stackName(opts))
+	}
+	if err := os.WriteFile(out, data, 0600); err != nil {
+		return fmt.Errorf("writing state: %w", err)
+	}
+
+	fmt.Printf("State written to %s\n", out)
+	return nil
+}
+
+func runPush(ctx context.Context, executor *terraform.Executor, opts *stateOptions, path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("state file: %w", err)
+	}
+	if err := backup(ctx, executor, opts); err != nil {
+		return err
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if err := executor.StatePush(ctx, absPath, opts.force); err != nil {
+		return fmt.Errorf("pushing state: %w", err)
+	}
+
+	fmt.Printf("Pushed %s\n", path)
+	return nil
+}
+
+func runList(ctx context.Context, executor *terraform.Executor) error {
+	state, err := pullState(ctx, executor)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("\n=== Resources ===")
+	for _, address := range state.Addresses() {
+		fmt.Println(address)
+	}
+	return nil
+}
+
+func runShow(ctx context.Context, executor *terraform.Executor, address string) error {
+	state, err := pullState(ctx, executor)
+	if err != nil {
+		return err
+	}
+
+	attributes, ok, err := state.MaskedInstance(address)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("resource %s not found in state", address)
+	}
+
+	fmt.Printf("\n=== %s ===\n", address)
+	fmt.Println(indentJSON(attributes))
+	return nil
+}
+
+func runMv(ctx context.Context, executor *terraform.Executor, opts *stateOptions, source, destination string) error {
+	if !opts.dryRun {
+		if err := backup(ctx, executor, opts); err != nil {
+			return err
+		}
+	}
+	if err := executor.StateMv(ctx, source, destination, opts.dryRun); err != nil {
+		return fmt.Errorf("moving %s: %w", source, err)
+	}
+
+	fmt.Printf("Moved %s to %s\n", source, destination)
+	return nil
+}
+
+func runRm(ctx context.Context, executor *terraform.Executor, opts *stateOptions, addresses []string) error {
+	if !opts.dryRun {
+		if err := backup(ctx, executor, opts); err != nil {
+			return err
+		}
+	}
+	for _, address := range addresses {
+		if err := executor.StateRm(ctx, address, opts.dryRun); err != nil {
+			return fmt.Errorf("removing %s: %w", address, err)
+		}
+		fmt.Printf("Removed %s\n", address)
+	}
+	return nil
+}
+
+// runRestore makes a local backup file or an S3 object version the current
+// state. The restored state's serial is bumped past the current one so the
+// push goes through Terraform's normal lineage and serial checks instead of
+// -force. It refuses while the state is locked, or when the lock cannot be
+// checked, and asks for confirmation.
+func runRestore(ctx context.Context, executor *terraform.Executor, backend terraform.Backend, opts *stateOptions, source string) error {
+	s3Backend, isS3 := backend.(*terraform.S3Backend)
+
+	var restoreData []byte
+	if _, err := os.Stat(source); err == nil {
+		if restoreData, err = os.ReadFile(source); err != nil {
+			return fmt.Errorf("reading backup: %w", err)
+		}
+	} else if isS3 {
+		if restoreData, err = terraform.GetStateVersion(ctx, s3Backend.Config, source); err != nil {
+			return err
+		}
+		source = "version " + source
+	} else {
+		return fmt.Errorf("backup file %s not found (restoring object versions needs the s3 backend)", source)
+	}
+
+	if isS3 && !s3Backend.Config.HasStateLocking() {
+		return fmt.Errorf("cannot check the state lock: neither dynamodb_table nor use_lockfile is configured")
+	}
+	if isS3 {
+		lock, err := terraform.GetStateLock(ctx, s3Backend.Config)
+		if err != nil {
+			return err
+		}
+		if lock != nil {
+			return fmt.Errorf("state is locked by %s; wait for it to finish or free it with `lock release`", lock)
+		}
+	}
+
+	current, err := executor.StatePull(ctx)
+	if err != nil {
+		return fmt.Errorf("pulling state: %w", err)
+	}
+
+	restored, err := terraform.PrepareRestore(restoreData, current)
+	if err != nil {
+		return err
+	}
+
+	if !opts.yes {
+		if err := confirm(fmt.Sprintf("Restore %s as the current state of %s/%s?", source, opts.env, stackName(opts))); err != nil {
+			return err
+		}
+	}
+
+	if err := backup(ctx, executor, opts); err != nil {
+		return err
+	}
+
+	restoredPath := filepath.Join(executor.GetWorkDir(), "restore.tfstate")
+	if err := os.WriteFile(restoredPath, restored, 0600); err != nil {
+		return fmt.Errorf("writing restored state: %w", err)
+	}
+	if err := executor.StatePush(ctx, restoredPath, false); err != nil {
+		return fmt.Errorf("pushing restored state: %w", err)
+	}
+
+	fmt.Printf("Restored state from %s\n", source)
+	return nil
+}
+
+// confirm asks a yes/no question on stdin and fails unless the answer is yes
+func confirm(question string) error {
+	fmt.Printf("%s Type 'yes' to continue: ", question)
+	answer, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("reading confirmation: %w", err)
+	}
+	if strings.TrimSpace(answer) != "yes" {
+		return fmt.Errorf("restore cancelled")
+	}
+	return nil
+}
+
+func requireS3(backend terraform.Backend, command string) (*terraform.S3Backend, error) {
+	s3Backend, ok := backend.(*terraform.S3Backend)
+	if !ok {
+		return nil, fmt.Errorf("%s needs the s3 backend, this environment uses %s", command, backend.Type())
+	}
+	return s3Backend, nil
+}
+
+func runHistory(ctx context.Context, backend terraform.Backend, limit int) error {
+	s3Backend, err := requireS3(backend, "history")
+	if err != nil {
+		return err
+	}
+
+	versions, err := terraform.ListStateVersions(ctx, s3Backend.Config, limit)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		fmt.Println("No state versions found.")
+		return nil
+	}
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tLAST MODIFIED\tSERIAL\tLINEAGE\tINSTANCES\t")
+	for _, v := range versions {
+		current := ""
+		if v.IsLatest {
+			current = "(current)"
+		}
+		if v.DeleteMarker {
+			fmt.Fprintf(w, "%s\t%s\t-\t-\t-\tdeleted %s\n", v.VersionID, v.LastModified.Format(time.RFC3339), current)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\t%s\n", v.VersionID, v.LastModified.Format(time.RFC3339), v.Serial, v.Lineage, v.Instances, current)
+	}
+	return w.Flush()
+}
+
+func runDiff(ctx context.Context, backend terraform.Backend, fromVersion, toVersion string) error {
+	s3Backend, err := requireS3(backend, "diff")
+	if err != nil {
+		return err
+	}
+
+	states := make([]*terraform.RawState, 2)
+	for i, versionID := range []string{fromVersion, toVersion} {
+		data, err := terraform.GetStateVersion(ctx, s3Backend.Config, versionID)
+		if err != nil {
+			return err
+		}
+		if states[i], err = terraform.ParseState(data); err != nil {
+			return fmt.Errorf("version %s: %w", versionID, err)
+		}
+	}
+
+	fmt.Printf("\n=== %s (serial %d) -> %s (serial %d) ===\n", fromVersion, states[0].Serial, toVersion, states[1].Serial)
+	if states[0].Lineage != states[1].Lineage {
+		redact.Printf("[WARNING] Versions have different lineages: %s, %s\n", states[0].Lineage, states[1].Lineage)
+	}
+
+	added, removed := terraform.DiffStates(states[0], states[1])
+	for _, address := range added {
+		fmt.Printf("+ %s\n", address)
+	}
+	for _, address := range removed {
+		fmt.Printf("- %s\n", address)
+	}
+	fmt.Printf("\n%d added, %d removed\n", len(added), len(removed))
+	return nil
+}
+
+func indentJSON(data []byte) string {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "  "); err != nil {
+		return string(data)
+	}
+	return buf.String()
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kingoftowns/tf-go/internal/testutil"
+)
+
+const fixtureState = `{"version": 4, "serial": 5, "lineage": "lin-1", "resources": [
+  {"mode": "managed", "type": "null_resource", "name": "example", "instances": [{"attributes": {"id": "42"}}]}
+]}`
+
+// setupStateProject builds a project with a local backend so state commands run
+// without AWS, and a fake terraform holding fixtureState
+func setupStateProject(t *testing.T) (string, *testutil.FakeTerraform) {
+	t.Helper()
+
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		"environments/dev.yaml":  "backend:\n  type: local\n",
+		"app/stacks/web/main.tf": "resource \"null_resource\" \"example\" {}\n",
+	})
+	testutil.Chdir(t, root)
+	t.Setenv("TF_PATH", root)
+	t.Setenv("TF_ENV", "")
+
+	tf := testutil.InstallFakeTerraform(t)
+	tf.SetStatePull(t, fixtureState)
+	return root, tf
+}
+
+func backups(t *testing.T, root string) []string {
+	t.Helper()
+	files, _ := filepath.Glob(filepath.Join(root, ".terraform-state-backups", "dev", "web", "*.tfstate"))
+	return files
+}
+
+func TestPullWritesState(t *testing.T) {
+	root, _ := setupStateProject(t)
+
+	if err := run(context.Background(), []string{"pull", "-s", "web", "-e", "dev"}); err != nil {
+		t.Fatalf("pull returned error: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(root, "dev-web.tfstate"))
+	if err != nil || !strings.Contains(string(data), "lin-1") {
+		t.Errorf("pulled state not written: %v %s", err, data)
+	}
+	if len(backups(t, root)) != 0 {
+		t.Error("pull should not take a backup")
+	}
+}
+
+func TestMutatingCommandsBackUpFirst(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{name: "mv", args: []string{"mv", "null_resource.example", "null_resource.renamed", "-s", "web"}, want: "null_resource.example null_resource.renamed"},
+		{name: "rm", args: []string{"rm", "-s", "web", "null_resource.example"}, want: "null_resource.example"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, tf := setupStateProject(t)
+
+			if err := run(context.Background(), append(tt.args, "-e", "dev")); err != nil {
+				t.Fatalf("%s returned error: %v", tt.name, err)
+			}
+
+			files := backups(t, root)
+			if len(files) != 1 || !strings.HasSuffix(files[0], "-serial-5.tfstate") {
+				t.Fatalf("expected one serial-5 backup, got %v", files)
+			}
+
+			var found bool
+			for _, call := range tf.Invocations(t) {
+				line := strings.Join(call, " ")
+				if strings.HasPrefix(line, "state "+tt.name) && strings.HasSuffix(line, tt.want) {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("terraform state %s %s was not run: %v", tt.name, tt.want, tf.Invocations(t))
+			}
+		})
+	}
+}
+
+func TestStateFromSubdirectoryUsesProjectRoot(t *testing.T) {
+	root, tf := setupStateProject(t)
+	testutil.WriteFiles(t, root, map[string]string{"config.yaml": "project: shop\n"})
+	testutil.Chdir(t, filepath.Join(root, "app", "stacks", "web"))
+
+	if err := run(context.Background(), []string{"rm", "-s", "web", "-e", "dev", "null_resource.example"}); err != nil {
+		t.Fatalf("rm returned error: %v", err)
+	}
+	if len(backups(t, root)) != 1 {
+		t.Errorf("expected the backup under the project root, got %v", backups(t, root))
+	}
+
+	want := "-backend-config=path=" + filepath.Join(root, ".terraform-state", "dev", "web", "terraform.tfstate")
+	var found bool
+	for _, call := range tf.Invocations(t) {
+		for _, arg := range call {
+			found = found || arg == want
+		}
+	}
+	if !found {
+		t.Errorf("local state should be under the project root, want %s in %v", want, tf.Invocations(t))
+	}
+}
+
+func TestDryRunSkipsBackup(t *testing.T) {
+	root, _ := setupStateProject(t)
+
+	if err := run(context.Background(), []string{"rm", "-s", "web", "-e", "dev", "-dry-run", "null_resource.example"}); err != nil {
+		t.Fatalf("rm returned error: %v", err)
+	}
+	if len(backups(t, root)) != 0 {
+		t.Error("dry run should not take a backup")
+	}
+}
+
+func TestRestoreBumpsSerial(t *testing.T) {
+	root, tf := setupStateProject(t)
+	testutil.WriteFiles(t, root, map[string]string{
+		"old.tfstate": `{"version": 4, "serial": 2, "lineage": "lin-1", "resources": []}`,
+	})
+
+	stdin = strings.NewReader("yes\n")
+	t.Cleanup(func() { stdin = os.Stdin })
+
+	if err := run(context.Background(), []string{"restore", "-s", "web", "-e", "dev", "old.tfstate"}); err != nil {
+		t.Fatalf("restore returned error: %v", err)
+	}
+
+	state := tf.State(t)
+	if !strings.Contains(state, `"serial": 6`) || strings.Contains(state, "null_resource") {
+		t.Errorf("restored state not pushed with bumped serial:\n%s", state)
+	}
+	if len(backups(t, root)) != 1 {
+		t.Error("restore should back up the state it replaces")
+	}
+}
+
+func TestRestoreRejectsOtherLineage(t *testing.T) {
+	root, tf := setupStateProject(t)
+	testutil.WriteFiles(t, root, map[string]string{
+		"other.tfstate": `{"version": 4, "serial": 9, "lineage": "lin-2"}`,
+	})
+
+	err := run(context.Background(), []string{"restore", "-s", "web", "-e", "dev", "-yes", "other.tfstate"})
+	if err == nil || !strings.Contains(err.Error(), "lineage") {
+		t.Fatalf("expected lineage error, got %v", err)
+	}
+	if !strings.Contains(tf.State(t), "lin-1") {
+		t.Error("state should be untouched after a rejected restore")
+	}
+}
+
+func TestShowUnknownAddress(t *testing.T) {
+	setupStateProject(t)
+
+	err := run(context.Background(), []string{"show", "-s", "web", "-e", "dev", "null_resource.missing"})
+	if err == nil || !strings.Contains(err.Error(), "not found in state") {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+}
+
+func TestShowMasksSensitiveAttributes(t *testing.T) {
+	_, tf := setupStateProject(t)
+	tf.SetStatePull(t, `{"version": 4, "serial": 5, "lineage": "lin-1", "resources": [
+  {"mode": "managed", "type": "random_password", "name": "db", "instances": [{
+    "attributes": {"id": "none", "result": "hunter2"},
+    "sensitive_attributes": [[{"type": "get_attr", "value": "result"}]]
+  }]}
+]}`)
+
+	var err error
+	out := captureStdout(t, func() {
+		err = run(context.Background(), []string{"show", "-s", "web", "-e", "dev", "random_password.db"})
+	})
+	if err != nil {
+		t.Fatalf("show returned error: %v", err)
+	}
+	if strings.Contains(out, "hunter2") || !strings.Contains(out, `"result": "(sensitive value)"`) {
+		t.Errorf("show should mask sensitive attributes:\n%s", out)
+	}
+}
+
+func TestArgumentValidation(t *testing.T) {
+	if err := run(context.Background(), []string{"mv", "-s", "web", "only-one"}); err == nil {
+		t.Error("expected error for mv with one argument")
+	}
+	if err := run(context.Background(), []string{"bogus"}); err == nil {
+		t.Error("expected error for unknown command")
+	}
+}
+
+func TestRestoreRequiresConfirmation(t *testing.T) {
+	root, tf := setupStateProject(t)
+	testutil.WriteFiles(t, root, map[string]string{
+		"old.tfstate": `{"version": 4, "serial": 2, "lineage": "lin-1", "resources": []}`,
+	})
+	stdin = strings.NewReader("no\n")
+	t.Cleanup(func() { stdin = os.Stdin })
+
+	err := run(context.Background(), []string{"restore", "-s", "web", "-e", "dev", "old.tfstate"})
+	if err == nil || !strings.Contains(err.Error(), "cancelled") {
+		t.Fatalf("expected cancelled restore, got %v", err)
+	}
+	if !strings.Contains(tf.State(t), `"serial": 5`) {
+		t.Error("state should be untouched after a cancelled restore")
+	}
+}
+
+// setupVersionedState stores three versions of dev/web state in a fake S3
+// bucket and returns their version IDs, oldest first
+func setupVersionedState(t *testing.T) (*testutil.AWSServer, *testutil.FakeTerraform, []string) {
+	t.Helper()
+
+	root, tf := setupStateProject(t)
+	testutil.WriteFiles(t, root, map[string]string{
+		"environments/dev.yaml": `backend:
+  type: s3
+  config:
+    bucket: "tfstate"
+    key: ":ENV/:STACK/terraform.tfstate"
+    region: "us-east-1"
+    dynamodb_table: "locks"
+`,
+	})
+	aws := testutil.NewAWSServer(t)
+	aws.SetEnv(t)
+	t.Setenv("AWS_ACCOUNT_ID", testutil.DefaultAWSAccountID)
+
+	aws.CreateBucket("tfstate").Config["versioning"] = []byte("<VersioningConfiguration><Status>Enabled</Status></VersioningConfiguration>")
+	// An entry for another state so the lock table exists but dev/web is unlocked
+	aws.PutItem("locks", map[string]interface{}{"LockID": map[string]interface{}{"S": "tfstate/prod/web/terraform.tfstate"}})
+	var versions []string
+	for _, state := range []string{
+		`{"version": 4, "serial": 1, "lineage": "lin-1", "resources": []}`,
+		`{"version": 4, "serial": 2, "lineage": "lin-1", "resources": [
+		  {"mode": "managed", "type": "null_resource", "name": "a", "instances": [{"attributes": {}}]},
+		  {"mode": "managed", "type": "null_resource", "name": "b", "instances": [{"attributes": {}}]}]}`,
+		fixtureState,
+	} {
+		versions = append(versions, aws.PutObject("tfstate", "dev/web/terraform.tfstate", []byte(state)))
+	}
+	return aws, tf, versions
+}
+
+func TestHistoryAndDiff(t *testing.T) {
+	_, _, versions := setupVersionedState(t)
+
+	out := captureStdout(t, func() {
+		if err := run(context.Background(), []string{"history", "-s", "web", "-e", "dev"}); err != nil {
+			t.Fatalf("history returned error: %v", err)
+		}
+	})
+	for _, want := range []string{versions[0], versions[2], "(current)", "lin-1"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("history output missing %q:\n%s", want, out)
+		}
+	}
+
+	out = captureStdout(t, func() {
+		if err := run(context.Background(), []string{"diff", "-s", "web", "-e", "dev", versions[1], versions[2]}); err != nil {
+			t.Fatalf("diff returned error: %v", err)
+		}
+	})
+	for _, want := range []string{"+ null_resource.example", "- null_resource.a", "- null_resource.b", "1 added, 2 removed"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("diff output missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestHistoryLimit(t *testing.T) {
+	aws, _, versions := setupVersionedState(t)
+
+	out := captureStdout(t, func() {
+		if err := run(context.Background(), []string{"history", "-s", "web", "-e", "dev", "-limit", "1"}); err != nil {
+			t.Fatalf("history returned error: %v", err)
+		}
+	})
+	if !strings.Contains(out, versions[2]) || !strings.Contains(out, "INSTANCES") {
+		t.Errorf("history should list the newest version with its instance count:\n%s", out)
+	}
+	for _, old := range versions[:2] {
+		if strings.Contains(out, old) {
+			t.Errorf("history -limit 1 listed older version %s:\n%s", old, out)
+		}
+	}
+	var downloads int
+	for _, req := range aws.Requests() {
+		if strings.HasPrefix(req, "s3 GET /tfstate/dev/web/terraform.tfstate") {
+			downloads++
+		}
+	}
+	if downloads != 1 {
+		t.Errorf("history -limit 1 downloaded %d versions, want 1: %v", downloads, aws.Requests())
+	}
+}
+
+func TestRestoreVersion(t *testing.T) {
+	_, tf, versions := setupVersionedState(t)
+
+	if err := run(context.Background(), []string{"restore", "-s", "web", "-e", "dev", "-yes", versions[1]}); err != nil {
+		t.Fatalf("restore returned error: %v", err)
+	}
+
+	state := tf.State(t)
+	if !strings.Contains(state, "null_resource") || !strings.Contains(state, `"serial": 6`) {
+		t.Errorf("version %s not pushed with bumped serial:\n%s", versions[1], state)
+	}
+}
+
+func TestRestoreVersionRefusesWhileLocked(t *testing.T) {
+	aws, tf, versions := setupVersionedState(t)
+	aws.PutItem("locks", map[string]interface{}{
+		"LockID": map[string]interface{}{"S": "tfstate/dev/web/terraform.tfstate"},
+		"Info":   map[string]interface{}{"S": `{"ID": "lock-1", "Operation": "OperationTypeApply", "Who": "ci@runner"}`},
+	})
+
+	err := run(context.Background(), []string{"restore", "-s", "web", "-e", "dev", "-yes", versions[0]})
+	if err == nil || !strings.Contains(err.Error(), "locked by lock-1") {
+		t.Fatalf("expected lock error, got %v", err)
+	}
+	if !strings.Contains(tf.State(t), `"serial": 5`) {
+		t.Error("state should be untouched while locked")
+	}
+}
+
+func TestRestoreVersionChecksLockfile(t *testing.T) {
+	aws, tf, versions := setupVersionedState(t)
+	testutil.WriteFiles(t, ".", map[string]string{
+		"environments/dev.yaml": `backend:
+  type: s3
+  config:
+    bucket: "tfstate"
+    key: ":ENV/:STACK/terraform.tfstate"
+    region: "us-east-1"
+    use_lockfile: true
+`,
+	})
+	aws.PutObject("tfstate", "dev/web/terraform.tfstate.tflock", []byte(`{"ID": "lock-2", "Operation": "OperationTypeApply", "Who": "ci@runner"}`))
+
+	err := run(context.Background(), []string{"restore", "-s", "web", "-e", "dev", "-yes", versions[0]})
+	if err == nil || !strings.Contains(err.Error(), "locked by lock-2") {
+		t.Fatalf("expected lock file error, got %v", err)
+	}
+	if !strings.Contains(tf.State(t), `"serial": 5`) {
+		t.Error("state should be untouched while locked")
+	}
+}
+
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	original := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = original }()
+
+	done := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- string(data)
+	}()
+
+	fn()
+	w.Close()
+	return <-done
+}
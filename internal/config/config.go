@@ -2,21 +2,22 @@
 package config
 
 import (
-	"fmt"
 	"os"
-	"path/filepath"
 	"strings"
-
-	"github.com/kingoftowns/tf-go/internal/constants"
-	"gopkg.in/yaml.v3"
 )
 
 // Config represents the global configuration
 type Config struct {
+	Project      string                       `yaml:"project,omitempty"`
+	App          string                       `yaml:"app,omitempty"`
 	Vault        VaultConfig                  `yaml:"vault"`
 	Terraform    TerraformConfig              `yaml:"terraform"`
 	Defaults     DefaultsConfig               `yaml:"defaults"`
+	Dynamic      DynamicConfig                `yaml:"dynamic,omitempty"`
 	Environments map[string]EnvironmentConfig `yaml:"environments,omitempty"`
+
+	// Root is the project root the config was discovered in
+	Root string `yaml:"-"`
 }
 
 // VaultConfig holds Vault-related configuration
@@ -29,8 +30,33 @@ type VaultConfig struct {
 
 // TerraformConfig holds Terraform-related settings
 type TerraformConfig struct {
-	Version     string `yaml:"version"`
-	BackendType string `yaml:"backend_type"`
+	Version     string           `yaml:"version"`
+	BackendType string           `yaml:"backend_type"`
+	Backend     BackendTemplates `yaml:"backend"`
+
+	// SettingsVariables passes environment settings to Terraform as variables
+	SettingsVariables SettingsVariablesConfig `yaml:"settings_variables,omitempty"`
+}
+
+// SettingsVariablesConfig selects the Terraform variables environment
+// settings are passed as. Nothing is passed unless one is set.
+type SettingsVariablesConfig struct {
+	// Map names a variable that receives every setting as one map
+	Map string `yaml:"map,omitempty"`
+	// PerKey passes each top-level setting as a variable of its own, named
+	// after the key with Prefix in front
+	PerKey bool   `yaml:"per_key,omitempty"`
+	Prefix string `yaml:"prefix,omitempty"`
+}
+
+// BackendTemplates are the naming templates used for s3 backend settings an
+// environment leaves unset. They may use :ENV, :STACK, :ACCOUNT, :REGION,
+// :APP, :PROJECT, :BRANCH and :SETTING.<path>.
+type BackendTemplates struct {
+	Bucket        string `yaml:"bucket"`
+	Key           string `yaml:"key"`
+	Region        string `yaml:"region"`
+	DynamoDBTable string `yaml:"dynamodb_table"`
 }
 
 // DefaultsConfig holds default settings
@@ -39,15 +65,51 @@ type DefaultsConfig struct {
 	VarsPathTemplate     string `yaml:"vars_path_template"`
 	StackPathTemplate    string `yaml:"stack_path_template"`
 	ProviderPathTemplate string `yaml:"provider_path_template"`
+
+	// VarsLayers are where tfvars files are looked for, in the order they
+	// are applied. When empty, DefaultVarsLayers is used.
+	VarsLayers []VarsLayer `yaml:"vars_layers,omitempty"`
+}
+
+// DynamicConfig configures ${DYNAMIC:...} provider values
+type DynamicConfig struct {
+	// Commands are the external commands ${DYNAMIC:COMMAND(name)} may run,
+	// keyed by name. Vault documents can only refer to them by name.
+	Commands map[string]CommandConfig `yaml:"commands,omitempty"`
+}
+
+// CommandConfig is an external command whose trimmed output becomes a value
+type CommandConfig struct {
+	Command []string `yaml:"command"`
+	// Timeout is a Go duration such as 10s; it defaults to 30s
+	Timeout string `yaml:"timeout,omitempty"`
 }
 
 // EnvironmentConfig represents environment-specific configuration
 type EnvironmentConfig struct {
+	// Extends names an environment whose settings this one starts from.
+	// Maps such as vault, backend and settings are merged key by key.
+	Extends string `yaml:"extends,omitempty"`
+
 	Name        string                 `yaml:"name"`
 	Description string                 `yaml:"description"`
 	Vault       EnvVaultConfig         `yaml:"vault"`
 	Backend     BackendConfig          `yaml:"backend"`
 	Settings    map[string]interface{} `yaml:"settings"`
+
+	// Workspace selects a Terraform workspace for this environment. It may
+	// use the same placeholders as the backend naming templates.
+	Workspace string `yaml:"workspace,omitempty"`
+
+	// EKS names the cluster ${DYNAMIC:EKS_CLUSTER_*} provider values are read from
+	EKS EKSConfig `yaml:"eks,omitempty"`
+}
+
+// EKSConfig identifies an EKS cluster. Both settings may use the backend
+// naming placeholders.
+type EKSConfig struct {
+	Cluster string `yaml:"cluster"`
+	Region  string `yaml:"region,omitempty"`
 }
 
 // EnvVaultConfig holds environment-specific Vault configuration
@@ -59,54 +121,29 @@ type EnvVaultConfig struct {
 type BackendConfig struct {
 	Type   string                 `yaml:"type"`
 	Config map[string]interface{} `yaml:"config"`
+
+	// AutoCreate bootstraps the bucket and lock table before every deploy
+	AutoCreate bool `yaml:"auto_create,omitempty"`
+	// NoncurrentVersionDays is how long superseded state versions are kept
+	NoncurrentVersionDays int `yaml:"noncurrent_version_days,omitempty"`
 }
 
-// LoadConfig loads the global and environment-specific configuration
+// LoadConfig loads the configuration of an environment, discovering the
+// project root from the working directory. See Resolve for the layers.
 func LoadConfig(env string) (*Config, error) {
-	// Load global config
-	cfg := &Config{
-		Environments: make(map[string]EnvironmentConfig),
-	}
-
-	// Set default configuration
-	cfg.Defaults.Environment = constants.DefaultEnvironment
-	cfg.Defaults.VarsPathTemplate = constants.DefaultVarsPathTemplate
-	cfg.Defaults.StackPathTemplate = constants.DefaultStackPathTemplate
-	cfg.Defaults.ProviderPathTemplate = constants.DefaultProviderPathTemplate
-	cfg.Terraform.BackendType = constants.DefaultTerraformBackendType
-	cfg.Vault.Address = constants.DefaultVaultAddress
-	cfg.Vault.AuthMethod = constants.DefaultVaultAuthMethod
-
-	// Look for optional project-local config files
-	globalConfigPath := "./config.yaml"
-	if _, err := os.Stat(globalConfigPath); err == nil {
-		data, err := os.ReadFile(globalConfigPath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read config file: %w", err)
-		}
+	return Load(LoadOptions{Env: env})
+}
 
-		if err := yaml.Unmarshal(data, cfg); err != nil {
-			return nil, fmt.Errorf("failed to parse config file: %w", err)
-		}
+// BasePath returns the directory stack paths are relative to: TF_PATH if it
+// is set, otherwise the project root
+func (c *Config) BasePath() string {
+	if base := os.Getenv("TF_PATH"); base != "" {
+		return base
 	}
-
-	// Load environment-specific config if available
-	envConfigPath := filepath.Join("./environments", env+".yaml")
-	if _, err := os.Stat(envConfigPath); err == nil {
-		data, err := os.ReadFile(envConfigPath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read environment config file: %w", err)
-		}
-
-		envCfg := EnvironmentConfig{}
-		if err := yaml.Unmarshal(data, &envCfg); err != nil {
-			return nil, fmt.Errorf("failed to parse environment config file: %w", err)
-		}
-
-		cfg.Environments[env] = envCfg
+	if c.Root != "" {
+		return c.Root
 	}
-
-	return cfg, nil
+	return "."
 }
 
 // ResolveStackPath resolves the path to a stack
@@ -116,115 +153,64 @@ func (c *Config) ResolveStackPath(stack string) string {
 	return path
 }
 
-// ResolveVarsPath resolves the paths to vars files, returning base.tfvars first (if exists) then env-specific tfvars
-func (c *Config) ResolveVarsPath(env, stack, terraformPath string) []string {
-	var varsPaths []string
-
-	fmt.Printf("[DEBUG] ResolveVarsPath: env=%s, stack=%s, terraformPath=%s\n", env, stack, terraformPath)
-
-	// Look in the tfvars subdirectory first
-	tfvarsPath := filepath.Join(terraformPath, "config", "terraform", "tfvars")
-	if _, err := os.Stat(tfvarsPath); err == nil {
-		fmt.Printf("[DEBUG] Found tfvars directory: %s\n", tfvarsPath)
-		terraformPath = tfvarsPath
+// ResolveBackend returns the backend configuration for an environment, using
+// terraform.backend_type when the environment does not set a type. For s3
+// backends, unset bucket, key, region and dynamodb_table settings are filled
+// from the terraform.backend naming templates.
+func (c *Config) ResolveBackend(env string) BackendConfig {
+	backend := c.Environments[env].Backend
+	if backend.Type == "" {
+		backend.Type = c.Terraform.BackendType
 	}
-
-	// First check for base.tfvars recursively in the terraform directory (excluding hidden dirs)
-	fmt.Printf("[DEBUG] Looking for base.tfvars in directory: %s\n", terraformPath)
-	err := filepath.Walk(terraformPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if info.IsDir() {
-			// Skip hidden directories
-			if strings.HasPrefix(info.Name(), ".") {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-
-		if info.Name() == "base.tfvars" {
-			fmt.Printf("[DEBUG] Found base.tfvars: %s\n", path)
-			varsPaths = append(varsPaths, path)
-			return filepath.SkipAll // Stop after first match
-		}
-
-		return nil
-	})
-
-	if err != nil {
-		fmt.Printf("[DEBUG] Error walking directory for base.tfvars: %v\n", err)
+	if backend.Type != "s3" {
+		return backend
 	}
 
-	// Find environment-specific tfvars files
-	// Look for exact match first: env.tfvars (recursive)
-	exactMatchFound := false
-	fmt.Printf("[DEBUG] Looking for exact match %s.tfvars\n", env)
-	err = filepath.Walk(terraformPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if info.IsDir() {
-			// Skip hidden directories
-			if strings.HasPrefix(info.Name(), ".") {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-
-		if info.Name() == env+".tfvars" {
-			fmt.Printf("[DEBUG] Found exact match: %s\n", path)
-			varsPaths = append(varsPaths, path)
-			exactMatchFound = true
-			return filepath.SkipAll // Stop after first match
-		}
-
-		return nil
-	})
-
-	if err != nil {
-		fmt.Printf("[DEBUG] Error walking directory for exact match: %v\n", err)
+	settings := make(map[string]interface{}, len(backend.Config)+4)
+	for key, value := range backend.Config {
+		settings[key] = value
 	}
-
-	if exactMatchFound {
-		fmt.Printf("[DEBUG] Final varsPaths: %v\n", varsPaths)
-		return varsPaths
+	templates := map[string]string{
+		"bucket":         c.Terraform.Backend.Bucket,
+		"key":            c.Terraform.Backend.Key,
+		"region":         c.Terraform.Backend.Region,
+		"dynamodb_table": c.Terraform.Backend.DynamoDBTable,
 	}
-
-	// If exact match not found, look for files containing the env name (recursive search)
-	fmt.Printf("[DEBUG] Looking for files containing env name in directory: %s\n", terraformPath)
-	err = filepath.Walk(terraformPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if info.IsDir() {
-			// Skip hidden directories
-			if strings.HasPrefix(info.Name(), ".") {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-
-		fileName := info.Name()
-		fmt.Printf("[DEBUG] Checking file: %s\n", path)
-		if strings.HasSuffix(fileName, ".tfvars") && strings.Contains(fileName, env) {
-			fmt.Printf("[DEBUG] Found matching file: %s\n", path)
-			varsPaths = append(varsPaths, path)
-			return filepath.SkipAll // Stop after first match
+	if UsesLockfile(settings) {
+		// S3 native locking replaces the DynamoDB table
+		delete(templates, "dynamodb_table")
+	}
+	for key, template := range templates {
+		if _, ok := settings[key]; !ok && template != "" {
+			settings[key] = template
 		}
+	}
+	backend.Config = settings
+	return backend
+}
 
-		return nil
-	})
-
-	if err != nil {
-		fmt.Printf("[DEBUG] Error walking directory: %v\n", err)
+// UsesLockfile reports whether S3 backend settings turn on S3 native locking.
+// use_lockfile is passed to terraform init as written, so the string "true"
+// enables it just like the boolean
+func UsesLockfile(settings map[string]interface{}) bool {
+	switch v := settings["use_lockfile"].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
 	}
+	return false
+}
+
+// ResolveWorkspace returns the Terraform workspace an environment deploys
+// into, or "" when it uses the default workspace
+func (c *Config) ResolveWorkspace(env string) string {
+	return c.Environments[env].Workspace
+}
 
-	fmt.Printf("[DEBUG] Final varsPaths: %v\n", varsPaths)
-	return varsPaths
+// ResolveEKS returns the EKS cluster settings of an environment
+func (c *Config) ResolveEKS(env string) EKSConfig {
+	return c.Environments[env].EKS
 }
 
 // ResolveProviderPath resolves the path to provider config in Vault
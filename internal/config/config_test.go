@@ -0,0 +1,239 @@
+package config
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kingoftowns/tf-go/internal/testutil"
+)
+
+func TestResolveVarsPath(t *testing.T) {
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		"config/terraform/tfvars/base.tfvars":              "",
+		"config/terraform/tfvars/dev.tfvars":               "",
+		"config/terraform/tfvars/devops.tfvars":            "",
+		"config/terraform/tfvars/prod.tfvars":              "",
+		"config/terraform/tfvars/regions/us-west-2.tfvars": "",
+		"app/stacks/web/tfvars/base.tfvars":                "",
+		"app/stacks/web/tfvars/dev.tfvars":                 "",
+		"app/stacks/api/tfvars/dev.tfvars":                 "",
+	})
+	t.Setenv("AWS_REGION", "us-west-2")
+
+	cfg := &Config{}
+	got := cfg.ResolveVarsPath("dev", "web", root)
+	want := []string{
+		filepath.Join(root, "config/terraform/tfvars/base.tfvars"),
+		filepath.Join(root, "config/terraform/tfvars/dev.tfvars"),
+		filepath.Join(root, "app/stacks/web/tfvars/base.tfvars"),
+		filepath.Join(root, "app/stacks/web/tfvars/dev.tfvars"),
+		filepath.Join(root, "config/terraform/tfvars/regions/us-west-2.tfvars"),
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ResolveVarsPath:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// devops.tfvars is not a dev file, and without a stack no stack layer applies
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	got = cfg.ResolveVarsPath("devo", "", root)
+	if len(got) != 1 || got[0] != filepath.Join(root, "config/terraform/tfvars/base.tfvars") {
+		t.Errorf("ResolveVarsPath(devo) = %v, want only base.tfvars", got)
+	}
+}
+
+func TestExplainVarsPathFlagsSearchedFiles(t *testing.T) {
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		"config/terraform/tfvars/shared/base.tfvars": "",
+		"config/terraform/tfvars/envs/dev.tfvars":    "",
+		"config/terraform/tfvars/.old/base.tfvars":   "",
+	})
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+
+	cfg := &Config{}
+	if got := cfg.ResolveVarsPath("dev", "", root); len(got) != 0 {
+		t.Errorf("ResolveVarsPath = %v, want no files outside the layer paths", got)
+	}
+
+	var flagged []string
+	for _, candidate := range cfg.ExplainVarsPath("dev", "", root) {
+		if candidate.NoLongerRead {
+			path, _ := filepath.Rel(root, candidate.Path)
+			flagged = append(flagged, candidate.Layer+" "+path+": "+candidate.Reason)
+		}
+	}
+	want := []string{
+		"search config/terraform/tfvars/shared/base.tfvars: not at a layer path; earlier versions read it",
+		"search config/terraform/tfvars/envs/dev.tfvars: not at a layer path; earlier versions read it",
+	}
+	if strings.Join(flagged, "\n") != strings.Join(want, "\n") {
+		t.Errorf("flagged:\n%s\nwant:\n%s", strings.Join(flagged, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Custom layers are a deliberate layout, so nothing is flagged
+	cfg.Defaults.VarsLayers = []VarsLayer{{Name: "env", Path: "config/terraform/tfvars/envs/{{env}}.tfvars"}}
+	for _, candidate := range cfg.ExplainVarsPath("dev", "", root) {
+		if candidate.NoLongerRead {
+			t.Errorf("unexpected flagged candidate with vars_layers: %+v", candidate)
+		}
+	}
+}
+
+func TestExplainVarsPath(t *testing.T) {
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		"tfvars/common.tfvars":     "",
+		"tfvars/dev.tfvars":        "",
+		"tfvars/dev.tfvars.json":   "{}",
+		"tfvars/devops.tfvars":     "",
+		"tfvars/dev-old.tfvars":    "",
+		"tfvars/web/dev.tfvars":    "",
+		"tfvars/web/devops.tfvars": "",
+
+		"app/stacks/web/terraform.tfvars":       "",
+		"app/stacks/web/b.auto.tfvars":          "",
+		"app/stacks/web/a.auto.tfvars.json":     "{}",
+		"app/stacks/web/tfvars/dev.auto.tfvars": "",
+	})
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+
+	cfg := &Config{Defaults: DefaultsConfig{VarsLayers: []VarsLayer{
+		{Name: "common", Path: "tfvars/common.tfvars"},
+		{Name: "env", Path: "tfvars/{{env}}.tfvars"},
+		{Name: "again", Path: "tfvars/{{env}}.tfvars"},
+		{Name: "stack", Path: "tfvars/{{stack}}/{{env}}.tfvars"},
+		{Path: "tfvars/{{region}}.tfvars"},
+	}}}
+
+	var got []string
+	for _, candidate := range cfg.ExplainVarsPath("dev", "web", root) {
+		path, _ := filepath.Rel(root, candidate.Path)
+		if !filepath.IsAbs(candidate.Path) {
+			path = candidate.Path
+		}
+		result := "picked"
+		if !candidate.Picked {
+			result = candidate.Reason
+		}
+		got = append(got, candidate.Layer+" "+path+": "+result)
+	}
+	want := []string{
+		"stack_auto app/stacks/web/terraform.tfvars: picked",
+		"stack_auto app/stacks/web/a.auto.tfvars.json: picked",
+		"stack_auto app/stacks/web/b.auto.tfvars: picked",
+		"common tfvars/common.tfvars: picked",
+		"env tfvars/dev.tfvars: picked",
+		"env tfvars/dev.tfvars.json: picked",
+		"env tfvars/dev-old.tfvars: not an exact match for dev.tfvars",
+		"env tfvars/devops.tfvars: not an exact match for dev.tfvars",
+		"again tfvars/dev.tfvars: already considered for layer env",
+		"stack tfvars/web/dev.tfvars: picked",
+		"stack tfvars/web/devops.tfvars: not an exact match for dev.tfvars",
+		"vars_layers[4] tfvars/{{region}}.tfvars: no region: AWS_REGION and AWS_DEFAULT_REGION are not set",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ExplainVarsPath:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	candidates := cfg.ExplainVarsPath("dev", "", root)
+	if stack := candidates[len(candidates)-2]; stack.Layer != "stack" || stack.Reason != "no stack selected" {
+		t.Errorf("the stack layer should be skipped without a stack, got %+v", stack)
+	}
+}
+
+func TestLoadConfigEnvironmentFile(t *testing.T) {
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		"config.yaml": "vault:\n  address: http://vault.example:8200\n",
+		"environments/dev.yaml": `vault:
+  provider_path: kv/data/providers/dev
+backend:
+  type: s3
+  config:
+    bucket: state-:ENV
+`,
+	})
+	testutil.Chdir(t, root)
+
+	cfg, err := LoadConfig("dev")
+	if err != nil {
+		t.Fatalf("LoadConfig returned error: %v", err)
+	}
+
+	if cfg.Vault.Address != "http://vault.example:8200" {
+		t.Errorf("Vault.Address = %q", cfg.Vault.Address)
+	}
+	if got := cfg.ResolveProviderPath("dev"); got != "kv/data/providers/dev" {
+		t.Errorf("ResolveProviderPath = %q", got)
+	}
+	if got := cfg.Environments["dev"].Backend.Config["bucket"]; got != "state-:ENV" {
+		t.Errorf("backend bucket = %v", got)
+	}
+}
+
+func TestResolveBackendAppliesNamingTemplates(t *testing.T) {
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		"config.yaml": `project: k8s-cluster-info
+terraform:
+  backend:
+    bucket: "terraform-state-:PROJECT-:ACCOUNT"
+    region: "us-gov-west-1"
+`,
+		"environments/dev.yaml": `backend:
+  config:
+    key: "custom/:STACK.tfstate"
+`,
+		"environments/lockfile.yaml": `backend:
+  config:
+    use_lockfile: true
+`,
+		"environments/lockfile-string.yaml": `backend:
+  config:
+    use_lockfile: "true"
+`,
+	})
+	testutil.Chdir(t, root)
+
+	cfg, err := LoadConfig("dev")
+	if err != nil {
+		t.Fatalf("LoadConfig returned error: %v", err)
+	}
+
+	backend := cfg.ResolveBackend("dev")
+	want := map[string]interface{}{
+		"bucket":         "terraform-state-:PROJECT-:ACCOUNT",
+		"key":            "custom/:STACK.tfstate",
+		"region":         "us-gov-west-1",
+		"dynamodb_table": "terraform_locks_:PROJECT",
+	}
+	for key, value := range want {
+		if backend.Config[key] != value {
+			t.Errorf("backend %s = %v, want %v", key, backend.Config[key], value)
+		}
+	}
+	if cfg.Project != "k8s-cluster-info" {
+		t.Errorf("Project = %q", cfg.Project)
+	}
+
+	cfg, err = LoadConfig("lockfile")
+	if err != nil {
+		t.Fatalf("LoadConfig returned error: %v", err)
+	}
+	if _, ok := cfg.ResolveBackend("lockfile").Config["dynamodb_table"]; ok {
+		t.Error("dynamodb_table template should not apply when use_lockfile is set")
+	}
+
+	cfg, err = LoadConfig("lockfile-string")
+	if err != nil {
+		t.Fatalf("LoadConfig returned error: %v", err)
+	}
+	if _, ok := cfg.ResolveBackend("lockfile-string").Config["dynamodb_table"]; ok {
+		t.Error("dynamodb_table template should not apply when use_lockfile is the string \"true\"")
+	}
+}
@@ -0,0 +1,535 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/kingoftowns/tf-go/internal/constants"
+	"gopkg.in/yaml.v3"
+)
+
+// ProjectConfigFile marks the project root. It may hold project settings
+// too, which override those in config.yaml.
+const ProjectConfigFile = ".tf-go.yaml"
+
+// LegacyProjectConfigFile holds project settings, and marks the project root
+// when there is no ProjectConfigFile
+const LegacyProjectConfigFile = "config.yaml"
+
+// StackConfigFile holds settings for one stack, in the stack's directory
+const StackConfigFile = ".tf-go.stack.yaml"
+
+// EnvOverridePrefix starts the environment variables that override single
+// settings, e.g. TFGO_VAULT_ADDRESS for vault.address
+const EnvOverridePrefix = "TFGO_"
+
+// LoadOptions selects what Load reads
+type LoadOptions struct {
+	// Env is the environment whose environments/<env>.yaml is layered in
+	Env string
+	// Stack is the stack whose StackConfigFile is layered in, if any
+	Stack string
+	// Dir is where the search for the project root starts. It defaults to
+	// the working directory.
+	Dir string
+}
+
+// ResolvedValue is one setting of the merged config and the layer it came from
+type ResolvedValue struct {
+	Path   string
+	Value  interface{}
+	Source string
+}
+
+// Resolved is the merged config along with where every setting came from
+type Resolved struct {
+	Config *Config
+	// Root is the project root, where config.yaml and environments/ live
+	Root string
+	// Files are the config files that were read, lowest precedence first
+	Files []string
+	// Values are the merged settings, sorted by path
+	Values []ResolvedValue
+
+	tree map[string]interface{}
+}
+
+// Tree returns the merged settings as nested maps, as they would be written
+// in a single config.yaml
+func (r *Resolved) Tree() map[string]interface{} {
+	return r.tree
+}
+
+// layer is the settings of one config source and where each came from
+type layer struct {
+	tree    map[string]interface{}
+	sources map[string]string
+}
+
+// FindProjectRoot walks up from dir to the directory holding
+// ProjectConfigFile or, failing that, LegacyProjectConfigFile. It returns
+// false when neither is found.
+func FindProjectRoot(dir string) (string, bool) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+	for _, marker := range []string{ProjectConfigFile, LegacyProjectConfigFile} {
+		for current := dir; ; current = filepath.Dir(current) {
+			if info, err := os.Stat(filepath.Join(current, marker)); err == nil && !info.IsDir() {
+				return current, true
+			}
+			if filepath.Dir(current) == current {
+				break
+			}
+		}
+	}
+	return "", false
+}
+
+// UserConfigPath returns the user-level config file,
+// $XDG_CONFIG_HOME/tf-go/config.yaml or ~/.config/tf-go/config.yaml
+func UserConfigPath() string {
+	base := os.Getenv("XDG_CONFIG_HOME")
+	if base == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		base = filepath.Join(home, ".config")
+	}
+	return filepath.Join(base, "tf-go", "config.yaml")
+}
+
+// Load returns the merged configuration
+func Load(opts LoadOptions) (*Config, error) {
+	resolved, err := Resolve(opts)
+	if err != nil {
+		return nil, err
+	}
+	return resolved.Config, nil
+}
+
+// Resolve merges the configuration layers, each overriding the ones before:
+//
+//  1. built-in defaults
+//  2. the user config, see UserConfigPath
+//  3. config.yaml, then .tf-go.yaml, in the project root
+//  4. environments/<env>.yaml in the project root, and the files of the
+//     environments it extends
+//  5. .tf-go.stack.yaml in the stack's directory
+//  6. TFGO_* environment variables
+//
+// Maps are merged key by key; any other value, including a list, replaces
+// the one before it. The selected environment is then merged over the
+// environments it extends. Without a project root, the start directory is
+// used.
+func Resolve(opts LoadOptions) (*Resolved, error) {
+	dir := opts.Dir
+	if dir == "" {
+		dir = "."
+	}
+	root, found := FindProjectRoot(dir)
+	if !found {
+		var err error
+		if root, err = filepath.Abs(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	resolved := &Resolved{Root: root}
+	merged := defaultLayer()
+
+	configType := reflect.TypeOf(Config{})
+	for _, path := range []string{UserConfigPath(), filepath.Join(root, LegacyProjectConfigFile), filepath.Join(root, ProjectConfigFile)} {
+		if err := resolved.readLayer(&merged, path, configType, nil); err != nil {
+			return nil, err
+		}
+	}
+	chain, err := resolved.readEnvironments(&merged, opts.Env)
+	if err != nil {
+		return nil, err
+	}
+
+	// The stack directory depends on the stack path template, which the
+	// layers above may set
+	if opts.Stack != "" {
+		template, _ := lookupTree(merged.tree, "defaults", "stack_path_template").(string)
+		base := os.Getenv("TF_PATH")
+		if base == "" {
+			base = root
+		}
+		stackFile := filepath.Join(base, strings.ReplaceAll(template, "{{stack}}", opts.Stack), StackConfigFile)
+		if err := resolved.readLayer(&merged, stackFile, configType, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(chain) > 1 {
+		merged.inherit(chain)
+	}
+
+	overrides, err := envOverrideLayer()
+	if err != nil {
+		return nil, err
+	}
+	merged.merge(overrides, nil)
+
+	cfg, err := decodeTree(merged.tree)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Root = root
+	resolved.Config = cfg
+	resolved.tree = merged.tree
+	for path, source := range merged.sources {
+		resolved.Values = append(resolved.Values, ResolvedValue{Path: path, Value: lookupPath(merged.tree, path), Source: source})
+	}
+	sort.Slice(resolved.Values, func(i, j int) bool { return resolved.Values[i].Path < resolved.Values[j].Path })
+	return resolved, nil
+}
+
+// readLayer merges a config file into merged, under prefix. A missing file is
+// skipped.
+func (r *Resolved) readLayer(merged *layer, path string, t reflect.Type, prefix []string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	problems, node := checkFile(r.displayPath(path), data, t)
+	if len(problems) > 0 {
+		kind := "config"
+		if t == reflect.TypeOf(EnvironmentConfig{}) {
+			kind = "environment config"
+		}
+		return fmt.Errorf("invalid %s file:\n%w", kind, &ValidationError{Problems: problems})
+	}
+	r.Files = append(r.Files, path)
+	if node == nil {
+		return nil
+	}
+
+	file := layer{sources: make(map[string]string)}
+	value, err := file.read(node, strings.Join(prefix, "."), r.displayPath(path))
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	file.tree, _ = value.(map[string]interface{})
+	for i := len(prefix) - 1; i >= 0; i-- {
+		file.tree = map[string]interface{}{prefix[i]: file.tree}
+	}
+	merged.merge(file, nil)
+	return nil
+}
+
+// readEnvironments reads the environment file of env and of every
+// environment it extends, returning env followed by its ancestors
+func (r *Resolved) readEnvironments(merged *layer, env string) ([]string, error) {
+	var chain []string
+	for name := env; name != ""; {
+		if cycle := extendsCycle(chain, name); cycle != "" {
+			return nil, fmt.Errorf("environments extend each other in a cycle: %s", cycle)
+		}
+		chain = append(chain, name)
+
+		path := filepath.Join(r.Root, "environments", name+".yaml")
+		if err := r.readLayer(merged, path, reflect.TypeOf(EnvironmentConfig{}), []string{"environments", name}); err != nil {
+			return nil, err
+		}
+		if name != env && lookupTree(merged.tree, "environments", name) == nil {
+			return nil, fmt.Errorf("environment %s extends unknown environment %q", chain[len(chain)-2], name)
+		}
+		name, _ = lookupTree(merged.tree, "environments", name, "extends").(string)
+	}
+	return chain, nil
+}
+
+// extendsCycle describes the cycle formed by following chain to next, or
+// returns "" when next is not already in chain
+func extendsCycle(chain []string, next string) string {
+	for i, name := range chain {
+		if name == next {
+			return strings.Join(append(append([]string{}, chain[i:]...), next), " -> ")
+		}
+	}
+	return ""
+}
+
+// displayPath shows files in the project relative to its root
+func (r *Resolved) displayPath(path string) string {
+	if rel, err := filepath.Rel(r.Root, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return path
+}
+
+// read converts a YAML node to plain values, recording the file and line of
+// every setting under path
+func (l *layer) read(node *yaml.Node, path, file string) (interface{}, error) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind == yaml.MappingNode && len(node.Content) > 0 {
+		tree := make(map[string]interface{}, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			value, err := l.read(node.Content[i+1], joinPath(path, key), file)
+			if err != nil {
+				return nil, err
+			}
+			tree[key] = value
+		}
+		return tree, nil
+	}
+
+	var value interface{}
+	if err := node.Decode(&value); err != nil {
+		return nil, err
+	}
+	if node.Kind == yaml.MappingNode {
+		value = map[string]interface{}{}
+	}
+	l.sources[path] = fmt.Sprintf("%s:%d", file, node.Line)
+	return value, nil
+}
+
+// merge layers src over l. path is where both trees sit.
+func (l *layer) merge(src layer, path []string) {
+	if l.tree == nil {
+		l.tree = make(map[string]interface{})
+	}
+	for key, value := range src.tree {
+		keyPath := append(append([]string{}, path...), key)
+		existing, isMap := l.tree[key].(map[string]interface{})
+		incoming, incomingMap := value.(map[string]interface{})
+		if isMap && incomingMap && len(incoming) > 0 {
+			child := layer{tree: existing, sources: l.sources}
+			child.merge(layer{tree: incoming, sources: src.sources}, keyPath)
+			continue
+		}
+
+		l.tree[key] = value
+		prefix := strings.Join(keyPath, ".")
+		for p := range l.sources {
+			if p == prefix || strings.HasPrefix(p, prefix+".") {
+				delete(l.sources, p)
+			}
+		}
+		for p, source := range src.sources {
+			if p == prefix || strings.HasPrefix(p, prefix+".") {
+				l.sources[p] = source
+			}
+		}
+	}
+}
+
+// inherit replaces the settings of chain[0] with those of every environment
+// in chain merged in turn, from the last ancestor to chain[0] itself
+func (l *layer) inherit(chain []string) {
+	env := chain[0]
+	prefix := "environments." + env
+	inherited := layer{tree: make(map[string]interface{}), sources: make(map[string]string)}
+	for i := len(chain) - 1; i >= 0; i-- {
+		ancestor := "environments." + chain[i]
+		tree, _ := lookupTree(l.tree, "environments", chain[i]).(map[string]interface{})
+		sources := make(map[string]string)
+		for p, source := range l.sources {
+			if p == ancestor || strings.HasPrefix(p, ancestor+".") {
+				sources[prefix+strings.TrimPrefix(p, ancestor)] = source
+			}
+		}
+		inherited.merge(layer{tree: map[string]interface{}{"environments": map[string]interface{}{env: copyTree(tree)}}, sources: sources}, nil)
+	}
+
+	l.tree["environments"].(map[string]interface{})[env] = lookupTree(inherited.tree, "environments", env)
+	for p := range l.sources {
+		if p == prefix || strings.HasPrefix(p, prefix+".") {
+			delete(l.sources, p)
+		}
+	}
+	for p, source := range inherited.sources {
+		l.sources[p] = source
+	}
+}
+
+// copyTree copies nested maps so merging into the copy leaves tree alone
+func copyTree(tree map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(tree))
+	for key, value := range tree {
+		if nested, ok := value.(map[string]interface{}); ok {
+			value = copyTree(nested)
+		}
+		out[key] = value
+	}
+	return out
+}
+
+// defaultLayer holds the settings that apply when no file sets them
+func defaultLayer() layer {
+	tree := map[string]interface{}{
+		"vault": map[string]interface{}{
+			"address":     constants.DefaultVaultAddress,
+			"auth_method": constants.DefaultVaultAuthMethod,
+		},
+		"terraform": map[string]interface{}{
+			"backend_type": constants.DefaultTerraformBackendType,
+			"backend": map[string]interface{}{
+				"bucket":         constants.DefaultBackendBucketTemplate,
+				"key":            constants.DefaultBackendKeyTemplate,
+				"region":         constants.DefaultBackendRegionTemplate,
+				"dynamodb_table": constants.DefaultBackendLockTableTemplate,
+			},
+		},
+		"defaults": map[string]interface{}{
+			"environment":            constants.DefaultEnvironment,
+			"vars_path_template":     constants.DefaultVarsPathTemplate,
+			"stack_path_template":    constants.DefaultStackPathTemplate,
+			"provider_path_template": constants.DefaultProviderPathTemplate,
+		},
+	}
+	l := layer{tree: tree, sources: make(map[string]string)}
+	l.recordSources(tree, "", "default")
+	return l
+}
+
+func (l *layer) recordSources(tree map[string]interface{}, path, source string) {
+	for key, value := range tree {
+		if nested, ok := value.(map[string]interface{}); ok && len(nested) > 0 {
+			l.recordSources(nested, joinPath(path, key), source)
+			continue
+		}
+		l.sources[joinPath(path, key)] = source
+	}
+}
+
+// EnvOverride is an environment variable that overrides one setting
+type EnvOverride struct {
+	Variable string
+	Path     string
+}
+
+// EnvOverrides lists the environment variables that override settings. Every
+// string setting outside a map has one, named after its path: vault.address
+// is TFGO_VAULT_ADDRESS.
+func EnvOverrides() []EnvOverride {
+	var overrides []EnvOverride
+	var walk func(t reflect.Type, path string)
+	walk = func(t reflect.Type, path string) {
+		for name, field := range yamlFields(t) {
+			fieldPath := joinPath(path, name)
+			switch field.Type.Kind() {
+			case reflect.Struct:
+				walk(field.Type, fieldPath)
+			case reflect.String:
+				variable := EnvOverridePrefix + strings.ToUpper(strings.ReplaceAll(fieldPath, ".", "_"))
+				overrides = append(overrides, EnvOverride{Variable: variable, Path: fieldPath})
+			}
+		}
+	}
+	walk(reflect.TypeOf(Config{}), "")
+	sort.Slice(overrides, func(i, j int) bool { return overrides[i].Path < overrides[j].Path })
+	return overrides
+}
+
+func envOverrideLayer() (layer, error) {
+	l := layer{tree: make(map[string]interface{}), sources: make(map[string]string)}
+	for _, override := range EnvOverrides() {
+		value := os.Getenv(override.Variable)
+		if value == "" {
+			continue
+		}
+		if allowed, ok := enumFields[override.Path]; ok && !contains(allowed, value) {
+			return layer{}, fmt.Errorf("%s must be one of %s, got %q", override.Variable, strings.Join(allowed, ", "), value)
+		}
+
+		keys := strings.Split(override.Path, ".")
+		tree := l.tree
+		for _, key := range keys[:len(keys)-1] {
+			next, ok := tree[key].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				tree[key] = next
+			}
+			tree = next
+		}
+		tree[keys[len(keys)-1]] = value
+		l.sources[override.Path] = "env " + override.Variable
+	}
+	return l, nil
+}
+
+// decodeTree decodes merged settings into a Config. Every layer was checked
+// against the config types, so this only fails on an internal error.
+func decodeTree(tree map[string]interface{}) (*Config, error) {
+	data, err := yaml.Marshal(tree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to merge configuration: %w", err)
+	}
+	cfg := &Config{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to merge configuration: %w", err)
+	}
+	if cfg.Environments == nil {
+		cfg.Environments = make(map[string]EnvironmentConfig)
+	}
+	return cfg, nil
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// lookupTree follows keys through nested maps
+func lookupTree(tree map[string]interface{}, keys ...string) interface{} {
+	var value interface{} = tree
+	for _, key := range keys {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
+
+// lookupPath finds the value at a dotted path recorded by read. Keys that
+// contain dots are matched greedily.
+func lookupPath(tree map[string]interface{}, path string) interface{} {
+	if value, ok := tree[path]; ok {
+		return value
+	}
+	for i := len(path) - 1; i > 0; i-- {
+		if path[i] != '.' {
+			continue
+		}
+		if nested, ok := tree[path[:i]].(map[string]interface{}); ok {
+			if value := lookupPath(nested, path[i+1:]); value != nil {
+				return value
+			}
+		}
+	}
+	return nil
+}
+
+func contains(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kingoftowns/tf-go/internal/testutil"
+)
+
+func TestFindProjectRoot(t *testing.T) {
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		".tf-go.yaml":                 "",
+		"config.yaml":                 "project: shop\n",
+		"modules/network/config.yaml": "project: not-the-root\n",
+		"app/stacks/web/main.tf":      "",
+	})
+	root, _ = filepath.EvalSymlinks(root)
+
+	tests := []struct {
+		dir  string
+		want string
+	}{
+		{root, root},
+		{filepath.Join(root, "app", "stacks", "web"), root},
+		// .tf-go.yaml marks the root even above a nearer config.yaml
+		{filepath.Join(root, "modules", "network"), root},
+	}
+	for _, tt := range tests {
+		got, found := FindProjectRoot(tt.dir)
+		if !found || got != tt.want {
+			t.Errorf("FindProjectRoot(%s) = %s, %v, want %s", tt.dir, got, found, tt.want)
+		}
+	}
+
+	// Without a .tf-go.yaml the nearest config.yaml marks the root
+	separate := t.TempDir()
+	testutil.WriteFiles(t, separate, map[string]string{
+		"config.yaml":          "project: shop\n",
+		"app/stacks/api/x.txt": "",
+	})
+	separate, _ = filepath.EvalSymlinks(separate)
+	if got, found := FindProjectRoot(filepath.Join(separate, "app", "stacks", "api")); !found || got != separate {
+		t.Errorf("FindProjectRoot = %s, %v, want %s", got, found, separate)
+	}
+}
+
+func TestResolveLayers(t *testing.T) {
+	userDir := t.TempDir()
+	testutil.WriteFiles(t, userDir, map[string]string{
+		"tf-go/config.yaml": "vault:\n  address: http://user-vault:8200\nproject: from-user\napp: from-user\n",
+	})
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		"config.yaml": `project: shop
+app: from-project
+terraform:
+  backend_type: s3
+environments:
+  dev:
+    name: Development
+    settings:
+      replicas: 1
+      zones: [a, b]
+`,
+		".tf-go.yaml": "app: from-marker\n",
+		"environments/dev.yaml": `settings:
+  replicas: 2
+`,
+		"app/stacks/web/.tf-go.stack.yaml": "app: web\n",
+	})
+	root, _ = filepath.EvalSymlinks(root)
+	testutil.Chdir(t, filepath.Join(root, "app", "stacks", "web"))
+	t.Setenv("XDG_CONFIG_HOME", userDir)
+	t.Setenv("TF_PATH", "")
+	t.Setenv("TFGO_TERRAFORM_BACKEND_TYPE", "local")
+
+	resolved, err := Resolve(LoadOptions{Env: "dev", Stack: "web"})
+	if err != nil {
+		t.Fatalf("Resolve returned error: %v", err)
+	}
+
+	cfg := resolved.Config
+	if cfg.Root != root {
+		t.Errorf("Root = %s, want %s", cfg.Root, root)
+	}
+	if cfg.Project != "shop" || cfg.App != "web" || cfg.Vault.Address != "http://user-vault:8200" {
+		t.Errorf("unexpected merge: project %q, app %q, vault %q", cfg.Project, cfg.App, cfg.Vault.Address)
+	}
+	if cfg.Terraform.BackendType != "local" {
+		t.Errorf("BackendType = %q, want the TFGO_ override", cfg.Terraform.BackendType)
+	}
+	dev := cfg.Environments["dev"]
+	if dev.Name != "Development" || dev.Settings["replicas"] != 2 {
+		t.Errorf("environment files should merge into config.yaml's entry, got %+v", dev)
+	}
+	if len(resolved.Files) != 5 {
+		t.Errorf("expected 5 files read, got %v", resolved.Files)
+	}
+
+	var got []string
+	for _, value := range resolved.Values {
+		if strings.HasPrefix(value.Path, "terraform.backend.") || strings.HasPrefix(value.Path, "defaults.") {
+			continue
+		}
+		got = append(got, fmt.Sprintf("%s=%v (%s)", value.Path, value.Value, value.Source))
+	}
+	want := []string{
+		"app=web (app/stacks/web/.tf-go.stack.yaml:1)",
+		"environments.dev.name=Development (config.yaml:7)",
+		"environments.dev.settings.replicas=2 (environments/dev.yaml:2)",
+		"environments.dev.settings.zones=[a b] (config.yaml:10)",
+		"project=shop (config.yaml:1)",
+		"terraform.backend_type=local (env TFGO_TERRAFORM_BACKEND_TYPE)",
+		"vault.address=http://user-vault:8200 (" + filepath.Join(userDir, "tf-go", "config.yaml") + ":2)",
+		"vault.auth_method=token (default)",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("values:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestResolveReportsInvalidLayers(t *testing.T) {
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		"config.yaml":                      "project: shop\n",
+		"app/stacks/web/.tf-go.stack.yaml": "ap: web\n",
+	})
+	testutil.Chdir(t, root)
+	t.Setenv("TF_PATH", "")
+
+	_, err := Load(LoadOptions{Stack: "web"})
+	if err == nil || !strings.Contains(err.Error(), "app/stacks/web/.tf-go.stack.yaml:1:1: unknown field ap") {
+		t.Errorf("expected the stack file's problem, got %v", err)
+	}
+
+	t.Setenv("TFGO_VAULT_AUTH_METHOD", "approle")
+	_, err = Load(LoadOptions{})
+	if err == nil || err.Error() != `TFGO_VAULT_AUTH_METHOD must be one of token, got "approle"` {
+		t.Errorf("unexpected error for a bad override: %v", err)
+	}
+}
+
+func TestResolveExtends(t *testing.T) {
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		"config.yaml": `project: shop
+environments:
+  base:
+    vault:
+      provider_path: kv/data/providers/shared
+    backend:
+      type: s3
+      config:
+        bucket: state-shared
+        encrypt: true
+    settings:
+      replicas: 1
+      zones: [a]
+`,
+		"environments/stage.yaml": `extends: base
+name: Staging
+settings:
+  replicas: 2
+`,
+		"environments/prod.yaml": `extends: stage
+name: Production
+backend:
+  config:
+    bucket: state-prod
+settings:
+  zones: [a, b, c]
+`,
+	})
+	testutil.Chdir(t, root)
+
+	resolved, err := Resolve(LoadOptions{Env: "prod"})
+	if err != nil {
+		t.Fatalf("Resolve returned error: %v", err)
+	}
+	prod := resolved.Config.Environments["prod"]
+	if prod.Name != "Production" || prod.Extends != "stage" {
+		t.Errorf("the environment's own settings should win, got %+v", prod)
+	}
+	if prod.Vault.ProviderPath != "kv/data/providers/shared" || prod.Backend.Type != "s3" {
+		t.Errorf("vault and backend should be inherited, got %+v", prod)
+	}
+	if prod.Backend.Config["bucket"] != "state-prod" || prod.Backend.Config["encrypt"] != true {
+		t.Errorf("backend.config should be merged key by key, got %v", prod.Backend.Config)
+	}
+	if prod.Settings["replicas"] != 2 || fmt.Sprint(prod.Settings["zones"]) != "[a b c]" {
+		t.Errorf("settings = %v", prod.Settings)
+	}
+	if stage := resolved.Config.Environments["stage"]; stage.Name != "Staging" {
+		t.Errorf("ancestors should be loaded too, got %+v", stage)
+	}
+
+	sources := make(map[string]string)
+	for _, value := range resolved.Values {
+		sources[value.Path] = value.Source
+	}
+	for path, want := range map[string]string{
+		"environments.prod.vault.provider_path":   "config.yaml:5",
+		"environments.prod.backend.config.bucket": "environments/prod.yaml:5",
+		"environments.prod.settings.replicas":     "environments/stage.yaml:4",
+		"environments.base.settings.replicas":     "config.yaml:12",
+	} {
+		if sources[path] != want {
+			t.Errorf("source of %s = %q, want %q", path, sources[path], want)
+		}
+	}
+}
+
+func TestResolveExtendsErrors(t *testing.T) {
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		"environments/a.yaml":    "extends: b\n",
+		"environments/b.yaml":    "extends: c\n",
+		"environments/c.yaml":    "extends: a\n",
+		"environments/solo.yaml": "extends: missing\n",
+	})
+	testutil.Chdir(t, root)
+
+	if _, err := LoadConfig("a"); err == nil || err.Error() != "environments extend each other in a cycle: a -> b -> c -> a" {
+		t.Errorf("unexpected cycle error: %v", err)
+	}
+	if _, err := LoadConfig("solo"); err == nil || err.Error() != `environment solo extends unknown environment "missing"` {
+		t.Errorf("unexpected error for an unknown parent: %v", err)
+	}
+}
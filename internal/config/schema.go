@@ -0,0 +1,93 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// SchemaID is where the published config.yaml schema lives. The environment
+// schema sits next to it.
+const SchemaID = "https://raw.githubusercontent.com/kingoftowns/tf-go/main/schema/"
+
+// enumFields lists settings that only accept a fixed set of values, by the
+// path of their key
+var enumFields = map[string][]string{
+	"terraform.backend_type": BackendTypes,
+	"vault.auth_method":      AuthMethods,
+	"backend.type":           BackendTypes,
+}
+
+// ConfigSchema returns the JSON Schema of config.yaml
+func ConfigSchema() ([]byte, error) {
+	return marshalSchema("config.schema.json", "tf-go config.yaml", reflect.TypeOf(Config{}))
+}
+
+// EnvironmentSchema returns the JSON Schema of environments/*.yaml files
+func EnvironmentSchema() ([]byte, error) {
+	return marshalSchema("environment.schema.json", "tf-go environment file", reflect.TypeOf(EnvironmentConfig{}))
+}
+
+func marshalSchema(file, title string, t reflect.Type) ([]byte, error) {
+	schema := typeSchema(t, "")
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["$id"] = SchemaID + file
+	schema["title"] = title
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// typeSchema describes the YAML a Go type decodes from. Structs reject
+// unknown keys, the way LoadConfig does. path is the key path within an
+// environment or config.yaml, used to find enumFields.
+func typeSchema(t reflect.Type, path string) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		for name, field := range yamlFields(t) {
+			fieldPath := name
+			if path != "" {
+				fieldPath = path + "." + name
+			}
+			properties[name] = typeSchema(field.Type, fieldPath)
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+	case reflect.Map:
+		valuePath := path + ".*"
+		if strings.HasSuffix(path, "environments") {
+			// Environments in config.yaml use the environment file's keys
+			valuePath = ""
+		}
+		if t.Elem().Kind() == reflect.Interface {
+			return map[string]interface{}{"type": "object"}
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": typeSchema(t.Elem(), valuePath),
+		}
+	case reflect.Slice:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": typeSchema(t.Elem(), path),
+		}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.String:
+		schema := map[string]interface{}{"type": "string"}
+		if values, ok := enumFields[path]; ok {
+			schema["enum"] = values
+		}
+		return schema
+	default:
+		return map[string]interface{}{}
+	}
+}
@@ -0,0 +1,316 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kingoftowns/tf-go/internal/constants"
+	"github.com/kingoftowns/tf-go/internal/redact"
+)
+
+// VarsLayer is one place a tfvars file is looked for. Path is relative to the
+// base path and may use {{env}}, {{stack}}, {{stack_path}} and {{region}}.
+type VarsLayer struct {
+	Name string `yaml:"name"`
+	Path string `yaml:"path"`
+}
+
+// VarsCandidate is one tfvars file considered while resolving vars files
+type VarsCandidate struct {
+	Layer string
+	// Path is the expanded path, or the layer's template when it could not
+	// be expanded
+	Path   string
+	Picked bool
+	// Reason says why a candidate was rejected
+	Reason string
+	// NoLongerRead is set when the search of earlier versions read the file
+	// and no layer reads it now. See searchedVarsFiles.
+	NoLongerRead bool
+}
+
+// ResolveVarsLayers returns defaults.vars_layers, or when it is empty the
+// built-in layers:
+//
+//  1. global_base: config/terraform/tfvars/base.tfvars
+//  2. env_base: config/terraform/tfvars/{{env}}.tfvars
+//  3. stack_base: {{stack_path}}/tfvars/base.tfvars
+//  4. stack_env: defaults.vars_path_template
+//  5. region: config/terraform/tfvars/regions/{{region}}.tfvars
+func (c *Config) ResolveVarsLayers() []VarsLayer {
+	if len(c.Defaults.VarsLayers) > 0 {
+		return c.Defaults.VarsLayers
+	}
+	stackEnv := c.Defaults.VarsPathTemplate
+	if stackEnv == "" {
+		stackEnv = constants.DefaultVarsPathTemplate
+	}
+	return []VarsLayer{
+		{Name: "global_base", Path: "config/terraform/tfvars/base.tfvars"},
+		{Name: "env_base", Path: "config/terraform/tfvars/{{env}}.tfvars"},
+		{Name: "stack_base", Path: "{{stack_path}}/tfvars/base.tfvars"},
+		{Name: "stack_env", Path: stackEnv},
+		{Name: "region", Path: "config/terraform/tfvars/regions/{{region}}.tfvars"},
+	}
+}
+
+// AutoVarsFiles returns the tfvars files Terraform loads on its own from dir,
+// in the order it loads them: terraform.tfvars, terraform.tfvars.json, then
+// every *.auto.tfvars and *.auto.tfvars.json file by name
+func AutoVarsFiles(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var files, auto []string
+	for _, name := range []string{"terraform.tfvars", "terraform.tfvars.json"} {
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil && !info.IsDir() {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && (strings.HasSuffix(name, ".auto.tfvars") || strings.HasSuffix(name, ".auto.tfvars.json")) {
+			auto = append(auto, filepath.Join(dir, name))
+		}
+	}
+	// ReadDir sorts by name, as Terraform does
+	return append(files, auto...)
+}
+
+// ResolveVarsPath returns the tfvars files that exist for env and stack, in
+// layer order, so later files override earlier ones. See ExplainVarsPath.
+func (c *Config) ResolveVarsPath(env, stack, basePath string) []string {
+	var varsPaths []string
+	for _, candidate := range c.ExplainVarsPath(env, stack, basePath) {
+		if candidate.Picked {
+			redact.Printf("[DEBUG] tfvars %s: using %s\n", candidate.Layer, candidate.Path)
+			varsPaths = append(varsPaths, candidate.Path)
+		} else if candidate.NoLongerRead {
+			redact.Printf("[WARNING] %s is no longer read: tfvars files are only found at the layer paths, move it to one of them\n", candidate.Path)
+		} else {
+			redact.Printf("[DEBUG] tfvars %s: skipping %s: %s\n", candidate.Layer, candidate.Path, candidate.Reason)
+		}
+	}
+	return varsPaths
+}
+
+// ExplainVarsPath lists every tfvars file considered for env and stack. The
+// stack's own AutoVarsFiles come first, as layer stack_auto, since Terraform
+// gives them less weight than files passed with -var-file. Each layer then
+// names exactly one file, which is picked when it exists, followed by the
+// same name with .json added when that exists too. Layers that need a stack
+// are skipped without one, and {{region}} comes from AWS_REGION or
+// AWS_DEFAULT_REGION. Other tfvars files next to a layer's file whose name
+// contains the one looked for, such as devops.tfvars for dev.tfvars, are
+// listed as rejected to show that only exact names match.
+func (c *Config) ExplainVarsPath(env, stack, basePath string) []VarsCandidate {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	stackTemplate := c.Defaults.StackPathTemplate
+	if stackTemplate == "" {
+		stackTemplate = constants.DefaultStackPathTemplate
+	}
+	values := map[string]string{
+		"{{env}}":        env,
+		"{{stack}}":      stack,
+		"{{stack_path}}": strings.ReplaceAll(stackTemplate, "{{stack}}", stack),
+		"{{region}}":     region,
+	}
+
+	// Expand every layer first, so that no layer's file is reported as
+	// another layer's near miss
+	var candidates []VarsCandidate
+	expanded := make(map[int]bool)
+	listed := make(map[string]bool)
+	for i, layer := range c.ResolveVarsLayers() {
+		name := layer.Name
+		if name == "" {
+			name = fmt.Sprintf("vars_layers[%d]", i)
+		}
+		candidate := VarsCandidate{Layer: name, Path: layer.Path}
+		if layer.Path == "" {
+			candidate.Reason = "the layer has no path"
+		} else if candidate.Reason = missingVarsValue(layer.Path, env, stack, region); candidate.Reason == "" {
+			for placeholder, value := range values {
+				candidate.Path = strings.ReplaceAll(candidate.Path, placeholder, value)
+			}
+			if !filepath.IsAbs(candidate.Path) {
+				candidate.Path = filepath.Join(basePath, candidate.Path)
+			}
+			expanded[i] = !listed[candidate.Path]
+			listed[candidate.Path] = true
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	var explained []VarsCandidate
+	if stack != "" {
+		for _, path := range AutoVarsFiles(filepath.Join(basePath, values["{{stack_path}}"])) {
+			explained = append(explained, VarsCandidate{Layer: "stack_auto", Path: path, Picked: true})
+			listed[path] = true
+		}
+	}
+	layerOf := make(map[string]string)
+	for i, candidate := range candidates {
+		if candidate.Reason == "" {
+			if previous, ok := layerOf[candidate.Path]; ok {
+				candidate.Reason = "already considered for layer " + previous
+			} else {
+				layerOf[candidate.Path] = candidate.Layer
+				info, err := os.Stat(candidate.Path)
+				switch {
+				case os.IsNotExist(err):
+					candidate.Reason = "not found"
+				case err != nil:
+					candidate.Reason = err.Error()
+				case info.IsDir():
+					candidate.Reason = "is a directory"
+				default:
+					candidate.Picked = true
+				}
+			}
+		}
+		explained = append(explained, candidate)
+		if !expanded[i] {
+			continue
+		}
+		if jsonPath := candidate.Path + ".json"; strings.HasSuffix(candidate.Path, ".tfvars") && !listed[jsonPath] {
+			if info, err := os.Stat(jsonPath); err == nil && !info.IsDir() {
+				explained = append(explained, VarsCandidate{Layer: candidate.Layer, Path: jsonPath, Picked: true})
+				listed[jsonPath] = true
+			}
+		}
+		explained = append(explained, nearMisses(candidate, listed)...)
+	}
+	if len(c.Defaults.VarsLayers) == 0 {
+		explained = markNoLongerRead(explained, searchedVarsFiles(env, basePath))
+	}
+	return explained
+}
+
+// markNoLongerRead flags the searched files that are not picked, adding the
+// ones not yet listed as candidates of layer "search"
+func markNoLongerRead(explained []VarsCandidate, searched []string) []VarsCandidate {
+	const note = "earlier versions read it"
+	for _, path := range searched {
+		found := false
+		for i := range explained {
+			if explained[i].Path == path {
+				found = true
+				if !explained[i].Picked {
+					explained[i].NoLongerRead = true
+					explained[i].Reason += "; " + note
+				}
+			}
+		}
+		if !found {
+			explained = append(explained, VarsCandidate{
+				Layer:        "search",
+				Path:         path,
+				Reason:       "not at a layer path; " + note,
+				NoLongerRead: true,
+			})
+		}
+	}
+	return explained
+}
+
+// searchedVarsFiles returns the files tf-go read before vars layers existed.
+// It searched config/terraform/tfvars under the base path, or the base path
+// itself without that directory, recursively and skipping hidden
+// directories, for the first base.tfvars, then the first <env>.tfvars or,
+// failing that, the first tfvars file whose name contains env.
+func searchedVarsFiles(env, basePath string) []string {
+	dir := filepath.Join(basePath, "config", "terraform", "tfvars")
+	if _, err := os.Stat(dir); err != nil {
+		dir = basePath
+	}
+	first := func(match func(name string) bool) string {
+		var found string
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if path != dir && strings.HasPrefix(info.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if match(info.Name()) {
+				found = path
+				return filepath.SkipAll
+			}
+			return nil
+		})
+		return found
+	}
+
+	var files []string
+	if path := first(func(name string) bool { return name == "base.tfvars" }); path != "" {
+		files = append(files, path)
+	}
+	if env == "" {
+		return files
+	}
+	path := first(func(name string) bool { return name == env+".tfvars" })
+	if path == "" {
+		path = first(func(name string) bool { return strings.HasSuffix(name, ".tfvars") && strings.Contains(name, env) })
+	}
+	if path != "" {
+		files = append(files, path)
+	}
+	return files
+}
+
+// missingVarsValue explains why a layer's path cannot be expanded, or
+// returns "" when it can
+func missingVarsValue(path, env, stack, region string) string {
+	switch {
+	case env == "" && strings.Contains(path, "{{env}}"):
+		return "no environment selected"
+	case stack == "" && (strings.Contains(path, "{{stack}}") || strings.Contains(path, "{{stack_path}}")):
+		return "no stack selected"
+	case region == "" && strings.Contains(path, "{{region}}"):
+		return "no region: AWS_REGION and AWS_DEFAULT_REGION are not set"
+	}
+	return ""
+}
+
+// nearMisses lists the tfvars files next to a layer's file whose name
+// contains the one looked for. listed holds the files already listed, which
+// are skipped.
+func nearMisses(layer VarsCandidate, listed map[string]bool) []VarsCandidate {
+	path := layer.Path
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil
+	}
+	want := filepath.Base(path)
+	stem := strings.TrimSuffix(want, ".tfvars")
+
+	var candidates []VarsCandidate
+	for _, entry := range entries {
+		name := entry.Name()
+		sibling := filepath.Join(filepath.Dir(path), name)
+		isTfvars := strings.HasSuffix(name, ".tfvars") || strings.HasSuffix(name, ".tfvars.json")
+		if entry.IsDir() || !isTfvars || name == want || name == want+".json" || stem == "" || !strings.Contains(name, stem) {
+			continue
+		}
+		if listed[sibling] {
+			continue
+		}
+		listed[sibling] = true
+		candidates = append(candidates, VarsCandidate{
+			Layer:  layer.Layer,
+			Path:   sibling,
+			Reason: "not an exact match for " + want,
+		})
+	}
+	return candidates
+}
@@ -0,0 +1,407 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// BackendTypes are the values backend.type and terraform.backend_type accept
+var BackendTypes = []string{"consul", "gcs", "http", "local", "pg", "s3"}
+
+// AuthMethods are the values vault.auth_method accepts
+var AuthMethods = []string{"token"}
+
+// Problem is one thing wrong with a config file, at the position of the YAML
+// node it concerns
+type Problem struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Line == 0 {
+		return fmt.Sprintf("%s: %s", p.File, p.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", p.File, p.Line, p.Column, p.Message)
+}
+
+// ValidationError lists every problem found in one or more config files
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		lines[i] = problem.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// checkFile parses data and checks it against t, returning the problems and
+// the document's root node. An empty file has no root node.
+func checkFile(path string, data []byte, t reflect.Type) ([]Problem, *yaml.Node) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return []Problem{parseProblem(path, err)}, nil
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	root := doc.Content[0]
+	c := &checker{file: path}
+	c.check(root, t, "")
+	switch t {
+	case reflect.TypeOf(Config{}):
+		c.checkConfig(root)
+	case reflect.TypeOf(EnvironmentConfig{}):
+		c.checkEnvironment(root, "")
+	}
+	sort.SliceStable(c.problems, func(i, j int) bool {
+		if c.problems[i].Line != c.problems[j].Line {
+			return c.problems[i].Line < c.problems[j].Line
+		}
+		return c.problems[i].Column < c.problems[j].Column
+	})
+	return c.problems, root
+}
+
+// parseProblem turns a YAML syntax error into a problem. yaml.v3 reports
+// syntax errors as "yaml: line N: message".
+func parseProblem(path string, err error) Problem {
+	message := strings.TrimPrefix(err.Error(), "yaml: ")
+	var line int
+	if n, _ := fmt.Sscanf(message, "line %d:", &line); n == 1 {
+		message = strings.TrimSpace(message[strings.Index(message, ":")+1:])
+		return Problem{File: path, Line: line, Column: 1, Message: message}
+	}
+	return Problem{File: path, Message: message}
+}
+
+type checker struct {
+	file     string
+	problems []Problem
+}
+
+func (c *checker) report(node *yaml.Node, format string, args ...interface{}) {
+	c.problems = append(c.problems, Problem{File: c.file, Line: node.Line, Column: node.Column, Message: fmt.Sprintf(format, args...)})
+}
+
+// check compares node with the Go type it is decoded into
+func (c *checker) check(node *yaml.Node, t reflect.Type, path string) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Tag == "!!null" {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if !c.expectKind(node, yaml.MappingNode, path, "a mapping") {
+			return
+		}
+		fields := yamlFields(t)
+		c.eachKey(node, path, func(key, value *yaml.Node, keyPath string) {
+			field, ok := fields[key.Value]
+			if !ok {
+				c.report(key, "unknown field %s (known fields: %s)", keyPath, strings.Join(sortedFieldNames(fields), ", "))
+				return
+			}
+			c.check(value, field.Type, keyPath)
+		})
+	case reflect.Map:
+		if !c.expectKind(node, yaml.MappingNode, path, "a mapping") {
+			return
+		}
+		c.eachKey(node, path, func(key, value *yaml.Node, keyPath string) {
+			c.check(value, t.Elem(), keyPath)
+		})
+	case reflect.Slice:
+		if !c.expectKind(node, yaml.SequenceNode, path, "a list") {
+			return
+		}
+		for i, item := range node.Content {
+			c.check(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case reflect.String:
+		c.expectKind(node, yaml.ScalarNode, path, "a string")
+	case reflect.Bool:
+		if c.expectKind(node, yaml.ScalarNode, path, "true or false") && node.Tag != "!!bool" {
+			c.report(node, "%s must be true or false, got %q", path, node.Value)
+		}
+	case reflect.Int:
+		if c.expectKind(node, yaml.ScalarNode, path, "a whole number") && node.Tag != "!!int" {
+			c.report(node, "%s must be a whole number, got %q", path, node.Value)
+		}
+	}
+}
+
+func (c *checker) expectKind(node *yaml.Node, kind yaml.Kind, path, description string) bool {
+	if node.Kind == kind {
+		return true
+	}
+	c.report(node, "%s must be %s, got %s", path, description, describeNode(node))
+	return false
+}
+
+// eachKey calls fn for every key of a mapping, reporting duplicate keys
+func (c *checker) eachKey(node *yaml.Node, path string, fn func(key, value *yaml.Node, keyPath string)) {
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		keyPath := key.Value
+		if path != "" {
+			keyPath = path + "." + key.Value
+		}
+		if seen[key.Value] {
+			c.report(key, "%s is set more than once", keyPath)
+			continue
+		}
+		seen[key.Value] = true
+		fn(key, value, keyPath)
+	}
+}
+
+// checkConfig checks the settings of config.yaml that have a fixed set of
+// values or a format
+func (c *checker) checkConfig(root *yaml.Node) {
+	c.checkOneOf(lookupNode(root, "terraform", "backend_type"), "terraform.backend_type", BackendTypes)
+	c.checkOneOf(lookupNode(root, "vault", "auth_method"), "vault.auth_method", AuthMethods)
+
+	if commands := lookupNode(root, "dynamic", "commands"); commands != nil && commands.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(commands.Content); i += 2 {
+			name, command := commands.Content[i], commands.Content[i+1]
+			path := "dynamic.commands." + name.Value
+			if argv := lookupNode(command, "command"); argv == nil || (argv.Kind == yaml.SequenceNode && len(argv.Content) == 0) {
+				c.report(name, "%s.command must list the program and its arguments", path)
+			}
+			c.checkDuration(lookupNode(command, "timeout"), path+".timeout")
+		}
+	}
+
+	if environments := lookupNode(root, "environments"); environments != nil && environments.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(environments.Content); i += 2 {
+			c.checkEnvironment(environments.Content[i+1], "environments."+environments.Content[i].Value+".")
+		}
+	}
+}
+
+// checkEnvironment checks the settings of an environment with a fixed set of
+// values. prefix places the environment within its file.
+func (c *checker) checkEnvironment(env *yaml.Node, prefix string) {
+	c.checkOneOf(lookupNode(env, "backend", "type"), prefix+"backend.type", BackendTypes)
+	if days := lookupNode(env, "backend", "noncurrent_version_days"); days != nil && days.Tag == "!!int" && strings.HasPrefix(days.Value, "-") {
+		c.report(days, "%sbackend.noncurrent_version_days must not be negative", prefix)
+	}
+}
+
+func (c *checker) checkOneOf(node *yaml.Node, path string, allowed []string) {
+	if node == nil || node.Kind != yaml.ScalarNode || node.Value == "" {
+		return
+	}
+	for _, value := range allowed {
+		if node.Value == value {
+			return
+		}
+	}
+	c.report(node, "%s must be one of %s, got %q", path, strings.Join(allowed, ", "), node.Value)
+}
+
+func (c *checker) checkDuration(node *yaml.Node, path string) {
+	if node == nil || node.Kind != yaml.ScalarNode || node.Value == "" {
+		return
+	}
+	if _, err := time.ParseDuration(node.Value); err != nil {
+		c.report(node, "%s must be a duration such as 30s or 2m, got %q", path, node.Value)
+	}
+}
+
+// lookupNode follows keys through nested mappings, returning nil when one of
+// them is missing
+func lookupNode(node *yaml.Node, keys ...string) *yaml.Node {
+	for _, key := range keys {
+		if node == nil || node.Kind != yaml.MappingNode {
+			return nil
+		}
+		var next *yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				next = node.Content[i+1]
+				break
+			}
+		}
+		node = next
+	}
+	return node
+}
+
+func describeNode(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return "a mapping"
+	case yaml.SequenceNode:
+		return "a list"
+	default:
+		return fmt.Sprintf("%q", node.Value)
+	}
+}
+
+// yamlFields maps the YAML keys of a struct to its fields
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field
+	}
+	return fields
+}
+
+func sortedFieldNames(fields map[string]reflect.StructField) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateFiles checks config.yaml and every environments/*.yaml file under
+// root without loading them, returning the files it checked. Files that do
+// not exist are skipped. All problems are returned in one *ValidationError.
+func ValidateFiles(root string) ([]string, error) {
+	envFiles, err := filepath.Glob(filepath.Join(root, "environments", "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(envFiles)
+
+	var files []string
+	var problems []Problem
+	check := func(path string, t reflect.Type) (*yaml.Node, error) {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, path)
+		fileProblems, node := checkFile(path, data, t)
+		problems = append(problems, fileProblems...)
+		return node, nil
+	}
+
+	graph := extendsGraph{known: make(map[string]bool), extends: make(map[string]extendsRef)}
+	for _, name := range []string{LegacyProjectConfigFile, ProjectConfigFile} {
+		path := filepath.Join(root, name)
+		node, err := check(path, reflect.TypeOf(Config{}))
+		if err != nil {
+			return files, err
+		}
+		if environments := lookupNode(node, "environments"); environments != nil && environments.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(environments.Content); i += 2 {
+				graph.add(environments.Content[i].Value, path, environments.Content[i+1])
+			}
+		}
+	}
+	for _, path := range envFiles {
+		node, err := check(path, reflect.TypeOf(EnvironmentConfig{}))
+		if err != nil {
+			return files, err
+		}
+		graph.add(strings.TrimSuffix(filepath.Base(path), ".yaml"), path, node)
+	}
+	problems = append(problems, graph.check()...)
+	if len(problems) > 0 {
+		return files, &ValidationError{Problems: problems}
+	}
+	return files, nil
+}
+
+// extendsGraph collects the environments of a project and what each extends,
+// to check the references between files
+type extendsGraph struct {
+	known   map[string]bool
+	extends map[string]extendsRef
+}
+
+type extendsRef struct {
+	file string
+	node *yaml.Node
+}
+
+// add records an environment. Later files override the extends of earlier
+// ones, the way Resolve layers them.
+func (g *extendsGraph) add(env, file string, node *yaml.Node) {
+	g.known[env] = true
+	if extends := lookupNode(node, "extends"); extends != nil && extends.Kind == yaml.ScalarNode && extends.Value != "" {
+		g.extends[env] = extendsRef{file: file, node: extends}
+	}
+}
+
+// check reports references to unknown environments and cycles. A cycle is
+// reported once, at the environment in it whose name sorts first.
+func (g *extendsGraph) check() []Problem {
+	envs := make([]string, 0, len(g.extends))
+	for env := range g.extends {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+
+	var problems []Problem
+	for _, env := range envs {
+		ref := g.extends[env]
+		report := func(format string, args ...interface{}) {
+			problems = append(problems, Problem{File: ref.file, Line: ref.node.Line, Column: ref.node.Column, Message: fmt.Sprintf(format, args...)})
+		}
+		if !g.known[ref.node.Value] {
+			report("%s extends unknown environment %q", env, ref.node.Value)
+			continue
+		}
+
+		chain := []string{env}
+		for name := ref.node.Value; ; {
+			if cycle := extendsCycle(chain, name); cycle != "" {
+				if name == env && env == minString(chain) {
+					report("environments extend each other in a cycle: %s", cycle)
+				}
+				break
+			}
+			chain = append(chain, name)
+			next, ok := g.extends[name]
+			if !ok {
+				break
+			}
+			name = next.node.Value
+		}
+	}
+	return problems
+}
+
+func minString(values []string) string {
+	min := values[0]
+	for _, value := range values[1:] {
+		if value < min {
+			min = value
+		}
+	}
+	return min
+}
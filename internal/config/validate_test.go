@@ -0,0 +1,150 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kingoftowns/tf-go/internal/testutil"
+)
+
+func TestValidateFiles(t *testing.T) {
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		"config.yaml": `vault:
+  address: http://vault.example:8200
+  auth_method: approle
+terraform:
+  backend_type: s4
+  bakend: {}
+dynamic:
+  commands:
+    build-id:
+      command: []
+      timeout: soon
+environments:
+  dev:
+    backend:
+      type: azurerm
+`,
+		"environments/dev.yaml": `name: Development
+backend:
+  type: s3
+  auto_create: yes please
+  noncurrent_version_days: -1
+  config:
+    bucket: state-:ENV
+settings:
+  replicas: 3
+workspace: [dev]
+eks:
+  cluster: platform
+  cluster: other
+`,
+		"environments/prod.yaml": "name: Production\nbackend:\n  type: s3\n",
+		"environments/bad.yaml":  "name: [unclosed\n",
+	})
+
+	files, err := ValidateFiles(root)
+	if len(files) != 4 {
+		t.Errorf("expected 4 checked files, got %v", files)
+	}
+	var invalid *ValidationError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("expected *ValidationError, got %v", err)
+	}
+
+	var got []string
+	for _, problem := range invalid.Problems {
+		problem.File, _ = filepath.Rel(root, problem.File)
+		got = append(got, problem.String())
+	}
+	want := []string{
+		`config.yaml:3:16: vault.auth_method must be one of token, got "approle"`,
+		`config.yaml:5:17: terraform.backend_type must be one of consul, gcs, http, local, pg, s3, got "s4"`,
+		`config.yaml:6:3: unknown field terraform.bakend (known fields: backend, backend_type, settings_variables, version)`,
+		`config.yaml:9:5: dynamic.commands.build-id.command must list the program and its arguments`,
+		`config.yaml:11:16: dynamic.commands.build-id.timeout must be a duration such as 30s or 2m, got "soon"`,
+		`config.yaml:15:13: environments.dev.backend.type must be one of consul, gcs, http, local, pg, s3, got "azurerm"`,
+		`environments/bad.yaml:1:1: did not find expected ',' or ']'`,
+		`environments/dev.yaml:4:16: backend.auto_create must be true or false, got "yes please"`,
+		`environments/dev.yaml:5:28: backend.noncurrent_version_days must not be negative`,
+		`environments/dev.yaml:10:12: workspace must be a string, got a list`,
+		`environments/dev.yaml:13:3: eks.cluster is set more than once`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("problems:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestLoadConfigIsStrict(t *testing.T) {
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		"environments/dev.yaml": "backend:\n  type: s3\n  bucket: state\n",
+	})
+	testutil.Chdir(t, root)
+
+	_, err := LoadConfig("dev")
+	want := "invalid environment config file:\nenvironments/dev.yaml:3:3: unknown field backend.bucket (known fields: auto_create, config, noncurrent_version_days, type)"
+	if err == nil || err.Error() != want {
+		t.Errorf("LoadConfig error = %v, want %q", err, want)
+	}
+}
+
+// TestPublishedSchemas keeps the schemas in schema/ in step with the config
+// types. Run with TF_GO_UPDATE_SCHEMA=1 to regenerate them.
+func TestPublishedSchemas(t *testing.T) {
+	for file, generate := range map[string]func() ([]byte, error){
+		"config.schema.json":      ConfigSchema,
+		"environment.schema.json": EnvironmentSchema,
+	} {
+		want, err := generate()
+		if err != nil {
+			t.Fatalf("generating %s: %v", file, err)
+		}
+		path := filepath.Join("..", "..", "schema", file)
+		if os.Getenv("TF_GO_UPDATE_SCHEMA") != "" {
+			if err := os.WriteFile(path, want, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(want) {
+			t.Errorf("schema/%s is out of date; run TF_GO_UPDATE_SCHEMA=1 go test ./internal/config", file)
+		}
+	}
+}
+
+func TestValidateFilesChecksExtends(t *testing.T) {
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		"config.yaml":             "environments:\n  base:\n    name: Base\n  ci:\n    extends: nightly\n",
+		"environments/dev.yaml":   "extends: base\n",
+		"environments/prod.yaml":  "extends: stage\n",
+		"environments/stage.yaml": "extends: prod\n",
+	})
+
+	_, err := ValidateFiles(root)
+	var invalid *ValidationError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("expected *ValidationError, got %v", err)
+	}
+	var got []string
+	for _, problem := range invalid.Problems {
+		problem.File, _ = filepath.Rel(root, problem.File)
+		got = append(got, problem.String())
+	}
+	want := []string{
+		`config.yaml:5:14: ci extends unknown environment "nightly"`,
+		`environments/prod.yaml:1:10: environments extend each other in a cycle: prod -> stage -> prod`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("problems:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
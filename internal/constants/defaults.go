@@ -1,5 +1,7 @@
 package constants
 
+import "time"
+
 // DefaultEnvironment is the default environment used throughout the application
 const DefaultEnvironment = "usgw1-dev-devops"
 
@@ -13,13 +15,49 @@ const DefaultVaultAddress = "http://127.0.0.1:8200"
 const DefaultVaultAuthMethod = "token"
 
 // DefaultTerraformBackendType is the default backend type for Terraform
-const DefaultTerraformBackendType = "local"
+const DefaultTerraformBackendType = "s3"
 
-// DefaultVarsPathTemplate is the default template for tfvars file paths
-const DefaultVarsPathTemplate = "./tfvars/{{env}}/{{stack}}.tfvars"
+// DefaultVarsPathTemplate is the default stack_env tfvars layer: the environment's tfvars file inside the stack
+const DefaultVarsPathTemplate = "{{stack_path}}/tfvars/{{env}}.tfvars"
 
 // DefaultStackPathTemplate is the default template for stack paths  
 const DefaultStackPathTemplate = "./app/stacks/{{stack}}"
 
 // DefaultProviderPathTemplate is the default template for provider paths in Vault
-const DefaultProviderPathTemplate = "terraform/data/providers"
\ No newline at end of file
+const DefaultProviderPathTemplate = "terraform/data/providers"
+
+// DefaultNoncurrentVersionDays is how long superseded state versions are kept in the backend bucket
+const DefaultNoncurrentVersionDays = 90
+
+// DefaultLocalStatePath is where the local backend keeps state, relative to the project root
+const DefaultLocalStatePath = ".terraform-state/:ENV/:STACK/terraform.tfstate"
+
+// DefaultBackendBucketTemplate names the S3 state bucket when an environment does not set one
+const DefaultBackendBucketTemplate = "terraform-state-:PROJECT-:ACCOUNT"
+
+// DefaultBackendKeyTemplate is the state object key when an environment does not set one
+const DefaultBackendKeyTemplate = ":ENV/:STACK/terraform.tfstate"
+
+// DefaultBackendRegionTemplate is the backend region when an environment does not set one
+const DefaultBackendRegionTemplate = ":REGION"
+
+// DefaultBackendLockTableTemplate names the DynamoDB lock table when an environment does not set one
+const DefaultBackendLockTableTemplate = "terraform_locks_:PROJECT"
+
+// DefaultStateBackupDir is where state is snapshotted before mutating state commands, relative to the project root
+const DefaultStateBackupDir = ".terraform-state-backups"
+
+// DefaultStateHistoryLimit is how many of the newest state versions `state history` lists
+const DefaultStateHistoryLimit = 20
+
+// DefaultLockReleaseAge is how old a state lock must be before `lock release` frees it without other evidence
+const DefaultLockReleaseAge = 2 * time.Hour
+
+// DefaultLockAuditLog is where `lock release` records every release attempt, relative to the project root
+const DefaultLockAuditLog = ".terraform-lock-audit.log"
+
+// LockAuditPrefix is where `lock release` also records every attempt in the s3 state bucket
+const LockAuditPrefix = "tf-go/lock-audit/"
+
+// DefaultDynamicCommandTimeout bounds an external command run for ${DYNAMIC:COMMAND(name)}
+const DefaultDynamicCommandTimeout = 30 * time.Second
@@ -0,0 +1,175 @@
+// Package redact keeps secret values out of tf-go's debug and warning output.
+// Secrets are registered as they are read, and every debug print goes through
+// Printf or Println, which replace registered values before writing.
+package redact
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Placeholder replaces a secret in output
+const Placeholder = "(redacted)"
+
+// minSecretLength keeps very short values, which would match all over the
+// output, from being registered
+const minSecretLength = 4
+
+// secretKeys are config keys whose values are always treated as secrets
+var secretKeys = map[string]bool{
+	"access_key":    true,
+	"api_key":       true,
+	"app_key":       true,
+	"client_key":    true,
+	"client_secret": true,
+	"credentials":   true,
+	"passphrase":    true,
+	"passwd":        true,
+	"password":      true,
+	"private_key":   true,
+	"secret":        true,
+	"secret_id":     true,
+	"secret_key":    true,
+	"session_token": true,
+	"token":         true,
+}
+
+// secretSuffixes mark further keys as secrets, e.g. vault_token, db_password
+// or db_pass
+var secretSuffixes = []string{"_token", "_pass", "_passwd", "_password", "_passphrase", "_secret", "_secret_id", "_secret_key", "_api_key"}
+
+var (
+	mu      sync.RWMutex
+	secrets []string
+	// output is where Printf and Println write; nil means os.Stdout
+	output io.Writer
+)
+
+// IsSecretKey reports whether values stored under a config key are secrets
+func IsSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	if secretKeys[key] {
+		return true
+	}
+	for _, suffix := range secretSuffixes {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Register adds values that must not appear in output
+func Register(values ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, value := range values {
+		if len(value) < minSecretLength {
+			continue
+		}
+		known := false
+		for _, secret := range secrets {
+			if secret == value {
+				known = true
+				break
+			}
+		}
+		if !known {
+			secrets = append(secrets, value)
+		}
+	}
+	// Replace longer secrets first, so one that contains another is
+	// redacted whole
+	sort.SliceStable(secrets, func(i, j int) bool {
+		return len(secrets[i]) > len(secrets[j])
+	})
+}
+
+// RegisterConfig registers every string stored under a secret key in config,
+// at any depth
+func RegisterConfig(config map[string]interface{}) {
+	for key, value := range config {
+		switch v := value.(type) {
+		case string:
+			if IsSecretKey(key) {
+				Register(v)
+			}
+		case map[string]interface{}:
+			RegisterConfig(v)
+		case []interface{}:
+			for _, item := range v {
+				switch item := item.(type) {
+				case string:
+					if IsSecretKey(key) {
+						Register(item)
+					}
+				case map[string]interface{}:
+					RegisterConfig(item)
+				}
+			}
+		}
+	}
+}
+
+// Reset forgets every registered secret
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	secrets = nil
+}
+
+// String replaces every registered secret in s
+func String(s string) string {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, Placeholder)
+	}
+	return s
+}
+
+// Contains reports whether s holds a registered secret
+func Contains(s string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, secret := range secrets {
+		if strings.Contains(s, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetOutput sends Printf and Println output to w, for example os.Stderr when
+// stdout carries machine-readable output. nil restores stdout.
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	output = w
+}
+
+// Printf formats like fmt.Printf and writes the result to the output with
+// secrets redacted
+func Printf(format string, args ...interface{}) {
+	write(String(fmt.Sprintf(format, args...)))
+}
+
+// Println formats like fmt.Println and writes the result to the output with
+// secrets redacted
+func Println(args ...interface{}) {
+	write(String(fmt.Sprintln(args...)))
+}
+
+func write(s string) {
+	mu.RLock()
+	w := output
+	mu.RUnlock()
+	if w == nil {
+		w = os.Stdout
+	}
+	fmt.Fprint(w, s)
+}
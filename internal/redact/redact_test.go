@@ -0,0 +1,64 @@
+package redact
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsSecretKey(t *testing.T) {
+	for key, want := range map[string]bool{
+		"token":          true,
+		"secret_key":     true,
+		"vault_token":    true,
+		"DB_PASSWORD":    true,
+		"client_secret":  true,
+		"secret_id":      true,
+		"db_pass":        true,
+		"ldap_passwd":    true,
+		"passphrase":     true,
+		"password_hint":  false,
+		"passenger":      false,
+		"region":         false,
+		"token_file":     false,
+		"config_context": false,
+	} {
+		if got := IsSecretKey(key); got != want {
+			t.Errorf("IsSecretKey(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	Reset()
+	defer Reset()
+
+	Register("abc", "token-1234", "token-1234-long")
+	RegisterConfig(map[string]interface{}{
+		"region": "us-east-1",
+		"kubernetes": map[string]interface{}{
+			"password": "hunter22",
+			"exec":     []interface{}{map[string]interface{}{"api_token": "nested-secret"}},
+		},
+	})
+
+	got := String("abc token-1234-long token-1234 hunter22 nested-secret us-east-1")
+	want := "abc (redacted) (redacted) (redacted) (redacted) us-east-1"
+	if got != want {
+		t.Errorf("String = %q, want %q", got, want)
+	}
+}
+
+func TestSetOutput(t *testing.T) {
+	Reset()
+	defer Reset()
+	var out strings.Builder
+	SetOutput(&out)
+	defer SetOutput(nil)
+
+	Register("hunter22")
+	Printf("[DEBUG] password=%s\n", "hunter22")
+	Println("[DEBUG]", "done")
+	if got := out.String(); got != "[DEBUG] password=(redacted)\n[DEBUG] done\n" {
+		t.Errorf("output = %q", got)
+	}
+}
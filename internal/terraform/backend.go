@@ -0,0 +1,470 @@
+package terraform
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	tfgoconfig "github.com/kingoftowns/tf-go/internal/config"
+	"github.com/kingoftowns/tf-go/internal/constants"
+	"github.com/kingoftowns/tf-go/internal/redact"
+)
+
+// Backend is a Terraform state backend that tf-go can configure
+type Backend interface {
+	// Type returns the Terraform backend type, e.g. "s3"
+	Type() string
+	// Validate checks that every required setting is present and well formed
+	Validate() error
+	// Settings returns every backend argument, passed to terraform init as -backend-config
+	Settings() map[string]interface{}
+	// Describe returns a one-line summary of where state is stored
+	Describe() string
+}
+
+// NewBackend builds the backend selected by backendCfg.Type, expanding naming
+// placeholders in its settings
+func NewBackend(ctx context.Context, backendCfg tfgoconfig.BackendConfig, naming *Naming) (Backend, error) {
+	if backendCfg.Type == "s3" {
+		s3Config, err := ResolveS3BackendConfig(ctx, NewS3BackendConfig(backendCfg), naming)
+		if err != nil {
+			return nil, err
+		}
+		return &S3Backend{Config: s3Config}, nil
+	}
+
+	settings := make(map[string]interface{}, len(backendCfg.Config))
+	for key, value := range backendCfg.Config {
+		expanded, err := naming.ExpandValue(ctx, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s backend %s: %w", backendCfg.Type, key, err)
+		}
+		settings[key] = expanded
+	}
+
+	switch backendCfg.Type {
+	case "local":
+		return newLocalBackend(ctx, settings, naming)
+	case "http":
+		return newHTTPBackend(settings, naming)
+	case "gcs":
+		return &GCSBackend{Config: settings}, nil
+	case "consul":
+		return &ConsulBackend{Config: settings}, nil
+	case "pg":
+		return &PgBackend{Config: settings}, nil
+	default:
+		return nil, fmt.Errorf("unsupported backend type: %s", backendCfg.Type)
+	}
+}
+
+// setupBackend records the backend for Init and writes a backend stub unless
+// the stack already declares a backend block of the same type. Settings the
+// stack hardcodes in that block are reported when tf-go overrides them.
+func (e *Executor) setupBackend(backend Backend) error {
+	stack, err := ParseStackConfig(e.workDir)
+	if err != nil {
+		return fmt.Errorf("failed to check existing backend: %w", err)
+	}
+	existing, err := stack.BackendType()
+	if err != nil {
+		return err
+	}
+
+	switch existing {
+	case "":
+		if err := e.CreateBackendFile(backend); err != nil {
+			return fmt.Errorf("failed to create backend file: %w", err)
+		}
+	case backend.Type():
+		redact.Printf("[DEBUG] Stack declares its own %s backend block at %s, keeping it\n", existing, stack.Backends[0].Location())
+		for _, conflict := range stack.Backends[0].ConflictingSettings(backend.Settings()) {
+			redact.Printf("[WARNING] Backend %s: stack sets %s; -backend-config overrides it\n", existing, conflict)
+		}
+	default:
+		return fmt.Errorf("stack declares a %q backend at %s but the environment is configured for %q", existing, stack.Backends[0].Location(), backend.Type())
+	}
+
+	e.backend = backend
+	return nil
+}
+
+// CreateBackendFile writes an empty backend block of the backend's type to
+// backend.tf. The settings themselves are supplied at init time through
+// -backend-config, so this only acts as a partial configuration for stacks that
+// do not declare a backend of their own.
+func (e *Executor) CreateBackendFile(backend Backend) error {
+	f, err := os.Create(filepath.Join(e.workDir, "backend.tf"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "terraform {\n  backend %q {}\n}\n", backend.Type())
+	return err
+}
+
+// BackendConfigArgs returns the backend's settings as sorted key=value
+// arguments for terraform init -backend-config. Lists and objects such as
+// assume_role and endpoints are written as HCL expressions, which Terraform
+// parses for non-primitive backend attributes.
+func BackendConfigArgs(backend Backend) []string {
+	settings := backend.Settings()
+
+	keys := make([]string, 0, len(settings))
+	for key, value := range settings {
+		if !isEmptyBackendValue(value) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	args := make([]string, 0, len(keys))
+	for _, key := range keys {
+		args = append(args, key+"="+formatBackendConfigValue(settings[key]))
+	}
+	return args
+}
+
+func isEmptyBackendValue(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+// formatBackendConfigValue formats a primitive as its raw string and lists
+// and maps as HCL expressions
+func formatBackendConfigValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case map[string]interface{}, []interface{}, []string:
+		return hclExpression(v)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// hclTraversal is a reference, such as var.token, written into HCL as is
+type hclTraversal string
+
+// hclExpression renders a Go value as an HCL expression
+func hclExpression(value interface{}) string {
+	switch v := value.(type) {
+	case hclTraversal:
+		return string(v)
+	case nil:
+		return "null"
+	case string:
+		return quoteHCLString(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case int, int64, float64:
+		return fmt.Sprintf("%v", v)
+	case []string:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = item
+		}
+		return hclExpression(items)
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = hclExpression(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		items := make([]string, len(keys))
+		for i, key := range keys {
+			items[i] = hclObjectKey(key) + " = " + hclExpression(v[key])
+		}
+		return "{ " + strings.Join(items, ", ") + " }"
+	default:
+		return quoteHCLString(fmt.Sprintf("%v", v))
+	}
+}
+
+// hclIdentifierPattern matches names HCL accepts unquoted
+var hclIdentifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// hclObjectKey leaves identifiers bare and quotes other object keys, such as
+// tag names containing dots or slashes
+func hclObjectKey(key string) string {
+	if hclIdentifierPattern.MatchString(key) {
+		return key
+	}
+	return quoteHCLString(key)
+}
+
+// quoteHCLString quotes s as an HCL string literal, escaping template sequences
+// and control characters so that no value can end the string or inject HCL
+func quoteHCLString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i, r := range s {
+		switch {
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == '"':
+			b.WriteString(`\"`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case (r == '$' || r == '%') && strings.HasPrefix(s[i+1:], "{"):
+			// $${ and %%{ are the literal forms of ${ and %{
+			b.WriteRune(r)
+			b.WriteRune(r)
+		case unicode.IsControl(r):
+			fmt.Fprintf(&b, `\u%04x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func settingString(settings map[string]interface{}, key string) string {
+	if value, ok := settings[key]; ok && value != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return ""
+}
+
+// LocalBackend stores state in a file on the machine running tf-go
+type LocalBackend struct {
+	Path string
+	// Workspace is the selected Terraform workspace, if not the default
+	Workspace string
+}
+
+// newLocalBackend resolves a relative state path against the project root,
+// because Terraform runs in a temporary workspace that is removed afterwards
+// and tf-go may be started from any directory in the project
+func newLocalBackend(ctx context.Context, settings map[string]interface{}, naming *Naming) (*LocalBackend, error) {
+	path := settingString(settings, "path")
+	if path == "" {
+		var err error
+		if path, err = naming.Expand(ctx, constants.DefaultLocalStatePath); err != nil {
+			return nil, err
+		}
+	}
+
+	if !filepath.IsAbs(path) && naming.Root != "" {
+		path = filepath.Join(naming.Root, path)
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve local state path %s: %w", path, err)
+	}
+
+	return &LocalBackend{Path: absPath}, nil
+}
+
+func (b *LocalBackend) Type() string { return "local" }
+
+func (b *LocalBackend) Validate() error {
+	if b.Path == "" {
+		return fmt.Errorf("local backend requires a path")
+	}
+	if strings.HasSuffix(b.Path, string(filepath.Separator)) {
+		return fmt.Errorf("local backend path must be a file, got directory %s", b.Path)
+	}
+	return nil
+}
+
+// Settings keeps non-default workspaces next to the state file, since
+// Terraform would otherwise put them in the temporary working directory
+func (b *LocalBackend) Settings() map[string]interface{} {
+	settings := map[string]interface{}{"path": b.Path}
+	if b.Workspace != "" {
+		settings["workspace_dir"] = b.workspaceDir()
+	}
+	return settings
+}
+
+func (b *LocalBackend) Describe() string {
+	if b.Workspace != "" {
+		return filepath.Join(b.workspaceDir(), b.Workspace, filepath.Base(b.Path))
+	}
+	return b.Path
+}
+
+func (b *LocalBackend) workspaceDir() string {
+	return filepath.Join(filepath.Dir(b.Path), "terraform.tfstate.d")
+}
+
+// HTTPBackend stores state behind a REST endpoint such as GitLab's managed
+// Terraform state API
+type HTTPBackend struct {
+	Config map[string]interface{}
+}
+
+// newHTTPBackend fills in GitLab state API addresses when gitlab_project_id is
+// set instead of an explicit address
+func newHTTPBackend(settings map[string]interface{}, naming *Naming) (*HTTPBackend, error) {
+	projectID := settingString(settings, "gitlab_project_id")
+	stateName := settingString(settings, "gitlab_state_name")
+	apiURL := settingString(settings, "gitlab_api_url")
+	delete(settings, "gitlab_project_id")
+	delete(settings, "gitlab_state_name")
+	delete(settings, "gitlab_api_url")
+
+	if projectID != "" && settingString(settings, "address") == "" {
+		if apiURL == "" {
+			apiURL = os.Getenv("CI_API_V4_URL")
+		}
+		if apiURL == "" {
+			return nil, fmt.Errorf("http backend: gitlab_project_id requires gitlab_api_url or CI_API_V4_URL")
+		}
+		if stateName == "" {
+			stateName = naming.Env + "-" + naming.Stack
+		}
+
+		address := fmt.Sprintf("%s/projects/%s/terraform/state/%s",
+			strings.TrimSuffix(apiURL, "/"), url.PathEscape(projectID), url.PathEscape(stateName))
+		settings["address"] = address
+		settings["lock_address"] = address + "/lock"
+		settings["unlock_address"] = address + "/lock"
+		settings["lock_method"] = "POST"
+		settings["unlock_method"] = "DELETE"
+		if _, ok := settings["username"]; !ok && os.Getenv("GITLAB_CI") == "true" {
+			// The job token is picked up by Terraform from TF_HTTP_PASSWORD
+			settings["username"] = "gitlab-ci-token"
+		}
+	}
+
+	return &HTTPBackend{Config: settings}, nil
+}
+
+func (b *HTTPBackend) Type() string { return "http" }
+
+func (b *HTTPBackend) Validate() error {
+	for _, key := range []string{"address", "lock_address", "unlock_address"} {
+		value := settingString(b.Config, key)
+		if value == "" {
+			if key == "address" {
+				return fmt.Errorf("http backend requires address (or gitlab_project_id)")
+			}
+			continue
+		}
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("http backend %s must be an http(s) URL, got %q", key, value)
+		}
+	}
+	return nil
+}
+
+func (b *HTTPBackend) Settings() map[string]interface{} { return b.Config }
+
+func (b *HTTPBackend) Describe() string { return settingString(b.Config, "address") }
+
+// GCSBackend stores state in a Google Cloud Storage bucket
+type GCSBackend struct {
+	Config map[string]interface{}
+}
+
+func (b *GCSBackend) Type() string { return "gcs" }
+
+func (b *GCSBackend) Validate() error {
+	bucket := settingString(b.Config, "bucket")
+	if bucket == "" {
+		return fmt.Errorf("gcs backend requires bucket")
+	}
+	if strings.Contains(bucket, "/") {
+		return fmt.Errorf("gcs backend bucket must be a bucket name, not a gs:// URL or path, got %q", bucket)
+	}
+	if settingString(b.Config, "encryption_key") != "" && settingString(b.Config, "kms_encryption_key") != "" {
+		return fmt.Errorf("gcs backend accepts encryption_key or kms_encryption_key, not both")
+	}
+	return nil
+}
+
+func (b *GCSBackend) Settings() map[string]interface{} { return b.Config }
+
+func (b *GCSBackend) Describe() string {
+	location := "gs://" + settingString(b.Config, "bucket")
+	if prefix := strings.Trim(settingString(b.Config, "prefix"), "/"); prefix != "" {
+		location += "/" + prefix
+	}
+	return location
+}
+
+// ConsulBackend stores state in the Consul KV store
+type ConsulBackend struct {
+	Config map[string]interface{}
+}
+
+func (b *ConsulBackend) Type() string { return "consul" }
+
+func (b *ConsulBackend) Validate() error {
+	path := settingString(b.Config, "path")
+	if path == "" {
+		return fmt.Errorf("consul backend requires path")
+	}
+	if strings.HasPrefix(path, "/") {
+		return fmt.Errorf("consul backend path must not start with '/', got %q", path)
+	}
+	if scheme := settingString(b.Config, "scheme"); scheme != "" && scheme != "http" && scheme != "https" {
+		return fmt.Errorf("consul backend scheme must be http or https, got %q", scheme)
+	}
+	return nil
+}
+
+func (b *ConsulBackend) Settings() map[string]interface{} { return b.Config }
+
+func (b *ConsulBackend) Describe() string {
+	address := settingString(b.Config, "address")
+	if address == "" {
+		address = "consul"
+	}
+	return address + "/" + settingString(b.Config, "path")
+}
+
+// PgBackend stores state in a PostgreSQL database
+type PgBackend struct {
+	Config map[string]interface{}
+}
+
+func (b *PgBackend) Type() string { return "pg" }
+
+func (b *PgBackend) Validate() error {
+	if settingString(b.Config, "conn_str") == "" && os.Getenv("PG_CONN_STR") == "" {
+		return fmt.Errorf("pg backend requires conn_str or the PG_CONN_STR environment variable")
+	}
+	return nil
+}
+
+func (b *PgBackend) Settings() map[string]interface{} { return b.Config }
+
+func (b *PgBackend) Describe() string {
+	schema := settingString(b.Config, "schema_name")
+	if schema == "" {
+		schema = "terraform_remote_state"
+	}
+	return "postgres schema " + schema
+}
@@ -0,0 +1,219 @@
+package terraform
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	tfgoconfig "github.com/kingoftowns/tf-go/internal/config"
+	"github.com/kingoftowns/tf-go/internal/testutil"
+)
+
+func backendArgs(backend Backend) string {
+	return strings.Join(BackendConfigArgs(backend), "\n")
+}
+
+func TestNewBackendConfigArgsForEachType(t *testing.T) {
+	root := t.TempDir()
+	testutil.Chdir(t, root)
+	t.Setenv("AWS_ACCOUNT_ID", "111122223333")
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("GITLAB_CI", "true")
+
+	tests := []struct {
+		name    string
+		backend tfgoconfig.BackendConfig
+		want    []string
+	}{
+		{
+			name:    "local default path",
+			backend: tfgoconfig.BackendConfig{Type: "local"},
+			want: []string{
+				"path=" + filepath.Join(root, ".terraform-state", "dev", "web", "terraform.tfstate"),
+			},
+		},
+		{
+			name: "s3",
+			backend: tfgoconfig.BackendConfig{Type: "s3", Config: map[string]interface{}{
+				"bucket": "state-:ACCOUNT", "key": ":ENV/:STACK/terraform.tfstate", "region": "us-east-1", "kms_key_id": "alias/state",
+				"use_path_style": true,
+				"assume_role":    map[string]interface{}{"role_arn": "arn:aws:iam::111122223333:role/:ENV-state"},
+				"endpoints":      map[string]interface{}{"s3": "http://localhost:4566"},
+			}},
+			want: []string{
+				"bucket=state-111122223333",
+				"key=dev/web/terraform.tfstate",
+				"kms_key_id=alias/state",
+				"encrypt=true",
+				"use_path_style=true",
+				`assume_role={ role_arn = "arn:aws:iam::111122223333:role/dev-state" }`,
+				`endpoints={ s3 = "http://localhost:4566" }`,
+			},
+		},
+		{
+			name: "http from gitlab project",
+			backend: tfgoconfig.BackendConfig{Type: "http", Config: map[string]interface{}{
+				"gitlab_project_id": 42, "gitlab_api_url": "https://gitlab.example.com/api/v4",
+			}},
+			want: []string{
+				"address=https://gitlab.example.com/api/v4/projects/42/terraform/state/dev-web",
+				"lock_address=https://gitlab.example.com/api/v4/projects/42/terraform/state/dev-web/lock",
+				"unlock_method=DELETE",
+				"username=gitlab-ci-token",
+			},
+		},
+		{
+			name: "gcs",
+			backend: tfgoconfig.BackendConfig{Type: "gcs", Config: map[string]interface{}{
+				"bucket": "state-:ENV", "prefix": ":STACK",
+			}},
+			want: []string{"bucket=state-dev", "prefix=web"},
+		},
+		{
+			name: "consul",
+			backend: tfgoconfig.BackendConfig{Type: "consul", Config: map[string]interface{}{
+				"address": "consul.example.com:8500", "path": "terraform/:ENV/:STACK", "gzip": true,
+			}},
+			want: []string{"path=terraform/dev/web", "gzip=true"},
+		},
+		{
+			name: "pg",
+			backend: tfgoconfig.BackendConfig{Type: "pg", Config: map[string]interface{}{
+				"conn_str": "postgres://db/terraform", "schema_name": ":ENV_:STACK",
+			}},
+			want: []string{"schema_name=dev_web"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend, err := NewBackend(context.Background(), tt.backend, NewNaming(nil, "dev", "web"))
+			if err != nil {
+				t.Fatalf("NewBackend returned error: %v", err)
+			}
+			if err := backend.Validate(); err != nil {
+				t.Fatalf("Validate returned error: %v", err)
+			}
+			got := backendArgs(backend)
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("backend config args missing %q:\n%s", want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestBackendValidation(t *testing.T) {
+	t.Setenv("PG_CONN_STR", "")
+
+	tests := []struct {
+		name    string
+		backend Backend
+		wantErr string
+	}{
+		{name: "s3 missing bucket", backend: &S3Backend{Config: S3BackendConfig{Key: "k", Region: "r"}}, wantErr: "requires bucket"},
+		{name: "s3 unknown option", backend: &S3Backend{Config: S3BackendConfig{Bucket: "b", Key: "k", Region: "r", Options: map[string]interface{}{"use_path_styl": true}}}, wantErr: `unknown option "use_path_styl"`},
+		{name: "s3 unknown assume_role attribute", backend: &S3Backend{Config: S3BackendConfig{Bucket: "b", Key: "k", Region: "r", Options: map[string]interface{}{"assume_role": map[string]interface{}{"arn": "x"}}}}, wantErr: `unknown option "arn" in assume_role`},
+		{name: "http missing address", backend: &HTTPBackend{Config: map[string]interface{}{}}, wantErr: "requires address"},
+		{name: "http bad scheme", backend: &HTTPBackend{Config: map[string]interface{}{"address": "ftp://x"}}, wantErr: "http(s) URL"},
+		{name: "gcs missing bucket", backend: &GCSBackend{Config: map[string]interface{}{}}, wantErr: "requires bucket"},
+		{name: "gcs bucket URL", backend: &GCSBackend{Config: map[string]interface{}{"bucket": "gs://state"}}, wantErr: "not a gs:// URL"},
+		{name: "gcs two encryption keys", backend: &GCSBackend{Config: map[string]interface{}{"bucket": "state", "encryption_key": "a", "kms_encryption_key": "b"}}, wantErr: "not both"},
+		{name: "consul missing path", backend: &ConsulBackend{Config: map[string]interface{}{}}, wantErr: "requires path"},
+		{name: "pg missing conn_str", backend: &PgBackend{Config: map[string]interface{}{}}, wantErr: "requires conn_str"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.backend.Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewBackendUnsupportedType(t *testing.T) {
+	if _, err := NewBackend(context.Background(), tfgoconfig.BackendConfig{Type: "azurerm"}, NewNaming(nil, "dev", "web")); err == nil {
+		t.Fatal("expected error for unsupported backend type")
+	}
+}
+
+func TestQuoteHCLString(t *testing.T) {
+	got := quoteHCLString("a\"b\\c${d}\n")
+	want := `"a\"b\\c$${d}\n"`
+	if got != want {
+		t.Errorf("quoteHCLString = %s, want %s", got, want)
+	}
+
+	// Whatever the input, the literal must parse back to exactly that value
+	for _, value := range []string{
+		`"} resource "null_resource" "x" {`,
+		"${file(\"/etc/passwd\")} %{ if true }x%{ endif }",
+		"$${already} $$ %% $",
+		"line\r\nbell\a nul\x00 esc\x1b \u2028",
+	} {
+		expr, diags := hclsyntax.ParseExpression([]byte(quoteHCLString(value)), "test", hcl.InitialPos)
+		if diags.HasErrors() {
+			t.Errorf("quoteHCLString(%q) does not parse: %s", value, diags.Error())
+			continue
+		}
+		parsed, diags := expr.Value(nil)
+		if diags.HasErrors() || parsed.AsString() != value {
+			t.Errorf("quoteHCLString(%q) parses to %q (%v)", value, parsed.GoString(), diags)
+		}
+	}
+}
+
+func TestSetupBackend(t *testing.T) {
+	backend := &LocalBackend{Path: "/tmp/state.tfstate"}
+
+	t.Run("no backend block writes stub", func(t *testing.T) {
+		executor := &Executor{workDir: t.TempDir()}
+		if err := executor.setupBackend(backend); err != nil {
+			t.Fatalf("setupBackend returned error: %v", err)
+		}
+		got := readTestFile(t, filepath.Join(executor.workDir, "backend.tf"))
+		if got != "terraform {\n  backend \"local\" {}\n}\n" {
+			t.Errorf("unexpected backend.tf:\n%s", got)
+		}
+	})
+
+	t.Run("matching block is kept", func(t *testing.T) {
+		executor := &Executor{workDir: t.TempDir()}
+		testutil.WriteFiles(t, executor.workDir, map[string]string{
+			"terraform.tf": "terraform {\n  backend \"local\" {\n    workspace_dir = \"ws\"\n  }\n}\n",
+		})
+		if err := executor.setupBackend(backend); err != nil {
+			t.Fatalf("setupBackend returned error: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(executor.workDir, "backend.tf")); !os.IsNotExist(err) {
+			t.Errorf("backend.tf should not be written when the stack declares a backend")
+		}
+	})
+
+	t.Run("conflicting block fails", func(t *testing.T) {
+		executor := &Executor{workDir: t.TempDir()}
+		testutil.WriteFiles(t, executor.workDir, map[string]string{
+			"terraform.tf": "terraform {\n  backend \"s3\" {}\n}\n",
+		})
+		err := executor.setupBackend(backend)
+		if err == nil || !strings.Contains(err.Error(), `declares a "s3" backend`) {
+			t.Errorf("expected backend conflict error, got %v", err)
+		}
+	})
+}
+
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	return string(data)
+}
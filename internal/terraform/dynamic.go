@@ -0,0 +1,508 @@
+package terraform
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tfgoconfig "github.com/kingoftowns/tf-go/internal/config"
+	"github.com/kingoftowns/tf-go/internal/redact"
+)
+
+// ParamType is the type of a dynamic value argument
+type ParamType int
+
+const (
+	ParamString ParamType = iota
+	ParamBool
+	ParamInt
+	ParamDuration
+)
+
+func (t ParamType) String() string {
+	switch t {
+	case ParamBool:
+		return "bool"
+	case ParamInt:
+		return "int"
+	case ParamDuration:
+		return "duration"
+	}
+	return "string"
+}
+
+// DynamicParam declares one argument of a dynamic value. Arguments without a
+// Default are required.
+type DynamicParam struct {
+	Name    string
+	Type    ParamType
+	Default interface{}
+}
+
+// DynamicArgs holds the arguments of a call, converted to their declared types
+type DynamicArgs map[string]interface{}
+
+func (a DynamicArgs) String(name string) string          { v, _ := a[name].(string); return v }
+func (a DynamicArgs) Bool(name string) bool              { v, _ := a[name].(bool); return v }
+func (a DynamicArgs) Int(name string) int                { v, _ := a[name].(int); return v }
+func (a DynamicArgs) Duration(name string) time.Duration { v, _ := a[name].(time.Duration); return v }
+
+// DynamicFunc computes ${DYNAMIC:NAME(args)}
+type DynamicFunc struct {
+	Name        string
+	Description string
+	Params      []DynamicParam
+	Resolve     func(ctx context.Context, env *DynamicEnv, args DynamicArgs) (string, error)
+}
+
+// DynamicRegistry maps dynamic value names to the functions computing them
+type DynamicRegistry struct {
+	funcs map[string]DynamicFunc
+}
+
+// NewDynamicRegistry returns an empty registry
+func NewDynamicRegistry() *DynamicRegistry {
+	return &DynamicRegistry{funcs: make(map[string]DynamicFunc)}
+}
+
+// DefaultDynamicRegistry returns a registry holding the built-in dynamic values
+func DefaultDynamicRegistry() *DynamicRegistry {
+	registry := NewDynamicRegistry()
+	for _, fn := range builtinDynamicFuncs {
+		if err := registry.Register(fn); err != nil {
+			panic(err)
+		}
+	}
+	return registry
+}
+
+var dynamicNamePattern = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+// Register adds a dynamic value. Names are upper case and unique.
+func (r *DynamicRegistry) Register(fn DynamicFunc) error {
+	if !dynamicNamePattern.MatchString(fn.Name) {
+		return fmt.Errorf("invalid dynamic value name %q", fn.Name)
+	}
+	if _, ok := r.funcs[fn.Name]; ok {
+		return fmt.Errorf("dynamic value %s is already registered", fn.Name)
+	}
+	if fn.Resolve == nil {
+		return fmt.Errorf("dynamic value %s has no resolve function", fn.Name)
+	}
+	r.funcs[fn.Name] = fn
+	return nil
+}
+
+// Lookup returns the registered dynamic value called name
+func (r *DynamicRegistry) Lookup(name string) (DynamicFunc, bool) {
+	fn, ok := r.funcs[name]
+	return fn, ok
+}
+
+// Names returns the registered names in order
+func (r *DynamicRegistry) Names() []string {
+	names := make([]string, 0, len(r.funcs))
+	for name := range r.funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DynamicEnv is what dynamic values may depend on besides their arguments
+type DynamicEnv struct {
+	Naming *Naming
+	// Root is the project root, which FILE paths are relative to
+	Root string
+	// EKS is the environment's cluster, used when a call names none
+	EKS EKSCluster
+	// Commands are the external commands COMMAND may run
+	Commands map[string]tfgoconfig.CommandConfig
+}
+
+// DynamicCall is a parsed ${DYNAMIC:NAME(args)} reference
+type DynamicCall struct {
+	Name string
+	Args DynamicArgs
+	// Key identifies the call with its arguments normalized, for caching
+	Key string
+}
+
+// dynamicArg is one argument as written, named when given as name=value
+type dynamicArg struct {
+	name  string
+	value string
+}
+
+var dynamicCallPattern = regexp.MustCompile(`^\$\{DYNAMIC:([A-Za-z0-9_]+)(?:\((.*)\))?\}$`)
+
+// isDynamicReference reports whether value is a ${DYNAMIC:...} reference
+func isDynamicReference(value string) bool {
+	return strings.HasPrefix(value, "${DYNAMIC:") && strings.HasSuffix(value, "}")
+}
+
+// Parse reads a ${DYNAMIC:NAME} or ${DYNAMIC:NAME(args)} reference and
+// checks its arguments against the registered parameters. Arguments are
+// positional or name=value, separated by commas; double-quoted arguments may
+// contain commas and parentheses.
+func (r *DynamicRegistry) Parse(expression string) (*DynamicCall, error) {
+	match := dynamicCallPattern.FindStringSubmatch(expression)
+	if match == nil {
+		return nil, fmt.Errorf("malformed dynamic value %s", expression)
+	}
+	fn, ok := r.Lookup(match[1])
+	if !ok {
+		return nil, fmt.Errorf("unknown dynamic value ${DYNAMIC:%s} (known: %s)", match[1], strings.Join(r.Names(), ", "))
+	}
+
+	written, err := splitDynamicArgs(match[2])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name, err)
+	}
+	args, err := bindDynamicArgs(fn, written)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]string, len(fn.Params))
+	for i, param := range fn.Params {
+		parts[i] = fmt.Sprintf("%s=%v", param.Name, args[param.Name])
+	}
+	return &DynamicCall{Name: fn.Name, Args: args, Key: fn.Name + "(" + strings.Join(parts, ",") + ")"}, nil
+}
+
+func splitDynamicArgs(s string) ([]dynamicArg, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	var raw []string
+	var current strings.Builder
+	quoted, escaped := false, false
+	for _, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			raw = append(raw, current.String())
+			current.Reset()
+			continue
+		}
+		current.WriteRune(c)
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote in arguments %q", s)
+	}
+	raw = append(raw, current.String())
+
+	args := make([]dynamicArg, len(raw))
+	for i, item := range raw {
+		item = strings.TrimSpace(item)
+		if eq := strings.Index(item, "="); eq > 0 && !strings.HasPrefix(item, `"`) && hclIdentifierPattern.MatchString(item[:eq]) {
+			args[i].name = item[:eq]
+			item = strings.TrimSpace(item[eq+1:])
+		}
+		if strings.HasPrefix(item, `"`) {
+			unquoted, err := strconv.Unquote(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted argument %s", item)
+			}
+			item = unquoted
+		}
+		args[i].value = item
+	}
+	return args, nil
+}
+
+func bindDynamicArgs(fn DynamicFunc, written []dynamicArg) (DynamicArgs, error) {
+	if len(written) > len(fn.Params) {
+		return nil, fmt.Errorf("%s takes at most %d arguments, got %d", fn.Name, len(fn.Params), len(written))
+	}
+
+	values := make(map[string]string)
+	named := false
+	for i, arg := range written {
+		name := arg.name
+		if name == "" {
+			if named {
+				return nil, fmt.Errorf("%s: positional argument after a named one", fn.Name)
+			}
+			name = fn.Params[i].Name
+		} else {
+			named = true
+		}
+		if _, ok := values[name]; ok {
+			return nil, fmt.Errorf("%s: argument %s given twice", fn.Name, name)
+		}
+		values[name] = arg.value
+	}
+
+	args := make(DynamicArgs, len(fn.Params))
+	for _, param := range fn.Params {
+		value, ok := values[param.Name]
+		delete(values, param.Name)
+		if !ok {
+			if param.Default == nil {
+				return nil, fmt.Errorf("%s: missing argument %s", fn.Name, param.Name)
+			}
+			args[param.Name] = param.Default
+			continue
+		}
+		converted, err := convertDynamicArg(param.Type, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: argument %s must be a %s, got %q", fn.Name, param.Name, param.Type, value)
+		}
+		args[param.Name] = converted
+	}
+	for name := range values {
+		return nil, fmt.Errorf("%s: unknown argument %s", fn.Name, name)
+	}
+	return args, nil
+}
+
+func convertDynamicArg(paramType ParamType, value string) (interface{}, error) {
+	switch paramType {
+	case ParamBool:
+		return strconv.ParseBool(value)
+	case ParamInt:
+		return strconv.Atoi(value)
+	case ParamDuration:
+		return time.ParseDuration(value)
+	}
+	return value, nil
+}
+
+// DynamicTraceEntry records how one ${DYNAMIC:...} reference was resolved.
+// It never holds the value.
+type DynamicTraceEntry struct {
+	Path       string
+	Expression string
+	Cached     bool
+	Duration   time.Duration
+	Err        error
+}
+
+func (t DynamicTraceEntry) String() string {
+	outcome := "resolved in " + t.Duration.Round(time.Millisecond).String()
+	switch {
+	case t.Err != nil:
+		outcome = "failed: " + t.Err.Error()
+	case t.Cached:
+		outcome = "cached"
+	}
+	return fmt.Sprintf("%s = %s (%s)", t.Path, t.Expression, outcome)
+}
+
+// DynamicResolver resolves the ${DYNAMIC:...} references of one run. Each
+// distinct call is resolved once, and every reference is traced.
+type DynamicResolver struct {
+	registry *DynamicRegistry
+	env      *DynamicEnv
+	cache    map[string]string
+	trace    []DynamicTraceEntry
+}
+
+// NewDynamicResolver creates a resolver for one run
+func NewDynamicResolver(registry *DynamicRegistry, env DynamicEnv) *DynamicResolver {
+	if env.Naming == nil {
+		env.Naming = NewNaming(nil, "", "")
+	}
+	return &DynamicResolver{registry: registry, env: &env, cache: make(map[string]string)}
+}
+
+// Trace returns every reference resolved so far, in order
+func (r *DynamicResolver) Trace() []DynamicTraceEntry {
+	return append([]DynamicTraceEntry(nil), r.trace...)
+}
+
+// Resolve returns the value of a ${DYNAMIC:...} reference found at path
+func (r *DynamicResolver) Resolve(ctx context.Context, expression, path string) (string, error) {
+	entry := DynamicTraceEntry{Path: path, Expression: expression}
+	value, err := r.resolve(ctx, expression, &entry)
+	if err != nil {
+		entry.Err = err
+		err = fmt.Errorf("%s: %w", path, err)
+	}
+	r.trace = append(r.trace, entry)
+	return value, err
+}
+
+func (r *DynamicResolver) resolve(ctx context.Context, expression string, entry *DynamicTraceEntry) (string, error) {
+	call, err := r.registry.Parse(expression)
+	if err != nil {
+		return "", err
+	}
+	if value, ok := r.cache[call.Key]; ok {
+		entry.Cached = true
+		return value, nil
+	}
+
+	fn, _ := r.registry.Lookup(call.Name)
+	start := time.Now()
+	value, err := fn.Resolve(ctx, r.env, call.Args)
+	entry.Duration = time.Since(start)
+	if err != nil {
+		return "", err
+	}
+	r.cache[call.Key] = value
+	return value, nil
+}
+
+// ResolveDynamicValues replaces every ${DYNAMIC:...} reference in a provider
+// document. A token set to EKS_CLUSTER_TOKEN directly in a provider or block
+// that supports exec becomes an exec block instead, so the provider fetches a
+// new token whenever the old one expires.
+func ResolveDynamicValues(ctx context.Context, input map[string]interface{}, resolver *DynamicResolver) (map[string]interface{}, error) {
+	result := make(map[string]interface{}, len(input))
+	for _, providerType := range sortedDynamicKeys(input) {
+		value := input[providerType]
+		schema := providerSchemas[providerType]
+		switch v := value.(type) {
+		case map[string]interface{}:
+			resolved, err := resolver.resolveMap(ctx, v, schema, providerType)
+			if err != nil {
+				return nil, err
+			}
+			result[providerType] = resolved
+		case []interface{}:
+			instances := make([]interface{}, len(v))
+			for i, item := range v {
+				instance, ok := item.(map[string]interface{})
+				if !ok {
+					instances[i] = item
+					continue
+				}
+				resolved, err := resolver.resolveMap(ctx, instance, schema, fmt.Sprintf("%s[%d]", providerType, i))
+				if err != nil {
+					return nil, err
+				}
+				instances[i] = resolved
+			}
+			result[providerType] = instances
+		default:
+			result[providerType] = v
+		}
+	}
+	return result, nil
+}
+
+func (r *DynamicResolver) resolveMap(ctx context.Context, input map[string]interface{}, schema ProviderSchema, path string) (map[string]interface{}, error) {
+	result := make(map[string]interface{}, len(input))
+	for _, key := range sortedDynamicKeys(input) {
+		value := input[key]
+		keyPath := path + "." + key
+		switch v := value.(type) {
+		case string:
+			if !isDynamicReference(v) {
+				result[key] = v
+				continue
+			}
+			if exec, ok, err := r.tokenExecBlock(v, key, input, schema, keyPath); err != nil {
+				return nil, err
+			} else if ok {
+				result["exec"] = exec
+				continue
+			}
+			resolved, err := r.Resolve(ctx, v, keyPath)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = resolved
+		case map[string]interface{}:
+			resolved, err := r.resolveMap(ctx, v, schema.Blocks[key], keyPath)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = resolved
+		case []interface{}:
+			items := make([]interface{}, len(v))
+			for i, item := range v {
+				itemPath := fmt.Sprintf("%s[%d]", keyPath, i)
+				switch item := item.(type) {
+				case map[string]interface{}:
+					resolved, err := r.resolveMap(ctx, item, schema.Blocks[key], itemPath)
+					if err != nil {
+						return nil, err
+					}
+					items[i] = resolved
+				case string:
+					if !isDynamicReference(item) {
+						items[i] = item
+						continue
+					}
+					resolved, err := r.Resolve(ctx, item, itemPath)
+					if err != nil {
+						return nil, err
+					}
+					items[i] = resolved
+				default:
+					items[i] = item
+				}
+			}
+			result[key] = items
+		default:
+			result[key] = v
+		}
+	}
+	return result, nil
+}
+
+// tokenExecBlock returns the exec block that replaces a token set to
+// EKS_CLUSTER_TOKEN, when the block it is in supports exec and has none
+func (r *DynamicResolver) tokenExecBlock(expression, key string, body map[string]interface{}, schema ProviderSchema, path string) (map[string]interface{}, bool, error) {
+	_, supportsExec := schema.Blocks["exec"]
+	_, hasExec := body["exec"]
+	if key != "token" || !supportsExec || hasExec {
+		return nil, false, nil
+	}
+	call, err := r.registry.Parse(expression)
+	if err != nil || call.Name != "EKS_CLUSTER_TOKEN" {
+		// Errors are reported when the value is resolved normally
+		return nil, false, nil
+	}
+
+	entry := DynamicTraceEntry{Path: path, Expression: expression}
+	cluster, err := r.env.eksCluster(call.Args)
+	var exec map[string]interface{}
+	if err == nil {
+		exec, err = eksExecBlock(cluster)
+	}
+	if err != nil {
+		entry.Err = err
+		r.trace = append(r.trace, entry)
+		return nil, false, fmt.Errorf("%s: %w", path, err)
+	}
+	entry.Expression += " as exec block"
+	r.trace = append(r.trace, entry)
+	return exec, true, nil
+}
+
+// sortedDynamicKeys orders a document's keys, so values are resolved and
+// traced in the same order on every run
+func sortedDynamicKeys(input map[string]interface{}) []string {
+	keys := make([]string, 0, len(input))
+	for key := range input {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// printDynamicTrace writes the resolution trace as debug output
+func printDynamicTrace(trace []DynamicTraceEntry) {
+	if len(trace) == 0 {
+		return
+	}
+	redact.Printf("[DEBUG] Resolved %d dynamic values:\n", len(trace))
+	for _, entry := range trace {
+		redact.Printf("  %s\n", entry)
+	}
+}
@@ -0,0 +1,308 @@
+package terraform
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/kingoftowns/tf-go/internal/constants"
+	"github.com/kingoftowns/tf-go/internal/redact"
+)
+
+var eksParams = []DynamicParam{
+	{Name: "cluster", Type: ParamString, Default: ""},
+	{Name: "region", Type: ParamString, Default: ""},
+}
+
+// builtinDynamicFuncs are the dynamic values every run can use
+var builtinDynamicFuncs = []DynamicFunc{
+	{
+		Name:        "EKS_CLUSTER_ENDPOINT",
+		Description: "API server endpoint of an EKS cluster",
+		Params:      eksParams,
+		Resolve: func(ctx context.Context, env *DynamicEnv, args DynamicArgs) (string, error) {
+			info, err := env.describeEKSCluster(ctx, args)
+			if err != nil {
+				return "", err
+			}
+			return info.Endpoint, nil
+		},
+	},
+	{
+		Name:        "EKS_CLUSTER_CA",
+		Description: "PEM encoded certificate authority of an EKS cluster",
+		Params:      eksParams,
+		Resolve: func(ctx context.Context, env *DynamicEnv, args DynamicArgs) (string, error) {
+			info, err := env.describeEKSCluster(ctx, args)
+			if err != nil {
+				return "", err
+			}
+			return info.CertificateAuthority, nil
+		},
+	},
+	{
+		Name:        "EKS_CLUSTER_TOKEN",
+		Description: "bearer token for an EKS cluster, valid for 15 minutes",
+		Params:      eksParams,
+		Resolve: func(ctx context.Context, env *DynamicEnv, args DynamicArgs) (string, error) {
+			cluster, err := env.eksCluster(args)
+			if err != nil {
+				return "", err
+			}
+			token, _, err := EKSToken(ctx, cluster)
+			return token, err
+		},
+	},
+	{
+		Name:        "SSM_PARAMETER",
+		Description: "value of an SSM parameter, decrypted when it is a SecureString",
+		Params: []DynamicParam{
+			{Name: "name", Type: ParamString},
+			{Name: "region", Type: ParamString, Default: ""},
+		},
+		Resolve: resolveSSMParameter,
+	},
+	{
+		Name:        "SECRETS_MANAGER_SECRET",
+		Description: "a Secrets Manager secret, or one key of a JSON secret",
+		Params: []DynamicParam{
+			{Name: "id", Type: ParamString},
+			{Name: "key", Type: ParamString, Default: ""},
+			{Name: "region", Type: ParamString, Default: ""},
+		},
+		Resolve: resolveSecretsManagerSecret,
+	},
+	{
+		Name:        "AWS_ACCOUNT_ID",
+		Description: "account of the current AWS credentials, from sts:GetCallerIdentity",
+		Resolve: func(ctx context.Context, env *DynamicEnv, args DynamicArgs) (string, error) {
+			return lookupAccountID(ctx)
+		},
+	},
+	{
+		Name:        "AWS_REGION",
+		Description: "region the AWS SDK is configured for",
+		Resolve: func(ctx context.Context, env *DynamicEnv, args DynamicArgs) (string, error) {
+			if env.Naming.Region != "" {
+				return env.Naming.Region, nil
+			}
+			awsCfg, err := config.LoadDefaultConfig(ctx)
+			if err != nil {
+				return "", fmt.Errorf("failed to load AWS config: %w", err)
+			}
+			if awsCfg.Region == "" {
+				return "", fmt.Errorf("no AWS region is configured: set AWS_REGION or a region in the AWS profile")
+			}
+			return awsCfg.Region, nil
+		},
+	},
+	{
+		Name:        "GIT_SHA",
+		Description: "commit being deployed, from CI_COMMIT_SHA or git",
+		Params:      []DynamicParam{{Name: "short", Type: ParamBool, Default: false}},
+		Resolve: func(ctx context.Context, env *DynamicEnv, args DynamicArgs) (string, error) {
+			sha := os.Getenv("CI_COMMIT_SHA")
+			if sha == "" {
+				out, err := exec.CommandContext(ctx, "git", "rev-parse", "HEAD").Output()
+				if err != nil {
+					return "", fmt.Errorf("cannot determine the git commit: set CI_COMMIT_SHA or run inside a git checkout")
+				}
+				sha = strings.TrimSpace(string(out))
+			}
+			if args.Bool("short") && len(sha) > 8 {
+				sha = sha[:8]
+			}
+			return sha, nil
+		},
+	},
+	{
+		Name:        "GIT_BRANCH",
+		Description: "branch being deployed, from CI_COMMIT_REF_NAME or git",
+		Resolve: func(ctx context.Context, env *DynamicEnv, args DynamicArgs) (string, error) {
+			return env.Naming.value(ctx, "BRANCH")
+		},
+	},
+	{
+		Name:        "FILE",
+		Description: "contents of a file, relative to the project root",
+		Params: []DynamicParam{
+			{Name: "path", Type: ParamString},
+			{Name: "trim", Type: ParamBool, Default: true},
+		},
+		Resolve: func(ctx context.Context, env *DynamicEnv, args DynamicArgs) (string, error) {
+			path := expandHomeDir(args.String("path")).(string)
+			if !filepath.IsAbs(path) && env.Root != "" {
+				path = filepath.Join(env.Root, path)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return "", err
+			}
+			if args.Bool("trim") {
+				return strings.TrimSpace(string(data)), nil
+			}
+			return string(data), nil
+		},
+	},
+	{
+		Name:        "SETTING",
+		Description: "a setting of the environment, by its dotted path; maps and lists as JSON",
+		Params:      []DynamicParam{{Name: "path", Type: ParamString}},
+		Resolve: func(ctx context.Context, env *DynamicEnv, args DynamicArgs) (string, error) {
+			value, ok := lookupSetting(env.Naming.Settings, args.String("path"))
+			if !ok {
+				return "", fmt.Errorf("environment %q has no setting %s", env.Naming.Env, args.String("path"))
+			}
+			return formatSetting(value), nil
+		},
+	},
+	{
+		Name:        "COMMAND",
+		Description: "trimmed output of an external command configured under dynamic.commands",
+		Params:      []DynamicParam{{Name: "name", Type: ParamString}},
+		Resolve:     resolveCommand,
+	},
+}
+
+// eksCluster returns the cluster a call names, or the environment's cluster
+func (env *DynamicEnv) eksCluster(args DynamicArgs) (EKSCluster, error) {
+	cluster := env.EKS
+	if name := args.String("cluster"); name != "" {
+		cluster = EKSCluster{Name: name, Region: env.EKS.Region}
+	}
+	if region := args.String("region"); region != "" {
+		cluster.Region = region
+	}
+	if cluster.Name == "" {
+		return EKSCluster{}, fmt.Errorf("no EKS cluster: set eks.cluster for the environment or CLUSTER_NAME, or pass cluster")
+	}
+	return cluster, nil
+}
+
+func (env *DynamicEnv) describeEKSCluster(ctx context.Context, args DynamicArgs) (*EKSClusterInfo, error) {
+	cluster, err := env.eksCluster(args)
+	if err != nil {
+		return nil, err
+	}
+	return DescribeEKSCluster(ctx, cluster)
+}
+
+// loadAWSConfig loads the default AWS config, in region when one is given
+func loadAWSConfig(ctx context.Context, region string) (aws.Config, error) {
+	var opts []func(*config.LoadOptions) error
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	awsCfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	return awsCfg, nil
+}
+
+func resolveSSMParameter(ctx context.Context, env *DynamicEnv, args DynamicArgs) (string, error) {
+	awsCfg, err := loadAWSConfig(ctx, args.String("region"))
+	if err != nil {
+		return "", err
+	}
+
+	name := args.String("name")
+	out, err := ssm.NewFromConfig(awsCfg).GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read SSM parameter %s: %w", name, err)
+	}
+	if out.Parameter == nil {
+		return "", fmt.Errorf("SSM parameter %s has no value", name)
+	}
+
+	value := aws.ToString(out.Parameter.Value)
+	if out.Parameter.Type == ssmtypes.ParameterTypeSecureString {
+		redact.Register(value)
+	}
+	return value, nil
+}
+
+func resolveSecretsManagerSecret(ctx context.Context, env *DynamicEnv, args DynamicArgs) (string, error) {
+	awsCfg, err := loadAWSConfig(ctx, args.String("region"))
+	if err != nil {
+		return "", err
+	}
+
+	id := args.String("id")
+	out, err := secretsmanager.NewFromConfig(awsCfg).GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(id),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret %s: %w", id, err)
+	}
+	if out.SecretString == nil {
+		return "", fmt.Errorf("secret %s is binary; only string secrets are supported", id)
+	}
+	secret := aws.ToString(out.SecretString)
+	redact.Register(secret)
+
+	key := args.String("key")
+	if key == "" {
+		return secret, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+		return "", fmt.Errorf("secret %s is not a JSON object, so key %s cannot be read", id, key)
+	}
+	field, ok := fields[key]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no key %s", id, key)
+	}
+	value, ok := field.(string)
+	if !ok {
+		encoded, _ := json.Marshal(field)
+		value = string(encoded)
+	}
+	redact.Register(value)
+	return value, nil
+}
+
+func resolveCommand(ctx context.Context, env *DynamicEnv, args DynamicArgs) (string, error) {
+	name := args.String("name")
+	command, ok := env.Commands[name]
+	if !ok || len(command.Command) == 0 {
+		return "", fmt.Errorf("no command %q is configured under dynamic.commands", name)
+	}
+
+	timeout := constants.DefaultDynamicCommandTimeout
+	if command.Timeout != "" {
+		parsed, err := time.ParseDuration(command.Timeout)
+		if err != nil {
+			return "", fmt.Errorf("command %s has an invalid timeout %q", name, command.Timeout)
+		}
+		timeout = parsed
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command.Command[0], command.Command[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("command %s timed out after %s", name, timeout)
+		}
+		return "", fmt.Errorf("command %s failed: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -0,0 +1,289 @@
+package terraform
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tfgoconfig "github.com/kingoftowns/tf-go/internal/config"
+	"github.com/kingoftowns/tf-go/internal/redact"
+	"github.com/kingoftowns/tf-go/internal/testutil"
+)
+
+func TestDynamicRegistryParse(t *testing.T) {
+	registry := DefaultDynamicRegistry()
+
+	call, err := registry.Parse(`${DYNAMIC:SECRETS_MANAGER_SECRET("db/creds, primary", key=password)}`)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if call.Args.String("id") != "db/creds, primary" || call.Args.String("key") != "password" || call.Args.String("region") != "" {
+		t.Errorf("unexpected args: %v", call.Args)
+	}
+	if call.Key != "SECRETS_MANAGER_SECRET(id=db/creds, primary,key=password,region=)" {
+		t.Errorf("unexpected key %s", call.Key)
+	}
+
+	call, err = registry.Parse(`${DYNAMIC:GIT_SHA(true)}`)
+	if err != nil || !call.Args.Bool("short") {
+		t.Errorf("expected short=true, got %v, %v", call, err)
+	}
+	call, err = registry.Parse(`${DYNAMIC:EKS_CLUSTER_TOKEN}`)
+	if err != nil || call.Name != "EKS_CLUSTER_TOKEN" {
+		t.Errorf("expected call without arguments, got %v, %v", call, err)
+	}
+
+	for expression, want := range map[string]string{
+		`${DYNAMIC:NOPE}`:                         "unknown dynamic value ${DYNAMIC:NOPE} (known: AWS_ACCOUNT_ID,",
+		`${DYNAMIC:GIT_SHA(maybe)}`:               "GIT_SHA: argument short must be a bool",
+		`${DYNAMIC:SSM_PARAMETER}`:                "SSM_PARAMETER: missing argument name",
+		`${DYNAMIC:SSM_PARAMETER(a, b, c)}`:       "SSM_PARAMETER takes at most 2 arguments",
+		`${DYNAMIC:SSM_PARAMETER(a, decrypt=no)}`: "SSM_PARAMETER: unknown argument decrypt",
+		`${DYNAMIC:SSM_PARAMETER(name=a, b)}`:     "positional argument after a named one",
+		`${DYNAMIC:FILE("unterminated)}`:          "unterminated quote",
+	} {
+		if _, err := registry.Parse(expression); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Parse(%s) error = %v, want %q", expression, err, want)
+		}
+	}
+}
+
+func TestDynamicRegistryRegister(t *testing.T) {
+	registry := DefaultDynamicRegistry()
+	calls := 0
+	err := registry.Register(DynamicFunc{
+		Name:   "ECHO",
+		Params: []DynamicParam{{Name: "value", Type: ParamString}, {Name: "times", Type: ParamInt, Default: 1}},
+		Resolve: func(ctx context.Context, env *DynamicEnv, args DynamicArgs) (string, error) {
+			calls++
+			return strings.Repeat(args.String("value"), args.Int("times")), nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if err := registry.Register(DynamicFunc{Name: "ECHO", Resolve: func(context.Context, *DynamicEnv, DynamicArgs) (string, error) { return "", nil }}); err == nil {
+		t.Error("expected duplicate registration to fail")
+	}
+
+	resolver := NewDynamicResolver(registry, DynamicEnv{})
+	resolved, err := ResolveDynamicValues(context.Background(), map[string]interface{}{
+		"datadog": map[string]interface{}{
+			"api_url": "${DYNAMIC:ECHO(ab, times=2)}",
+			"labels":  []interface{}{"${DYNAMIC:ECHO(ab, 2)}", "static"},
+		},
+	}, resolver)
+	if err != nil {
+		t.Fatalf("ResolveDynamicValues failed: %v", err)
+	}
+	datadog := resolved["datadog"].(map[string]interface{})
+	if datadog["api_url"] != "abab" || datadog["labels"].([]interface{})[0] != "abab" {
+		t.Errorf("unexpected values: %v", datadog)
+	}
+	if calls != 1 {
+		t.Errorf("equal calls should be resolved once, got %d", calls)
+	}
+
+	trace := resolver.Trace()
+	if len(trace) != 2 || trace[0].Cached == trace[1].Cached {
+		t.Fatalf("expected one fresh and one cached entry, got %v", trace)
+	}
+	if !strings.Contains(trace[0].String()+trace[1].String(), "datadog.labels[0] = ${DYNAMIC:ECHO(ab, 2)} (cached)") {
+		t.Errorf("unexpected trace: %v", trace)
+	}
+}
+
+func TestResolveDynamicValuesEKS(t *testing.T) {
+	newEKSServer(t)
+	executable, _ := os.Executable()
+
+	resolver := NewDynamicResolver(DefaultDynamicRegistry(), DynamicEnv{EKS: EKSCluster{Name: "dev-cluster", Region: "us-east-1"}})
+	resolved, err := ResolveDynamicValues(context.Background(), map[string]interface{}{
+		"kubernetes": map[string]interface{}{
+			"host":                   "${DYNAMIC:EKS_CLUSTER_ENDPOINT}",
+			"cluster_ca_certificate": "${DYNAMIC:EKS_CLUSTER_CA}",
+			"token":                  "${DYNAMIC:EKS_CLUSTER_TOKEN}",
+		},
+		"helm": []interface{}{map[string]interface{}{
+			"kubernetes": map[string]interface{}{"token": "${DYNAMIC:EKS_CLUSTER_TOKEN(cluster=other, region=eu-west-1)}"},
+		}},
+		"kubectl": map[string]interface{}{"token": "${DYNAMIC:EKS_CLUSTER_TOKEN}"},
+	}, resolver)
+	if err != nil {
+		t.Fatalf("ResolveDynamicValues failed: %v", err)
+	}
+
+	kubernetes := resolved["kubernetes"].(map[string]interface{})
+	if kubernetes["host"] != "https://ABC.gr7.us-east-1.eks.amazonaws.com" || kubernetes["cluster_ca_certificate"] != testCA {
+		t.Errorf("unexpected kubernetes config: %v", kubernetes)
+	}
+	if _, ok := kubernetes["token"]; ok {
+		t.Error("kubernetes token should be replaced by an exec block")
+	}
+	exec, ok := kubernetes["exec"].(map[string]interface{})
+	if !ok || exec["command"] != executable || exec["api_version"] != execCredentialVersion {
+		t.Fatalf("unexpected exec block: %v", kubernetes["exec"])
+	}
+	args := exec["args"].([]interface{})
+	if len(args) != 5 || args[0] != EKSTokenCommand || args[2] != "dev-cluster" || args[4] != "us-east-1" {
+		t.Errorf("unexpected exec args: %v", args)
+	}
+
+	helmKubernetes := resolved["helm"].([]interface{})[0].(map[string]interface{})["kubernetes"].(map[string]interface{})
+	helmArgs := helmKubernetes["exec"].(map[string]interface{})["args"].([]interface{})
+	if helmArgs[2] != "other" || helmArgs[4] != "eu-west-1" {
+		t.Errorf("helm exec block should use the cluster named in the call: %v", helmArgs)
+	}
+
+	// Providers tf-go has no exec schema for get a static token
+	if token, _ := resolved["kubectl"].(map[string]interface{})["token"].(string); !strings.HasPrefix(token, eksTokenPrefix) {
+		t.Errorf("expected static token for kubectl, got %q", token)
+	}
+
+	if len(resolver.Trace()) != 5 {
+		t.Errorf("expected 5 trace entries, got %v", resolver.Trace())
+	}
+}
+
+func TestResolveDynamicValuesErrors(t *testing.T) {
+	newEKSServer(t)
+
+	for _, tt := range []struct {
+		cluster EKSCluster
+		value   string
+		want    string
+	}{
+		{EKSCluster{Name: "dev-cluster"}, "${DYNAMIC:EKS_CLUSTER_VERSION}", "kubernetes.host: unknown dynamic value ${DYNAMIC:EKS_CLUSTER_VERSION}"},
+		{EKSCluster{}, "${DYNAMIC:EKS_CLUSTER_ENDPOINT}", "set eks.cluster for the environment or CLUSTER_NAME"},
+		{EKSCluster{Name: "missing"}, "${DYNAMIC:EKS_CLUSTER_ENDPOINT}", "failed to describe EKS cluster missing"},
+	} {
+		resolver := NewDynamicResolver(DefaultDynamicRegistry(), DynamicEnv{EKS: tt.cluster})
+		_, err := ResolveDynamicValues(context.Background(), map[string]interface{}{
+			"kubernetes": map[string]interface{}{"host": tt.value},
+		}, resolver)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("ResolveDynamicValues(%s, %+v) error = %v, want %q", tt.value, tt.cluster, err, tt.want)
+		}
+		if trace := resolver.Trace(); len(trace) != 1 || trace[0].Err == nil {
+			t.Errorf("expected a failed trace entry, got %v", trace)
+		}
+	}
+}
+
+func TestBuiltinAWSDynamicValues(t *testing.T) {
+	aws := newEKSServer(t)
+	aws.PutParameter("/app/plain", "hello", false)
+	aws.PutParameter("/app/secure", "ssm-secret-value", true)
+	aws.PutSecret("db/creds", `{"username": "app", "password": "sm-secret-value"}`)
+	redact.Reset()
+	defer redact.Reset()
+
+	resolver := NewDynamicResolver(DefaultDynamicRegistry(), DynamicEnv{})
+	for expression, want := range map[string]string{
+		"${DYNAMIC:SSM_PARAMETER(/app/plain)}":                      "hello",
+		"${DYNAMIC:SSM_PARAMETER(/app/secure)}":                     "ssm-secret-value",
+		"${DYNAMIC:SECRETS_MANAGER_SECRET(db/creds, key=password)}": "sm-secret-value",
+		"${DYNAMIC:SECRETS_MANAGER_SECRET(db/creds)}":               `{"username": "app", "password": "sm-secret-value"}`,
+		"${DYNAMIC:AWS_ACCOUNT_ID}":                                 "123456789012",
+		"${DYNAMIC:AWS_REGION}":                                     "us-east-1",
+	} {
+		got, err := resolver.Resolve(context.Background(), expression, "test")
+		if err != nil || got != want {
+			t.Errorf("%s = %q, %v; want %q", expression, got, err, want)
+		}
+	}
+
+	if got := redact.String("ssm-secret-value sm-secret-value hello"); got != "(redacted) (redacted) hello" {
+		t.Errorf("secure values should be registered for redaction, got %q", got)
+	}
+
+	for expression, want := range map[string]string{
+		"${DYNAMIC:SSM_PARAMETER(/app/missing)}":                   "failed to read SSM parameter /app/missing",
+		"${DYNAMIC:SECRETS_MANAGER_SECRET(db/creds, key=missing)}": "secret db/creds has no key missing",
+	} {
+		if _, err := resolver.Resolve(context.Background(), expression, "test"); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s error = %v, want %q", expression, err, want)
+		}
+	}
+}
+
+func TestBuiltinLocalDynamicValues(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ca.pem"), []byte("  pem  \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CI_COMMIT_SHA", "0123456789abcdef")
+	t.Setenv("CI_COMMIT_REF_NAME", "main")
+
+	resolver := NewDynamicResolver(DefaultDynamicRegistry(), DynamicEnv{
+		Naming: NewNaming(nil, "dev", "web"),
+		Commands: map[string]tfgoconfig.CommandConfig{
+			"echo":  {Command: []string{"sh", "-c", "echo ' from-command '"}},
+			"slow":  {Command: []string{"sleep", "5"}, Timeout: "50ms"},
+			"fails": {Command: []string{"sh", "-c", "echo broken >&2; exit 3"}},
+		},
+	})
+
+	for expression, want := range map[string]string{
+		"${DYNAMIC:GIT_SHA}":                                             "0123456789abcdef",
+		"${DYNAMIC:GIT_SHA(short=true)}":                                 "01234567",
+		"${DYNAMIC:GIT_BRANCH}":                                          "main",
+		`${DYNAMIC:FILE("` + filepath.Join(dir, "ca.pem") + `")}`:        "pem",
+		`${DYNAMIC:FILE("` + filepath.Join(dir, "ca.pem") + `", false)}`: "  pem  \n",
+		"${DYNAMIC:COMMAND(echo)}":                                       "from-command",
+	} {
+		got, err := resolver.Resolve(context.Background(), expression, "test")
+		if err != nil || got != want {
+			t.Errorf("%s = %q, %v; want %q", expression, got, err, want)
+		}
+	}
+
+	start := time.Now()
+	for expression, want := range map[string]string{
+		"${DYNAMIC:COMMAND(slow)}":    "command slow timed out after 50ms",
+		"${DYNAMIC:COMMAND(fails)}":   "command fails failed: exit status 3: broken",
+		"${DYNAMIC:COMMAND(unknown)}": `no command "unknown" is configured under dynamic.commands`,
+	} {
+		if _, err := resolver.Resolve(context.Background(), expression, "test"); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s error = %v, want %q", expression, err, want)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("timeout was not enforced, took %s", elapsed)
+	}
+}
+
+func TestFileDynamicValueFromSubdirectory(t *testing.T) {
+	root := t.TempDir()
+	testutil.WriteFiles(t, root, map[string]string{
+		"config.yaml":            "project: shop\n",
+		"certs/ca.pem":           "root-ca\n",
+		"app/stacks/web/main.tf": "",
+		"app/stacks/web/ca.pem":  "stack-ca\n",
+	})
+	testutil.Chdir(t, filepath.Join(root, "app", "stacks", "web"))
+	t.Setenv("TF_PATH", "")
+
+	cfg, err := tfgoconfig.Load(tfgoconfig.LoadOptions{})
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	resolver := NewDynamicResolver(DefaultDynamicRegistry(), DynamicEnv{
+		Naming: NewNaming(cfg, "dev", "web"),
+		Root:   cfg.Root,
+	})
+
+	for expression, want := range map[string]string{
+		`${DYNAMIC:FILE(certs/ca.pem)}`:                                     "root-ca",
+		`${DYNAMIC:FILE(app/stacks/web/ca.pem)}`:                            "stack-ca",
+		`${DYNAMIC:FILE("` + filepath.Join(root, "certs", "ca.pem") + `")}`: "root-ca",
+	} {
+		got, err := resolver.Resolve(context.Background(), expression, "test")
+		if err != nil || got != want {
+			t.Errorf("%s = %q, %v; want %q", expression, got, err, want)
+		}
+	}
+}
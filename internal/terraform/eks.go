@@ -0,0 +1,178 @@
+package terraform
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eks"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	tfgoconfig "github.com/kingoftowns/tf-go/internal/config"
+	"github.com/kingoftowns/tf-go/internal/redact"
+)
+
+// EKSTokenCommand is the argument that makes a tf-go command print an EKS
+// token as a Kubernetes ExecCredential instead of running normally. The
+// generated kubernetes and helm providers run it through their exec block.
+const EKSTokenCommand = "eks-token"
+
+// eksTokenPrefix marks a bearer token as a presigned STS request
+const eksTokenPrefix = "k8s-aws-v1."
+
+// eksTokenLifetime is how long EKS accepts a token. Credentials are reported
+// as expiring a minute earlier, so clients fetch a new one in time.
+const eksTokenLifetime = 15 * time.Minute
+
+// execCredentialVersion is the client.authentication.k8s.io API version the
+// exec block uses
+const execCredentialVersion = "client.authentication.k8s.io/v1beta1"
+
+// EKSCluster identifies the cluster ${DYNAMIC:EKS_CLUSTER_*} values come from
+type EKSCluster struct {
+	Name   string
+	Region string
+}
+
+// ResolveEKSCluster expands the environment's eks settings. Without an eks
+// cluster setting the CLUSTER_NAME environment variable is used, and the
+// region falls back to the AWS SDK's default region.
+func ResolveEKSCluster(ctx context.Context, cfg *tfgoconfig.Config, env string, naming *Naming) (EKSCluster, error) {
+	settings := cfg.ResolveEKS(env)
+	if settings.Cluster == "" {
+		settings.Cluster = os.Getenv("CLUSTER_NAME")
+	}
+
+	var cluster EKSCluster
+	var err error
+	if cluster.Name, err = naming.Expand(ctx, settings.Cluster); err != nil {
+		return EKSCluster{}, fmt.Errorf("resolving eks cluster: %w", err)
+	}
+	if cluster.Region, err = naming.Expand(ctx, settings.Region); err != nil {
+		return EKSCluster{}, fmt.Errorf("resolving eks region: %w", err)
+	}
+	return cluster, nil
+}
+
+// EKSClusterInfo is what providers need to reach a cluster's API server
+type EKSClusterInfo struct {
+	Endpoint string
+	// CertificateAuthority is the PEM encoded cluster CA
+	CertificateAuthority string
+}
+
+// DescribeEKSCluster looks up the API endpoint and CA of the cluster
+func DescribeEKSCluster(ctx context.Context, cluster EKSCluster) (*EKSClusterInfo, error) {
+	awsCfg, err := loadAWSConfig(ctx, cluster.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := eks.NewFromConfig(awsCfg).DescribeCluster(ctx, &eks.DescribeClusterInput{
+		Name: aws.String(cluster.Name),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe EKS cluster %s: %w", cluster.Name, err)
+	}
+	if out.Cluster == nil || aws.ToString(out.Cluster.Endpoint) == "" {
+		status := ""
+		if out.Cluster != nil {
+			status = string(out.Cluster.Status)
+		}
+		return nil, fmt.Errorf("EKS cluster %s has no API endpoint yet (status %s)", cluster.Name, status)
+	}
+
+	info := &EKSClusterInfo{Endpoint: aws.ToString(out.Cluster.Endpoint)}
+	if out.Cluster.CertificateAuthority != nil {
+		ca, err := base64.StdEncoding.DecodeString(aws.ToString(out.Cluster.CertificateAuthority.Data))
+		if err != nil {
+			return nil, fmt.Errorf("EKS cluster %s has an invalid certificate authority: %w", cluster.Name, err)
+		}
+		info.CertificateAuthority = string(ca)
+	}
+	return info, nil
+}
+
+// EKSToken creates a bearer token for the cluster, the way aws eks get-token
+// does: a presigned STS GetCallerIdentity request bound to the cluster name.
+// It returns the time after which a new token should be used.
+func EKSToken(ctx context.Context, cluster EKSCluster) (string, time.Time, error) {
+	awsCfg, err := loadAWSConfig(ctx, cluster.Region)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	issued := time.Now()
+	presigned, err := sts.NewPresignClient(sts.NewFromConfig(awsCfg)).PresignGetCallerIdentity(ctx, &sts.GetCallerIdentityInput{},
+		func(opts *sts.PresignOptions) {
+			opts.ClientOptions = append(opts.ClientOptions, func(o *sts.Options) {
+				o.APIOptions = append(o.APIOptions,
+					smithyhttp.AddHeaderValue("x-k8s-aws-id", cluster.Name),
+					smithyhttp.AddHeaderValue("X-Amz-Expires", "60"),
+				)
+			})
+		})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to create EKS token for %s: %w", cluster.Name, err)
+	}
+
+	token := eksTokenPrefix + base64.RawURLEncoding.EncodeToString([]byte(presigned.URL))
+	redact.Register(token)
+	return token, issued.Add(eksTokenLifetime - time.Minute), nil
+}
+
+// eksExecBlock is the provider exec block that runs the current executable
+// with EKSTokenCommand. The provider runs it again whenever the token it
+// holds expires, so applies that outlast a token keep working.
+func eksExecBlock(cluster EKSCluster) (map[string]interface{}, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate tf-go executable for the EKS token exec block: %w", err)
+	}
+
+	args := []interface{}{EKSTokenCommand, "-cluster", cluster.Name}
+	if cluster.Region != "" {
+		args = append(args, "-region", cluster.Region)
+	}
+	return map[string]interface{}{
+		"api_version": execCredentialVersion,
+		"command":     executable,
+		"args":        args,
+	}, nil
+}
+
+// RunEKSTokenCommand prints an ExecCredential holding a fresh EKS token. args
+// are the arguments following EKSTokenCommand.
+func RunEKSTokenCommand(ctx context.Context, args []string) error {
+	var cluster EKSCluster
+	flags := flag.NewFlagSet(EKSTokenCommand, flag.ContinueOnError)
+	flags.StringVar(&cluster.Name, "cluster", "", "EKS cluster name")
+	flags.StringVar(&cluster.Region, "region", "", "EKS cluster region")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if cluster.Name == "" {
+		return fmt.Errorf("%s requires -cluster", EKSTokenCommand)
+	}
+
+	token, expires, err := EKSToken(ctx, cluster)
+	if err != nil {
+		return err
+	}
+
+	credential := map[string]interface{}{
+		"kind":       "ExecCredential",
+		"apiVersion": execCredentialVersion,
+		"spec":       map[string]interface{}{},
+		"status": map[string]interface{}{
+			"expirationTimestamp": expires.UTC().Format(time.RFC3339),
+			"token":               token,
+		},
+	}
+	return json.NewEncoder(os.Stdout).Encode(credential)
+}
@@ -0,0 +1,86 @@
+package terraform
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	tfgoconfig "github.com/kingoftowns/tf-go/internal/config"
+	"github.com/kingoftowns/tf-go/internal/testutil"
+)
+
+const testCA = "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+
+func newEKSServer(t *testing.T) *testutil.AWSServer {
+	t.Helper()
+	aws := testutil.NewAWSServer(t)
+	aws.SetEnv(t)
+	aws.PutCluster(testutil.EKSCluster{
+		Name:     "dev-cluster",
+		Endpoint: "https://ABC.gr7.us-east-1.eks.amazonaws.com",
+		CAData:   base64.StdEncoding.EncodeToString([]byte(testCA)),
+	})
+	return aws
+}
+
+func TestResolveEKSCluster(t *testing.T) {
+	cfg := &tfgoconfig.Config{Environments: map[string]tfgoconfig.EnvironmentConfig{
+		"dev": {EKS: tfgoconfig.EKSConfig{Cluster: ":ENV-cluster", Region: "eu-west-1"}},
+	}}
+	t.Setenv("CLUSTER_NAME", "from-env")
+
+	cluster, err := ResolveEKSCluster(context.Background(), cfg, "dev", NewNaming(cfg, "dev", "web"))
+	if err != nil {
+		t.Fatalf("ResolveEKSCluster failed: %v", err)
+	}
+	if cluster != (EKSCluster{Name: "dev-cluster", Region: "eu-west-1"}) {
+		t.Errorf("cluster = %+v", cluster)
+	}
+
+	cluster, err = ResolveEKSCluster(context.Background(), cfg, "prod", NewNaming(cfg, "prod", "web"))
+	if err != nil || cluster.Name != "from-env" {
+		t.Errorf("expected CLUSTER_NAME fallback, got %+v, %v", cluster, err)
+	}
+}
+
+func TestDescribeEKSCluster(t *testing.T) {
+	newEKSServer(t)
+
+	info, err := DescribeEKSCluster(context.Background(), EKSCluster{Name: "dev-cluster"})
+	if err != nil {
+		t.Fatalf("DescribeEKSCluster failed: %v", err)
+	}
+	if info.Endpoint != "https://ABC.gr7.us-east-1.eks.amazonaws.com" || info.CertificateAuthority != testCA {
+		t.Errorf("unexpected cluster info: %+v", info)
+	}
+
+	if _, err := DescribeEKSCluster(context.Background(), EKSCluster{Name: "missing"}); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("expected error for unknown cluster, got %v", err)
+	}
+}
+
+func TestEKSToken(t *testing.T) {
+	newEKSServer(t)
+
+	token, expires, err := EKSToken(context.Background(), EKSCluster{Name: "dev-cluster", Region: "us-east-1"})
+	if err != nil {
+		t.Fatalf("EKSToken failed: %v", err)
+	}
+	if !strings.HasPrefix(token, eksTokenPrefix) {
+		t.Fatalf("token %q lacks %s prefix", token, eksTokenPrefix)
+	}
+	presigned, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, eksTokenPrefix))
+	if err != nil {
+		t.Fatalf("token is not base64url: %v", err)
+	}
+	for _, want := range []string{"Action=GetCallerIdentity", "X-Amz-Expires=60", "x-k8s-aws-id", "X-Amz-Signature="} {
+		if !strings.Contains(string(presigned), want) {
+			t.Errorf("presigned URL missing %q: %s", want, presigned)
+		}
+	}
+	if remaining := time.Until(expires); remaining <= 13*time.Minute || remaining > 14*time.Minute {
+		t.Errorf("token reported as expiring in %s", remaining)
+	}
+}
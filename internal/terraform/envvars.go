@@ -0,0 +1,180 @@
+package terraform
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// envReferencePrefix starts an environment variable reference
+const envReferencePrefix = "${ENV:"
+
+// envVarName is a valid environment variable name in a reference
+var envVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// UnresolvedEnvVar is a reference ResolveEnvVars could not replace
+type UnresolvedEnvVar struct {
+	// Path is where the reference appears, e.g. aws.default_tags.tags.owner
+	Path string
+	// Reference is the reference as written
+	Reference string
+	// Reason says why it could not be resolved
+	Reason string
+}
+
+// UnresolvedEnvVarsError lists every reference that could not be resolved, so
+// all missing variables can be fixed in one go
+type UnresolvedEnvVarsError struct {
+	Unresolved []UnresolvedEnvVar
+}
+
+func (e *UnresolvedEnvVarsError) Error() string {
+	lines := make([]string, len(e.Unresolved))
+	for i, u := range e.Unresolved {
+		lines[i] = fmt.Sprintf("  %s: %s %s", u.Path, u.Reference, u.Reason)
+	}
+	return fmt.Sprintf("%d unresolved environment variable reference(s):\n%s", len(e.Unresolved), strings.Join(lines, "\n"))
+}
+
+// ResolveEnvVars replaces ${ENV:...} references anywhere inside the strings of
+// a document, including strings in lists. A reference takes one of the forms
+//
+//	${ENV:NAME}           the value of NAME, which must be set
+//	${ENV:NAME:-default}  the value of NAME, or default when NAME is unset or empty
+//	${ENV:NAME:?message}  the value of NAME, failing with message when NAME is unset or empty
+//
+// Every reference that cannot be resolved is reported in an
+// *UnresolvedEnvVarsError.
+func ResolveEnvVars(input map[string]interface{}) (map[string]interface{}, error) {
+	var unresolved []UnresolvedEnvVar
+	result := resolveEnvMap(input, "", &unresolved)
+	if len(unresolved) > 0 {
+		return nil, &UnresolvedEnvVarsError{Unresolved: unresolved}
+	}
+	return result, nil
+}
+
+func resolveEnvMap(input map[string]interface{}, path string, unresolved *[]UnresolvedEnvVar) map[string]interface{} {
+	keys := make([]string, 0, len(input))
+	for key := range input {
+		keys = append(keys, key)
+	}
+	// Sorted, so unresolved references are listed in a stable order
+	sort.Strings(keys)
+
+	result := make(map[string]interface{}, len(input))
+	for _, key := range keys {
+		keyPath := key
+		if path != "" {
+			keyPath = path + "." + key
+		}
+		result[key] = resolveEnvValue(input[key], keyPath, unresolved)
+	}
+	return result
+}
+
+func resolveEnvValue(value interface{}, path string, unresolved *[]UnresolvedEnvVar) interface{} {
+	switch v := value.(type) {
+	case string:
+		return interpolateEnv(v, path, unresolved)
+	case map[string]interface{}:
+		return resolveEnvMap(v, path, unresolved)
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = resolveEnvValue(item, fmt.Sprintf("%s[%d]", path, i), unresolved)
+		}
+		return items
+	default:
+		return v
+	}
+}
+
+// interpolateEnv replaces the references in s. A default may itself contain
+// braces, e.g. ${ENV:REGION:-${DYNAMIC:AWS_REGION}}.
+func interpolateEnv(s, path string, unresolved *[]UnresolvedEnvVar) string {
+	if !strings.Contains(s, envReferencePrefix) {
+		return s
+	}
+
+	var out strings.Builder
+	for {
+		start := strings.Index(s, envReferencePrefix)
+		if start < 0 {
+			out.WriteString(s)
+			return out.String()
+		}
+		out.WriteString(s[:start])
+
+		end := matchingBrace(s, start+1)
+		if end < 0 {
+			*unresolved = append(*unresolved, UnresolvedEnvVar{Path: path, Reference: s[start:], Reason: "is missing its closing brace"})
+			return out.String()
+		}
+		reference := s[start : end+1]
+		value, reason := lookupEnvReference(s[start+len(envReferencePrefix) : end])
+		if reason != "" {
+			*unresolved = append(*unresolved, UnresolvedEnvVar{Path: path, Reference: reference, Reason: reason})
+		}
+		out.WriteString(value)
+		s = s[end+1:]
+	}
+}
+
+// matchingBrace returns the index of the brace closing the one at open
+func matchingBrace(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// lookupEnvReference resolves the body of a reference, the part between
+// "${ENV:" and "}". It returns a reason when the reference cannot be resolved.
+func lookupEnvReference(body string) (string, string) {
+	name, modifier, operand := body, "", ""
+	if i := strings.Index(body, ":"); i >= 0 {
+		name, modifier = body[:i], body[i:]
+		switch {
+		case strings.HasPrefix(modifier, ":-"), strings.HasPrefix(modifier, ":?"):
+			operand = modifier[2:]
+			modifier = modifier[:2]
+		default:
+			return "", fmt.Sprintf("has an unknown modifier %q (use :- or :?)", modifier)
+		}
+	}
+	if !envVarName.MatchString(name) {
+		return "", "is not a valid environment variable name"
+	}
+
+	value, set := os.LookupEnv(name)
+	switch modifier {
+	case ":-":
+		if value == "" {
+			return operand, ""
+		}
+	case ":?":
+		if value == "" {
+			if operand == "" {
+				return "", "is required but not set"
+			}
+			return "", "is required: " + operand
+		}
+	default:
+		if !set {
+			return "", "is not set"
+		}
+	}
+	return value, ""
+}
@@ -0,0 +1,84 @@
+package terraform
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveEnvVars(t *testing.T) {
+	t.Setenv("ACCOUNT", "123456789012")
+	t.Setenv("OWNER", "platform")
+	t.Setenv("EMPTY", "")
+
+	resolved, err := ResolveEnvVars(map[string]interface{}{
+		"aws": map[string]interface{}{
+			"assume_role": map[string]interface{}{
+				"role_arn": "arn:aws:iam::${ENV:ACCOUNT}:role/${ENV:ROLE:-deployer}",
+			},
+			"allowed_account_ids": []interface{}{"${ENV:ACCOUNT}", "${ENV:OTHER_ACCOUNT:-}", 42},
+			"default_tags":        []interface{}{map[string]interface{}{"owner": "${ENV:OWNER:?set OWNER}"}},
+			"region":              "${ENV:REGION:-${DYNAMIC:AWS_REGION}}",
+			"profile":             "${ENV:EMPTY}",
+			"max_retries":         3,
+		},
+	})
+	if err != nil {
+		t.Fatalf("ResolveEnvVars failed: %v", err)
+	}
+
+	want := map[string]interface{}{
+		"aws": map[string]interface{}{
+			"assume_role": map[string]interface{}{
+				"role_arn": "arn:aws:iam::123456789012:role/deployer",
+			},
+			"allowed_account_ids": []interface{}{"123456789012", "", 42},
+			"default_tags":        []interface{}{map[string]interface{}{"owner": "platform"}},
+			"region":              "${DYNAMIC:AWS_REGION}",
+			"profile":             "",
+			"max_retries":         3,
+		},
+	}
+	if !reflect.DeepEqual(resolved, want) {
+		t.Errorf("ResolveEnvVars() = %v, want %v", resolved, want)
+	}
+}
+
+func TestResolveEnvVarsUnresolved(t *testing.T) {
+	t.Setenv("EMPTY", "")
+
+	_, err := ResolveEnvVars(map[string]interface{}{
+		"kubernetes": map[string]interface{}{
+			"config_context": "${ENV:TFGO_TEST_UNSET}",
+			"config_path":    "${ENV:EMPTY:?point it at a kubeconfig}",
+		},
+		"helm": map[string]interface{}{
+			"registry": []interface{}{map[string]interface{}{
+				"url":      "oci://${ENV:TFGO_TEST_REGISTRY:?}/charts",
+				"username": "${ENV:TFGO_TEST_UNSET:=x}",
+			}},
+			"repository_cache": "${ENV:BAD-NAME}",
+			"burst_limit":      "${ENV:TFGO_TEST_UNSET",
+		},
+	})
+
+	var unresolvedErr *UnresolvedEnvVarsError
+	if !errors.As(err, &unresolvedErr) {
+		t.Fatalf("expected *UnresolvedEnvVarsError, got %v", err)
+	}
+	want := []UnresolvedEnvVar{
+		{"helm.burst_limit", "${ENV:TFGO_TEST_UNSET", "is missing its closing brace"},
+		{"helm.registry[0].url", "${ENV:TFGO_TEST_REGISTRY:?}", "is required but not set"},
+		{"helm.registry[0].username", "${ENV:TFGO_TEST_UNSET:=x}", `has an unknown modifier ":=x" (use :- or :?)`},
+		{"helm.repository_cache", "${ENV:BAD-NAME}", "is not a valid environment variable name"},
+		{"kubernetes.config_context", "${ENV:TFGO_TEST_UNSET}", "is not set"},
+		{"kubernetes.config_path", "${ENV:EMPTY:?point it at a kubeconfig}", "is required: point it at a kubeconfig"},
+	}
+	if !reflect.DeepEqual(unresolvedErr.Unresolved, want) {
+		t.Errorf("Unresolved = %+v\nwant %+v", unresolvedErr.Unresolved, want)
+	}
+	if !strings.HasPrefix(err.Error(), "6 unresolved environment variable reference(s):\n  helm.burst_limit: ") {
+		t.Errorf("unexpected message: %s", err)
+	}
+}
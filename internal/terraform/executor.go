@@ -2,26 +2,30 @@ package terraform
 
 import (
 	"context"
-	"encoding/base64"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
-	"text/template"
 
 	"github.com/hashicorp/terraform-exec/tfexec"
 	tfjson "github.com/hashicorp/terraform-json"
+	tfgoconfig "github.com/kingoftowns/tf-go/internal/config"
+	"github.com/kingoftowns/tf-go/internal/redact"
 )
 
 // Executor handles Terraform operations
 type Executor struct {
-	workDir    string
-	srcPath    string
-	tf         *tfexec.Terraform
-	envVars    map[string]string
-	cleanupFns []func() error
+	workDir     string
+	srcPath     string
+	tf          *tfexec.Terraform
+	backend     Backend
+	workspace   string
+	dynamic     *DynamicResolver
+	credentials ProviderCredentials
+	tfvars      TfvarsEnv
+	envVars     map[string]string
+	cleanupFns  []func() error
 }
 
 // NewExecutor creates a new Terraform executor
@@ -61,212 +65,10 @@ func (e *Executor) Clean() error {
 	return nil
 }
 
-// ResolveEnvVars processes a map and resolves any environment variable references
-func ResolveEnvVars(input map[string]interface{}) map[string]interface{} {
-	result := make(map[string]interface{})
-	
-	for key, value := range input {
-		switch v := value.(type) {
-		case string:
-			// Handle string environment variables using ${ENV:VAR_NAME} syntax
-			if len(v) > 7 && v[:6] == "${ENV:" && v[len(v)-1:] == "}" {
-				envVar := v[6 : len(v)-1]
-				if envValue := os.Getenv(envVar); envValue != "" {
-					result[key] = envValue
-				} else {
-					// Keep the original if env var not found
-					result[key] = v
-				}
-			} else {
-				result[key] = v
-			}
-		case map[string]interface{}:
-			// Recursively resolve nested maps
-			result[key] = ResolveEnvVars(v)
-		case []interface{}:
-			// Handle array values
-			resolvedArray := make([]interface{}, len(v))
-			for i, item := range v {
-				if nestedMap, ok := item.(map[string]interface{}); ok {
-					resolvedArray[i] = ResolveEnvVars(nestedMap)
-				} else {
-					resolvedArray[i] = item
-				}
-			}
-			result[key] = resolvedArray
-		default:
-			result[key] = v
-		}
-	}
-	
-	return result
-}
-
-// getEKSClusterEndpoint retrieves the endpoint for an EKS cluster
-func getEKSClusterEndpoint(ctx context.Context, clusterName string) (string, error) {
-	// In a real implementation, this would use AWS SDK to get the cluster endpoint
-	// Example with AWS SDK (pseudocode):
-	// 
-	// import (
-	//     "github.com/aws/aws-sdk-go-v2/aws"
-	//     "github.com/aws/aws-sdk-go-v2/service/eks"
-	// )
-	//
-	// cfg, err := aws.LoadDefaultConfig(ctx)
-	// if err != nil {
-	//     return "", err
-	// }
-	//
-	// client := eks.NewFromConfig(cfg)
-	// result, err := client.DescribeCluster(ctx, &eks.DescribeClusterInput{
-	//     Name: aws.String(clusterName),
-	// })
-	// if err != nil {
-	//     return "", err
-	// }
-	//
-	// return *result.Cluster.Endpoint, nil
-
-	// For demonstration, we'll execute the AWS CLI command
-	// This is not ideal for production; the AWS SDK should be used instead
-	cmd := fmt.Sprintf("aws eks describe-cluster --name %s --query 'cluster.endpoint' --output text", clusterName)
-	out, err := executeCommand(ctx, cmd)
-	if err != nil {
-		return "", err
-	}
-	
-	return strings.TrimSpace(out), nil
-}
-
-// getEKSClusterCA retrieves the CA certificate for an EKS cluster
-func getEKSClusterCA(ctx context.Context, clusterName string) (string, error) {
-	// In a real implementation, this would use AWS SDK to get the cluster CA certificate
-	
-	// For demonstration, we'll execute the AWS CLI command
-	cmd := fmt.Sprintf("aws eks describe-cluster --name %s --query 'cluster.certificateAuthority.data' --output text", clusterName)
-	out, err := executeCommand(ctx, cmd)
-	if err != nil {
-		return "", err
-	}
-	
-	return strings.TrimSpace(out), nil
-}
-
-// getEKSClusterToken generates a token for authenticating with an EKS cluster
-func getEKSClusterToken(ctx context.Context, clusterName string) (string, error) {
-	// In a real implementation, this would use AWS SDK to generate a token
-	
-	// For demonstration, we'll execute the AWS CLI command
-	cmd := fmt.Sprintf("aws eks get-token --cluster-name %s --query 'status.token' --output text", clusterName)
-	out, err := executeCommand(ctx, cmd)
-	if err != nil {
-		return "", err
-	}
-	
-	return strings.TrimSpace(out), nil
-}
-
-// executeCommand runs a command and returns its output
-func executeCommand(ctx context.Context, cmd string) (string, error) {
-	// This is a basic implementation; in production, you would want more robust handling
-	parts := strings.Fields(cmd)
-	
-	command := exec.CommandContext(ctx, parts[0], parts[1:]...)
-	output, err := command.Output()
-	if err != nil {
-		return "", err
-	}
-	
-	return string(output), nil
-}
-
-// ResolveDynamicValues processes dynamic values that need to be computed
-func ResolveDynamicValues(ctx context.Context, input map[string]interface{}) map[string]interface{} {
-	result := make(map[string]interface{})
-	
-	for key, value := range input {
-		switch v := value.(type) {
-		case string:
-			// Handle dynamic values using ${DYNAMIC:VALUE_TYPE} syntax
-			if len(v) > 11 && v[:10] == "${DYNAMIC:" && v[len(v)-1:] == "}" {
-				dynamicType := v[10 : len(v)-1]
-				
-				// Handle different types of dynamic values
-				switch dynamicType {
-				case "EKS_CLUSTER_ENDPOINT":
-					// Get EKS cluster endpoint
-					if clusterName := os.Getenv("CLUSTER_NAME"); clusterName != "" {
-						endpoint, err := getEKSClusterEndpoint(ctx, clusterName)
-						if err == nil {
-							result[key] = endpoint
-						} else {
-							result[key] = v // Keep original on error
-						}
-					} else {
-						result[key] = v
-					}
-				case "EKS_CLUSTER_TOKEN":
-					// Get EKS cluster token
-					if clusterName := os.Getenv("CLUSTER_NAME"); clusterName != "" {
-						token, err := getEKSClusterToken(ctx, clusterName)
-						if err == nil {
-							result[key] = token
-						} else {
-							result[key] = v // Keep original on error
-						}
-					} else {
-						result[key] = v
-					}
-				case "EKS_CLUSTER_CA":
-					// Get EKS cluster CA certificate
-					if clusterName := os.Getenv("CLUSTER_NAME"); clusterName != "" {
-						ca, err := getEKSClusterCA(ctx, clusterName)
-						if err == nil {
-							// Base64 decode for Terraform provider
-							decoded, err := base64.StdEncoding.DecodeString(ca)
-							if err == nil {
-								result[key] = string(decoded)
-							} else {
-								result[key] = v // Keep original on error
-							}
-						} else {
-							result[key] = v // Keep original on error
-						}
-					} else {
-						result[key] = v
-					}
-				default:
-					result[key] = v
-				}
-			} else {
-				result[key] = v
-			}
-		case map[string]interface{}:
-			// Recursively resolve nested maps
-			result[key] = ResolveDynamicValues(ctx, v)
-		case []interface{}:
-			// Handle array values
-			resolvedArray := make([]interface{}, len(v))
-			for i, item := range v {
-				if nestedMap, ok := item.(map[string]interface{}); ok {
-					resolvedArray[i] = ResolveDynamicValues(ctx, nestedMap)
-				} else {
-					resolvedArray[i] = item
-				}
-			}
-			result[key] = resolvedArray
-		default:
-			result[key] = v
-		}
-	}
-	
-	return result
-}
-
 // Setup prepares the Terraform workspace
-func (e *Executor) Setup(ctx context.Context, srcPath string, providerConfig map[string]interface{}, backendConfig *S3BackendConfig) error {
-	fmt.Printf("[DEBUG] Copying Terraform files from: %s\n", srcPath)
-	fmt.Printf("[DEBUG] Working directory: %s\n", e.workDir)
+func (e *Executor) Setup(ctx context.Context, srcPath string, providerConfig map[string]interface{}, backend Backend) error {
+	redact.Printf("[DEBUG] Copying Terraform files from: %s\n", srcPath)
+	redact.Printf("[DEBUG] Working directory: %s\n", e.workDir)
 	
 	// Store source path for later use
 	e.srcPath = srcPath
@@ -276,6 +78,16 @@ func (e *Executor) Setup(ctx context.Context, srcPath string, providerConfig map
 	if err != nil {
 		return fmt.Errorf("failed to copy stack files: %w", err)
 	}
+
+	// The stack's terraform.tfvars and *.auto.tfvars files are compiled into
+	// compiled.tfvars with the other tfvars files, so Terraform must not load
+	// them a second time, or at all when a deploy leaves them out
+	for _, path := range tfgoconfig.AutoVarsFiles(e.workDir) {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove %s from the working directory: %w", filepath.Base(path), err)
+		}
+		redact.Printf("[DEBUG] Removed %s from the working directory, it is only loaded through compiled.tfvars\n", filepath.Base(path))
+	}
 	
 	// Also copy global configuration files if they exist
 	// Look for config/terraform directory - handle both stack and non-stack paths
@@ -291,7 +103,7 @@ func (e *Executor) Setup(ctx context.Context, srcPath string, providerConfig map
 		configPath = filepath.Join(filepath.Dir(filepath.Dir(srcPath)), "config", "terraform")
 	}
 	if _, err := os.Stat(configPath); err == nil {
-		fmt.Printf("[DEBUG] Found global config at: %s\n", configPath)
+		redact.Printf("[DEBUG] Found global config at: %s\n", configPath)
 		
 		// Copy specific global files
 		globalFiles := []string{
@@ -305,7 +117,7 @@ func (e *Executor) Setup(ctx context.Context, srcPath string, providerConfig map
 			if _, err := os.Stat(srcFile); err == nil {
 				destFile := filepath.Join(e.workDir, filename)
 				if err := copyFile(srcFile, destFile); err == nil {
-					fmt.Printf("[DEBUG] Copied global file: %s\n", filename)
+					redact.Printf("[DEBUG] Copied global file: %s\n", filename)
 				}
 			}
 		}
@@ -313,16 +125,26 @@ func (e *Executor) Setup(ctx context.Context, srcPath string, providerConfig map
 	
 	// Debug: list what files were copied
 	if files, err := os.ReadDir(e.workDir); err == nil {
-		fmt.Printf("[DEBUG] Files in working directory:\n")
+		redact.Printf("[DEBUG] Files in working directory:\n")
 		for _, file := range files {
-			fmt.Printf("  - %s\n", file.Name())
+			redact.Printf("  - %s\n", file.Name())
 		}
 	}
 
 	// Process provider config to resolve environment variables and dynamic values
-	resolvedConfig := providerConfig
-	resolvedConfig = ResolveEnvVars(resolvedConfig)
-	resolvedConfig = ResolveDynamicValues(ctx, resolvedConfig)
+	resolvedConfig, err := ResolveEnvVars(providerConfig)
+	if err != nil {
+		return fmt.Errorf("failed to resolve provider environment variables: %w", err)
+	}
+	if e.dynamic == nil {
+		e.dynamic = NewDynamicResolver(DefaultDynamicRegistry(), DynamicEnv{})
+	}
+	resolvedConfig, err = ResolveDynamicValues(ctx, resolvedConfig, e.dynamic)
+	printDynamicTrace(e.dynamic.Trace())
+	if err != nil {
+		return fmt.Errorf("failed to resolve dynamic provider values: %w", err)
+	}
+	redact.RegisterConfig(resolvedConfig)
 
 	// Create provider.tf file
 	err = e.createProviderFile(resolvedConfig)
@@ -332,28 +154,27 @@ func (e *Executor) Setup(ctx context.Context, srcPath string, providerConfig map
 	
 	// Debug: show what provider.tf was actually generated
 	if providerContent, err := os.ReadFile(filepath.Join(e.workDir, "provider.tf")); err == nil {
-		fmt.Printf("[DEBUG] Generated provider.tf content:\n%s\n", string(providerContent))
+		redact.Printf("[DEBUG] Generated provider.tf content:\n%s\n", string(providerContent))
 	}
 	
 	// Debug: verify kubeconfig accessibility if kubernetes provider is configured
 	if kubernetesConfig, ok := resolvedConfig["kubernetes"].(map[string]interface{}); ok {
 		if configPath, ok := kubernetesConfig["config_path"].(string); ok {
 			if _, err := os.Stat(configPath); err != nil {
-				fmt.Printf("[WARNING] Kubeconfig file not found: %s (error: %v)\n", configPath, err)
+				redact.Printf("[WARNING] Kubeconfig file not found: %s (error: %v)\n", configPath, err)
 			} else {
-				fmt.Printf("[DEBUG] Kubeconfig file found: %s\n", configPath)
+				redact.Printf("[DEBUG] Kubeconfig file found: %s\n", configPath)
 				if context, ok := kubernetesConfig["config_context"].(string); ok {
-					fmt.Printf("[DEBUG] Using kubernetes context: %s\n", context)
+					redact.Printf("[DEBUG] Using kubernetes context: %s\n", context)
 				}
 			}
 		}
 	}
 
 	// Setup backend if provided
-	if backendConfig != nil {
-		// Create backend.tf file (skip S3 bucket creation for now)
-		if err := e.CreateBackendFile(*backendConfig); err != nil {
-			return fmt.Errorf("failed to create backend file: %w", err)
+	if backend != nil {
+		if err := e.setupBackend(backend); err != nil {
+			return err
 		}
 	}
 
@@ -387,8 +208,24 @@ func (e *Executor) Init(ctx context.Context) error {
 		return fmt.Errorf("terraform executor not set up")
 	}
 
+	// Backend settings are passed on the command line so the stack's own
+	// backend block (or the generated stub) stays a partial configuration
+	var opts []tfexec.InitOption
+	if e.backend != nil {
+		for _, arg := range BackendConfigArgs(e.backend) {
+			opts = append(opts, tfexec.BackendConfig(arg))
+		}
+	}
+
 	// Initialize Terraform
-	return e.tf.Init(ctx)
+	if err := e.tf.Init(ctx, opts...); err != nil {
+		return err
+	}
+
+	if e.workspace == "" {
+		return nil
+	}
+	return e.selectWorkspace(ctx)
 }
 
 // Plan runs terraform plan
@@ -399,16 +236,16 @@ func (e *Executor) Plan(ctx context.Context, varsFiles []string, cliVars []strin
 
 	planFilePath := filepath.Join(e.workDir, "terraform.tfplan")
 	
-	fmt.Printf("[DEBUG] Creating plan file at: %s\n", planFilePath)
+	redact.Printf("[DEBUG] Creating plan file at: %s\n", planFilePath)
 
 	// Compile variables from multiple tfvars files (base first, then env-specific)
 	var opts []tfexec.PlanOption
 	compiledVarsFile := filepath.Join(e.workDir, "compiled.tfvars")
 	
-	if len(varsFiles) > 0 || len(cliVars) > 0 {
-		fmt.Printf("[DEBUG] Compiling %d tfvars files and %d CLI vars with variables.tf defaults\n", len(varsFiles), len(cliVars))
+	if len(varsFiles) > 0 || len(cliVars) > 0 || len(e.tfvars.Settings) > 0 {
+		redact.Printf("[DEBUG] Compiling %d tfvars files and %d CLI vars with variables.tf defaults\n", len(varsFiles), len(cliVars))
 		// Pass both source path and work dir so we can find variables.tf in source and write to work dir
-		err := CompileWithVariablesTfFromSourceAndCLI(varsFiles, cliVars, e.srcPath, e.workDir, compiledVarsFile)
+		err := CompileWithVariablesTfFromSourceAndCLI(ctx, varsFiles, cliVars, e.srcPath, e.workDir, compiledVarsFile, e.tfvars)
 		if err != nil {
 			return nil, fmt.Errorf("failed to compile tfvars: %w", err)
 		}
@@ -419,38 +256,38 @@ func (e *Executor) Plan(ctx context.Context, varsFiles []string, cliVars []strin
 			tfexec.Out(planFilePath),
 		}
 		
-		fmt.Printf("[DEBUG] Using compiled vars file: %s\n", compiledVarsFile)
+		redact.Printf("[DEBUG] Using compiled vars file: %s\n", compiledVarsFile)
 	} else {
 		opts = []tfexec.PlanOption{tfexec.Out(planFilePath)}
 	}
 
 	// Run plan and save to file
-	fmt.Println("[DEBUG] Executing terraform plan command...")
+	redact.Println("[DEBUG] Executing terraform plan command...")
 	hasChanges, err := e.tf.Plan(ctx, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("terraform plan failed: %w", err)
 	}
-	fmt.Printf("[DEBUG] Plan complete. Has changes: %v\n", hasChanges)
+	redact.Printf("[DEBUG] Plan complete. Has changes: %v\n", hasChanges)
 	
 	// If no changes detected, let's run a more detailed plan to see what's happening
 	if !hasChanges {
-		fmt.Println("[DEBUG] No changes detected, running detailed plan for debugging...")
+		redact.Println("[DEBUG] No changes detected, running detailed plan for debugging...")
 		
 		// Check if there are any .tf files that define resources
 		tfFiles, _ := filepath.Glob(filepath.Join(e.workDir, "*.tf"))
-		fmt.Printf("[DEBUG] Found %d .tf files in working directory\n", len(tfFiles))
+		redact.Printf("[DEBUG] Found %d .tf files in working directory\n", len(tfFiles))
 		
 		// Check current state to see what resources Terraform thinks exist
 		if state, err := e.tf.Show(ctx); err == nil && state != nil && state.Values != nil && state.Values.RootModule != nil {
-			fmt.Printf("[DEBUG] Current state contains %d resources\n", len(state.Values.RootModule.Resources))
+			redact.Printf("[DEBUG] Current state contains %d resources\n", len(state.Values.RootModule.Resources))
 			if len(state.Values.RootModule.Resources) > 0 {
-				fmt.Println("[DEBUG] Resources in current state:")
+				redact.Println("[DEBUG] Resources in current state:")
 				for _, resource := range state.Values.RootModule.Resources {
-					fmt.Printf("  - %s\n", resource.Address)
+					redact.Printf("  - %s\n", resource.Address)
 				}
 			}
 		} else {
-			fmt.Printf("[DEBUG] Could not read current state: %v\n", err)
+			redact.Printf("[DEBUG] Could not read current state: %v\n", err)
 		}
 		
 		// Try to run terraform plan without saving to file to see raw output
@@ -464,28 +301,28 @@ func (e *Executor) Plan(ctx context.Context, varsFiles []string, cliVars []strin
 		// Run plan again without file output to get console output
 		_, debugErr := e.tf.Plan(ctx, planOpts...)
 		if debugErr != nil {
-			fmt.Printf("[DEBUG] Debug plan also failed: %v\n", debugErr)
+			redact.Printf("[DEBUG] Debug plan also failed: %v\n", debugErr)
 		}
 	}
 
 	// Get the structured plan from the file
-	fmt.Println("[DEBUG] Reading plan file to extract structured data...")
+	redact.Println("[DEBUG] Reading plan file to extract structured data...")
 	plan, err := e.tf.ShowPlanFile(ctx, planFilePath)
 	if err != nil {
-		fmt.Printf("[DEBUG] Error reading plan file: %v\n", err)
+		redact.Printf("[DEBUG] Error reading plan file: %v\n", err)
 		
 		// Try to read raw plan file contents for debugging
-		fmt.Println("[DEBUG] Attempting to read raw plan file...")
+		redact.Println("[DEBUG] Attempting to read raw plan file...")
 		rawPlan, readErr := os.ReadFile(planFilePath)
 		if readErr == nil {
-			fmt.Println("[DEBUG] Raw plan file contents (first 500 bytes):")
+			redact.Println("[DEBUG] Raw plan file contents (first 500 bytes):")
 			if len(rawPlan) > 500 {
-				fmt.Printf("%s...\n", rawPlan[:500])
+				redact.Printf("%s...\n", rawPlan[:500])
 			} else {
-				fmt.Printf("%s\n", rawPlan)
+				redact.Printf("%s\n", rawPlan)
 			}
 		} else {
-			fmt.Printf("[DEBUG] Failed to read raw plan file: %v\n", readErr)
+			redact.Printf("[DEBUG] Failed to read raw plan file: %v\n", readErr)
 		}
 		
 		// Return error instead of empty plan
@@ -493,13 +330,13 @@ func (e *Executor) Plan(ctx context.Context, varsFiles []string, cliVars []strin
 	}
 
 	// Log plan details for debugging
-	fmt.Printf("[DEBUG] Plan format version: %s\n", plan.FormatVersion)
-	fmt.Printf("[DEBUG] Terraform version: %s\n", plan.TerraformVersion)
-	fmt.Printf("[DEBUG] Resource changes count: %d\n", len(plan.ResourceChanges))
+	redact.Printf("[DEBUG] Plan format version: %s\n", plan.FormatVersion)
+	redact.Printf("[DEBUG] Terraform version: %s\n", plan.TerraformVersion)
+	redact.Printf("[DEBUG] Resource changes count: %d\n", len(plan.ResourceChanges))
 	
 	// Log detailed resource changes
 	if len(plan.ResourceChanges) > 0 {
-		fmt.Println("[DEBUG] Resource changes details:")
+		redact.Println("[DEBUG] Resource changes details:")
 		for i, rc := range plan.ResourceChanges {
 			if rc.Change != nil {
 				action := "unknown"
@@ -510,7 +347,7 @@ func (e *Executor) Plan(ctx context.Context, varsFiles []string, cliVars []strin
 				} else if rc.Change.Actions.Delete() {
 					action = "delete"
 				}
-				fmt.Printf("  [%d] %s: %s (%s)\n", i, rc.Address, rc.Type, action)
+				redact.Printf("  [%d] %s: %s (%s)\n", i, rc.Address, rc.Type, action)
 			}
 		}
 	}
@@ -527,9 +364,9 @@ func (e *Executor) Apply(ctx context.Context, varsFiles []string, cliVars []stri
 	var opts []tfexec.ApplyOption
 	
 	// Compile variables if files provided
-	if len(varsFiles) > 0 || len(cliVars) > 0 {
+	if len(varsFiles) > 0 || len(cliVars) > 0 || len(e.tfvars.Settings) > 0 {
 		compiledVarsFile := filepath.Join(e.workDir, "compiled.tfvars")
-		err := CompileWithVariablesTfFromSourceAndCLI(varsFiles, cliVars, e.srcPath, e.workDir, compiledVarsFile)
+		err := CompileWithVariablesTfFromSourceAndCLI(ctx, varsFiles, cliVars, e.srcPath, e.workDir, compiledVarsFile, e.tfvars)
 		if err != nil {
 			return fmt.Errorf("failed to compile tfvars: %w", err)
 		}
@@ -549,9 +386,9 @@ func (e *Executor) Destroy(ctx context.Context, varsFiles []string, cliVars []st
 	var opts []tfexec.DestroyOption
 	
 	// Compile variables if files provided
-	if len(varsFiles) > 0 || len(cliVars) > 0 {
+	if len(varsFiles) > 0 || len(cliVars) > 0 || len(e.tfvars.Settings) > 0 {
 		compiledVarsFile := filepath.Join(e.workDir, "compiled.tfvars")
-		err := CompileWithVariablesTfFromSourceAndCLI(varsFiles, cliVars, e.srcPath, e.workDir, compiledVarsFile)
+		err := CompileWithVariablesTfFromSourceAndCLI(ctx, varsFiles, cliVars, e.srcPath, e.workDir, compiledVarsFile, e.tfvars)
 		if err != nil {
 			return fmt.Errorf("failed to compile tfvars: %w", err)
 		}
@@ -586,6 +423,23 @@ func (e *Executor) Output(ctx context.Context) (map[string]*tfjson.StateOutput,
 	return result, nil
 }
 
+// SetDynamicResolver sets the resolver for ${DYNAMIC:...} provider values.
+// Without one, Setup uses the built-in values with no environment settings.
+func (e *Executor) SetDynamicResolver(resolver *DynamicResolver) {
+	e.dynamic = resolver
+}
+
+// SetProviderCredentials sets the credentials tf-go holds itself that
+// generated provider blocks may reuse
+func (e *Executor) SetProviderCredentials(credentials ProviderCredentials) {
+	e.credentials = credentials
+}
+
+// SetTfvarsEnv sets what compiled tfvars draw on besides the tfvars files
+func (e *Executor) SetTfvarsEnv(env TfvarsEnv) {
+	e.tfvars = env
+}
+
 // SetEnvVar sets an environment variable for Terraform
 func (e *Executor) SetEnvVar(key, value string) {
 	e.envVars[key] = value
@@ -599,239 +453,72 @@ func (e *Executor) GetWorkDir() string {
 	return e.workDir
 }
 
-// ProviderGenerator interface for creating provider configurations
-type ProviderGenerator interface {
-	Generate(writer io.Writer, config map[string]interface{}) error
-}
-
-// AWSProviderGenerator handles AWS provider configuration
-type AWSProviderGenerator struct{}
-
-func (g *AWSProviderGenerator) Generate(writer io.Writer, config map[string]interface{}) error {
-	tmpl, err := template.New("aws_provider").Parse(`
-provider "aws" {
-  region     = "{{ .region }}"
-  {{- if .access_key }}
-  access_key = "{{ .access_key }}"
-  {{- end }}
-  {{- if .secret_key }}
-  secret_key = "{{ .secret_key }}"
-  {{- end }}
-  {{- if .profile }}
-  profile    = "{{ .profile }}"
-  {{- end }}
-  {{- if .default_tags }}
-  default_tags {
-    tags = {
-      {{- range $key, $value := .default_tags }}
-      {{ $key }} = "{{ $value }}"
-      {{- end }}
-    }
-  }
-  {{- end }}
-}
-`)
+// createProviderFile generates provider.tf in the working directory
+func (e *Executor) createProviderFile(providerConfig map[string]interface{}) error {
+	instances, err := ProviderInstances(providerConfig)
 	if err != nil {
 		return err
 	}
-	return tmpl.Execute(writer, config)
-}
 
-// KubernetesProviderGenerator handles Kubernetes provider configuration
-type KubernetesProviderGenerator struct{}
-
-func (g *KubernetesProviderGenerator) Generate(writer io.Writer, config map[string]interface{}) error {
-	// Expand tilde in config_path if present
-	if configPath, ok := config["config_path"].(string); ok && strings.HasPrefix(configPath, "~/") {
-		homeDir, err := os.UserHomeDir()
-		if err == nil {
-			expandedPath := filepath.Join(homeDir, configPath[2:])
-			config["config_path"] = expandedPath
-			fmt.Printf("[DEBUG] Expanded kubeconfig path from %s to %s\n", configPath, expandedPath)
-		}
-	}
-	
-	tmpl, err := template.New("kubernetes_provider").Parse(`
-provider "kubernetes" {
-  {{- if .config_path }}
-  config_path = "{{ .config_path }}"
-  {{- end }}
-  {{- if .config_context }}
-  config_context = "{{ .config_context }}"
-  {{- end }}
-  {{- if .host }}
-  host = "{{ .host }}"
-  {{- end }}
-  {{- if .token }}
-  token = "{{ .token }}"
-  {{- end }}
-  {{- if .cluster_ca_certificate }}
-  cluster_ca_certificate = <<EOT
-{{ .cluster_ca_certificate }}
-EOT
-  {{- end }}
-}
-`)
+	// Check which provider blocks the stack already declares
+	stack, err := ParseStackConfig(e.workDir)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to check existing providers: %w", err)
 	}
-	return tmpl.Execute(writer, config)
-}
-
-// HelmProviderGenerator handles Helm provider configuration
-type HelmProviderGenerator struct{}
-
-func (g *HelmProviderGenerator) Generate(writer io.Writer, config map[string]interface{}) error {
-	// Expand tilde in kubernetes.config_path if present
-	if kubernetesConfig, ok := config["kubernetes"].(map[string]interface{}); ok {
-		if configPath, ok := kubernetesConfig["config_path"].(string); ok && strings.HasPrefix(configPath, "~/") {
-			homeDir, err := os.UserHomeDir()
-			if err == nil {
-				expandedPath := filepath.Join(homeDir, configPath[2:])
-				kubernetesConfig["config_path"] = expandedPath
-				fmt.Printf("[DEBUG] Expanded helm kubeconfig path from %s to %s\n", configPath, expandedPath)
+	
+	// Render every instance the stack does not define itself before touching
+	// the file, so a bad entry leaves no partial provider.tf behind. Secret
+	// settings are replaced by variables and never written into provider.tf.
+	var content strings.Builder
+	var secrets []ProviderSecret
+	var incomplete []string
+	for _, instance := range instances {
+		if existing, ok := stack.Providers[instance.Address()]; ok {
+			redact.Printf("[DEBUG] Stack already configures provider %s at %s, not generating it\n", instance.Address(), existing.Location())
+			for _, conflict := range existing.ConflictingSettings(instance.Config) {
+				redact.Printf("[WARNING] Provider %s: stack sets %s; the stack's block is used\n", instance.Address(), conflict)
 			}
+			continue
+		}
+		if stack.MissingRequiredProvider(instance.Type) {
+			redact.Printf("[WARNING] Provider %s is not in required_providers; Terraform will look for hashicorp/%s\n", instance.Type, instance.Type)
 		}
-	}
-	
-	tmpl, err := template.New("helm_provider").Parse(`
-provider "helm" {
-  {{- if .kubernetes }}
-  kubernetes {
-    {{- if .kubernetes.config_path }}
-    config_path = "{{ .kubernetes.config_path }}"
-    {{- end }}
-    {{- if .kubernetes.config_context }}
-    config_context = "{{ .kubernetes.config_context }}"
-    {{- end }}
-    {{- if .kubernetes.host }}
-    host = "{{ .kubernetes.host }}"
-    {{- end }}
-    {{- if .kubernetes.token }}
-    token = "{{ .kubernetes.token }}"
-    {{- end }}
-    {{- if .kubernetes.cluster_ca_certificate }}
-    cluster_ca_certificate = <<EOT
-{{ .kubernetes.cluster_ca_certificate }}
-EOT
-    {{- end }}
-  }
-  {{- end }}
-}
-`)
-	if err != nil {
-		return err
-	}
-	return tmpl.Execute(writer, config)
-}
-
-// ProviderGeneratorFactory returns the appropriate generator for a provider type
-func ProviderGeneratorFactory(providerType string) (ProviderGenerator, error) {
-	switch providerType {
-	case "aws":
-		return &AWSProviderGenerator{}, nil
-	case "kubernetes":
-		return &KubernetesProviderGenerator{}, nil
-	case "helm":
-		return &HelmProviderGenerator{}, nil
-	default:
-		return nil, fmt.Errorf("unsupported provider type: %s", providerType)
-	}
-}
 
-// checkExistingProviders scans for existing provider blocks in .tf files
-func (e *Executor) checkExistingProviders() (map[string]bool, error) {
-	existingProviders := make(map[string]bool)
-	
-	// Get all .tf files in the working directory
-	tfFiles, err := filepath.Glob(filepath.Join(e.workDir, "*.tf"))
-	if err != nil {
-		return nil, err
-	}
-	
-	for _, tfFile := range tfFiles {
-		content, err := os.ReadFile(tfFile)
+		instance, err := instance.Prepare(e.credentials)
+		if err != nil {
+			incomplete = append(incomplete, err.Error())
+			continue
+		}
+		generator, err := ProviderGeneratorFactory(instance.Type)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		
-		// Simple regex-based detection of provider blocks
-		// Look for patterns like: provider "aws" {, provider "kubernetes" {, etc.
-		lines := strings.Split(string(content), "\n")
-		for _, line := range lines {
-			trimmedLine := strings.TrimSpace(line)
-			if strings.HasPrefix(trimmedLine, "provider ") && strings.Contains(trimmedLine, "{") {
-				// Extract provider name from the line
-				// Example: provider "aws" { -> aws
-				if start := strings.Index(trimmedLine, "\""); start != -1 {
-					end := strings.Index(trimmedLine[start+1:], "\"")
-					if end != -1 {
-						providerName := trimmedLine[start+1 : start+1+end]
-						existingProviders[providerName] = true
-					}
-				}
-			}
+		config, instanceSecrets := instance.externalizeSecrets()
+		if err := generator.Generate(&content, config); err != nil {
+			return fmt.Errorf("failed to generate %s provider: %w", instance.Address(), err)
 		}
+		secrets = append(secrets, instanceSecrets...)
 	}
-	
-	return existingProviders, nil
-}
 
-// createProviderFile generates provider.tf in the working directory
-func (e *Executor) createProviderFile(providerConfig map[string]interface{}) error {
-	// Check if any provider files already exist
-	existingProviders, err := e.checkExistingProviders()
-	if err != nil {
-		return fmt.Errorf("failed to check existing providers: %w", err)
-	}
-	
-	// Filter out providers that already exist
-	filteredConfig := make(map[string]interface{})
-	for providerType, config := range providerConfig {
-		if !existingProviders[providerType] {
-			filteredConfig[providerType] = config
-		}
+	if len(incomplete) > 0 {
+		return fmt.Errorf("incomplete provider configuration:\n  %s", strings.Join(incomplete, "\n  "))
 	}
-	
+
 	// If no new providers to add, skip creating the file
-	if len(filteredConfig) == 0 {
+	if content.Len() == 0 {
 		return nil
 	}
-	
-	f, err := os.Create(filepath.Join(e.workDir, "provider.tf"))
-	if err != nil {
+	writeSecretVariables(&content, secrets)
+	if err := validateHCL([]byte(content.String()), "provider.tf"); err != nil {
 		return err
 	}
-	defer f.Close()
-	
-	// Track if we've added any providers
-	providersAdded := false
-	
-	// Process each provider in the filtered configuration
-	for providerType, config := range filteredConfig {
-		configMap, ok := config.(map[string]interface{})
-		if !ok {
-			continue
-		}
-		
-		generator, err := ProviderGeneratorFactory(providerType)
-		if err != nil {
-			// Skip unsupported providers
-			continue
-		}
-		
-		if err := generator.Generate(f, configMap); err != nil {
-			return fmt.Errorf("failed to generate %s provider: %w", providerType, err)
+
+	if len(secrets) > 0 {
+		if err := writeProviderSecrets(e.workDir, secrets); err != nil {
+			return fmt.Errorf("failed to write provider secrets: %w", err)
 		}
-		
-		providersAdded = true
 	}
-	
-	if !providersAdded {
-		return fmt.Errorf("no supported provider configuration found")
-	}
-	
-	return nil
+	return os.WriteFile(filepath.Join(e.workDir, "provider.tf"), []byte(content.String()), 0644)
 }
 
 // Helper to copy directories recursively
@@ -0,0 +1,220 @@
+package terraform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// StateVersion is one S3 object version of a state file
+type StateVersion struct {
+	VersionID    string
+	LastModified time.Time
+	IsLatest     bool
+	DeleteMarker bool
+	Serial       int64
+	Lineage      string
+	// Instances counts resource instances, so a resource with count = 3 adds 3
+	Instances int
+}
+
+// ListStateVersions returns the newest limit versions of the backend's state
+// object, newest first, with the serial, lineage and instance count of each.
+// Only the listed versions are downloaded. A limit of 0 or less lists every
+// version
+func ListStateVersions(ctx context.Context, cfg S3BackendConfig, limit int) ([]StateVersion, error) {
+	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(cfg.Region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	client := s3.NewFromConfig(awsCfg)
+	key := cfg.StateKey()
+
+	var versions []StateVersion
+	paginator := s3.NewListObjectVersionsPaginator(client, &s3.ListObjectVersionsInput{
+		Bucket: aws.String(cfg.Bucket),
+		Prefix: aws.String(key),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list versions of s3://%s/%s: %w", cfg.Bucket, key, err)
+		}
+
+		for _, v := range page.Versions {
+			if aws.ToString(v.Key) != key {
+				continue
+			}
+			versions = append(versions, StateVersion{
+				VersionID:    aws.ToString(v.VersionId),
+				LastModified: aws.ToTime(v.LastModified),
+				IsLatest:     aws.ToBool(v.IsLatest),
+			})
+		}
+
+		for _, m := range page.DeleteMarkers {
+			if aws.ToString(m.Key) != key {
+				continue
+			}
+			versions = append(versions, StateVersion{
+				VersionID:    aws.ToString(m.VersionId),
+				LastModified: aws.ToTime(m.LastModified),
+				IsLatest:     aws.ToBool(m.IsLatest),
+				DeleteMarker: true,
+			})
+		}
+	}
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].LastModified.After(versions[j].LastModified)
+	})
+	if limit > 0 && len(versions) > limit {
+		versions = versions[:limit]
+	}
+
+	for i := range versions {
+		if versions[i].DeleteMarker {
+			continue
+		}
+		data, err := getObjectVersion(ctx, client, cfg, versions[i].VersionID)
+		if err != nil {
+			return nil, err
+		}
+		state, err := ParseState(data)
+		if err != nil {
+			return nil, fmt.Errorf("version %s: %w", versions[i].VersionID, err)
+		}
+		versions[i].Serial = state.Serial
+		versions[i].Lineage = state.Lineage
+		versions[i].Instances = len(state.Addresses())
+	}
+	return versions, nil
+}
+
+// GetStateVersion returns the content of one version of the backend's state object
+func GetStateVersion(ctx context.Context, cfg S3BackendConfig, versionID string) ([]byte, error) {
+	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(cfg.Region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	return getObjectVersion(ctx, s3.NewFromConfig(awsCfg), cfg, versionID)
+}
+
+func getObjectVersion(ctx context.Context, client *s3.Client, cfg S3BackendConfig, versionID string) ([]byte, error) {
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:    aws.String(cfg.Bucket),
+		Key:       aws.String(cfg.StateKey()),
+		VersionId: aws.String(versionID),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read version %s of s3://%s/%s: %w", versionID, cfg.Bucket, cfg.StateKey(), err)
+	}
+	defer out.Body.Close()
+
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read version %s: %w", versionID, err)
+	}
+	return data, nil
+}
+
+// StateSummary describes the current state of a stack: when it was last
+// written and what it holds
+type StateSummary struct {
+	LastModified     time.Time `json:"last_modified"`
+	Serial           int64     `json:"serial"`
+	TerraformVersion string    `json:"terraform_version"`
+	Resources        int       `json:"resources"`
+}
+
+// ReadStateSummary reads the backend's current state without running
+// Terraform. It returns nil when no state has been written yet. Only the s3
+// and local backends can be read directly.
+func ReadStateSummary(ctx context.Context, backend Backend) (*StateSummary, error) {
+	var data []byte
+	var lastModified time.Time
+
+	switch b := backend.(type) {
+	case *S3Backend:
+		awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(b.Config.Region))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS config: %w", err)
+		}
+		key := b.Config.StateKey()
+		out, err := s3.NewFromConfig(awsCfg).GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(b.Config.Bucket),
+			Key:    aws.String(key),
+		})
+		var noSuchKey *s3types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read s3://%s/%s: %w", b.Config.Bucket, key, err)
+		}
+		defer out.Body.Close()
+		if data, err = io.ReadAll(out.Body); err != nil {
+			return nil, fmt.Errorf("failed to read s3://%s/%s: %w", b.Config.Bucket, key, err)
+		}
+		lastModified = aws.ToTime(out.LastModified)
+
+	case *LocalBackend:
+		path := b.Describe()
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		lastModified = info.ModTime()
+
+	default:
+		return nil, fmt.Errorf("reading state from the %s backend is not supported", backend.Type())
+	}
+
+	state, err := ParseState(data)
+	if err != nil {
+		return nil, err
+	}
+	return &StateSummary{
+		LastModified:     lastModified.UTC(),
+		Serial:           state.Serial,
+		TerraformVersion: state.TerraformVersion,
+		Resources:        len(state.Addresses()),
+	}, nil
+}
+
+// DiffStates returns the resource addresses present in to but not from
+// (added) and in from but not to (removed)
+func DiffStates(from, to *RawState) (added, removed []string) {
+	before := make(map[string]bool)
+	for _, address := range from.Addresses() {
+		before[address] = true
+	}
+	after := make(map[string]bool)
+	for _, address := range to.Addresses() {
+		after[address] = true
+		if !before[address] {
+			added = append(added, address)
+		}
+	}
+	for _, address := range from.Addresses() {
+		if !after[address] {
+			removed = append(removed, address)
+		}
+	}
+	return added, removed
+}
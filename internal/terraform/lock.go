@@ -0,0 +1,313 @@
+package terraform
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	tfgoconfig "github.com/kingoftowns/tf-go/internal/config"
+	"github.com/kingoftowns/tf-go/internal/constants"
+)
+
+// StateLock is the lock Terraform holds in the DynamoDB lock table, or in the
+// S3 lock file when use_lockfile is set, while it writes state
+type StateLock struct {
+	ID        string `json:"ID"`
+	Operation string `json:"Operation"`
+	Info      string `json:"Info"`
+	Who       string `json:"Who"`
+	Version   string `json:"Version"`
+	Created   string `json:"Created"`
+	Path      string `json:"Path"`
+}
+
+// UsesLockfile reports whether the backend locks state with an S3 lock file
+// next to the state (use_lockfile)
+func (c S3BackendConfig) UsesLockfile() bool {
+	return tfgoconfig.UsesLockfile(c.Options)
+}
+
+// LockfileKey is the key of the S3 lock file Terraform writes with
+// use_lockfile
+func (c S3BackendConfig) LockfileKey() string {
+	return c.StateKey() + ".tflock"
+}
+
+// HasStateLocking reports whether Terraform locks the backend's state at all
+func (c S3BackendConfig) HasStateLocking() bool {
+	return c.DynamoDBTable != "" || c.UsesLockfile()
+}
+
+// GetStateLock returns the lock currently held on the backend's state, or nil
+// when the state is unlocked or no locking is configured. With use_lockfile
+// the S3 lock file is checked, and with dynamodb_table the lock table; when
+// both are set, as while migrating between them, either lock counts.
+func GetStateLock(ctx context.Context, cfg S3BackendConfig) (*StateLock, error) {
+	if !cfg.HasStateLocking() {
+		return nil, nil
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(cfg.Region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	if cfg.UsesLockfile() {
+		lock, err := getLockfile(ctx, s3.NewFromConfig(awsCfg), cfg)
+		if err != nil || lock != nil {
+			return lock, err
+		}
+	}
+	if cfg.DynamoDBTable == "" {
+		return nil, nil
+	}
+
+	out, err := dynamodb.NewFromConfig(awsCfg).GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(cfg.DynamoDBTable),
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"LockID": &dynamodbtypes.AttributeValueMemberS{Value: cfg.Bucket + "/" + cfg.StateKey()},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lock for %s: %w", cfg.StateKey(), err)
+	}
+	if len(out.Item) == 0 {
+		return nil, nil
+	}
+
+	lock := &StateLock{}
+	if info, ok := out.Item["Info"].(*dynamodbtypes.AttributeValueMemberS); ok {
+		if err := json.Unmarshal([]byte(info.Value), lock); err != nil {
+			return nil, fmt.Errorf("failed to parse lock info for %s: %w", cfg.StateKey(), err)
+		}
+	}
+	return lock, nil
+}
+
+// getLockfile reads the S3 lock file, which holds the lock info as JSON, or
+// returns nil when there is none
+func getLockfile(ctx context.Context, client *s3.Client, cfg S3BackendConfig) (*StateLock, error) {
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(cfg.Bucket),
+		Key:    aws.String(cfg.LockfileKey()),
+	})
+	var noSuchKey *s3types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lock file s3://%s/%s: %w", cfg.Bucket, cfg.LockfileKey(), err)
+	}
+	defer out.Body.Close()
+
+	lock := &StateLock{}
+	if err := json.NewDecoder(out.Body).Decode(lock); err != nil {
+		return nil, fmt.Errorf("failed to parse lock file s3://%s/%s: %w", cfg.Bucket, cfg.LockfileKey(), err)
+	}
+	return lock, nil
+}
+
+// String summarises the lock for error messages
+func (l *StateLock) String() string {
+	return fmt.Sprintf("%s (operation %s by %s at %s)", l.ID, l.Operation, l.Who, l.Created)
+}
+
+// CreatedAt parses the time Terraform took the lock
+func (l *StateLock) CreatedAt() (time.Time, error) {
+	created, err := time.Parse(time.RFC3339Nano, l.Created)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("lock %s has no usable creation time %q", l.ID, l.Created)
+	}
+	return created, nil
+}
+
+// ForceUnlock releases the state lock with the given ID
+func (e *Executor) ForceUnlock(ctx context.Context, lockID string) error {
+	if e.tf == nil {
+		return fmt.Errorf("terraform executor not set up")
+	}
+	return e.tf.ForceUnlock(ctx, lockID)
+}
+
+// ciJobFinishedStatuses are the GitLab job statuses after which a job can no
+// longer hold a lock
+var ciJobFinishedStatuses = map[string]bool{
+	"success":  true,
+	"failed":   true,
+	"canceled": true,
+	"skipped":  true,
+}
+
+// CIJob is a GitLab CI job as far as lock release needs it
+type CIJob struct {
+	ID     string
+	Status string
+	// Finished reports whether the job has ended and can no longer hold a lock
+	Finished   bool
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// GetCIJob looks up a GitLab CI job in the current project. It uses
+// CI_API_V4_URL and CI_PROJECT_ID, and authenticates with GITLAB_TOKEN or,
+// failing that, CI_JOB_TOKEN.
+func GetCIJob(ctx context.Context, jobID string) (*CIJob, error) {
+	apiURL := os.Getenv("CI_API_V4_URL")
+	if apiURL == "" {
+		apiURL = "https://gitlab.com/api/v4"
+	}
+	projectID := os.Getenv("CI_PROJECT_ID")
+	if projectID == "" {
+		return nil, fmt.Errorf("CI_PROJECT_ID must be set to look up CI job %s", jobID)
+	}
+
+	endpoint := fmt.Sprintf("%s/projects/%s/jobs/%s", strings.TrimSuffix(apiURL, "/"), url.PathEscape(projectID), url.PathEscape(jobID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("GITLAB_TOKEN"); token != "" {
+		req.Header.Set("PRIVATE-TOKEN", token)
+	} else if token := os.Getenv("CI_JOB_TOKEN"); token != "" {
+		req.Header.Set("JOB-TOKEN", token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up CI job %s: %w", jobID, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to look up CI job %s: %s", jobID, resp.Status)
+	}
+
+	var job struct {
+		Status     string     `json:"status"`
+		StartedAt  *time.Time `json:"started_at"`
+		FinishedAt *time.Time `json:"finished_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return nil, fmt.Errorf("failed to parse CI job %s: %w", jobID, err)
+	}
+	result := &CIJob{ID: jobID, Status: job.Status, Finished: ciJobFinishedStatuses[job.Status]}
+	if job.StartedAt != nil {
+		result.StartedAt = *job.StartedAt
+	}
+	if job.FinishedAt != nil {
+		result.FinishedAt = *job.FinishedAt
+	}
+	return result, nil
+}
+
+// ciJobMention finds "CI job <id>" in a lock's Who or Info, as tf-go writes
+// it, or a GitLab job URL
+var ciJobMention = regexp.MustCompile(`(?i)(?:CI job |/-/jobs/)(\d+)`)
+
+// CheckHeldBy returns an error unless the lock could have been taken by the
+// finished job: it was created while the job ran, and its Who and Info name
+// no other job
+func (j *CIJob) CheckHeldBy(lock *StateLock) error {
+	for _, field := range []string{lock.Who, lock.Info} {
+		for _, match := range ciJobMention.FindAllStringSubmatch(field, -1) {
+			if match[1] != j.ID {
+				return fmt.Errorf("lock %s names CI job %s, not %s", lock.ID, match[1], j.ID)
+			}
+		}
+	}
+	created, err := lock.CreatedAt()
+	if err != nil {
+		return err
+	}
+	if j.StartedAt.IsZero() || j.FinishedAt.IsZero() {
+		return fmt.Errorf("CI job %s has no start and finish time to compare with lock %s", j.ID, lock.ID)
+	}
+	if created.Before(j.StartedAt) || created.After(j.FinishedAt) {
+		return fmt.Errorf("lock %s was taken at %s, outside CI job %s (%s to %s), so the job does not hold it",
+			lock.ID, created.Format(time.RFC3339), j.ID, j.StartedAt.Format(time.RFC3339), j.FinishedAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// LockAuditEntry records one attempt to release a state lock
+type LockAuditEntry struct {
+	Time        time.Time  `json:"time"`
+	Environment string     `json:"environment"`
+	Stack       string     `json:"stack"`
+	StateKey    string     `json:"state_key"`
+	Lock        *StateLock `json:"lock"`
+	ReleasedBy  string     `json:"released_by"`
+	Reason      string     `json:"reason"`
+	Outcome     string     `json:"outcome"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// AppendLockAudit appends entry to the audit log at path as one JSON line
+func AppendLockAudit(path string, entry LockAuditEntry) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return nil
+}
+
+// PutLockAudit stores entry as its own object in the state bucket, under
+// constants.LockAuditPrefix and the state key, so the record outlives the
+// machine that released the lock, such as an ephemeral CI runner
+func PutLockAudit(ctx context.Context, cfg S3BackendConfig, entry LockAuditEntry) error {
+	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(cfg.Region))
+	if err != nil {
+		return fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry: %w", err)
+	}
+
+	key := LockAuditKey(cfg, entry)
+	_, err = s3.NewFromConfig(awsCfg).PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(cfg.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write audit entry to s3://%s/%s: %w", cfg.Bucket, key, err)
+	}
+	return nil
+}
+
+// LockAuditKey is the state bucket key PutLockAudit stores entry at
+func LockAuditKey(cfg S3BackendConfig, entry LockAuditEntry) string {
+	return fmt.Sprintf("%s%s/%s-%s.json", constants.LockAuditPrefix, cfg.StateKey(), entry.Time.UTC().Format("20060102T150405.000000000Z"), entry.Outcome)
+}
@@ -0,0 +1,289 @@
+package terraform
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// StateMigration is one state object to copy from SourceKey to TargetKey
+type StateMigration struct {
+	SourceKey string
+	TargetKey string
+	Serial    int64
+	Lineage   string
+	Resources int
+	// Digest is the MD5 the S3 backend keeps in the lock table for the source, if any
+	Digest string
+	// TargetExists is set when an object is already stored at TargetKey
+	TargetExists bool
+}
+
+// keyPattern matches state keys against a template such as
+// ":ENV/:STACK/terraform.tfstate", capturing the placeholder values
+type keyPattern struct {
+	re     *regexp.Regexp
+	names  []string
+	prefix string
+}
+
+func compileKeyPattern(pattern string) (*keyPattern, error) {
+	matches := namingPlaceholder.FindAllStringSubmatchIndex(pattern, -1)
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("key pattern %q has no placeholders", pattern)
+	}
+
+	p := &keyPattern{prefix: pattern[:matches[0][0]]}
+	var expr strings.Builder
+	expr.WriteString("^")
+	last := 0
+	for _, m := range matches {
+		expr.WriteString(regexp.QuoteMeta(pattern[last:m[0]]))
+		expr.WriteString("([^/]+)")
+		name := pattern[m[2]:m[3]]
+		if name == "MOD_NAME" {
+			name = "STACK"
+		}
+		p.names = append(p.names, name)
+		last = m[1]
+	}
+	expr.WriteString(regexp.QuoteMeta(pattern[last:]))
+	expr.WriteString("$")
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid key pattern %q: %w", pattern, err)
+	}
+	p.re = re
+	return p, nil
+}
+
+// match returns the placeholder values captured from key. A placeholder used
+// twice must capture the same value both times.
+func (p *keyPattern) match(key string) (map[string]string, bool) {
+	groups := p.re.FindStringSubmatch(key)
+	if groups == nil {
+		return nil, false
+	}
+
+	values := make(map[string]string, len(p.names))
+	for i, name := range p.names {
+		value := groups[i+1]
+		if existing, ok := values[name]; ok && existing != value {
+			return nil, false
+		}
+		values[name] = value
+	}
+	return values, true
+}
+
+// withCaptured returns a copy of n with the values captured from a source key
+func (n Naming) withCaptured(values map[string]string) *Naming {
+	fields := map[string]*string{
+		"ENV": &n.Env, "STACK": &n.Stack, "ACCOUNT": &n.Account, "REGION": &n.Region,
+		"APP": &n.App, "PROJECT": &n.Project, "BRANCH": &n.Branch,
+	}
+	for name, value := range values {
+		if field, ok := fields[name]; ok {
+			*field = value
+		}
+	}
+	return &n
+}
+
+// PlanStateMigration finds every state object in the backend bucket whose key
+// matches from and works out its key under to. Placeholders in to are filled
+// from the values captured by from, then from naming. Nothing is modified.
+func PlanStateMigration(ctx context.Context, cfg S3BackendConfig, naming *Naming, from, to string) ([]StateMigration, error) {
+	pattern, err := compileKeyPattern(from)
+	if err != nil {
+		return nil, err
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(cfg.Region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	s3Client := s3.NewFromConfig(awsCfg)
+
+	existing := make(map[string]bool)
+	var sourceKeys []string
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{Bucket: aws.String(cfg.Bucket)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list s3://%s: %w", cfg.Bucket, err)
+		}
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			existing[key] = true
+			if strings.HasPrefix(key, pattern.prefix) {
+				sourceKeys = append(sourceKeys, key)
+			}
+		}
+	}
+
+	var dynamoClient *dynamodb.Client
+	if cfg.DynamoDBTable != "" {
+		dynamoClient = dynamodb.NewFromConfig(awsCfg)
+	}
+
+	var migrations []StateMigration
+	for _, key := range sourceKeys {
+		values, ok := pattern.match(key)
+		if !ok {
+			continue
+		}
+
+		target, err := naming.withCaptured(values).Expand(ctx, to)
+		if err != nil {
+			return nil, fmt.Errorf("target key for %s: %w", key, err)
+		}
+		if target == key {
+			continue
+		}
+
+		data, err := getObject(ctx, s3Client, cfg.Bucket, key)
+		if err != nil {
+			return nil, err
+		}
+		state, err := ParseState(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+
+		migration := StateMigration{
+			SourceKey:    key,
+			TargetKey:    target,
+			Serial:       state.Serial,
+			Lineage:      state.Lineage,
+			Resources:    len(state.Addresses()),
+			TargetExists: existing[target],
+		}
+		if dynamoClient != nil {
+			if migration.Digest, err = getStateDigest(ctx, dynamoClient, cfg, key); err != nil {
+				return nil, err
+			}
+		}
+		migrations = append(migrations, migration)
+	}
+
+	return migrations, nil
+}
+
+// MigrateState copies each planned state object to its target key together
+// with its lock-table digest, then reads the copy back and checks that serial,
+// lineage and digest survived. Source objects are left in place.
+func MigrateState(ctx context.Context, cfg S3BackendConfig, migrations []StateMigration) error {
+	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(cfg.Region))
+	if err != nil {
+		return fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	s3Client := s3.NewFromConfig(awsCfg)
+	dynamoClient := dynamodb.NewFromConfig(awsCfg)
+
+	for _, m := range migrations {
+		fmt.Printf("Copying s3://%s/%s -> %s\n", cfg.Bucket, m.SourceKey, m.TargetKey)
+
+		_, err := s3Client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:     aws.String(cfg.Bucket),
+			Key:        aws.String(m.TargetKey),
+			CopySource: aws.String(copySource(cfg.Bucket, m.SourceKey)),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to copy %s: %w", m.SourceKey, err)
+		}
+
+		data, err := getObject(ctx, s3Client, cfg.Bucket, m.TargetKey)
+		if err != nil {
+			return err
+		}
+		state, err := ParseState(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", m.TargetKey, err)
+		}
+		if state.Serial != m.Serial || state.Lineage != m.Lineage {
+			return fmt.Errorf("verification failed for %s: serial/lineage %d/%s, expected %d/%s",
+				m.TargetKey, state.Serial, state.Lineage, m.Serial, m.Lineage)
+		}
+
+		if m.Digest == "" {
+			continue
+		}
+		sum := md5.Sum(data)
+		if digest := hex.EncodeToString(sum[:]); digest != m.Digest {
+			return fmt.Errorf("verification failed for %s: lock table digest %s does not match state content %s", m.TargetKey, m.Digest, digest)
+		}
+		_, err = dynamoClient.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(cfg.DynamoDBTable),
+			Item: map[string]dynamodbtypes.AttributeValue{
+				"LockID": &dynamodbtypes.AttributeValueMemberS{Value: stateDigestID(cfg.Bucket, m.TargetKey)},
+				"Digest": &dynamodbtypes.AttributeValueMemberS{Value: m.Digest},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to copy lock table digest for %s: %w", m.TargetKey, err)
+		}
+	}
+
+	return nil
+}
+
+// copySource URL-encodes bucket/key for the x-amz-copy-source header
+func copySource(bucket, key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return bucket + "/" + strings.Join(segments, "/")
+}
+
+// stateDigestID is the lock-table key under which the S3 backend stores the
+// MD5 of a state object
+func stateDigestID(bucket, key string) string {
+	return bucket + "/" + key + "-md5"
+}
+
+func getStateDigest(ctx context.Context, client *dynamodb.Client, cfg S3BackendConfig, key string) (string, error) {
+	out, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(cfg.DynamoDBTable),
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"LockID": &dynamodbtypes.AttributeValueMemberS{Value: stateDigestID(cfg.Bucket, key)},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read lock table digest for %s: %w", key, err)
+	}
+	if digest, ok := out.Item["Digest"].(*dynamodbtypes.AttributeValueMemberS); ok {
+		return digest.Value, nil
+	}
+	return "", nil
+}
+
+func getObject(ctx context.Context, client *s3.Client, bucket, key string) ([]byte, error) {
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read s3://%s/%s: %w", bucket, key, err)
+	}
+	defer out.Body.Close()
+
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read s3://%s/%s: %w", bucket, key, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,43 @@
+package terraform
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeyPatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    map[string]string
+	}{
+		{pattern: ":ENV/:STACK/terraform.tfstate", key: "dev/web/terraform.tfstate", want: map[string]string{"ENV": "dev", "STACK": "web"}},
+		{pattern: "stacks/:MOD_NAME/:ENV/terraform.tfstate", key: "stacks/web/prod/terraform.tfstate", want: map[string]string{"ENV": "prod", "STACK": "web"}},
+		{pattern: ":REGION/:ENV/stacks/:STACK/terraform.tfstate", key: "us-east-1/dev/stacks/web/terraform.tfstate", want: map[string]string{"REGION": "us-east-1", "ENV": "dev", "STACK": "web"}},
+		{pattern: ":ENV/:STACK/terraform.tfstate", key: "dev/web/nested/terraform.tfstate", want: nil},
+		{pattern: ":ENV/:STACK/:ENV.tfstate", key: "dev/web/prod.tfstate", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			p, err := compileKeyPattern(tt.pattern)
+			if err != nil {
+				t.Fatalf("compileKeyPattern returned error: %v", err)
+			}
+			got, ok := p.match(tt.key)
+			if tt.want == nil {
+				if ok {
+					t.Errorf("match(%q) = %v, want no match", tt.key, got)
+				}
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("match(%q) = %v, want %v", tt.key, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := compileKeyPattern("terraform.tfstate"); err == nil {
+		t.Error("expected error for pattern without placeholders")
+	}
+}
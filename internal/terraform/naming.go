@@ -0,0 +1,217 @@
+package terraform
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	tfgoconfig "github.com/kingoftowns/tf-go/internal/config"
+	"github.com/kingoftowns/tf-go/internal/redact"
+)
+
+// namingPlaceholder matches the placeholders accepted in backend settings.
+// :MOD_NAME is kept as a Terraspace-compatible alias for :STACK.
+var namingPlaceholder = regexp.MustCompile(`:(ENV|STACK|MOD_NAME|ACCOUNT|REGION|APP|PROJECT|BRANCH|SETTING(?:\.[A-Za-z0-9_-]+)+)`)
+
+// Naming supplies the values substituted for :ENV, :STACK, :ACCOUNT, :REGION,
+// :APP, :PROJECT, :BRANCH and :SETTING.<path> in backend settings. The
+// account and branch are only looked up the first time a template uses them.
+type Naming struct {
+	Env     string
+	Stack   string
+	Account string
+	Region  string
+	App     string
+	Project string
+	Branch  string
+	// Settings are the environment's settings, read by :SETTING.<path>
+	Settings map[string]interface{}
+	// Root is the project root, which relative local state paths are under
+	Root string
+}
+
+// NewNaming collects naming values from the configuration and environment.
+// The project defaults to CI_PROJECT_NAME and then the name of the project
+// root holding config.yaml, never the current directory, so that the default
+// bucket name does not depend on where tf-go runs.
+func NewNaming(cfg *tfgoconfig.Config, env, stack string) *Naming {
+	n := &Naming{
+		Env:     env,
+		Stack:   stack,
+		Account: os.Getenv("AWS_ACCOUNT_ID"),
+		Region:  os.Getenv("AWS_REGION"),
+		App:     os.Getenv("TF_APP"),
+		Project: os.Getenv("CI_PROJECT_NAME"),
+		Branch:  os.Getenv("CI_COMMIT_REF_NAME"),
+	}
+
+	if n.Region == "" {
+		n.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if cfg != nil && cfg.App != "" {
+		n.App = cfg.App
+	}
+	if cfg != nil && cfg.Project != "" {
+		n.Project = cfg.Project
+	}
+	if cfg != nil {
+		n.Settings = cfg.Environments[env].Settings
+		n.Root = cfg.Root
+	}
+	if n.Project == "" && cfg != nil && cfg.Root != "" {
+		// Without a config file Root is only the directory tf-go started in
+		if root, found := tfgoconfig.FindProjectRoot(cfg.Root); found && root == cfg.Root {
+			n.Project = filepath.Base(cfg.Root)
+		}
+	}
+
+	return n
+}
+
+// Expand replaces every placeholder in s. A placeholder whose value cannot be
+// determined is an error rather than being left in the name.
+func (n *Naming) Expand(ctx context.Context, s string) (string, error) {
+	var expandErr error
+	result := namingPlaceholder.ReplaceAllStringFunc(s, func(match string) string {
+		if expandErr != nil {
+			return match
+		}
+		value, err := n.value(ctx, match[1:])
+		if err != nil {
+			expandErr = err
+			return match
+		}
+		return value
+	})
+	if expandErr != nil {
+		return "", fmt.Errorf("resolving %q: %w", s, expandErr)
+	}
+	return result, nil
+}
+
+// ExpandValue expands placeholders in strings, including those nested in maps
+// and lists such as assume_role or endpoints blocks
+func (n *Naming) ExpandValue(ctx context.Context, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return n.Expand(ctx, v)
+	case map[string]interface{}:
+		resolved := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			expanded, err := n.ExpandValue(ctx, item)
+			if err != nil {
+				return nil, err
+			}
+			resolved[key] = expanded
+		}
+		return resolved, nil
+	case []interface{}:
+		resolved := make([]interface{}, len(v))
+		for i, item := range v {
+			expanded, err := n.ExpandValue(ctx, item)
+			if err != nil {
+				return nil, err
+			}
+			resolved[i] = expanded
+		}
+		return resolved, nil
+	default:
+		return value, nil
+	}
+}
+
+func (n *Naming) value(ctx context.Context, name string) (string, error) {
+	if path, ok := strings.CutPrefix(name, "SETTING."); ok {
+		return n.setting(path)
+	}
+	switch name {
+	case "ENV":
+		return n.required(name, n.Env, "pass -env")
+	case "STACK", "MOD_NAME":
+		return n.required(name, n.Stack, "pass -stack")
+	case "ACCOUNT":
+		if n.Account == "" {
+			account, err := lookupAccountID(ctx)
+			if err != nil {
+				return "", fmt.Errorf("cannot resolve :ACCOUNT: set AWS_ACCOUNT_ID or configure AWS credentials: %w", err)
+			}
+			n.Account = account
+		}
+		return n.Account, nil
+	case "REGION":
+		return n.required(name, n.Region, "set the backend region or AWS_REGION")
+	case "APP":
+		return n.required(name, n.App, "set app in config.yaml or TF_APP")
+	case "PROJECT":
+		return n.required(name, n.Project, "set project in config.yaml or CI_PROJECT_NAME")
+	case "BRANCH":
+		if n.Branch == "" {
+			n.Branch = currentGitBranch(ctx)
+		}
+		return n.required(name, n.Branch, "set CI_COMMIT_REF_NAME or run inside a git checkout")
+	}
+	return "", fmt.Errorf("unknown placeholder :%s", name)
+}
+
+// setting expands :SETTING.<path>. The longest part of path that names a
+// setting is used, so a template can continue after it with a dot, as in
+// :SETTING.suffix.tfstate.
+func (n *Naming) setting(path string) (string, error) {
+	keys := strings.Split(path, ".")
+	for i := len(keys); i > 0; i-- {
+		if value, ok := lookupSetting(n.Settings, strings.Join(keys[:i], ".")); ok {
+			rest := ""
+			if i < len(keys) {
+				rest = "." + strings.Join(keys[i:], ".")
+			}
+			return formatSetting(value) + rest, nil
+		}
+	}
+	return "", fmt.Errorf("cannot resolve :SETTING.%s: environment %q has no setting %s", path, n.Env, keys[0])
+}
+
+func (n *Naming) required(name, value, hint string) (string, error) {
+	if value == "" {
+		return "", fmt.Errorf("cannot resolve :%s: %s", name, hint)
+	}
+	return value, nil
+}
+
+// lookupAccountID asks STS for the account of the current AWS credentials
+func lookupAccountID(ctx context.Context) (string, error) {
+	awsCfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	identity, err := sts.NewFromConfig(awsCfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get caller identity: %w", err)
+	}
+	if identity.Account == nil || *identity.Account == "" {
+		return "", fmt.Errorf("caller identity has no account")
+	}
+
+	redact.Printf("[DEBUG] Got account ID from STS: %s\n", *identity.Account)
+	return *identity.Account, nil
+}
+
+// currentGitBranch returns the checked-out branch, or "" outside a git
+// repository or on a detached HEAD
+func currentGitBranch(ctx context.Context) string {
+	out, err := exec.CommandContext(ctx, "git", "rev-parse", "--abbrev-ref", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	branch := strings.TrimSpace(string(out))
+	if branch == "HEAD" {
+		return ""
+	}
+	return branch
+}
@@ -0,0 +1,580 @@
+package terraform
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/kingoftowns/tf-go/internal/redact"
+)
+
+// ProviderSchema tells the provider writer which keys of a provider's config
+// are nested blocks. Every other key is written as an attribute, so a map
+// value becomes an object expression such as tags = { team = "platform" }.
+type ProviderSchema struct {
+	Blocks map[string]ProviderSchema
+	// Required lists the settings the provider cannot work without. It is
+	// checked before provider.tf is written.
+	Required []RequiredAttribute
+	// Prepare adjusts a provider's top-level config before it is validated
+	// and written, e.g. to fill in credentials
+	Prepare func(config map[string]interface{}, credentials ProviderCredentials) (map[string]interface{}, error)
+}
+
+// RequiredAttribute is a provider setting that must be present. Setting one
+// of Env instead also satisfies it, because the provider reads those
+// variables itself. With When set, it is only required when that setting is.
+type RequiredAttribute struct {
+	Name string
+	Env  []string
+	When string
+}
+
+// ProviderCredentials are credentials tf-go holds itself that provider blocks
+// may reuse
+type ProviderCredentials struct {
+	// VaultAddress and VaultToken are tf-go's own Vault login. A vault
+	// provider that configures no authentication is given them.
+	VaultAddress string
+	VaultToken   string
+}
+
+// providerSchemas lists the nested blocks of the providers tf-go knows about.
+// Providers without an entry are written with every key as an attribute.
+var providerSchemas = map[string]ProviderSchema{
+	"aws": {Blocks: map[string]ProviderSchema{
+		"assume_role":                   {},
+		"assume_role_with_web_identity": {},
+		"default_tags":                  {},
+		"endpoints":                     {},
+		"ignore_tags":                   {},
+	}},
+	"kubernetes": {Blocks: map[string]ProviderSchema{
+		"exec":        {},
+		"experiments": {},
+	}},
+	"helm": {Blocks: map[string]ProviderSchema{
+		"kubernetes": {Blocks: map[string]ProviderSchema{
+			"exec": {},
+		}},
+		"registry":    {},
+		"experiments": {},
+	}},
+	"google":      googleSchema,
+	"google-beta": googleSchema,
+	"azurerm": {
+		Blocks: map[string]ProviderSchema{
+			"features": {Blocks: map[string]ProviderSchema{
+				"api_management":             {},
+				"app_configuration":          {},
+				"application_insights":       {},
+				"cognitive_account":          {},
+				"key_vault":                  {},
+				"log_analytics_workspace":    {},
+				"machine_learning":           {},
+				"managed_disk":               {},
+				"postgresql_flexible_server": {},
+				"recovery_service":           {},
+				"recovery_services_vaults":   {},
+				"resource_group":             {},
+				"subscription":               {},
+				"template_deployment":        {},
+				"virtual_machine":            {},
+				"virtual_machine_scale_set":  {},
+			}},
+		},
+		Required: []RequiredAttribute{
+			{Name: "subscription_id", Env: []string{"ARM_SUBSCRIPTION_ID"}},
+			{Name: "client_id", Env: []string{"ARM_CLIENT_ID"}, When: "client_secret"},
+			{Name: "tenant_id", Env: []string{"ARM_TENANT_ID"}, When: "client_secret"},
+		},
+		Prepare: prepareAzureRM,
+	},
+	"vault": {
+		Blocks: map[string]ProviderSchema{
+			"auth_login":            {},
+			"auth_login_aws":        {},
+			"auth_login_azure":      {},
+			"auth_login_cert":       {},
+			"auth_login_gcp":        {},
+			"auth_login_jwt":        {},
+			"auth_login_kerberos":   {},
+			"auth_login_kubernetes": {},
+			"auth_login_oci":        {},
+			"auth_login_oidc":       {},
+			"auth_login_radius":     {},
+			"auth_login_token_file": {},
+			"auth_login_userpass":   {},
+			"client_auth":           {},
+			"headers":               {},
+		},
+		Required: []RequiredAttribute{
+			{Name: "address", Env: []string{"VAULT_ADDR"}},
+		},
+		Prepare: prepareVault,
+	},
+	"datadog": {
+		Blocks: map[string]ProviderSchema{
+			"default_tags": {},
+		},
+		Required: []RequiredAttribute{
+			{Name: "api_key", Env: []string{"DD_API_KEY", "DATADOG_API_KEY"}},
+			{Name: "app_key", Env: []string{"DD_APP_KEY", "DATADOG_APP_KEY"}},
+		},
+	},
+}
+
+var googleSchema = ProviderSchema{
+	Blocks: map[string]ProviderSchema{
+		"batching": {},
+	},
+	Required: []RequiredAttribute{
+		{Name: "project", Env: []string{"GOOGLE_PROJECT", "GOOGLE_CLOUD_PROJECT", "GCLOUD_PROJECT", "CLOUDSDK_CORE_PROJECT"}},
+	},
+	Prepare: prepareGoogle,
+}
+
+// prepareGoogle accepts a service account key stored in Vault as a JSON
+// object and passes it to the provider as the JSON string it expects
+func prepareGoogle(config map[string]interface{}, _ ProviderCredentials) (map[string]interface{}, error) {
+	key, ok := config["credentials"].(map[string]interface{})
+	if !ok {
+		return config, nil
+	}
+	encoded, err := json.Marshal(key)
+	if err != nil {
+		return nil, fmt.Errorf("credentials: %w", err)
+	}
+	redact.Register(string(encoded))
+	return withSetting(config, "credentials", string(encoded)), nil
+}
+
+// prepareAzureRM adds the features block azurerm refuses to start without
+func prepareAzureRM(config map[string]interface{}, _ ProviderCredentials) (map[string]interface{}, error) {
+	if _, ok := config["features"]; ok {
+		return config, nil
+	}
+	return withSetting(config, "features", map[string]interface{}{}), nil
+}
+
+// prepareVault passes tf-go's own Vault login through to a vault provider
+// that configures neither a token nor an auth_login block
+func prepareVault(config map[string]interface{}, credentials ProviderCredentials) (map[string]interface{}, error) {
+	if _, ok := config["address"]; !ok && credentials.VaultAddress != "" {
+		config = withSetting(config, "address", credentials.VaultAddress)
+	}
+	if _, ok := config["token"]; ok || credentials.VaultToken == "" {
+		return config, nil
+	}
+	for key := range config {
+		if strings.HasPrefix(key, "auth_login") {
+			return config, nil
+		}
+	}
+	return withSetting(config, "token", credentials.VaultToken), nil
+}
+
+// withSetting returns a copy of config with key set to value
+func withSetting(config map[string]interface{}, key string, value interface{}) map[string]interface{} {
+	updated := make(map[string]interface{}, len(config)+1)
+	for k, v := range config {
+		updated[k] = v
+	}
+	updated[key] = value
+	return updated
+}
+
+// missingSettings returns a message for every required setting config lacks
+func (s ProviderSchema) missingSettings(config map[string]interface{}) []string {
+	var missing []string
+	for _, required := range s.Required {
+		if required.When != "" && !hasSetting(config, required.When) {
+			continue
+		}
+		if hasSetting(config, required.Name) {
+			continue
+		}
+		satisfied := false
+		for _, name := range required.Env {
+			if os.Getenv(name) != "" {
+				satisfied = true
+				break
+			}
+		}
+		if satisfied {
+			continue
+		}
+
+		message := required.Name + " is required"
+		if required.When != "" {
+			message += " when " + required.When + " is set"
+		}
+		if len(required.Env) > 0 {
+			message += " (or set " + strings.Join(required.Env, " or ") + ")"
+		}
+		missing = append(missing, message)
+	}
+	return missing
+}
+
+func hasSetting(config map[string]interface{}, key string) bool {
+	value, ok := config[key]
+	if !ok || value == nil {
+		return false
+	}
+	if s, isString := value.(string); isString {
+		return s != ""
+	}
+	return true
+}
+
+// Prepare applies the provider's Prepare step and checks its required
+// settings, returning the instance with the prepared config
+func (p ProviderInstance) Prepare(credentials ProviderCredentials) (ProviderInstance, error) {
+	schema := providerSchemas[p.Type]
+	if schema.Prepare != nil {
+		config, err := schema.Prepare(p.Config, credentials)
+		if err != nil {
+			return p, fmt.Errorf("provider %s: %w", p.Address(), err)
+		}
+		p.Config = config
+	}
+	if missing := schema.missingSettings(p.Config); len(missing) > 0 {
+		return p, fmt.Errorf("provider %s: %s", p.Address(), strings.Join(missing, "; "))
+	}
+	return p, nil
+}
+
+// ProviderInstance is one provider block to generate. Every instance but the
+// default one of its type has an alias.
+type ProviderInstance struct {
+	Type   string
+	Alias  string
+	Config map[string]interface{}
+}
+
+// Address returns how resources refer to the instance, e.g. aws or aws.west
+func (p ProviderInstance) Address() string {
+	return providerAddress(p.Type, p.Alias)
+}
+
+func providerAddress(providerType, alias string) string {
+	if alias == "" {
+		return providerType
+	}
+	return providerType + "." + alias
+}
+
+// ProviderInstances flattens a Vault provider document into provider
+// instances. Each value is either one provider config or a list of them, so
+// several regions or accounts can be configured with aliases:
+//
+//	{"aws": [{"region": "us-east-1"}, {"alias": "west", "region": "us-west-2"}]}
+//
+// A type may have at most one instance without an alias, and aliases must be
+// unique within a type. Instances are ordered by type, default first.
+func ProviderInstances(doc map[string]interface{}) ([]ProviderInstance, error) {
+	providerTypes := make([]string, 0, len(doc))
+	for providerType := range doc {
+		providerTypes = append(providerTypes, providerType)
+	}
+	sort.Strings(providerTypes)
+
+	var instances []ProviderInstance
+	for _, providerType := range providerTypes {
+		var configs []map[string]interface{}
+		switch v := doc[providerType].(type) {
+		case map[string]interface{}:
+			configs = append(configs, v)
+		case []interface{}:
+			for i, item := range v {
+				config, ok := item.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("provider %s[%d]: configuration must be a map, got %T", providerType, i, item)
+				}
+				configs = append(configs, config)
+			}
+		default:
+			return nil, fmt.Errorf("provider %s: configuration must be a map or a list of maps, got %T", providerType, v)
+		}
+
+		var typeInstances []ProviderInstance
+		seen := make(map[string]bool)
+		for i, config := range configs {
+			alias := ""
+			if value, ok := config["alias"]; ok {
+				if alias, ok = value.(string); !ok || !hclIdentifierPattern.MatchString(alias) {
+					return nil, fmt.Errorf("provider %s[%d]: invalid alias %v", providerType, i, value)
+				}
+			}
+			if seen[alias] {
+				if alias == "" {
+					return nil, fmt.Errorf("provider %s: more than one instance without an alias", providerType)
+				}
+				return nil, fmt.Errorf("provider %s: alias %q is used more than once", providerType, alias)
+			}
+			seen[alias] = true
+			typeInstances = append(typeInstances, ProviderInstance{Type: providerType, Alias: alias, Config: config})
+		}
+
+		sort.SliceStable(typeInstances, func(i, j int) bool {
+			return typeInstances[i].Alias < typeInstances[j].Alias
+		})
+		instances = append(instances, typeInstances...)
+	}
+	return instances, nil
+}
+
+// ProviderGenerator interface for creating provider configurations
+type ProviderGenerator interface {
+	Generate(writer io.Writer, config map[string]interface{}) error
+}
+
+// HCLProviderGenerator renders a provider config map from Vault as a provider
+// block, using Schema to decide which keys are nested blocks
+type HCLProviderGenerator struct {
+	Name   string
+	Schema ProviderSchema
+}
+
+func (g *HCLProviderGenerator) Generate(writer io.Writer, config map[string]interface{}) error {
+	if g.Name == "aws" {
+		config = wrapDefaultTags(config)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "\nprovider %s {\n", quoteHCLString(g.Name))
+	if err := writeHCLBody(&b, config, g.Schema, 1, g.Name); err != nil {
+		return err
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(writer, b.String())
+	return err
+}
+
+// ProviderGeneratorFactory returns the generator for a provider type
+func ProviderGeneratorFactory(providerType string) (ProviderGenerator, error) {
+	if !hclIdentifierPattern.MatchString(providerType) {
+		return nil, fmt.Errorf("invalid provider name %q", providerType)
+	}
+	return &HCLProviderGenerator{Name: providerType, Schema: providerSchemas[providerType]}, nil
+}
+
+// writeHCLBody writes the attributes of body, then its nested blocks. alias
+// comes first, as in hand-written provider blocks. A block given as a list of
+// maps is written once per element. path names the body in errors.
+func writeHCLBody(b *strings.Builder, body map[string]interface{}, schema ProviderSchema, depth int, path string) error {
+	indent := strings.Repeat("  ", depth)
+
+	keys := make([]string, 0, len(body))
+	for key := range body {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if (keys[i] == "alias") != (keys[j] == "alias") {
+			return keys[i] == "alias"
+		}
+		return keys[i] < keys[j]
+	})
+
+	var attributes, blocks []string
+	width := 0
+	for _, key := range keys {
+		if _, isBlock := schema.Blocks[key]; isBlock {
+			blocks = append(blocks, key)
+			continue
+		}
+		if !hclIdentifierPattern.MatchString(key) {
+			return fmt.Errorf("%s: invalid attribute name %q", path, key)
+		}
+		attributes = append(attributes, key)
+		if len(key) > width {
+			width = len(key)
+		}
+	}
+
+	// Align the equals signs the way terraform fmt does
+	for _, key := range attributes {
+		value := body[key]
+		if key == "config_path" {
+			value = expandHomeDir(value)
+		}
+		fmt.Fprintf(b, "%s%-*s = %s\n", indent, width, key, hclExpression(value))
+	}
+
+	for _, key := range blocks {
+		var instances []map[string]interface{}
+		switch v := body[key].(type) {
+		case map[string]interface{}:
+			instances = append(instances, v)
+		case []interface{}:
+			for _, item := range v {
+				instance, ok := item.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("%s.%s: every element of a block list must be a map", path, key)
+				}
+				instances = append(instances, instance)
+			}
+		default:
+			return fmt.Errorf("%s.%s is a block and must be a map or a list of maps, got %T", path, key, v)
+		}
+
+		for _, instance := range instances {
+			fmt.Fprintf(b, "%s%s {\n", indent, key)
+			if err := writeHCLBody(b, instance, schema.Blocks[key], depth+1, path+"."+key); err != nil {
+				return err
+			}
+			fmt.Fprintf(b, "%s}\n", indent)
+		}
+	}
+	return nil
+}
+
+// expandHomeDir expands a leading ~/ in kubeconfig paths, which Terraform
+// itself does not do
+func expandHomeDir(value interface{}) interface{} {
+	path, ok := value.(string)
+	if !ok || !strings.HasPrefix(path, "~/") {
+		return value
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return value
+	}
+	expanded := filepath.Join(homeDir, path[2:])
+	redact.Printf("[DEBUG] Expanded kubeconfig path from %s to %s\n", path, expanded)
+	return expanded
+}
+
+// wrapDefaultTags accepts the older Vault format where aws default_tags holds
+// the tags directly, and moves them under default_tags.tags
+func wrapDefaultTags(config map[string]interface{}) map[string]interface{} {
+	defaultTags, ok := config["default_tags"].(map[string]interface{})
+	if !ok {
+		return config
+	}
+	if _, nested := defaultTags["tags"].(map[string]interface{}); nested && len(defaultTags) == 1 {
+		return config
+	}
+
+	wrapped := make(map[string]interface{}, len(config))
+	for key, value := range config {
+		wrapped[key] = value
+	}
+	wrapped["default_tags"] = map[string]interface{}{"tags": defaultTags}
+	return wrapped
+}
+
+// ProviderSecretsFile holds the values of secret provider settings. It sits
+// next to provider.tf with mode 0600, and Terraform loads it automatically.
+const ProviderSecretsFile = "tfgo-provider-secrets.auto.tfvars.json"
+
+// providerVariablePrefix starts the names of the variables secret provider
+// settings are passed through
+const providerVariablePrefix = "tfgo_"
+
+// ProviderSecret is a secret provider setting that reaches Terraform as a
+// sensitive variable rather than as a literal in provider.tf
+type ProviderSecret struct {
+	Variable string
+	Value    string
+}
+
+var invalidVariableChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// externalizeSecrets returns a copy of the instance's config in which every
+// string under a secret key, such as token or password, and every string
+// holding a value registered with redact, such as a resolved SecureString
+// parameter, is replaced by a reference to a variable, along with the values
+// those variables take
+func (p ProviderInstance) externalizeSecrets() (map[string]interface{}, []ProviderSecret) {
+	name := providerVariablePrefix + p.Type
+	if p.Alias != "" {
+		name += "_" + p.Alias
+	}
+	var secrets []ProviderSecret
+	config := externalizeSecrets(p.Config, name, &secrets)
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].Variable < secrets[j].Variable })
+	return config, secrets
+}
+
+func externalizeSecrets(config map[string]interface{}, name string, secrets *[]ProviderSecret) map[string]interface{} {
+	result := make(map[string]interface{}, len(config))
+	for key, value := range config {
+		keyName := name + "_" + invalidVariableChars.ReplaceAllString(key, "_")
+		switch v := value.(type) {
+		case string:
+			if v != "" && (redact.IsSecretKey(key) || redact.Contains(v)) {
+				*secrets = append(*secrets, ProviderSecret{Variable: keyName, Value: v})
+				result[key] = hclTraversal("var." + keyName)
+				continue
+			}
+			result[key] = v
+		case map[string]interface{}:
+			result[key] = externalizeSecrets(v, keyName, secrets)
+		case []interface{}:
+			items := make([]interface{}, len(v))
+			for i, item := range v {
+				if nested, ok := item.(map[string]interface{}); ok {
+					items[i] = externalizeSecrets(nested, fmt.Sprintf("%s_%d", keyName, i), secrets)
+				} else if s, ok := item.(string); ok && redact.Contains(s) {
+					itemName := fmt.Sprintf("%s_%d", keyName, i)
+					*secrets = append(*secrets, ProviderSecret{Variable: itemName, Value: s})
+					items[i] = hclTraversal("var." + itemName)
+				} else {
+					items[i] = item
+				}
+			}
+			result[key] = items
+		default:
+			result[key] = v
+		}
+	}
+	return result
+}
+
+// writeSecretVariables declares the variables secret settings are read from.
+// They are sensitive, so Terraform keeps their values out of plan output.
+func writeSecretVariables(b *strings.Builder, secrets []ProviderSecret) {
+	for _, secret := range secrets {
+		fmt.Fprintf(b, "\nvariable %s {\n  type      = string\n  sensitive = true\n}\n", quoteHCLString(secret.Variable))
+	}
+}
+
+// writeProviderSecrets writes the secret values to ProviderSecretsFile, which
+// only the current user can read
+func writeProviderSecrets(dir string, secrets []ProviderSecret) error {
+	values := make(map[string]string, len(secrets))
+	for _, secret := range secrets {
+		values[secret.Variable] = secret.Value
+	}
+	content, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, ProviderSecretsFile)
+	// Remove any copy from the stack first, since WriteFile keeps the mode
+	// of an existing file
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.WriteFile(path, content, 0600)
+}
+
+// validateHCL parses generated configuration, so a rendering bug fails here
+// instead of as a confusing error from terraform init
+func validateHCL(content []byte, filename string) error {
+	if _, diags := hclsyntax.ParseConfig(content, filename, hcl.InitialPos); diags.HasErrors() {
+		return fmt.Errorf("generated %s is not valid HCL: %s", filename, diags.Error())
+	}
+	return nil
+}
@@ -4,17 +4,16 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"path/filepath"
+	"sort"
 	"strings"
-	"text/template"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/sts"
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	tfgoconfig "github.com/kingoftowns/tf-go/internal/config"
 )
 
 // S3BackendConfig represents configuration for an S3 backend
@@ -26,9 +25,69 @@ type S3BackendConfig struct {
 	Encrypt        bool
 	RoleARN        string
 	Profile        string
+	KMSKeyID       string
+
+	// Options holds every other S3 backend argument (assume_role, endpoints,
+	// use_path_style, ...) and is passed through to terraform init unchanged
+	Options map[string]interface{}
+
+	// Workspace is the selected Terraform workspace, which moves the state
+	// object under workspace_key_prefix. It is not a backend argument.
+	Workspace string
+
+	// NoncurrentVersionDays controls the lifecycle rule applied when the bucket is bootstrapped
+	NoncurrentVersionDays int
 }
 
-// EnsureS3Backend creates the S3 bucket and DynamoDB table if they don't exist
+// NewS3BackendConfig reads the S3 settings from an environment's backend config
+func NewS3BackendConfig(backend tfgoconfig.BackendConfig) S3BackendConfig {
+	s3Config := S3BackendConfig{
+		NoncurrentVersionDays: backend.NoncurrentVersionDays,
+	}
+
+	if backend.Type != "s3" {
+		return s3Config
+	}
+
+	if bucket, ok := backend.Config["bucket"]; ok {
+		s3Config.Bucket = fmt.Sprintf("%v", bucket)
+	}
+	if key, ok := backend.Config["key"]; ok {
+		s3Config.Key = fmt.Sprintf("%v", key)
+	}
+	if region, ok := backend.Config["region"]; ok {
+		s3Config.Region = fmt.Sprintf("%v", region)
+	}
+	if dynamo, ok := backend.Config["dynamodb_table"]; ok {
+		s3Config.DynamoDBTable = fmt.Sprintf("%v", dynamo)
+	}
+	if kmsKey, ok := backend.Config["kms_key_id"]; ok {
+		s3Config.KMSKeyID = fmt.Sprintf("%v", kmsKey)
+	}
+	if roleARN, ok := backend.Config["role_arn"]; ok {
+		s3Config.RoleARN = fmt.Sprintf("%v", roleARN)
+	}
+	if profile, ok := backend.Config["profile"]; ok {
+		s3Config.Profile = fmt.Sprintf("%v", profile)
+	}
+
+	for key, value := range backend.Config {
+		switch key {
+		case "bucket", "key", "region", "dynamodb_table", "kms_key_id", "role_arn", "profile", "encrypt":
+			continue
+		}
+		if s3Config.Options == nil {
+			s3Config.Options = make(map[string]interface{})
+		}
+		s3Config.Options[key] = value
+	}
+
+	return s3Config
+}
+
+// EnsureS3Backend creates the S3 bucket and DynamoDB table if they don't exist.
+// Newly created buckets are hardened; existing ones are left untouched and can
+// be checked with AuditS3Backend.
 func EnsureS3Backend(ctx context.Context, cfg S3BackendConfig) error {
 	// Load AWS config
 	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(cfg.Region))
@@ -44,8 +103,13 @@ func EnsureS3Backend(ctx context.Context, cfg S3BackendConfig) error {
 		Bucket: aws.String(cfg.Bucket),
 	})
 	
+	if err != nil && !isNotFound(err) {
+		// A 403 or network error says nothing about whether the bucket exists
+		return fmt.Errorf("failed to check S3 bucket %s: %w", cfg.Bucket, err)
+	}
 	if err != nil {
 		// Bucket doesn't exist, create it
+		fmt.Printf("Creating S3 bucket: %s\n", cfg.Bucket)
 		_, err = s3Client.CreateBucket(ctx, &s3.CreateBucketInput{
 			Bucket: aws.String(cfg.Bucket),
 			// Add location constraint if not in us-east-1
@@ -56,37 +120,9 @@ func EnsureS3Backend(ctx context.Context, cfg S3BackendConfig) error {
 			return fmt.Errorf("failed to create S3 bucket: %w", err)
 		}
 		
-		// Enable versioning on the bucket
-		_, err = s3Client.PutBucketVersioning(ctx, &s3.PutBucketVersioningInput{
-			Bucket: aws.String(cfg.Bucket),
-			VersioningConfiguration: &s3types.VersioningConfiguration{
-				Status: s3types.BucketVersioningStatusEnabled,
-			},
-		})
-		
-		if err != nil {
-			return fmt.Errorf("failed to enable versioning on S3 bucket: %w", err)
-		}
-		
-		// Enable default encryption if required
-		if cfg.Encrypt {
-			_, err = s3Client.PutBucketEncryption(ctx, &s3.PutBucketEncryptionInput{
-				Bucket: aws.String(cfg.Bucket),
-				ServerSideEncryptionConfiguration: &s3types.ServerSideEncryptionConfiguration{
-					Rules: []s3types.ServerSideEncryptionRule{
-						{
-							ApplyServerSideEncryptionByDefault: &s3types.ServerSideEncryptionByDefault{
-								SSEAlgorithm: s3types.ServerSideEncryptionAes256,
-							},
-							BucketKeyEnabled: aws.Bool(true),
-						},
-					},
-				},
-			})
-			
-			if err != nil {
-				return fmt.Errorf("failed to configure encryption on S3 bucket: %w", err)
-			}
+		// Lock down the new bucket before any state lands in it
+		if err := hardenS3Bucket(ctx, s3Client, cfg); err != nil {
+			return err
 		}
 	}
 	
@@ -100,8 +136,12 @@ func EnsureS3Backend(ctx context.Context, cfg S3BackendConfig) error {
 			TableName: aws.String(cfg.DynamoDBTable),
 		})
 		
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("failed to check DynamoDB table %s: %w", cfg.DynamoDBTable, err)
+		}
 		if err != nil {
 			// Table doesn't exist, create it
+			fmt.Printf("Creating DynamoDB lock table: %s\n", cfg.DynamoDBTable)
 			_, err = dynamoClient.CreateTable(ctx, &dynamodb.CreateTableInput{
 				TableName: aws.String(cfg.DynamoDBTable),
 				AttributeDefinitions: []dynamodbtypes.AttributeDefinition{
@@ -141,6 +181,10 @@ func getS3BucketConfiguration(region string) *s3types.CreateBucketConfiguration
 }
 
 // GenerateBackendConfig creates a Terraform backend configuration
+//
+// Deprecated: it only covers bucket, key, region, dynamodb_table, encrypt and
+// role_arn. Use S3Backend.Settings, which BackendConfigArgs passes to
+// terraform init, for every S3 option.
 func GenerateBackendConfig(cfg S3BackendConfig) map[string]interface{} {
 	backendConfig := map[string]interface{}{
 		"bucket": cfg.Bucket,
@@ -163,121 +207,198 @@ func GenerateBackendConfig(cfg S3BackendConfig) map[string]interface{} {
 	return backendConfig
 }
 
-// CreateBackendFile generates a backend.tf file for Terraform
-func (e *Executor) CreateBackendFile(cfg S3BackendConfig) error {
-	// Check if AWS_PROFILE is set and use it in the backend config
-	profile := os.Getenv("AWS_PROFILE")
-	
-	backendContent := `
-terraform {
-  backend "s3" {
-    bucket         = "{{.Bucket}}"
-    key            = "{{.Key}}"
-    region         = "{{.Region}}"
-    {{- if .DynamoDBTable }}
-    dynamodb_table = "{{.DynamoDBTable}}"
-    {{- end }}
-    {{- if .Encrypt }}
-    encrypt        = true
-    {{- end }}
-    {{- if .RoleARN }}
-    role_arn       = "{{.RoleARN}}"
-    {{- end }}
-    {{- if .Profile }}
-    profile        = "{{.Profile}}"
-    {{- end }}
-  }
+// S3Backend stores state in an S3 bucket with optional DynamoDB locking
+type S3Backend struct {
+	Config S3BackendConfig
 }
-`
-	
-	// Add profile to config if set
-	if profile != "" {
-		cfg.Profile = profile
+
+func (b *S3Backend) Type() string { return "s3" }
+
+func (b *S3Backend) Validate() error {
+	var missing []string
+	if b.Config.Bucket == "" {
+		missing = append(missing, "bucket")
 	}
-	
-	tmpl, err := template.New("backend").Parse(backendContent)
-	if err != nil {
-		return err
+	if b.Config.Key == "" {
+		missing = append(missing, "key")
 	}
-	
-	backendFile := filepath.Join(e.workDir, "backend.tf")
-	f, err := os.Create(backendFile)
-	if err != nil {
-		return err
+	if b.Config.Region == "" {
+		missing = append(missing, "region")
 	}
-	defer f.Close()
-	
-	return tmpl.Execute(f, cfg)
+	if len(missing) > 0 {
+		return fmt.Errorf("s3 backend requires %s", strings.Join(missing, ", "))
+	}
+	return validateS3Options(b.Config.Options)
 }
 
-// ResolveS3BackendConfig processes environment variables and templates in S3 backend config
-func ResolveS3BackendConfig(ctx context.Context, input S3BackendConfig, env, stack string) S3BackendConfig {
-	// Create a copy of the input config
-	result := input
-	
-	// Get AWS account ID for bucket naming
-	accountID := os.Getenv("AWS_ACCOUNT_ID")
-	fmt.Printf("[DEBUG] AWS_ACCOUNT_ID env var: %s\n", accountID)
-	
-	if accountID == "" {
-		// Try to get account ID from AWS profile if available
-		profile := os.Getenv("AWS_PROFILE")
-		fmt.Printf("[DEBUG] AWS_PROFILE env var: %s\n", profile)
-		
-		if profile != "" {
-			fmt.Printf("[DEBUG] Attempting to load AWS config with profile: %s\n", profile)
-			if awsCfg, err := config.LoadDefaultConfig(ctx, config.WithSharedConfigProfile(profile)); err == nil {
-				fmt.Printf("[DEBUG] Successfully loaded AWS config\n")
-				stsClient := sts.NewFromConfig(awsCfg)
-				if identity, err := stsClient.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{}); err == nil && identity.Account != nil {
-					accountID = *identity.Account
-					fmt.Printf("[DEBUG] Got account ID from STS: %s\n", accountID)
-				} else {
-					fmt.Printf("[DEBUG] Failed to get caller identity: %v\n", err)
-				}
-			} else {
-				fmt.Printf("[DEBUG] Failed to load AWS config: %v\n", err)
+// Settings returns the S3 backend arguments. AWS_PROFILE is used as the
+// profile when none is configured, matching how tf-go itself talks to AWS.
+func (b *S3Backend) Settings() map[string]interface{} {
+	cfg := b.Config
+	if cfg.Profile == "" {
+		cfg.Profile = os.Getenv("AWS_PROFILE")
+	}
+
+	settings := make(map[string]interface{}, len(cfg.Options)+8)
+	for key, value := range cfg.Options {
+		settings[key] = value
+	}
+	settings["bucket"] = cfg.Bucket
+	settings["key"] = cfg.Key
+	settings["region"] = cfg.Region
+	settings["dynamodb_table"] = cfg.DynamoDBTable
+	settings["kms_key_id"] = cfg.KMSKeyID
+	settings["role_arn"] = cfg.RoleARN
+	settings["profile"] = cfg.Profile
+	if cfg.Encrypt {
+		settings["encrypt"] = true
+	}
+	return settings
+}
+
+// s3BackendOptions lists every argument the Terraform S3 backend accepts.
+// Block-valued arguments map to their allowed nested attributes.
+
+var s3BackendOptions = map[string][]string{
+	"access_key":                         nil,
+	"acl":                                nil,
+	"allowed_account_ids":                nil,
+	"assume_role":                        {"duration", "external_id", "policy", "policy_arns", "role_arn", "session_name", "source_identity", "tags", "transitive_tag_keys"},
+	"assume_role_with_web_identity":      {"duration", "policy", "policy_arns", "role_arn", "session_name", "web_identity_token", "web_identity_token_file"},
+	"bucket":                             nil,
+	"custom_ca_bundle":                   nil,
+	"dynamodb_endpoint":                  nil,
+	"dynamodb_table":                     nil,
+	"ec2_metadata_service_endpoint":      nil,
+	"ec2_metadata_service_endpoint_mode": nil,
+	"encrypt":                            nil,
+	"endpoint":                           nil,
+	"endpoints":                          {"dynamodb", "iam", "s3", "sso", "sts"},
+	"external_id":                        nil,
+	"forbidden_account_ids":              nil,
+	"force_path_style":                   nil,
+	"http_proxy":                         nil,
+	"https_proxy":                        nil,
+	"iam_endpoint":                       nil,
+	"insecure":                           nil,
+	"key":                                nil,
+	"kms_key_id":                         nil,
+	"max_retries":                        nil,
+	"no_proxy":                           nil,
+	"profile":                            nil,
+	"region":                             nil,
+	"retry_mode":                         nil,
+	"role_arn":                           nil,
+	"secret_key":                         nil,
+	"session_name":                       nil,
+	"shared_config_files":                nil,
+	"shared_credentials_file":            nil,
+	"shared_credentials_files":           nil,
+	"skip_credentials_validation":        nil,
+	"skip_metadata_api_check":            nil,
+	"skip_region_validation":             nil,
+	"skip_requesting_account_id":         nil,
+	"skip_s3_checksum":                   nil,
+	"sse_customer_key":                   nil,
+	"sts_endpoint":                       nil,
+	"sts_region":                         nil,
+	"token":                              nil,
+	"use_dualstack_endpoint":             nil,
+	"use_fips_endpoint":                  nil,
+	"use_legacy_workflow":                nil,
+	"use_lockfile":                       nil,
+	"use_path_style":                     nil,
+	"workspace_key_prefix":               nil,
+}
+
+// validateS3Options rejects arguments the S3 backend does not understand, so a
+// typo fails before terraform init rather than during it
+func validateS3Options(options map[string]interface{}) error {
+	var problems []string
+	for key, value := range options {
+		nested, known := s3BackendOptions[key]
+		if !known {
+			problems = append(problems, fmt.Sprintf("unknown option %q", key))
+			continue
+		}
+		if nested == nil {
+			continue
+		}
+		block, ok := value.(map[string]interface{})
+		if !ok {
+			problems = append(problems, fmt.Sprintf("option %q must be a map", key))
+			continue
+		}
+		for attr := range block {
+			if !containsString(nested, attr) {
+				problems = append(problems, fmt.Sprintf("unknown option %q in %s", attr, key))
 			}
 		}
-		// Fallback if we still can't get it
-		if accountID == "" {
-			fmt.Printf("[DEBUG] Using fallback account ID: ACCOUNT\n")
-			accountID = "ACCOUNT"
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("s3 backend: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
 		}
 	}
-	
-	// If input config is empty, use the backend.rb equivalent logic
-	if result.Bucket == "" {
-		result.Bucket = fmt.Sprintf("terraform-state-k8s-cluster-info-%s", accountID)
+	return false
+}
+
+func (b *S3Backend) Describe() string {
+	return fmt.Sprintf("s3://%s/%s in %s", b.Config.Bucket, b.Config.StateKey(), b.Config.Region)
+}
+
+// ResolveS3BackendConfig expands naming placeholders in every S3 backend
+// setting. The region is expanded first so that other settings can use :REGION.
+func ResolveS3BackendConfig(ctx context.Context, input S3BackendConfig, naming *Naming) (S3BackendConfig, error) {
+	result := input
+	result.Encrypt = true // State is always encrypted at rest
+
+	region, err := naming.Expand(ctx, input.Region)
+	if err != nil {
+		return result, fmt.Errorf("s3 backend region: %w", err)
 	}
-	
-	if result.Key == "" {
-		result.Key = fmt.Sprintf("%s/%s/terraform.tfstate", env, stack)
+	result.Region = region
+	if region != "" {
+		naming.Region = region
 	}
-	
-	if result.DynamoDBTable == "" {
-		result.DynamoDBTable = "terraform_locks_k8s-cluster-info"
+
+	fields := []struct {
+		name  string
+		value *string
+	}{
+		{"bucket", &result.Bucket},
+		{"key", &result.Key},
+		{"dynamodb_table", &result.DynamoDBTable},
+		{"kms_key_id", &result.KMSKeyID},
+		{"role_arn", &result.RoleARN},
+		{"profile", &result.Profile},
 	}
-	
-	if result.Region == "" {
-		result.Region = "us-gov-west-1" // Default region from your backend.rb
+	for _, field := range fields {
+		expanded, err := naming.Expand(ctx, *field.value)
+		if err != nil {
+			return result, fmt.Errorf("s3 backend %s: %w", field.name, err)
+		}
+		*field.value = expanded
 	}
-	
-	result.Encrypt = true // Always encrypt as per backend.rb
-	
-	// Process string templating for any remaining placeholders
-	result.Bucket = strings.ReplaceAll(result.Bucket, ":ENV", env)
-	result.Bucket = strings.ReplaceAll(result.Bucket, ":STACK", stack)
-	result.Bucket = strings.ReplaceAll(result.Bucket, ":ACCOUNT", accountID)
-	
-	result.Key = strings.ReplaceAll(result.Key, ":ENV", env)
-	result.Key = strings.ReplaceAll(result.Key, ":STACK", stack)
-	result.Key = strings.ReplaceAll(result.Key, ":MOD_NAME", stack)
-	
-	if result.DynamoDBTable != "" {
-		result.DynamoDBTable = strings.ReplaceAll(result.DynamoDBTable, ":ENV", env)
-		result.DynamoDBTable = strings.ReplaceAll(result.DynamoDBTable, ":STACK", stack)
+
+	if input.Options != nil {
+		result.Options = make(map[string]interface{}, len(input.Options))
+		for key, value := range input.Options {
+			expanded, err := naming.ExpandValue(ctx, value)
+			if err != nil {
+				return result, fmt.Errorf("s3 backend %s: %w", key, err)
+			}
+			result.Options[key] = expanded
+		}
 	}
-	
-	return result
-}
\ No newline at end of file
+
+	return result, nil
+}
@@ -0,0 +1,359 @@
+package terraform
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	tfgoconfig "github.com/kingoftowns/tf-go/internal/config"
+	"github.com/kingoftowns/tf-go/internal/constants"
+	"github.com/kingoftowns/tf-go/internal/testutil"
+)
+
+func TestEnsureS3BackendCreatesBucketAndTable(t *testing.T) {
+	aws := testutil.NewAWSServer(t)
+	aws.SetEnv(t)
+
+	cfg := S3BackendConfig{
+		Bucket:        "tfstate-test",
+		Key:           "dev/web/terraform.tfstate",
+		Region:        "us-east-1",
+		DynamoDBTable: "tf-locks",
+		Encrypt:       true,
+	}
+	if err := EnsureS3Backend(context.Background(), cfg); err != nil {
+		t.Fatalf("EnsureS3Backend returned error: %v", err)
+	}
+
+	bucket := aws.Bucket("tfstate-test")
+	if bucket == nil {
+		t.Fatal("bucket was not created")
+	}
+	if !bucket.VersioningEnabled() {
+		t.Error("versioning was not enabled")
+	}
+	for subresource, want := range map[string]string{
+		"encryption":        "aws:kms",
+		"publicAccessBlock": "<RestrictPublicBuckets>true</RestrictPublicBuckets>",
+		"policy":            `"aws:SecureTransport":"false"`,
+		"lifecycle":         "<NoncurrentDays>90</NoncurrentDays>",
+	} {
+		if got := string(bucket.Config[subresource]); !strings.Contains(got, want) {
+			t.Errorf("%s = %s, want it to contain %s", subresource, got, want)
+		}
+	}
+
+	table := aws.Table("tf-locks")
+	if table == nil {
+		t.Fatal("lock table was not created")
+	}
+	if table.HashKey != "LockID" {
+		t.Errorf("lock table hash key = %q, want LockID", table.HashKey)
+	}
+}
+
+func TestEnsureS3BackendLeavesExistingBucket(t *testing.T) {
+	aws := testutil.NewAWSServer(t)
+	aws.SetEnv(t)
+	aws.CreateBucket("tfstate-test")
+
+	cfg := S3BackendConfig{Bucket: "tfstate-test", Region: "us-east-1"}
+	if err := EnsureS3Backend(context.Background(), cfg); err != nil {
+		t.Fatalf("EnsureS3Backend returned error: %v", err)
+	}
+
+	for _, req := range aws.Requests() {
+		if strings.HasPrefix(req, "s3 PUT") {
+			t.Errorf("unexpected write to existing bucket: %s", req)
+		}
+	}
+}
+
+func TestEnsureS3BackendReportsAccessDenied(t *testing.T) {
+	aws := testutil.NewAWSServer(t)
+	aws.SetEnv(t)
+	denied := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer denied.Close()
+	t.Setenv("AWS_ENDPOINT_URL", denied.URL)
+
+	err := EnsureS3Backend(context.Background(), S3BackendConfig{Bucket: "someone-elses-state", Region: "us-east-1"})
+	if err == nil || !strings.Contains(err.Error(), "failed to check S3 bucket someone-elses-state") {
+		t.Fatalf("expected the HeadBucket error, got %v", err)
+	}
+}
+
+func TestAuditS3Backend(t *testing.T) {
+	aws := testutil.NewAWSServer(t)
+	aws.SetEnv(t)
+	ctx := context.Background()
+
+	cfg := S3BackendConfig{
+		Bucket:                "tfstate-test",
+		Region:                "us-gov-west-1",
+		DynamoDBTable:         "tf-locks",
+		KMSKeyID:              "alias/tfstate",
+		NoncurrentVersionDays: 30,
+	}
+	if err := EnsureS3Backend(ctx, cfg); err != nil {
+		t.Fatalf("EnsureS3Backend returned error: %v", err)
+	}
+
+	findings, err := AuditS3Backend(ctx, cfg)
+	if err != nil {
+		t.Fatalf("AuditS3Backend returned error: %v", err)
+	}
+	if len(findings) != 0 {
+		t.Errorf("freshly bootstrapped backend has findings: %v", findings)
+	}
+
+	bucket := aws.Bucket("tfstate-test")
+	if !strings.Contains(string(bucket.Config["policy"]), "arn:aws-us-gov:s3:::tfstate-test") {
+		t.Errorf("policy does not use the GovCloud partition: %s", bucket.Config["policy"])
+	}
+
+	// A bucket created outside tf-go with none of the settings
+	aws.CreateBucket("legacy-state")
+	findings, err = AuditS3Backend(ctx, S3BackendConfig{Bucket: "legacy-state", Region: "us-east-1", DynamoDBTable: "missing"})
+	if err != nil {
+		t.Fatalf("AuditS3Backend returned error: %v", err)
+	}
+
+	var checks []string
+	for _, f := range findings {
+		checks = append(checks, f.Check)
+	}
+	want := []string{"public access block", "TLS-only policy", "versioning", "KMS encryption", "noncurrent version lifecycle", "lock table exists"}
+	if strings.Join(checks, ",") != strings.Join(want, ",") {
+		t.Errorf("findings = %v, want %v", checks, want)
+	}
+
+	// Hardening the legacy bucket clears every bucket finding
+	if err := HardenS3Backend(ctx, S3BackendConfig{Bucket: "legacy-state", Region: "us-east-1"}); err != nil {
+		t.Fatalf("HardenS3Backend returned error: %v", err)
+	}
+	findings, err = AuditS3Backend(ctx, S3BackendConfig{Bucket: "legacy-state", Region: "us-east-1"})
+	if err != nil {
+		t.Fatalf("AuditS3Backend returned error: %v", err)
+	}
+	if len(findings) != 0 {
+		t.Errorf("hardened bucket still has findings: %v", findings)
+	}
+}
+
+func TestHardenS3BackendMergesPolicyAndLifecycle(t *testing.T) {
+	aws := testutil.NewAWSServer(t)
+	aws.SetEnv(t)
+	ctx := context.Background()
+
+	bucket := aws.CreateBucket("shared-state")
+	bucket.Config["policy"] = []byte(`{"Version":"2012-10-17","Statement":{"Sid":"CrossAccountRead","Effect":"Allow",` +
+		`"Principal":{"AWS":"arn:aws:iam::999999999999:root"},"Action":"s3:GetObject","Resource":"arn:aws:s3:::shared-state/*"}}`)
+	bucket.Config["lifecycle"] = []byte(`<LifecycleConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/">` +
+		`<Rule><ID>expire-logs</ID><Filter><Prefix>logs/</Prefix></Filter><Status>Enabled</Status><Expiration><Days>365</Days></Expiration></Rule>` +
+		`<Rule><ID>tf-go-noncurrent-state-versions</ID><Filter><Prefix></Prefix></Filter><Status>Enabled</Status>` +
+		`<NoncurrentVersionExpiration><NoncurrentDays>10</NoncurrentDays></NoncurrentVersionExpiration></Rule>` +
+		`</LifecycleConfiguration>`)
+
+	cfg := S3BackendConfig{Bucket: "shared-state", Region: "us-east-1", NoncurrentVersionDays: 30}
+	if err := HardenS3Backend(ctx, cfg); err != nil {
+		t.Fatalf("HardenS3Backend returned error: %v", err)
+	}
+	policy := string(bucket.Config["policy"])
+	for _, want := range []string{`"Sid":"CrossAccountRead"`, `"Sid":"DenyInsecureTransport"`} {
+		if !strings.Contains(policy, want) {
+			t.Errorf("policy is missing %s: %s", want, policy)
+		}
+	}
+	lifecycle := string(bucket.Config["lifecycle"])
+	if !strings.Contains(lifecycle, "<ID>expire-logs</ID>") || strings.Count(lifecycle, "<ID>tf-go-noncurrent-state-versions</ID>") != 1 ||
+		!strings.Contains(lifecycle, "<NoncurrentDays>30</NoncurrentDays>") {
+		t.Errorf("lifecycle rules were not merged: %s", lifecycle)
+	}
+
+	// A policy that already denies insecure transport is left alone
+	requests := len(aws.Requests())
+	if err := HardenS3Backend(ctx, cfg); err != nil {
+		t.Fatalf("HardenS3Backend returned error: %v", err)
+	}
+	for _, req := range aws.Requests()[requests:] {
+		if req == "s3 PUT /shared-state?policy" {
+			t.Errorf("an already merged policy should not be written again")
+		}
+	}
+}
+
+func TestHardenS3BackendReadsSingleStatementPolicy(t *testing.T) {
+	aws := testutil.NewAWSServer(t)
+	aws.SetEnv(t)
+
+	bucket := aws.CreateBucket("single-statement")
+	bucket.Config["policy"] = []byte(`{"Version":"2012-10-17","Statement":{"Sid":"TLSOnly","Effect":"Deny","Principal":"*","Action":"s3:*",` +
+		`"Resource":"arn:aws:s3:::single-statement/*","Condition":{"Bool":{"aws:SecureTransport":"false"}}}}`)
+	if err := HardenS3Backend(context.Background(), S3BackendConfig{Bucket: "single-statement", Region: "us-east-1"}); err != nil {
+		t.Fatalf("HardenS3Backend returned error: %v", err)
+	}
+	for _, req := range aws.Requests() {
+		if req == "s3 PUT /single-statement?policy" {
+			t.Errorf("a policy that already denies insecure transport should be left alone: %s", bucket.Config["policy"])
+		}
+	}
+}
+
+func TestHardenS3BackendRefusesConflicts(t *testing.T) {
+	aws := testutil.NewAWSServer(t)
+	aws.SetEnv(t)
+	ctx := context.Background()
+
+	for name, config := range map[string]map[string]string{
+		"a DenyInsecureTransport statement that allows": {
+			"policy": `{"Version":"2012-10-17","Statement":[{"Sid":"DenyInsecureTransport","Effect":"Allow","Principal":"*","Action":"s3:*","Resource":"*"}]}`,
+		},
+		"a legacy Prefix rule": {
+			"lifecycle": `<LifecycleConfiguration><Rule><ID>old</ID><Prefix>logs/</Prefix><Status>Enabled</Status>` +
+				`<Expiration><Days>30</Days></Expiration></Rule></LifecycleConfiguration>`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			bucketName := "state-" + strings.ReplaceAll(name, " ", "-")
+			bucket := aws.CreateBucket(bucketName)
+			for subresource, value := range config {
+				bucket.Config[subresource] = []byte(value)
+			}
+			err := HardenS3Backend(ctx, S3BackendConfig{Bucket: bucketName, Region: "us-east-1"})
+			if err == nil || !strings.Contains(err.Error(), "refusing to change") {
+				t.Fatalf("expected a conflict, got %v", err)
+			}
+			for _, req := range aws.Requests() {
+				if strings.HasPrefix(req, "s3 PUT /"+bucketName) {
+					t.Errorf("nothing should be written on a conflict, got %s", req)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveS3BackendConfigPlaceholders(t *testing.T) {
+	naming := &Naming{Env: "dev", Stack: "web", Account: "111122223333", App: "billing", Project: "platform", Branch: "main"}
+	got, err := ResolveS3BackendConfig(context.Background(), S3BackendConfig{
+		Bucket:        "state-:PROJECT-:ACCOUNT-:REGION",
+		Key:           ":APP/:BRANCH/:ENV/:STACK/terraform.tfstate",
+		Region:        "us-gov-west-1",
+		DynamoDBTable: "locks-:ENV-:MOD_NAME",
+		Options: map[string]interface{}{
+			"assume_role": map[string]interface{}{"role_arn": "arn:aws-us-gov:iam::111122223333:role/:ENV-state"},
+		},
+	}, naming)
+	if err != nil {
+		t.Fatalf("ResolveS3BackendConfig returned error: %v", err)
+	}
+
+	if got.Bucket != "state-platform-111122223333-us-gov-west-1" {
+		t.Errorf("Bucket = %q", got.Bucket)
+	}
+	if got.Key != "billing/main/dev/web/terraform.tfstate" {
+		t.Errorf("Key = %q", got.Key)
+	}
+	if got.DynamoDBTable != "locks-dev-web" {
+		t.Errorf("DynamoDBTable = %q", got.DynamoDBTable)
+	}
+	roleARN := got.Options["assume_role"].(map[string]interface{})["role_arn"]
+	if roleARN != "arn:aws-us-gov:iam::111122223333:role/dev-state" {
+		t.Errorf("assume_role.role_arn = %q", roleARN)
+	}
+	if !got.Encrypt {
+		t.Error("Encrypt should always be true")
+	}
+}
+
+func TestResolveS3BackendConfigRegionPlaceholder(t *testing.T) {
+	naming := &Naming{Env: "dev", Stack: "web", Account: "111122223333", Region: "eu-west-1"}
+	got, err := ResolveS3BackendConfig(context.Background(), S3BackendConfig{
+		Bucket: "state-:REGION",
+		Key:    ":ENV/:STACK/terraform.tfstate",
+		Region: ":REGION",
+	}, naming)
+	if err != nil {
+		t.Fatalf("ResolveS3BackendConfig returned error: %v", err)
+	}
+	if got.Region != "eu-west-1" || got.Bucket != "state-eu-west-1" {
+		t.Errorf("Region = %q, Bucket = %q", got.Region, got.Bucket)
+	}
+}
+
+func TestResolveS3BackendConfigAccountFromSTS(t *testing.T) {
+	aws := testutil.NewAWSServer(t)
+	aws.SetEnv(t)
+	t.Setenv("AWS_ACCOUNT_ID", "")
+
+	got, err := ResolveS3BackendConfig(context.Background(), S3BackendConfig{
+		Bucket: "state-:ACCOUNT", Key: "k", Region: "us-east-1",
+	}, NewNaming(nil, "dev", "web"))
+	if err != nil {
+		t.Fatalf("ResolveS3BackendConfig returned error: %v", err)
+	}
+	if got.Bucket != "state-"+testutil.DefaultAWSAccountID {
+		t.Errorf("Bucket = %q", got.Bucket)
+	}
+}
+
+func TestNewNamingProjectFromRoot(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "shop")
+	testutil.WriteFiles(t, root, map[string]string{
+		"config.yaml":            "terraform:\n  backend_type: s3\n",
+		"app/stacks/web/main.tf": "",
+	})
+	testutil.Chdir(t, filepath.Join(root, "app", "stacks", "web"))
+	t.Setenv("CI_PROJECT_NAME", "")
+
+	cfg, err := tfgoconfig.Load(tfgoconfig.LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := NewNaming(cfg, "dev", "web").Project; got != "shop" {
+		t.Errorf("Project = %q, want the project root's name shop", got)
+	}
+
+	// Without config.yaml there is no project root to name the project after
+	bare := t.TempDir()
+	testutil.Chdir(t, bare)
+	if cfg, err = tfgoconfig.Load(tfgoconfig.LoadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewNaming(cfg, "dev", "web").Expand(context.Background(), constants.DefaultBackendBucketTemplate)
+	if err == nil || !strings.Contains(err.Error(), "cannot resolve :PROJECT") {
+		t.Errorf("expected :PROJECT to be required, got %v", err)
+	}
+}
+
+func TestResolveS3BackendConfigUnresolvedPlaceholders(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   S3BackendConfig
+		wantErr string
+	}{
+		{name: "account", input: S3BackendConfig{Bucket: "state-:ACCOUNT", Region: "us-east-1"}, wantErr: "cannot resolve :ACCOUNT"},
+		{name: "region", input: S3BackendConfig{Bucket: "state", Region: ":REGION"}, wantErr: "cannot resolve :REGION"},
+		{name: "app", input: S3BackendConfig{Bucket: "state-:APP", Region: "us-east-1"}, wantErr: "cannot resolve :APP"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// No credentials at all, so the STS lookup fails
+			aws := testutil.NewAWSServer(t)
+			aws.SetEnv(t)
+			t.Setenv("AWS_ACCOUNT_ID", "")
+			t.Setenv("AWS_ACCESS_KEY_ID", "")
+			t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+
+			_, err := ResolveS3BackendConfig(context.Background(), tt.input, &Naming{Env: "dev", Stack: "web"})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
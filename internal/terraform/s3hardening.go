@@ -0,0 +1,449 @@
+package terraform
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+
+	"github.com/kingoftowns/tf-go/internal/constants"
+)
+
+// BackendFinding describes one hardening check that a state backend fails
+type BackendFinding struct {
+	Resource string
+	Check    string
+	Detail   string
+}
+
+func (f BackendFinding) String() string {
+	return fmt.Sprintf("%s: %s (%s)", f.Resource, f.Check, f.Detail)
+}
+
+// noncurrentVersionsRuleID is the ID of the lifecycle rule tf-go manages on
+// state buckets
+const noncurrentVersionsRuleID = "tf-go-noncurrent-state-versions"
+
+// noncurrentVersionDays returns the configured retention or the default
+func (cfg S3BackendConfig) noncurrentVersionDays() int32 {
+	if cfg.NoncurrentVersionDays > 0 {
+		return int32(cfg.NoncurrentVersionDays)
+	}
+	return constants.DefaultNoncurrentVersionDays
+}
+
+// HardenS3Backend applies the hardening settings to an existing state bucket
+func HardenS3Backend(ctx context.Context, cfg S3BackendConfig) error {
+	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(cfg.Region))
+	if err != nil {
+		return fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	return hardenS3Bucket(ctx, s3.NewFromConfig(awsCfg), cfg)
+}
+
+// hardenS3Bucket blocks public access, requires TLS, enables versioning and
+// KMS encryption, and expires noncurrent state versions. The TLS statement
+// and the lifecycle rule are merged into the bucket's existing policy and
+// rules; when they cannot be, nothing is changed and the conflict is
+// returned.
+func hardenS3Bucket(ctx context.Context, client *s3.Client, cfg S3BackendConfig) error {
+	bucket := aws.String(cfg.Bucket)
+
+	policy, err := mergedBucketPolicy(ctx, client, cfg)
+	if err != nil {
+		return err
+	}
+	rules, err := mergedLifecycleRules(ctx, client, cfg)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.PutPublicAccessBlock(ctx, &s3.PutPublicAccessBlockInput{
+		Bucket: bucket,
+		PublicAccessBlockConfiguration: &s3types.PublicAccessBlockConfiguration{
+			BlockPublicAcls:       aws.Bool(true),
+			BlockPublicPolicy:     aws.Bool(true),
+			IgnorePublicAcls:      aws.Bool(true),
+			RestrictPublicBuckets: aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to block public access on S3 bucket: %w", err)
+	}
+
+	if policy != "" {
+		_, err = client.PutBucketPolicy(ctx, &s3.PutBucketPolicyInput{
+			Bucket: bucket,
+			Policy: aws.String(policy),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set TLS-only policy on S3 bucket: %w", err)
+		}
+	}
+
+	_, err = client.PutBucketVersioning(ctx, &s3.PutBucketVersioningInput{
+		Bucket: bucket,
+		VersioningConfiguration: &s3types.VersioningConfiguration{
+			Status: s3types.BucketVersioningStatusEnabled,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enable versioning on S3 bucket: %w", err)
+	}
+
+	sse := &s3types.ServerSideEncryptionByDefault{
+		SSEAlgorithm: s3types.ServerSideEncryptionAwsKms,
+	}
+	if cfg.KMSKeyID != "" {
+		sse.KMSMasterKeyID = aws.String(cfg.KMSKeyID)
+	}
+	_, err = client.PutBucketEncryption(ctx, &s3.PutBucketEncryptionInput{
+		Bucket: bucket,
+		ServerSideEncryptionConfiguration: &s3types.ServerSideEncryptionConfiguration{
+			Rules: []s3types.ServerSideEncryptionRule{
+				{
+					ApplyServerSideEncryptionByDefault: sse,
+					BucketKeyEnabled:                   aws.Bool(true),
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to configure encryption on S3 bucket: %w", err)
+	}
+
+	_, err = client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket: bucket,
+		LifecycleConfiguration: &s3types.BucketLifecycleConfiguration{
+			Rules: rules,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to configure lifecycle rules on S3 bucket: %w", err)
+	}
+
+	return nil
+}
+
+// mergedBucketPolicy returns the bucket's policy with the TLS-only statement
+// added, or "" when the policy already denies insecure transport
+func mergedBucketPolicy(ctx context.Context, client *s3.Client, cfg S3BackendConfig) (string, error) {
+	current, err := client.GetBucketPolicy(ctx, &s3.GetBucketPolicyInput{Bucket: aws.String(cfg.Bucket)})
+	switch {
+	case isAWSErrorCode(err, "NoSuchBucketPolicy"):
+		return tlsOnlyBucketPolicy(cfg.Bucket, cfg.Region), nil
+	case err != nil:
+		return "", fmt.Errorf("failed to read bucket policy: %w", err)
+	}
+	return mergeTLSOnlyPolicy(aws.ToString(current.Policy), cfg.Bucket, cfg.Region)
+}
+
+// mergeTLSOnlyPolicy adds the DenyInsecureTransport statement to an existing
+// bucket policy, keeping every other statement. It returns "" when the policy
+// already denies insecure transport, and an error when the statement cannot
+// be added without changing the policy's meaning.
+func mergeTLSOnlyPolicy(policy, bucket, region string) (string, error) {
+	if policyDeniesInsecureTransport(policy) {
+		return "", nil
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(policy), &doc); err != nil {
+		return "", fmt.Errorf("refusing to change the policy of S3 bucket %s: it is not valid JSON: %w", bucket, err)
+	}
+	var statements []interface{}
+	switch s := doc["Statement"].(type) {
+	case nil:
+	case []interface{}:
+		statements = s
+	case map[string]interface{}:
+		statements = []interface{}{s}
+	default:
+		return "", fmt.Errorf("refusing to change the policy of S3 bucket %s: Statement is neither a statement nor a list", bucket)
+	}
+	for _, statement := range statements {
+		if s, ok := statement.(map[string]interface{}); ok && s["Sid"] == "DenyInsecureTransport" {
+			return "", fmt.Errorf("refusing to change the policy of S3 bucket %s: it has a DenyInsecureTransport statement that does not deny aws:SecureTransport=false; fix or rename it by hand", bucket)
+		}
+	}
+
+	var tlsOnly map[string]interface{}
+	if err := json.Unmarshal([]byte(tlsOnlyBucketPolicy(bucket, region)), &tlsOnly); err != nil {
+		return "", err
+	}
+	doc["Statement"] = append(statements, tlsOnly["Statement"].([]interface{})...)
+	if doc["Version"] == nil {
+		doc["Version"] = tlsOnly["Version"]
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// mergedLifecycleRules returns the bucket's lifecycle rules with tf-go's
+// noncurrent version rule added or, when a rule with its ID exists, updated
+func mergedLifecycleRules(ctx context.Context, client *s3.Client, cfg S3BackendConfig) ([]s3types.LifecycleRule, error) {
+	current, err := client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(cfg.Bucket)})
+	var rules []s3types.LifecycleRule
+	switch {
+	case isAWSErrorCode(err, "NoSuchLifecycleConfiguration"):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read bucket lifecycle: %w", err)
+	default:
+		rules = current.Rules
+	}
+
+	rule := s3types.LifecycleRule{
+		ID:     aws.String(noncurrentVersionsRuleID),
+		Status: s3types.ExpirationStatusEnabled,
+		Filter: &s3types.LifecycleRuleFilterMemberPrefix{Value: ""},
+		NoncurrentVersionExpiration: &s3types.NoncurrentVersionExpiration{
+			NoncurrentDays: aws.Int32(cfg.noncurrentVersionDays()),
+		},
+		AbortIncompleteMultipartUpload: &s3types.AbortIncompleteMultipartUpload{
+			DaysAfterInitiation: aws.Int32(7),
+		},
+	}
+	merged := make([]s3types.LifecycleRule, 0, len(rules)+1)
+	for _, existing := range rules {
+		if existing.Prefix != nil {
+			// S3 rejects a configuration that mixes Prefix and Filter rules
+			return nil, fmt.Errorf("refusing to change the lifecycle rules of S3 bucket %s: rule %q uses the legacy Prefix element, which cannot be combined with tf-go's rule; move it to a Filter by hand", cfg.Bucket, aws.ToString(existing.ID))
+		}
+		if aws.ToString(existing.ID) != noncurrentVersionsRuleID {
+			merged = append(merged, existing)
+		}
+	}
+	return append(merged, rule), nil
+}
+
+// AuditS3Backend checks an existing bucket and lock table against the
+// hardening settings and returns every check that fails
+func AuditS3Backend(ctx context.Context, cfg S3BackendConfig) ([]BackendFinding, error) {
+	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(cfg.Region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	client := s3.NewFromConfig(awsCfg)
+	bucket := aws.String(cfg.Bucket)
+	resource := "s3://" + cfg.Bucket
+
+	var findings []BackendFinding
+	report := func(check, detail string) {
+		findings = append(findings, BackendFinding{Resource: resource, Check: check, Detail: detail})
+	}
+
+	if _, err := client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: bucket}); err != nil {
+		report("bucket exists", "bucket not found or not accessible")
+		return findings, nil
+	}
+
+	pab, err := client.GetPublicAccessBlock(ctx, &s3.GetPublicAccessBlockInput{Bucket: bucket})
+	switch {
+	case isAWSErrorCode(err, "NoSuchPublicAccessBlockConfiguration"):
+		report("public access block", "not configured")
+	case err != nil:
+		return nil, fmt.Errorf("failed to read public access block: %w", err)
+	default:
+		c := pab.PublicAccessBlockConfiguration
+		if c == nil || !aws.ToBool(c.BlockPublicAcls) || !aws.ToBool(c.BlockPublicPolicy) ||
+			!aws.ToBool(c.IgnorePublicAcls) || !aws.ToBool(c.RestrictPublicBuckets) {
+			report("public access block", "not all four settings are enabled")
+		}
+	}
+
+	policy, err := client.GetBucketPolicy(ctx, &s3.GetBucketPolicyInput{Bucket: bucket})
+	switch {
+	case isAWSErrorCode(err, "NoSuchBucketPolicy"):
+		report("TLS-only policy", "bucket has no policy")
+	case err != nil:
+		return nil, fmt.Errorf("failed to read bucket policy: %w", err)
+	case !policyDeniesInsecureTransport(aws.ToString(policy.Policy)):
+		report("TLS-only policy", "policy does not deny aws:SecureTransport=false")
+	}
+
+	versioning, err := client.GetBucketVersioning(ctx, &s3.GetBucketVersioningInput{Bucket: bucket})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bucket versioning: %w", err)
+	}
+	if versioning.Status != s3types.BucketVersioningStatusEnabled {
+		report("versioning", "versioning is not enabled")
+	}
+
+	encryption, err := client.GetBucketEncryption(ctx, &s3.GetBucketEncryptionInput{Bucket: bucket})
+	switch {
+	case isAWSErrorCode(err, "ServerSideEncryptionConfigurationNotFoundError"):
+		report("KMS encryption", "default encryption is not configured")
+	case err != nil:
+		return nil, fmt.Errorf("failed to read bucket encryption: %w", err)
+	default:
+		if detail := checkKMSEncryption(encryption.ServerSideEncryptionConfiguration, cfg.KMSKeyID); detail != "" {
+			report("KMS encryption", detail)
+		}
+	}
+
+	lifecycle, err := client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{Bucket: bucket})
+	switch {
+	case isAWSErrorCode(err, "NoSuchLifecycleConfiguration"):
+		report("noncurrent version lifecycle", "bucket has no lifecycle rules")
+	case err != nil:
+		return nil, fmt.Errorf("failed to read bucket lifecycle: %w", err)
+	default:
+		expires := false
+		for _, rule := range lifecycle.Rules {
+			if rule.Status == s3types.ExpirationStatusEnabled && rule.NoncurrentVersionExpiration != nil {
+				expires = true
+			}
+		}
+		if !expires {
+			report("noncurrent version lifecycle", "no enabled rule expires noncurrent versions")
+		}
+	}
+
+	if cfg.DynamoDBTable != "" {
+		table, err := dynamodb.NewFromConfig(awsCfg).DescribeTable(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(cfg.DynamoDBTable),
+		})
+		if err != nil {
+			findings = append(findings, BackendFinding{
+				Resource: "dynamodb://" + cfg.DynamoDBTable,
+				Check:    "lock table exists",
+				Detail:   "table not found or not accessible",
+			})
+		} else if !hasLockIDHashKey(table) {
+			findings = append(findings, BackendFinding{
+				Resource: "dynamodb://" + cfg.DynamoDBTable,
+				Check:    "lock table key schema",
+				Detail:   "hash key must be the string attribute LockID",
+			})
+		}
+	}
+
+	return findings, nil
+}
+
+// tlsOnlyBucketPolicy denies every request to the bucket made without TLS
+func tlsOnlyBucketPolicy(bucket, region string) string {
+	bucketARN := fmt.Sprintf("arn:%s:s3:::%s", awsPartition(region), bucket)
+	policy := map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []map[string]interface{}{
+			{
+				"Sid":       "DenyInsecureTransport",
+				"Effect":    "Deny",
+				"Principal": "*",
+				"Action":    "s3:*",
+				"Resource":  []string{bucketARN, bucketARN + "/*"},
+				"Condition": map[string]interface{}{
+					"Bool": map[string]string{"aws:SecureTransport": "false"},
+				},
+			},
+		},
+	}
+	data, _ := json.Marshal(policy)
+	return string(data)
+}
+
+// policyDeniesInsecureTransport reports whether a bucket policy contains a
+// Deny statement conditioned on aws:SecureTransport being false
+// A policy may hold one statement object instead of a list.
+func policyDeniesInsecureTransport(policy string) bool {
+	type statement struct {
+		Effect    string
+		Condition map[string]map[string]interface{}
+	}
+	var doc struct {
+		Statement json.RawMessage
+	}
+	if err := json.Unmarshal([]byte(policy), &doc); err != nil {
+		return false
+	}
+	var statements []statement
+	if err := json.Unmarshal(doc.Statement, &statements); err != nil {
+		var single statement
+		if err := json.Unmarshal(doc.Statement, &single); err != nil {
+			return false
+		}
+		statements = []statement{single}
+	}
+
+	for _, stmt := range statements {
+		if stmt.Effect != "Deny" {
+			continue
+		}
+		if value, ok := stmt.Condition["Bool"]["aws:SecureTransport"]; ok && fmt.Sprintf("%v", value) == "false" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkKMSEncryption returns a description of what is wrong with the bucket's
+// default encryption, or "" if it uses KMS with the expected key
+func checkKMSEncryption(sse *s3types.ServerSideEncryptionConfiguration, kmsKeyID string) string {
+	if sse == nil || len(sse.Rules) == 0 || sse.Rules[0].ApplyServerSideEncryptionByDefault == nil {
+		return "default encryption is not configured"
+	}
+
+	def := sse.Rules[0].ApplyServerSideEncryptionByDefault
+	if def.SSEAlgorithm != s3types.ServerSideEncryptionAwsKms && def.SSEAlgorithm != s3types.ServerSideEncryptionAwsKmsDsse {
+		return fmt.Sprintf("uses %s instead of aws:kms", def.SSEAlgorithm)
+	}
+	if kmsKeyID != "" && aws.ToString(def.KMSMasterKeyID) != kmsKeyID {
+		return fmt.Sprintf("uses key %q instead of %q", aws.ToString(def.KMSMasterKeyID), kmsKeyID)
+	}
+	return ""
+}
+
+func hasLockIDHashKey(table *dynamodb.DescribeTableOutput) bool {
+	if table.Table == nil {
+		return false
+	}
+	for _, key := range table.Table.KeySchema {
+		if key.KeyType == "HASH" {
+			return aws.ToString(key.AttributeName) == "LockID"
+		}
+	}
+	return false
+}
+
+// awsPartition returns the ARN partition for a region
+func awsPartition(region string) string {
+	switch {
+	case strings.HasPrefix(region, "us-gov-"):
+		return "aws-us-gov"
+	case strings.HasPrefix(region, "cn-"):
+		return "aws-cn"
+	default:
+		return "aws"
+	}
+}
+
+// isNotFound reports whether err says an S3 bucket or DynamoDB table does not
+// exist. HeadBucket answers a missing bucket with a bare 404, NotFound.
+func isNotFound(err error) bool {
+	var notFound *s3types.NotFound
+	var noSuchBucket *s3types.NoSuchBucket
+	var noSuchTable *dynamodbtypes.ResourceNotFoundException
+	return errors.As(err, &notFound) || errors.As(err, &noSuchBucket) || errors.As(err, &noSuchTable) ||
+		isAWSErrorCode(err, "NotFound") || isAWSErrorCode(err, "NoSuchBucket")
+}
+
+// isAWSErrorCode reports whether err is an AWS API error with the given code
+func isAWSErrorCode(err error, code string) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == code
+}
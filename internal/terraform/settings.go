@@ -0,0 +1,91 @@
+package terraform
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	tfgoconfig "github.com/kingoftowns/tf-go/internal/config"
+)
+
+// TfvarsEnv is what compiled tfvars draw on besides the tfvars files
+type TfvarsEnv struct {
+	// Naming expands the placeholders of <%= expansion('...') %> in tfvars
+	// files. Without it expansions are left as written.
+	Naming *Naming
+	// Settings are variables taken from the environment's settings, see
+	// SettingsVariables. tfvars files and -var flags override them.
+	Settings map[string]interface{}
+}
+
+// SettingsVariables returns the Terraform variables terraform.settings_variables
+// makes of an environment's settings: one map variable holding them all,
+// one variable per top-level setting, or both
+func SettingsVariables(cfg *tfgoconfig.Config, env string) (map[string]interface{}, error) {
+	options := cfg.Terraform.SettingsVariables
+	settings := cfg.Environments[env].Settings
+	variables := make(map[string]interface{})
+
+	if options.Map != "" {
+		if !hclIdentifierPattern.MatchString(options.Map) {
+			return nil, fmt.Errorf("terraform.settings_variables.map: %q is not a valid variable name", options.Map)
+		}
+		all := settings
+		if all == nil {
+			all = map[string]interface{}{}
+		}
+		variables[options.Map] = all
+	}
+
+	if options.PerKey {
+		keys := make([]string, 0, len(settings))
+		for key := range settings {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			name := options.Prefix + key
+			if !hclIdentifierPattern.MatchString(name) {
+				return nil, fmt.Errorf("setting %s cannot be passed to Terraform: %q is not a valid variable name", key, name)
+			}
+			if _, exists := variables[name]; exists {
+				return nil, fmt.Errorf("setting %s cannot be passed to Terraform: variable %s is already the settings map", key, name)
+			}
+			variables[name] = settings[key]
+		}
+	}
+	return variables, nil
+}
+
+// lookupSetting finds a setting by its dotted path, such as db.instance_class
+func lookupSetting(settings map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = settings
+	for _, key := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// formatSetting formats a setting for use inside a string. Maps and lists
+// are written as JSON.
+func formatSetting(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case map[string]interface{}, []interface{}:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(data)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,127 @@
+package terraform
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	tfgoconfig "github.com/kingoftowns/tf-go/internal/config"
+	"github.com/kingoftowns/tf-go/internal/testutil"
+)
+
+func settingsConfig(options tfgoconfig.SettingsVariablesConfig) *tfgoconfig.Config {
+	return &tfgoconfig.Config{
+		Terraform: tfgoconfig.TerraformConfig{SettingsVariables: options},
+		Environments: map[string]tfgoconfig.EnvironmentConfig{
+			"dev": {Settings: map[string]interface{}{
+				"replicas":      2,
+				"state_suffix":  "blue",
+				"db":            map[string]interface{}{"instance_class": "db.t3.small", "multi_az": false},
+				"allowed_cidrs": []interface{}{"10.0.0.0/8"},
+			}},
+		},
+	}
+}
+
+func TestSettingsVariables(t *testing.T) {
+	variables, err := SettingsVariables(settingsConfig(tfgoconfig.SettingsVariablesConfig{}), "dev")
+	if err != nil || len(variables) != 0 {
+		t.Errorf("nothing should be passed by default, got %v, %v", variables, err)
+	}
+
+	variables, err = SettingsVariables(settingsConfig(tfgoconfig.SettingsVariablesConfig{Map: "tfgo_settings", PerKey: true, Prefix: "env_"}), "dev")
+	if err != nil {
+		t.Fatalf("SettingsVariables returned error: %v", err)
+	}
+	if settings, ok := variables["tfgo_settings"].(map[string]interface{}); !ok || len(settings) != 4 {
+		t.Errorf("tfgo_settings = %v", variables["tfgo_settings"])
+	}
+	if variables["env_replicas"] != 2 || variables["env_state_suffix"] != "blue" || len(variables) != 5 {
+		t.Errorf("unexpected per-key variables: %v", variables)
+	}
+
+	if variables, err = SettingsVariables(settingsConfig(tfgoconfig.SettingsVariablesConfig{Map: "tfgo_settings"}), "prod"); err != nil || len(variables["tfgo_settings"].(map[string]interface{})) != 0 {
+		t.Errorf("an environment without settings should pass an empty map, got %v, %v", variables, err)
+	}
+
+	_, err = SettingsVariables(settingsConfig(tfgoconfig.SettingsVariablesConfig{Map: "env_replicas", PerKey: true, Prefix: "env_"}), "dev")
+	if err == nil || err.Error() != "setting replicas cannot be passed to Terraform: variable env_replicas is already the settings map" {
+		t.Errorf("unexpected error for a clashing name: %v", err)
+	}
+	_, err = SettingsVariables(settingsConfig(tfgoconfig.SettingsVariablesConfig{Map: "tfgo settings"}), "dev")
+	if err == nil || !strings.Contains(err.Error(), `"tfgo settings" is not a valid variable name`) {
+		t.Errorf("unexpected error for an invalid name: %v", err)
+	}
+}
+
+func TestNamingExpandsSettings(t *testing.T) {
+	naming := NewNaming(settingsConfig(tfgoconfig.SettingsVariablesConfig{}), "dev", "web")
+
+	for template, want := range map[string]string{
+		":ENV/:STACK/:SETTING.state_suffix.tfstate": "dev/web/blue.tfstate",
+		"db-:SETTING.db.instance_class":             "db-db.t3.small",
+		":SETTING.replicas":                         "2",
+		":SETTING.allowed_cidrs":                    `["10.0.0.0/8"]`,
+	} {
+		got, err := naming.Expand(context.Background(), template)
+		if err != nil || got != want {
+			t.Errorf("Expand(%q) = %q, %v; want %q", template, got, err, want)
+		}
+	}
+
+	_, err := naming.Expand(context.Background(), "state-:SETTING.color")
+	if err == nil || !strings.Contains(err.Error(), `cannot resolve :SETTING.color: environment "dev" has no setting color`) {
+		t.Errorf("unexpected error for a missing setting: %v", err)
+	}
+
+	resolver := NewDynamicResolver(DefaultDynamicRegistry(), DynamicEnv{Naming: naming})
+	if got, err := resolver.Resolve(context.Background(), "${DYNAMIC:SETTING(db.multi_az)}", "aws.test"); err != nil || got != "false" {
+		t.Errorf("SETTING(db.multi_az) = %q, %v", got, err)
+	}
+}
+
+func TestCompileTfvarsWithSettings(t *testing.T) {
+	dir := t.TempDir()
+	testutil.WriteFiles(t, dir, map[string]string{
+		"app/stacks/web/variables.tf": "variable \"replicas\" {\n  default = 1\n}\n",
+		"dev.tfvars":                  "replicas = 3\nname = \"web-<%= expansion(':ENV') %>-<%= expansion(':SETTING.state_suffix') %>\"\n",
+	})
+	srcDir := filepath.Join(dir, "app", "stacks", "web")
+	output := filepath.Join(dir, "compiled.tfvars")
+
+	cfg := settingsConfig(tfgoconfig.SettingsVariablesConfig{Map: "tfgo_settings", PerKey: true})
+	settings, err := SettingsVariables(cfg, "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := TfvarsEnv{Naming: NewNaming(cfg, "dev", "web"), Settings: settings}
+	if err := CompileWithVariablesTfFromSourceAndCLI(context.Background(), []string{filepath.Join(dir, "dev.tfvars")}, []string{"state_suffix=green"}, srcDir, dir, output, env); err != nil {
+		t.Fatalf("compile returned error: %v", err)
+	}
+
+	content, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`name = "web-dev-blue"`,
+		// tfvars files and -var flags override settings
+		"replicas = 3",
+		`state_suffix = "green"`,
+		`allowed_cidrs = ["10.0.0.0/8"]`,
+		`db = {` + "\n" + `  instance_class = "db.t3.small"` + "\n  multi_az = false\n}",
+		`  db = { instance_class = "db.t3.small", multi_az = false }`,
+	} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("compiled tfvars is missing %q:\n%s", want, content)
+		}
+	}
+
+	testutil.WriteFiles(t, dir, map[string]string{"dev.tfvars": "name = \"<%= expansion(':SETTING.color') %>\"\n"})
+	err = CompileWithVariablesTfFromSourceAndCLI(context.Background(), []string{filepath.Join(dir, "dev.tfvars")}, nil, srcDir, dir, output, env)
+	if err == nil || !strings.Contains(err.Error(), "line 1: resolving \":SETTING.color\"") {
+		t.Errorf("unexpected error for a missing setting: %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+package terraform
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// StackConfig is what the root module in a working directory already
+// declares, found by parsing its .tf files rather than scanning lines, so
+// comments, heredocs and nested blocks are not mistaken for declarations.
+// Files in subdirectories, such as local modules, are not part of it.
+type StackConfig struct {
+	// Providers is keyed by provider address, e.g. "aws" or "aws.west"
+	Providers map[string]*StackBlock
+	// Backends holds every backend block inside a terraform block
+	Backends []*StackBlock
+	// Cloud is set when the stack uses an HCP Terraform cloud block
+	Cloud *StackBlock
+	// RequiredProviders maps local provider names to their source address
+	RequiredProviders map[string]string
+}
+
+// StackBlock is one provider or backend block and the attributes in it that
+// are literal values
+type StackBlock struct {
+	Type     string
+	Alias    string
+	Range    hcl.Range
+	Literals map[string]cty.Value
+}
+
+// Location returns file:line of the block
+func (b *StackBlock) Location() string {
+	return fmt.Sprintf("%s:%d", filepath.Base(b.Range.Filename), b.Range.Start.Line)
+}
+
+// ParseStackConfig parses the .tf files at the top level of dir
+func ParseStackConfig(dir string) (*StackConfig, error) {
+	tfFiles, err := filepath.Glob(filepath.Join(dir, "*.tf"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(tfFiles)
+
+	stack := &StackConfig{
+		Providers:         make(map[string]*StackBlock),
+		RequiredProviders: make(map[string]string),
+	}
+	parser := hclparse.NewParser()
+	for _, tfFile := range tfFiles {
+		content, err := os.ReadFile(tfFile)
+		if err != nil {
+			return nil, err
+		}
+		file, diags := parser.ParseHCL(content, tfFile)
+		if diags.HasErrors() {
+			return nil, fmt.Errorf("failed to parse %s: %s", filepath.Base(tfFile), diags.Error())
+		}
+		body, ok := file.Body.(*hclsyntax.Body)
+		if !ok {
+			continue
+		}
+		if err := stack.add(body); err != nil {
+			return nil, err
+		}
+	}
+	return stack, nil
+}
+
+func (s *StackConfig) add(body *hclsyntax.Body) error {
+	for _, block := range body.Blocks {
+		switch block.Type {
+		case "provider":
+			if len(block.Labels) != 1 {
+				continue
+			}
+			provider := newStackBlock(block.Labels[0], block)
+			if alias, ok := provider.Literals["alias"]; ok && alias.Type() == cty.String {
+				provider.Alias = alias.AsString()
+			}
+			address := providerAddress(provider.Type, provider.Alias)
+			if existing, ok := s.Providers[address]; ok {
+				return fmt.Errorf("provider %s is declared twice, at %s and %s", address, existing.Location(), provider.Location())
+			}
+			s.Providers[address] = provider
+
+		case "terraform":
+			for _, nested := range block.Body.Blocks {
+				switch nested.Type {
+				case "backend":
+					if len(nested.Labels) == 1 {
+						s.Backends = append(s.Backends, newStackBlock(nested.Labels[0], nested))
+					}
+				case "cloud":
+					s.Cloud = newStackBlock("cloud", nested)
+				case "required_providers":
+					s.addRequiredProviders(nested)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// addRequiredProviders records the source of each required provider. The
+// legacy form that gives only a version string has no source.
+func (s *StackConfig) addRequiredProviders(block *hclsyntax.Block) {
+	for name, attr := range block.Body.Attributes {
+		value, diags := attr.Expr.Value(nil)
+		source := ""
+		if !diags.HasErrors() && value.Type().IsObjectType() && value.Type().HasAttribute("source") {
+			if v := value.GetAttr("source"); v.Type() == cty.String && v.IsKnown() && !v.IsNull() {
+				source = v.AsString()
+			}
+		}
+		s.RequiredProviders[name] = source
+	}
+}
+
+// newStackBlock keeps the attributes of block whose values can be evaluated
+// without variables, i.e. literals
+func newStackBlock(blockType string, block *hclsyntax.Block) *StackBlock {
+	stackBlock := &StackBlock{
+		Type:     blockType,
+		Range:    block.DefRange(),
+		Literals: make(map[string]cty.Value),
+	}
+	for name, attr := range block.Body.Attributes {
+		if len(attr.Expr.Variables()) > 0 {
+			continue
+		}
+		if value, diags := attr.Expr.Value(nil); !diags.HasErrors() && value.IsWhollyKnown() {
+			stackBlock.Literals[name] = value
+		}
+	}
+	return stackBlock
+}
+
+// BackendType returns the type of the stack's backend block, or "" when it has
+// none. A stack with several backend blocks, or a cloud block, is an error
+// because tf-go could not configure its state.
+func (s *StackConfig) BackendType() (string, error) {
+	if s.Cloud != nil {
+		return "", fmt.Errorf("stack uses a cloud block at %s; tf-go manages state through backends only", s.Cloud.Location())
+	}
+	switch len(s.Backends) {
+	case 0:
+		return "", nil
+	case 1:
+		return s.Backends[0].Type, nil
+	default:
+		var locations []string
+		for _, backend := range s.Backends {
+			locations = append(locations, backend.Location())
+		}
+		return "", fmt.Errorf("stack declares more than one backend block (%s)", strings.Join(locations, ", "))
+	}
+}
+
+// ConflictingSettings compares the literal attributes of a stack block with
+// the settings tf-go would use and describes each one that differs
+func (b *StackBlock) ConflictingSettings(settings map[string]interface{}) []string {
+	var conflicts []string
+	for name, literal := range b.Literals {
+		want, ok := settings[name]
+		if !ok || name == "alias" {
+			continue
+		}
+		if got, ok := ctyPrimitive(literal); ok && got != fmt.Sprintf("%v", want) {
+			conflicts = append(conflicts, fmt.Sprintf("%s = %q at %s, tf-go has %q", name, got, b.Location(), fmt.Sprintf("%v", want)))
+		}
+	}
+	sort.Strings(conflicts)
+	return conflicts
+}
+
+// ctyPrimitive formats a string, number or bool value the way fmt would
+// format the same setting read from YAML or JSON
+func ctyPrimitive(value cty.Value) (string, bool) {
+	if value.IsNull() {
+		return "", false
+	}
+	switch value.Type() {
+	case cty.String:
+		return value.AsString(), true
+	case cty.Bool:
+		return fmt.Sprintf("%v", value.True()), true
+	case cty.Number:
+		f, _ := value.AsBigFloat().Float64()
+		return fmt.Sprintf("%v", f), true
+	}
+	return "", false
+}
+
+// hashicorpProviders are provider names Terraform resolves to hashicorp/<name>
+// without a required_providers entry
+var hashicorpProviders = map[string]bool{
+	"archive": true, "aws": true, "azurerm": true, "cloudinit": true, "dns": true,
+	"external": true, "google": true, "google-beta": true, "helm": true, "http": true,
+	"kubernetes": true, "local": true, "null": true, "random": true, "time": true,
+	"tls": true, "vault": true,
+}
+
+// MissingRequiredProvider reports whether Terraform would have to guess the
+// source of a provider: it is not in required_providers and is not one of the
+// hashicorp/ providers that resolve by name
+func (s *StackConfig) MissingRequiredProvider(providerType string) bool {
+	if _, ok := s.RequiredProviders[providerType]; ok {
+		return false
+	}
+	return !hashicorpProviders[providerType]
+}
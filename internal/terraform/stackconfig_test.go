@@ -0,0 +1,107 @@
+package terraform
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kingoftowns/tf-go/internal/testutil"
+)
+
+func TestParseStackConfig(t *testing.T) {
+	dir := t.TempDir()
+	testutil.WriteFiles(t, dir, map[string]string{
+		"main.tf": `# provider "google" {
+#   project = "commented-out"
+# }
+
+provider "aws" {
+  region = "us-west-2"
+}
+
+provider "aws" {
+  alias  = "west"
+  region = var.west_region
+  assume_role {
+    role_arn = "arn:aws:iam::111122223333:role/deploy"
+  }
+}
+
+locals {
+  readme = <<EOT
+provider "helm" {
+}
+EOT
+}
+`,
+		"terraform.tf": `terraform {
+  required_providers {
+    datadog = {
+      source  = "DataDog/datadog"
+      version = "~> 3.0"
+    }
+    aws = "~> 5.0"
+  }
+  backend "s3" {
+    bucket = "hardcoded"
+  }
+}
+`,
+		"modules/network/providers.tf": `provider "kubernetes" {}
+`,
+	})
+
+	stack, err := ParseStackConfig(dir)
+	if err != nil {
+		t.Fatalf("ParseStackConfig failed: %v", err)
+	}
+
+	var addresses []string
+	for address := range stack.Providers {
+		addresses = append(addresses, address)
+	}
+	if len(addresses) != 2 || stack.Providers["aws"] == nil || stack.Providers["aws.west"] == nil {
+		t.Errorf("providers = %v, want aws and aws.west only", addresses)
+	}
+	if _, ok := stack.Providers["aws.west"].Literals["region"]; ok {
+		t.Error("region from a variable should not be a literal")
+	}
+	if got := stack.Providers["aws"].Location(); got != "main.tf:5" {
+		t.Errorf("aws location = %s, want main.tf:5", got)
+	}
+
+	if backendType, err := stack.BackendType(); err != nil || backendType != "s3" {
+		t.Errorf("BackendType() = %q, %v", backendType, err)
+	}
+	if stack.RequiredProviders["datadog"] != "DataDog/datadog" {
+		t.Errorf("required_providers = %v", stack.RequiredProviders)
+	}
+	if stack.MissingRequiredProvider("datadog") || stack.MissingRequiredProvider("aws") || !stack.MissingRequiredProvider("grafana") {
+		t.Error("MissingRequiredProvider gave the wrong answer")
+	}
+
+	conflicts := stack.Providers["aws"].ConflictingSettings(map[string]interface{}{"region": "us-east-1", "profile": "dev"})
+	if len(conflicts) != 1 || !strings.Contains(conflicts[0], `region = "us-west-2" at main.tf:5, tf-go has "us-east-1"`) {
+		t.Errorf("conflicts = %v", conflicts)
+	}
+}
+
+func TestParseStackConfigErrors(t *testing.T) {
+	for name, files := range map[string]map[string]string{
+		"syntax error": {"main.tf": "provider \"aws\" {\n"},
+		"duplicate":    {"a.tf": "provider \"aws\" {}\n", "b.tf": "provider \"aws\" {}\n"},
+		"two backends": {"a.tf": "terraform {\n  backend \"s3\" {}\n}\n", "b.tf": "terraform {\n  backend \"local\" {}\n}\n"},
+		"cloud block":  {"main.tf": "terraform {\n  cloud {\n    organization = \"acme\"\n  }\n}\n"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			testutil.WriteFiles(t, dir, files)
+			stack, err := ParseStackConfig(dir)
+			if err == nil {
+				_, err = stack.BackendType()
+			}
+			if err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
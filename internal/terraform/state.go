@@ -0,0 +1,271 @@
+package terraform
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+)
+
+// RawState is the subset of the raw terraform.tfstate format (version 4) that
+// tf-go inspects
+type RawState struct {
+	Version          int                `json:"version"`
+	TerraformVersion string             `json:"terraform_version"`
+	Serial           int64              `json:"serial"`
+	Lineage          string             `json:"lineage"`
+	Resources        []RawStateResource `json:"resources"`
+}
+
+// RawStateResource is one resource block in a raw state file
+type RawStateResource struct {
+	Module    string             `json:"module,omitempty"`
+	Mode      string             `json:"mode"`
+	Type      string             `json:"type"`
+	Name      string             `json:"name"`
+	Instances []RawStateInstance `json:"instances"`
+}
+
+// RawStateInstance is one instance of a resource, keyed by count or for_each
+type RawStateInstance struct {
+	IndexKey   interface{}     `json:"index_key,omitempty"`
+	Attributes json.RawMessage `json:"attributes,omitempty"`
+	// SensitiveAttributes lists the paths of sensitive attribute values, each
+	// a list of get_attr and index steps
+	SensitiveAttributes [][]RawStatePathStep `json:"sensitive_attributes,omitempty"`
+}
+
+// RawStatePathStep is one step of an attribute path: a get_attr with the
+// attribute name, or an index with a list index or map key
+type RawStatePathStep struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// SensitiveValue replaces sensitive attribute values, as in terraform state show
+const SensitiveValue = "(sensitive value)"
+
+// ParseState decodes a raw state file as returned by terraform state pull
+func ParseState(data []byte) (*RawState, error) {
+	var state RawState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse state: %w", err)
+	}
+	return &state, nil
+}
+
+// Addresses returns the address of every resource instance in the state, sorted
+func (s *RawState) Addresses() []string {
+	var addresses []string
+	for _, resource := range s.Resources {
+		for _, instance := range resource.Instances {
+			addresses = append(addresses, resource.address(instance))
+		}
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// Instance returns the attributes of the resource instance at address
+func (s *RawState) Instance(address string) (json.RawMessage, bool) {
+	for _, resource := range s.Resources {
+		for _, instance := range resource.Instances {
+			if resource.address(instance) == address {
+				return instance.Attributes, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// MaskedInstance returns the attributes of the resource instance at address
+// with every value under its sensitive_attributes replaced by SensitiveValue
+func (s *RawState) MaskedInstance(address string) (json.RawMessage, bool, error) {
+	for _, resource := range s.Resources {
+		for _, instance := range resource.Instances {
+			if resource.address(instance) == address {
+				masked, err := instance.maskedAttributes()
+				return masked, true, err
+			}
+		}
+	}
+	return nil, false, nil
+}
+
+func (i RawStateInstance) maskedAttributes() (json.RawMessage, error) {
+	if len(i.SensitiveAttributes) == 0 {
+		return i.Attributes, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(i.Attributes))
+	decoder.UseNumber()
+	var attributes interface{}
+	if err := decoder.Decode(&attributes); err != nil {
+		return nil, fmt.Errorf("failed to parse attributes: %w", err)
+	}
+	for _, path := range i.SensitiveAttributes {
+		attributes = maskPath(attributes, path)
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(attributes); err != nil {
+		return nil, err
+	}
+	return json.RawMessage(bytes.TrimSpace(buf.Bytes())), nil
+}
+
+// maskPath replaces the value at path inside value. A path that does not
+// exist leaves value as it is.
+func maskPath(value interface{}, path []RawStatePathStep) interface{} {
+	if len(path) == 0 {
+		return SensitiveValue
+	}
+	step := path[0]
+	// Index values are written as {"value": ..., "type": ...}
+	var key interface{}
+	var typed struct {
+		Value interface{} `json:"value"`
+	}
+	if err := json.Unmarshal(step.Value, &typed); err == nil && typed.Value != nil {
+		key = typed.Value
+	} else {
+		json.Unmarshal(step.Value, &key)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if name, ok := key.(string); ok {
+			if child, exists := v[name]; exists {
+				v[name] = maskPath(child, path[1:])
+			}
+		}
+	case []interface{}:
+		if index, ok := key.(float64); ok && index >= 0 && int(index) < len(v) {
+			v[int(index)] = maskPath(v[int(index)], path[1:])
+		}
+	}
+	return value
+}
+
+func (r RawStateResource) address(instance RawStateInstance) string {
+	var parts []string
+	if r.Module != "" {
+		parts = append(parts, r.Module)
+	}
+	if r.Mode == "data" {
+		parts = append(parts, "data")
+	}
+	parts = append(parts, r.Type, r.Name)
+	address := strings.Join(parts, ".")
+
+	switch key := instance.IndexKey.(type) {
+	case nil:
+	case string:
+		address += fmt.Sprintf("[%q]", key)
+	case float64:
+		address += fmt.Sprintf("[%d]", int64(key))
+	default:
+		address += fmt.Sprintf("[%v]", key)
+	}
+	return address
+}
+
+// PrepareRestore returns backup rewritten so it can be pushed over current:
+// the lineage must match and the serial is moved past the current one, so
+// Terraform accepts the push without -force
+func PrepareRestore(backup, current []byte) ([]byte, error) {
+	var backupState map[string]interface{}
+	if err := json.Unmarshal(backup, &backupState); err != nil {
+		return nil, fmt.Errorf("failed to parse backup state: %w", err)
+	}
+
+	if len(strings.TrimSpace(string(current))) > 0 {
+		currentState, err := ParseState(current)
+		if err != nil {
+			return nil, err
+		}
+		if lineage, _ := backupState["lineage"].(string); lineage != currentState.Lineage {
+			return nil, fmt.Errorf("backup lineage %q does not match current state lineage %q", lineage, currentState.Lineage)
+		}
+		backupState["serial"] = currentState.Serial + 1
+	}
+
+	return json.MarshalIndent(backupState, "", "  ")
+}
+
+// StatePull returns the raw state of the initialized workspace, or nil when no
+// state has been written yet
+func (e *Executor) StatePull(ctx context.Context) ([]byte, error) {
+	if e.tf == nil {
+		return nil, fmt.Errorf("terraform executor not set up")
+	}
+
+	state, err := e.tf.StatePull(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(state) == "" {
+		return nil, nil
+	}
+	return []byte(state), nil
+}
+
+// BackupState pulls the current state into a timestamped file under dir and
+// returns its path. Nothing is written when there is no state yet.
+func (e *Executor) BackupState(ctx context.Context, dir string) (string, error) {
+	data, err := e.StatePull(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to pull state for backup: %w", err)
+	}
+	if data == nil {
+		return "", nil
+	}
+
+	state, err := ParseState(data)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	name := fmt.Sprintf("%s-serial-%d.tfstate", time.Now().UTC().Format("20060102T150405.000Z"), state.Serial)
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return "", fmt.Errorf("failed to write state backup: %w", err)
+	}
+	return path, nil
+}
+
+// StatePush uploads a local state file to the backend
+func (e *Executor) StatePush(ctx context.Context, path string, force bool) error {
+	if e.tf == nil {
+		return fmt.Errorf("terraform executor not set up")
+	}
+	return e.tf.StatePush(ctx, path, tfexec.Force(force))
+}
+
+// StateMv moves a resource address within the state
+func (e *Executor) StateMv(ctx context.Context, source, destination string, dryRun bool) error {
+	if e.tf == nil {
+		return fmt.Errorf("terraform executor not set up")
+	}
+	return e.tf.StateMv(ctx, source, destination, tfexec.DryRun(dryRun))
+}
+
+// StateRm removes a resource address from the state
+func (e *Executor) StateRm(ctx context.Context, address string, dryRun bool) error {
+	if e.tf == nil {
+		return fmt.Errorf("terraform executor not set up")
+	}
+	return e.tf.StateRm(ctx, address, tfexec.DryRun(dryRun))
+}
@@ -0,0 +1,106 @@
+package terraform
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testRawState = `{
+  "version": 4,
+  "serial": 7,
+  "lineage": "abc",
+  "resources": [
+    {"mode": "managed", "type": "aws_s3_bucket", "name": "logs", "instances": [{"attributes": {"id": "logs"}}]},
+    {"module": "module.vpc", "mode": "managed", "type": "aws_subnet", "name": "private", "instances": [
+      {"index_key": 0, "attributes": {"id": "subnet-0"}},
+      {"index_key": 1, "attributes": {"id": "subnet-1"}}
+    ]},
+    {"mode": "data", "type": "aws_caller_identity", "name": "current", "instances": [{"attributes": {}}]},
+    {"mode": "managed", "type": "aws_iam_role", "name": "app", "instances": [{"index_key": "web", "attributes": {"name": "web"}}]}
+  ]
+}`
+
+func TestParseStateAddresses(t *testing.T) {
+	state, err := ParseState([]byte(testRawState))
+	if err != nil {
+		t.Fatalf("ParseState returned error: %v", err)
+	}
+
+	want := []string{
+		`aws_iam_role.app["web"]`,
+		"aws_s3_bucket.logs",
+		"data.aws_caller_identity.current",
+		"module.vpc.aws_subnet.private[0]",
+		"module.vpc.aws_subnet.private[1]",
+	}
+	if got := state.Addresses(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Addresses() = %v, want %v", got, want)
+	}
+
+	attributes, ok := state.Instance("module.vpc.aws_subnet.private[1]")
+	if !ok || !strings.Contains(string(attributes), "subnet-1") {
+		t.Errorf("Instance() = %s, %v", attributes, ok)
+	}
+}
+
+func TestMaskedInstance(t *testing.T) {
+	state, err := ParseState([]byte(`{"version": 4, "resources": [
+  {"mode": "managed", "type": "aws_db_instance", "name": "main", "instances": [{
+    "attributes": {"id": "db-1", "password": "hunter2", "tags": {"owner": "ops", "token": "t0k"}, "users": [{"name": "app", "secret": "s3"}], "url": "a<b"},
+    "sensitive_attributes": [
+      [{"type": "get_attr", "value": "password"}],
+      [{"type": "get_attr", "value": "tags"}, {"type": "index", "value": {"value": "token", "type": "string"}}],
+      [{"type": "get_attr", "value": "users"}, {"type": "index", "value": {"value": 0, "type": "number"}}, {"type": "get_attr", "value": "secret"}],
+      [{"type": "get_attr", "value": "missing"}]
+    ]
+  }]}
+]}`))
+	if err != nil {
+		t.Fatalf("ParseState returned error: %v", err)
+	}
+
+	attributes, ok, err := state.MaskedInstance("aws_db_instance.main")
+	if err != nil || !ok {
+		t.Fatalf("MaskedInstance() = %v, %v", ok, err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(attributes, &got); err != nil {
+		t.Fatalf("invalid attributes %s: %v", attributes, err)
+	}
+	want := map[string]interface{}{
+		"id":       "db-1",
+		"password": SensitiveValue,
+		"tags":     map[string]interface{}{"owner": "ops", "token": SensitiveValue},
+		"users":    []interface{}{map[string]interface{}{"name": "app", "secret": SensitiveValue}},
+		"url":      "a<b",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MaskedInstance() = %s", attributes)
+	}
+	if strings.Contains(string(attributes), `\u003c`) {
+		t.Errorf("attributes should not be HTML escaped: %s", attributes)
+	}
+}
+
+func TestPrepareRestore(t *testing.T) {
+	backup := `{"version": 4, "serial": 3, "lineage": "abc", "resources": []}`
+
+	restored, err := PrepareRestore([]byte(backup), []byte(testRawState))
+	if err != nil {
+		t.Fatalf("PrepareRestore returned error: %v", err)
+	}
+	var state RawState
+	if err := json.Unmarshal(restored, &state); err != nil {
+		t.Fatalf("restored state is not valid JSON: %v", err)
+	}
+	if state.Serial != 8 || state.Lineage != "abc" {
+		t.Errorf("restored serial/lineage = %d/%s, want 8/abc", state.Serial, state.Lineage)
+	}
+
+	other := `{"version": 4, "serial": 3, "lineage": "other"}`
+	if _, err := PrepareRestore([]byte(other), []byte(testRawState)); err == nil || !strings.Contains(err.Error(), "lineage") {
+		t.Errorf("expected lineage mismatch error, got %v", err)
+	}
+}
@@ -2,14 +2,18 @@ package terraform
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	
-	"github.com/kingoftowns/tf-go/internal/constants"
+	"github.com/kingoftowns/tf-go/internal/redact"
 )
 
 // TerraformVariable represents a parsed Terraform variable
@@ -17,11 +21,17 @@ type TerraformVariable struct {
 	Name  string
 	Value interface{}
 	Type  string
+	// Source says where the value came from: the tfvars or variables.tf
+	// files that set it, environment settings or -var
+	Source string
 }
 
 // VariableCompiler handles merging multiple tfvars files
 type VariableCompiler struct {
 	variables map[string]TerraformVariable
+	// expand resolves the placeholders of <%= expansion('...') %>. Without
+	// it expansions are left as written.
+	expand func(string) (string, error)
 }
 
 // NewVariableCompiler creates a new variable compiler
@@ -33,14 +43,14 @@ func NewVariableCompiler() *VariableCompiler {
 
 // CompileVariables merges multiple tfvars files in order (later files override earlier ones)
 func (vc *VariableCompiler) CompileVariables(tfvarsFiles []string) (string, error) {
-	fmt.Printf("[DEBUG] Compiling variables from %d files\n", len(tfvarsFiles))
+	redact.Printf("[DEBUG] Compiling variables from %d files\n", len(tfvarsFiles))
 
 	// Process each tfvars file in order
 	for i, tfvarsFile := range tfvarsFiles {
-		fmt.Printf("[DEBUG] Processing tfvars file [%d]: %s\n", i+1, tfvarsFile)
+		redact.Printf("[DEBUG] Processing tfvars file [%d]: %s\n", i+1, tfvarsFile)
 
 		if _, err := os.Stat(tfvarsFile); os.IsNotExist(err) {
-			fmt.Printf("[WARNING] Tfvars file not found: %s\n", tfvarsFile)
+			redact.Printf("[WARNING] Tfvars file not found: %s\n", tfvarsFile)
 			continue
 		}
 
@@ -51,6 +61,7 @@ func (vc *VariableCompiler) CompileVariables(tfvarsFiles []string) (string, erro
 
 		// Merge variables (later files override earlier ones)
 		for name, variable := range variables {
+			variable.Source = tfvarsFile
 			if existingVar, exists := vc.variables[name]; exists {
 				// If both are maps, merge them instead of replacing
 				if existingMap, ok := existingVar.Value.(map[string]interface{}); ok {
@@ -64,20 +75,21 @@ func (vc *VariableCompiler) CompileVariables(tfvarsFiles []string) (string, erro
 						// Override with new values
 						for k, v := range newMap {
 							mergedMap[k] = v
-							fmt.Printf("[DEBUG] Merged map field '%s.%s': %v\n", name, k, v)
+							redact.Printf("[DEBUG] Merged map field '%s.%s': %v\n", name, k, v)
 						}
 						vc.variables[name] = TerraformVariable{
-							Name:  name,
-							Value: mergedMap,
-							Type:  "map",
+							Name:   name,
+							Value:  mergedMap,
+							Type:   "map",
+							Source: joinSources(existingVar.Source, tfvarsFile),
 						}
-						fmt.Printf("[DEBUG] Merged variable '%s' maps\n", name)
+						redact.Printf("[DEBUG] Merged variable '%s' maps from %s\n", name, tfvarsFile)
 						continue
 					}
 				}
-				fmt.Printf("[DEBUG] Overriding variable '%s': %v -> %v\n", name, existingVar.Value, variable.Value)
+				redact.Printf("[DEBUG] Overriding variable '%s' from %s: %v -> %v (was from %s)\n", name, tfvarsFile, existingVar.Value, variable.Value, existingVar.Source)
 			} else {
-				fmt.Printf("[DEBUG] Adding variable '%s': %v\n", name, variable.Value)
+				redact.Printf("[DEBUG] Adding variable '%s' from %s: %v\n", name, tfvarsFile, variable.Value)
 			}
 			vc.variables[name] = variable
 		}
@@ -87,8 +99,12 @@ func (vc *VariableCompiler) CompileVariables(tfvarsFiles []string) (string, erro
 	return vc.generateCompiledTfvars(), nil
 }
 
-// parseTfvarsFile parses a single .tfvars file
+// parseTfvarsFile parses a single .tfvars or .tfvars.json file
 func (vc *VariableCompiler) parseTfvarsFile(filename string) (map[string]TerraformVariable, error) {
+	if strings.HasSuffix(filename, ".json") {
+		return parseTfvarsJSON(filename)
+	}
+
 	file, err := os.Open(filename)
 	if err != nil {
 		return nil, err
@@ -107,6 +123,7 @@ func (vc *VariableCompiler) parseTfvarsFile(filename string) (map[string]Terrafo
 	mapStartPattern := regexp.MustCompile(`^(\w+)\s*=\s*\{`)
 	// ERB template pattern (Terraspace syntax)
 	erbPattern := regexp.MustCompile(`<%=\s*expansion\(['"]([^'"]+)['"]\)\s*%>`)
+	var expandErr error
 
 	var currentListVar string
 	var currentMapVar string
@@ -167,13 +184,16 @@ func (vc *VariableCompiler) parseTfvarsFile(filename string) (map[string]Terrafo
 		if matches := stringVarPattern.FindStringSubmatch(line); matches != nil {
 			value := matches[2]
 			// Handle ERB template expansion
-			if erbMatches := erbPattern.FindStringSubmatch(value); erbMatches != nil {
-				// Replace ERB expansion with the actual value
-				switch erbMatches[1] {
-				case ":ENV":
-					value = constants.DefaultEnvironment // Default for this case, could be made configurable
-				default:
-					// Keep original if we don't know how to expand it
+			if vc.expand != nil {
+				value = erbPattern.ReplaceAllStringFunc(value, func(erb string) string {
+					expanded, err := vc.expand(erbPattern.FindStringSubmatch(erb)[1])
+					if err != nil && expandErr == nil {
+						expandErr = fmt.Errorf("line %d: %w", lineNumber, err)
+					}
+					return expanded
+				})
+				if expandErr != nil {
+					return nil, expandErr
 				}
 			}
 			variables[matches[1]] = TerraformVariable{
@@ -237,6 +257,83 @@ func (vc *VariableCompiler) parseTfvarsFile(filename string) (map[string]Terrafo
 	return variables, nil
 }
 
+// parseTfvarsJSON parses a .tfvars.json file, which holds one JSON object
+// of variable values
+func parseTfvarsJSON(filename string) (map[string]TerraformVariable, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var values map[string]interface{}
+	if err := decoder.Decode(&values); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	variables := make(map[string]TerraformVariable, len(values))
+	for name, value := range values {
+		value = tfvarsJSONValue(value)
+		variables[name] = TerraformVariable{
+			Name:  name,
+			Value: value,
+			Type:  variableType(value),
+		}
+	}
+	return variables, nil
+}
+
+// tfvarsJSONValue converts a decoded JSON value to the form parseTfvarsFile
+// produces. Numbers become float64. Strings that formatVariable writes
+// between quotes as they are, the value itself or one directly inside a
+// map, are escaped; deeper strings are quoted by hclExpression.
+func tfvarsJSONValue(value interface{}) interface{} {
+	value = jsonNumbers(value)
+	switch v := value.(type) {
+	case string:
+		return hclStringContent(v)
+	case map[string]interface{}:
+		for key, item := range v {
+			if s, ok := item.(string); ok {
+				v[key] = hclStringContent(s)
+			}
+		}
+	}
+	return value
+}
+
+// jsonNumbers replaces every json.Number in value with a float64
+func jsonNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonNumbers(item)
+		}
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = jsonNumbers(item)
+		}
+	}
+	return value
+}
+
+// hclStringContent escapes s for use between the quotes of an HCL string
+func hclStringContent(s string) string {
+	quoted := quoteHCLString(s)
+	return quoted[1 : len(quoted)-1]
+}
+
+// joinSources records that a merged map took values from another source
+func joinSources(existing, source string) string {
+	if existing == "" || existing == source {
+		return source
+	}
+	return existing + ", " + source
+}
+
 // parseListValue parses a list value from tfvars
 func (vc *VariableCompiler) parseListValue(content string) []interface{} {
 	content = strings.TrimSpace(content)
@@ -323,6 +420,9 @@ func (vc *VariableCompiler) generateCompiledTfvars() string {
 
 	for _, name := range names {
 		variable := vc.variables[name]
+		if variable.Source != "" {
+			content.WriteString("# " + variable.Source + "\n")
+		}
 		content.WriteString(vc.formatVariable(variable))
 		content.WriteString("\n")
 	}
@@ -343,16 +443,22 @@ func (vc *VariableCompiler) formatVariable(variable TerraformVariable) string {
 		if list, ok := variable.Value.([]interface{}); ok {
 			var items []string
 			for _, item := range list {
-				items = append(items, fmt.Sprintf(`"%v"`, item))
+				items = append(items, hclExpression(item))
 			}
 			return fmt.Sprintf(`%s = [%s]`, variable.Name, strings.Join(items, ", "))
 		}
 		return fmt.Sprintf(`%s = []`, variable.Name)
 	case "map":
 		if mapVal, ok := variable.Value.(map[string]interface{}); ok {
+			keys := make([]string, 0, len(mapVal))
+			for k := range mapVal {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+
 			var items []string
-			for k, v := range mapVal {
-				switch val := v.(type) {
+			for _, k := range keys {
+				switch val := mapVal[k].(type) {
 				case string:
 					items = append(items, fmt.Sprintf(`  %s = "%s"`, k, val))
 				case bool:
@@ -364,7 +470,7 @@ func (vc *VariableCompiler) formatVariable(variable TerraformVariable) string {
 						items = append(items, fmt.Sprintf(`  %s = %g`, k, val))
 					}
 				default:
-					items = append(items, fmt.Sprintf(`  %s = "%v"`, k, val))
+					items = append(items, fmt.Sprintf(`  %s = %s`, hclObjectKey(k), hclExpression(val)))
 				}
 			}
 			return fmt.Sprintf("%s = {\n%s\n}", variable.Name, strings.Join(items, "\n"))
@@ -389,7 +495,7 @@ func CompileAndWriteTfvars(tfvarsFiles []string, outputPath string) error {
 		return fmt.Errorf("failed to write compiled tfvars: %w", err)
 	}
 
-	fmt.Printf("[DEBUG] Compiled tfvars written to: %s\n", outputPath)
+	redact.Printf("[DEBUG] Compiled tfvars written to: %s\n", outputPath)
 	return nil
 }
 
@@ -400,35 +506,35 @@ func CompileWithVariablesTf(tfvarsFiles []string, workDir string, outputPath str
 	// First, parse variables.tf to get default values
 	variablesTfPath := filepath.Join(workDir, "variables.tf")
 	if _, err := os.Stat(variablesTfPath); err == nil {
-		fmt.Printf("[DEBUG] Found variables.tf, parsing defaults\n")
+		redact.Printf("[DEBUG] Found variables.tf, parsing defaults\n")
 		defaults, err := compiler.parseVariablesTf(variablesTfPath)
 		if err != nil {
-			fmt.Printf("[WARNING] Failed to parse variables.tf: %v\n", err)
+			redact.Printf("[WARNING] Failed to parse variables.tf: %v\n", err)
 		} else {
 			// Add defaults to compiler
 			for name, variable := range defaults {
 				compiler.variables[name] = variable
 				if mapVal, ok := variable.Value.(map[string]interface{}); ok {
-					fmt.Printf("[DEBUG] Added default map for variable '%s' with %d fields:\n", name, len(mapVal))
+					redact.Printf("[DEBUG] Added default map for variable '%s' with %d fields:\n", name, len(mapVal))
 					for k, v := range mapVal {
-						fmt.Printf("[DEBUG]   %s.%s = %v (%T)\n", name, k, v, v)
+						redact.Printf("[DEBUG]   %s.%s = %v (%T)\n", name, k, v, v)
 					}
 				} else {
-					fmt.Printf("[DEBUG] Added default for variable '%s': %v (%T)\n", name, variable.Value, variable.Value)
+					redact.Printf("[DEBUG] Added default for variable '%s': %v (%T)\n", name, variable.Value, variable.Value)
 				}
 			}
 		}
 	} else {
-		fmt.Printf("[DEBUG] No variables.tf found at: %s\n", variablesTfPath)
+		redact.Printf("[DEBUG] No variables.tf found at: %s\n", variablesTfPath)
 	}
 
 	// Then compile tfvars files (these will override defaults)
-	fmt.Printf("[DEBUG] Before compiling tfvars, compiler has %d variables\n", len(compiler.variables))
+	redact.Printf("[DEBUG] Before compiling tfvars, compiler has %d variables\n", len(compiler.variables))
 	for name, variable := range compiler.variables {
 		if mapVal, ok := variable.Value.(map[string]interface{}); ok {
-			fmt.Printf("[DEBUG] Pre-compile variable '%s' has %d map fields\n", name, len(mapVal))
+			redact.Printf("[DEBUG] Pre-compile variable '%s' has %d map fields\n", name, len(mapVal))
 		} else {
-			fmt.Printf("[DEBUG] Pre-compile variable '%s': %v\n", name, variable.Value)
+			redact.Printf("[DEBUG] Pre-compile variable '%s': %v\n", name, variable.Value)
 		}
 	}
 	
@@ -437,14 +543,14 @@ func CompileWithVariablesTf(tfvarsFiles []string, workDir string, outputPath str
 		return fmt.Errorf("failed to compile variables: %w", err)
 	}
 
-	fmt.Printf("[DEBUG] Final compiled content:\n%s\n", compiledContent)
+	redact.Printf("[DEBUG] Final compiled content:\n%s\n", compiledContent)
 	
 	err = os.WriteFile(outputPath, []byte(compiledContent), 0644)
 	if err != nil {
 		return fmt.Errorf("failed to write compiled tfvars: %w", err)
 	}
 
-	fmt.Printf("[DEBUG] Compiled tfvars with defaults written to: %s\n", outputPath)
+	redact.Printf("[DEBUG] Compiled tfvars with defaults written to: %s\n", outputPath)
 	return nil
 }
 
@@ -454,52 +560,52 @@ func CompileWithVariablesTfFromSource(tfvarsFiles []string, srcDir string, workD
 
 	// Check if srcDir follows the stack pattern (contains app/stacks/{{stack}})
 	isStackPath := strings.Contains(srcDir, "/app/stacks/")
-	fmt.Printf("[DEBUG] srcDir: %s, isStackPath: %v\n", srcDir, isStackPath)
+	redact.Printf("[DEBUG] srcDir: %s, isStackPath: %v\n", srcDir, isStackPath)
 	
 	if isStackPath {
 		// For stack-specific path, look for variables.tf in the same directory
 		variablesTfPath := filepath.Join(srcDir, "variables.tf")
-		fmt.Printf("[DEBUG] Looking for stack variables.tf at: %s\n", variablesTfPath)
+		redact.Printf("[DEBUG] Looking for stack variables.tf at: %s\n", variablesTfPath)
 		
 		if _, err := os.Stat(variablesTfPath); err == nil {
-			fmt.Printf("[DEBUG] Found stack-specific variables.tf\n")
+			redact.Printf("[DEBUG] Found stack-specific variables.tf\n")
 			defaults, err := compiler.parseVariablesTf(variablesTfPath)
 			if err != nil {
-				fmt.Printf("[WARNING] Failed to parse variables.tf: %v\n", err)
+				redact.Printf("[WARNING] Failed to parse variables.tf: %v\n", err)
 			} else {
 				// Add defaults to compiler
-				fmt.Printf("[DEBUG] Found %d default variables in variables.tf\n", len(defaults))
+				redact.Printf("[DEBUG] Found %d default variables in variables.tf\n", len(defaults))
 				for name, variable := range defaults {
 					compiler.variables[name] = variable
 					if mapVal, ok := variable.Value.(map[string]interface{}); ok {
-						fmt.Printf("[DEBUG] Added stack default map for variable '%s' with %d fields:\n", name, len(mapVal))
+						redact.Printf("[DEBUG] Added stack default map for variable '%s' with %d fields:\n", name, len(mapVal))
 						for k, v := range mapVal {
-							fmt.Printf("[DEBUG]   %s.%s = %v (%T)\n", name, k, v, v)
+							redact.Printf("[DEBUG]   %s.%s = %v (%T)\n", name, k, v, v)
 						}
 					} else {
-						fmt.Printf("[DEBUG] Added stack default for variable '%s': %v (%T)\n", name, variable.Value, variable.Value)
+						redact.Printf("[DEBUG] Added stack default for variable '%s': %v (%T)\n", name, variable.Value, variable.Value)
 					}
 				}
 			}
 		} else {
-			fmt.Printf("[DEBUG] No variables.tf found at stack path: %s\n", variablesTfPath)
+			redact.Printf("[DEBUG] No variables.tf found at stack path: %s\n", variablesTfPath)
 		}
 	} else {
 		// For non-stack paths, find all variables.tf files recursively and compile from all of them
-		fmt.Printf("[DEBUG] Non-stack path detected, searching for all variables.tf files recursively\n")
+		redact.Printf("[DEBUG] Non-stack path detected, searching for all variables.tf files recursively\n")
 		
 		// Find TF_PATH root (go up until we find a directory that might contain app/stacks)
 		tfPath := findTfPathRoot(srcDir)
-		fmt.Printf("[DEBUG] Using TF_PATH root: %s\n", tfPath)
+		redact.Printf("[DEBUG] Using TF_PATH root: %s\n", tfPath)
 		
 		variablesTfPaths := findAllVariablesTfFiles(tfPath)
-		fmt.Printf("[DEBUG] Found %d variables.tf files\n", len(variablesTfPaths))
+		redact.Printf("[DEBUG] Found %d variables.tf files\n", len(variablesTfPaths))
 		
 		for _, path := range variablesTfPaths {
-			fmt.Printf("[DEBUG] Processing variables.tf: %s\n", path)
+			redact.Printf("[DEBUG] Processing variables.tf: %s\n", path)
 			defaults, err := compiler.parseVariablesTf(path)
 			if err != nil {
-				fmt.Printf("[WARNING] Failed to parse %s: %v\n", path, err)
+				redact.Printf("[WARNING] Failed to parse %s: %v\n", path, err)
 				continue
 			}
 			
@@ -521,13 +627,13 @@ func CompileWithVariablesTfFromSource(tfvarsFiles []string, srcDir string, workD
 								Value: mergedMap,
 								Type:  "map",
 							}
-							fmt.Printf("[DEBUG] Merged variable '%s' from %s\n", name, path)
+							redact.Printf("[DEBUG] Merged variable '%s' from %s\n", name, path)
 							continue
 						}
 					}
-					fmt.Printf("[DEBUG] Overriding variable '%s' from %s\n", name, path)
+					redact.Printf("[DEBUG] Overriding variable '%s' from %s\n", name, path)
 				} else {
-					fmt.Printf("[DEBUG] Added variable '%s' from %s\n", name, path)
+					redact.Printf("[DEBUG] Added variable '%s' from %s\n", name, path)
 				}
 				compiler.variables[name] = variable
 			}
@@ -535,12 +641,12 @@ func CompileWithVariablesTfFromSource(tfvarsFiles []string, srcDir string, workD
 	}
 
 	// Then compile tfvars files (these will override defaults)
-	fmt.Printf("[DEBUG] Before compiling tfvars, compiler has %d variables\n", len(compiler.variables))
+	redact.Printf("[DEBUG] Before compiling tfvars, compiler has %d variables\n", len(compiler.variables))
 	for name, variable := range compiler.variables {
 		if mapVal, ok := variable.Value.(map[string]interface{}); ok {
-			fmt.Printf("[DEBUG] Pre-compile variable '%s' has %d map fields\n", name, len(mapVal))
+			redact.Printf("[DEBUG] Pre-compile variable '%s' has %d map fields\n", name, len(mapVal))
 		} else {
-			fmt.Printf("[DEBUG] Pre-compile variable '%s': %v\n", name, variable.Value)
+			redact.Printf("[DEBUG] Pre-compile variable '%s': %v\n", name, variable.Value)
 		}
 	}
 	
@@ -549,14 +655,14 @@ func CompileWithVariablesTfFromSource(tfvarsFiles []string, srcDir string, workD
 		return fmt.Errorf("failed to compile variables: %w", err)
 	}
 
-	fmt.Printf("[DEBUG] Final compiled content:\n%s\n", compiledContent)
+	redact.Printf("[DEBUG] Final compiled content:\n%s\n", compiledContent)
 	
 	err = os.WriteFile(outputPath, []byte(compiledContent), 0644)
 	if err != nil {
 		return fmt.Errorf("failed to write compiled tfvars: %w", err)
 	}
 
-	fmt.Printf("[DEBUG] Compiled tfvars with defaults written to: %s\n", outputPath)
+	redact.Printf("[DEBUG] Compiled tfvars with defaults written to: %s\n", outputPath)
 	return nil
 }
 
@@ -595,7 +701,7 @@ func (vc *VariableCompiler) parseVariablesTf(filename string) (map[string]Terraf
 				currentVar = matches[1]
 				inVariable = true
 				braceCount = 0
-				fmt.Printf("[DEBUG] Found variable definition: %s\n", currentVar)
+				redact.Printf("[DEBUG] Found variable definition: %s\n", currentVar)
 			}
 			continue
 		}
@@ -609,7 +715,7 @@ func (vc *VariableCompiler) parseVariablesTf(filename string) (map[string]Terraf
 			if strings.Contains(line, "default") && strings.Contains(line, "=") && !inType {
 				inDefault = true
 				defaultContent = []string{}
-				fmt.Printf("[DEBUG] Found default line for %s: %s\n", currentVar, line)
+				redact.Printf("[DEBUG] Found default line for %s: %s\n", currentVar, line)
 
 				// Handle simple defaults on same line
 				if strings.Contains(line, "{}") {
@@ -666,7 +772,7 @@ func (vc *VariableCompiler) parseVariablesTf(filename string) (map[string]Terraf
 				if braceCount <= 1 && (strings.Contains(line, "}") || (!strings.Contains(line, "{") && !strings.Contains(line, "="))) {
 					inDefault = false
 					// Try to parse the complex default content
-					fmt.Printf("[DEBUG] Parsing complex default for variable '%s':\n%s\n", currentVar, strings.Join(defaultContent, "\n"))
+					redact.Printf("[DEBUG] Parsing complex default for variable '%s':\n%s\n", currentVar, strings.Join(defaultContent, "\n"))
 					
 					// Simple parsing for map defaults
 					defaultMap := make(map[string]interface{})
@@ -693,7 +799,7 @@ func (vc *VariableCompiler) parseVariablesTf(filename string) (map[string]Terraf
 								} else {
 									defaultMap[key] = strings.Trim(value, "\"")
 								}
-								fmt.Printf("[DEBUG] Parsed default: %s = %v (%T)\n", key, defaultMap[key], defaultMap[key])
+								redact.Printf("[DEBUG] Parsed default: %s = %v (%T)\n", key, defaultMap[key], defaultMap[key])
 							}
 						}
 					}
@@ -703,7 +809,7 @@ func (vc *VariableCompiler) parseVariablesTf(filename string) (map[string]Terraf
 						Value: defaultMap,
 						Type:  "map",
 					}
-					fmt.Printf("[DEBUG] Added complex default for '%s' with %d fields\n", currentVar, len(defaultMap))
+					redact.Printf("[DEBUG] Added complex default for '%s' with %d fields\n", currentVar, len(defaultMap))
 				}
 				continue
 			}
@@ -720,7 +826,7 @@ func (vc *VariableCompiler) parseVariablesTf(filename string) (map[string]Terraf
 							Value: defaults,
 							Type:  "map",
 						}
-						fmt.Printf("[DEBUG] Extracted optional defaults for %s: %v\n", currentVar, defaults)
+						redact.Printf("[DEBUG] Extracted optional defaults for %s: %v\n", currentVar, defaults)
 					}
 				}
 				continue
@@ -748,14 +854,14 @@ func (vc *VariableCompiler) extractOptionalDefaults(typeContent []string) map[st
 	// Join all lines and clean up whitespace
 	content := strings.Join(typeContent, "\n")
 
-	fmt.Printf("[DEBUG] Parsing type content:\n%s\n", content)
+	redact.Printf("[DEBUG] Parsing type content:\n%s\n", content)
 
 	// Look for each line with optional()
 	lines := strings.Split(content, "\n")
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
 		if strings.Contains(line, "optional(") {
-			fmt.Printf("[DEBUG] Processing optional line: %s\n", line)
+			redact.Printf("[DEBUG] Processing optional line: %s\n", line)
 
 			// Extract field name
 			fieldPattern := regexp.MustCompile(`(\w+)\s*=\s*optional\(`)
@@ -798,7 +904,7 @@ func (vc *VariableCompiler) extractOptionalDefaults(typeContent []string) map[st
 			}
 
 			defaultValue := strings.TrimSpace(line[defaultStart:defaultEnd])
-			fmt.Printf("[DEBUG] Extracted default value for %s: '%s'\n", fieldName, defaultValue)
+			redact.Printf("[DEBUG] Extracted default value for %s: '%s'\n", fieldName, defaultValue)
 
 			// Parse the default value
 			if defaultValue == "true" || defaultValue == "false" {
@@ -818,7 +924,7 @@ func (vc *VariableCompiler) extractOptionalDefaults(typeContent []string) map[st
 				}
 			}
 
-			fmt.Printf("[DEBUG] Parsed optional default: %s = %v (%T)\n", fieldName, defaults[fieldName], defaults[fieldName])
+			redact.Printf("[DEBUG] Parsed optional default: %s = %v (%T)\n", fieldName, defaults[fieldName], defaults[fieldName])
 		}
 	}
 
@@ -893,7 +999,7 @@ func findAllVariablesTfFiles(dir string) []string {
 	})
 	
 	if err != nil {
-		fmt.Printf("[DEBUG] Error during recursive search for variables.tf files: %v\n", err)
+		redact.Printf("[DEBUG] Error during recursive search for variables.tf files: %v\n", err)
 	}
 	
 	return results
@@ -968,63 +1074,71 @@ func parseCliVariable(cliVar string) (string, interface{}, error) {
 	return key, value, nil
 }
 
-// CompileWithVariablesTfFromSourceAndCLI compiles tfvars files, merges with variables.tf defaults, and includes CLI variables
-func CompileWithVariablesTfFromSourceAndCLI(tfvarsFiles []string, cliVars []string, srcDir string, workDir string, outputPath string) error {
+// CompileWithVariablesTfFromSourceAndCLI compiles tfvars files, merges with variables.tf defaults, and includes CLI variables.
+// Settings variables from env sit between the variables.tf defaults and the tfvars files.
+func CompileWithVariablesTfFromSourceAndCLI(ctx context.Context, tfvarsFiles []string, cliVars []string, srcDir string, workDir string, outputPath string, env TfvarsEnv) error {
 	compiler := NewVariableCompiler()
+	if env.Naming != nil {
+		compiler.expand = func(s string) (string, error) {
+			return env.Naming.Expand(ctx, s)
+		}
+	}
 	
 	// First, handle variables.tf defaults (same as before)
 	isStackPath := strings.Contains(srcDir, "/app/stacks/")
-	fmt.Printf("[DEBUG] srcDir: %s, isStackPath: %v\n", srcDir, isStackPath)
+	redact.Printf("[DEBUG] srcDir: %s, isStackPath: %v\n", srcDir, isStackPath)
 	
 	if isStackPath {
 		// For stack-specific path, look for variables.tf in the same directory
 		variablesTfPath := filepath.Join(srcDir, "variables.tf")
-		fmt.Printf("[DEBUG] Looking for stack variables.tf at: %s\n", variablesTfPath)
+		redact.Printf("[DEBUG] Looking for stack variables.tf at: %s\n", variablesTfPath)
 		
 		if _, err := os.Stat(variablesTfPath); err == nil {
-			fmt.Printf("[DEBUG] Found stack-specific variables.tf\n")
+			redact.Printf("[DEBUG] Found stack-specific variables.tf\n")
 			defaults, err := compiler.parseVariablesTf(variablesTfPath)
 			if err != nil {
-				fmt.Printf("[WARNING] Failed to parse variables.tf: %v\n", err)
+				redact.Printf("[WARNING] Failed to parse variables.tf: %v\n", err)
 			} else {
 				// Add defaults to compiler
-				fmt.Printf("[DEBUG] Found %d default variables in variables.tf\n", len(defaults))
+				redact.Printf("[DEBUG] Found %d default variables in variables.tf\n", len(defaults))
 				for name, variable := range defaults {
+					variable.Source = variablesTfPath
 					compiler.variables[name] = variable
 					if mapVal, ok := variable.Value.(map[string]interface{}); ok {
-						fmt.Printf("[DEBUG] Added stack default map for variable '%s' with %d fields:\n", name, len(mapVal))
+						redact.Printf("[DEBUG] Added stack default map for variable '%s' with %d fields:\n", name, len(mapVal))
 						for k, v := range mapVal {
-							fmt.Printf("[DEBUG]   %s.%s = %v (%T)\n", name, k, v, v)
+							redact.Printf("[DEBUG]   %s.%s = %v (%T)\n", name, k, v, v)
 						}
 					} else {
-						fmt.Printf("[DEBUG] Added stack default for variable '%s': %v (%T)\n", name, variable.Value, variable.Value)
+						redact.Printf("[DEBUG] Added stack default for variable '%s': %v (%T)\n", name, variable.Value, variable.Value)
 					}
 				}
 			}
 		} else {
-			fmt.Printf("[DEBUG] No variables.tf found at stack path: %s\n", variablesTfPath)
+			redact.Printf("[DEBUG] No variables.tf found at stack path: %s\n", variablesTfPath)
 		}
 	} else {
 		// For non-stack paths, find all variables.tf files recursively and compile from all of them
-		fmt.Printf("[DEBUG] Non-stack path detected, searching for all variables.tf files recursively\n")
+		redact.Printf("[DEBUG] Non-stack path detected, searching for all variables.tf files recursively\n")
 		
 		// Find TF_PATH root (go up until we find a directory that might contain app/stacks)
 		tfPath := findTfPathRoot(srcDir)
-		fmt.Printf("[DEBUG] Using TF_PATH root: %s\n", tfPath)
+		redact.Printf("[DEBUG] Using TF_PATH root: %s\n", tfPath)
 		
 		variablesTfPaths := findAllVariablesTfFiles(tfPath)
-		fmt.Printf("[DEBUG] Found %d variables.tf files\n", len(variablesTfPaths))
+		redact.Printf("[DEBUG] Found %d variables.tf files\n", len(variablesTfPaths))
 		
 		for _, path := range variablesTfPaths {
-			fmt.Printf("[DEBUG] Processing variables.tf: %s\n", path)
+			redact.Printf("[DEBUG] Processing variables.tf: %s\n", path)
 			defaults, err := compiler.parseVariablesTf(path)
 			if err != nil {
-				fmt.Printf("[WARNING] Failed to parse %s: %v\n", path, err)
+				redact.Printf("[WARNING] Failed to parse %s: %v\n", path, err)
 				continue
 			}
 			
 			// Merge defaults from this file
 			for name, variable := range defaults {
+				variable.Source = path
 				if existing, exists := compiler.variables[name]; exists {
 					// If both are maps, merge them
 					if existingMap, ok := existing.Value.(map[string]interface{}); ok {
@@ -1037,30 +1151,48 @@ func CompileWithVariablesTfFromSourceAndCLI(tfvarsFiles []string, cliVars []stri
 								mergedMap[k] = v
 							}
 							compiler.variables[name] = TerraformVariable{
-								Name:  name,
-								Value: mergedMap,
-								Type:  "map",
+								Name:   name,
+								Value:  mergedMap,
+								Type:   "map",
+								Source: joinSources(existing.Source, path),
 							}
-							fmt.Printf("[DEBUG] Merged variable '%s' from %s\n", name, path)
+							redact.Printf("[DEBUG] Merged variable '%s' from %s\n", name, path)
 							continue
 						}
 					}
-					fmt.Printf("[DEBUG] Overriding variable '%s' from %s\n", name, path)
+					redact.Printf("[DEBUG] Overriding variable '%s' from %s\n", name, path)
 				} else {
-					fmt.Printf("[DEBUG] Added variable '%s' from %s\n", name, path)
+					redact.Printf("[DEBUG] Added variable '%s' from %s\n", name, path)
 				}
 				compiler.variables[name] = variable
 			}
 		}
 	}
 	
+	// Environment settings override the defaults
+	settingNames := make([]string, 0, len(env.Settings))
+	for name := range env.Settings {
+		settingNames = append(settingNames, name)
+	}
+	sort.Strings(settingNames)
+	for _, name := range settingNames {
+		value := env.Settings[name]
+		compiler.variables[name] = TerraformVariable{
+			Name:   name,
+			Value:  value,
+			Type:   variableType(value),
+			Source: "environment settings",
+		}
+		redact.Printf("[DEBUG] Set variable '%s' from environment settings\n", name)
+	}
+
 	// Then compile tfvars files (these will override defaults)
-	fmt.Printf("[DEBUG] Before compiling tfvars, compiler has %d variables\n", len(compiler.variables))
+	redact.Printf("[DEBUG] Before compiling tfvars, compiler has %d variables\n", len(compiler.variables))
 	for name, variable := range compiler.variables {
 		if mapVal, ok := variable.Value.(map[string]interface{}); ok {
-			fmt.Printf("[DEBUG] Pre-compile variable '%s' has %d map fields\n", name, len(mapVal))
+			redact.Printf("[DEBUG] Pre-compile variable '%s' has %d map fields\n", name, len(mapVal))
 		} else {
-			fmt.Printf("[DEBUG] Pre-compile variable '%s': %v\n", name, variable.Value)
+			redact.Printf("[DEBUG] Pre-compile variable '%s': %v\n", name, variable.Value)
 		}
 	}
 	
@@ -1071,25 +1203,14 @@ func CompileWithVariablesTfFromSourceAndCLI(tfvarsFiles []string, cliVars []stri
 	
 	// Finally, apply CLI variables (these have highest priority)
 	if len(cliVars) > 0 {
-		fmt.Printf("[DEBUG] Processing %d CLI variables\n", len(cliVars))
+		redact.Printf("[DEBUG] Processing %d CLI variables\n", len(cliVars))
 		for _, cliVar := range cliVars {
 			key, value, err := parseCliVariable(cliVar)
 			if err != nil {
 				return fmt.Errorf("failed to parse CLI variable: %w", err)
 			}
 			
-			// Determine the type
-			varType := "string"
-			switch value.(type) {
-			case bool:
-				varType = "bool"
-			case int64, float64:
-				varType = "number"
-			case map[string]interface{}:
-				varType = "map"
-			case []interface{}:
-				varType = "list"
-			}
+			varType := variableType(value)
 			
 			// Check if variable already exists and is a map
 			if existing, exists := compiler.variables[key]; exists && varType == "string" {
@@ -1098,31 +1219,48 @@ func CompileWithVariablesTfFromSourceAndCLI(tfvarsFiles []string, cliVars []stri
 					parts := strings.SplitN(key, ".", 2)
 					if len(parts) == 2 {
 						existingMap[parts[1]] = value
-						fmt.Printf("[DEBUG] Updated map field '%s.%s' = %v from CLI\n", parts[0], parts[1], value)
+						redact.Printf("[DEBUG] Updated map field '%s.%s' = %v from CLI\n", parts[0], parts[1], value)
 						continue
 					}
 				}
 			}
 			
 			compiler.variables[key] = TerraformVariable{
-				Name:  key,
-				Value: value,
-				Type:  varType,
+				Name:   key,
+				Value:  value,
+				Type:   varType,
+				Source: "-var",
 			}
-			fmt.Printf("[DEBUG] Set CLI variable '%s' = %v (%s)\n", key, value, varType)
+			redact.Printf("[DEBUG] Set CLI variable '%s' = %v (%s)\n", key, value, varType)
 		}
 		
 		// Regenerate compiled content with CLI variables included
 		compiledContent = compiler.generateCompiledTfvars()
 	}
 	
-	fmt.Printf("[DEBUG] Final compiled content:\n%s\n", compiledContent)
+	redact.Printf("[DEBUG] Final compiled content:\n%s\n", compiledContent)
 	
 	err = os.WriteFile(outputPath, []byte(compiledContent), 0644)
 	if err != nil {
 		return fmt.Errorf("failed to write compiled tfvars: %w", err)
 	}
 	
-	fmt.Printf("[DEBUG] Compiled tfvars with defaults and CLI vars written to: %s\n", outputPath)
+	redact.Printf("[DEBUG] Compiled tfvars with defaults and CLI vars written to: %s\n", outputPath)
 	return nil
 }
+
+// variableType names the kind of a variable value, as formatVariable expects
+func variableType(value interface{}) string {
+	switch value.(type) {
+	case bool:
+		return "bool"
+	case int, int64, float64:
+		return "number"
+	case map[string]interface{}:
+		return "map"
+	case []interface{}:
+		return "list"
+	default:
+		return "string"
+	}
+}
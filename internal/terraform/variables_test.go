@@ -0,0 +1,56 @@
+package terraform
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kingoftowns/tf-go/internal/testutil"
+)
+
+func TestCompileVariablesWithJSON(t *testing.T) {
+	dir := t.TempDir()
+	testutil.WriteFiles(t, dir, map[string]string{
+		"base.tfvars": `replicas = 2
+name = "web"
+tags = {
+  team = "platform"
+}
+`,
+		"dev.tfvars.json": `{
+  "replicas": 3,
+  "motd": "say \"hi\"",
+  "tags": {"env": "dev"},
+  "zones": ["a", "b"],
+  "enabled": true
+}
+`,
+	})
+	base := filepath.Join(dir, "base.tfvars")
+	dev := filepath.Join(dir, "dev.tfvars.json")
+
+	compiled, err := NewVariableCompiler().CompileVariables([]string{base, dev})
+	if err != nil {
+		t.Fatalf("CompileVariables returned error: %v", err)
+	}
+	for _, want := range []string{
+		"# " + dev + "\nreplicas = 3\n",
+		"# " + base + "\nname = \"web\"\n",
+		"# " + dev + "\nmotd = \"say \\\"hi\\\"\"\n",
+		"# " + base + ", " + dev + "\ntags = {",
+		`  team = "platform"`,
+		`  env = "dev"`,
+		`zones = ["a", "b"]`,
+		"enabled = true",
+	} {
+		if !strings.Contains(compiled, want) {
+			t.Errorf("compiled tfvars is missing %q:\n%s", want, compiled)
+		}
+	}
+
+	testutil.WriteFiles(t, dir, map[string]string{"bad.tfvars.json": `{"replicas": `})
+	_, err = NewVariableCompiler().CompileVariables([]string{filepath.Join(dir, "bad.tfvars.json")})
+	if err == nil || !strings.Contains(err.Error(), "invalid JSON") {
+		t.Errorf("unexpected error for invalid JSON: %v", err)
+	}
+}
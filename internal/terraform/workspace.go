@@ -0,0 +1,98 @@
+package terraform
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	tfgoconfig "github.com/kingoftowns/tf-go/internal/config"
+	"github.com/kingoftowns/tf-go/internal/redact"
+)
+
+// DefaultWorkspace is the workspace Terraform uses when none is selected
+const DefaultWorkspace = "default"
+
+// defaultWorkspaceKeyPrefix is where the S3 backend keeps the state of
+// non-default workspaces unless workspace_key_prefix is set
+const defaultWorkspaceKeyPrefix = "env:"
+
+// ResolveWorkspace expands the environment's workspace setting and records it
+// on the backend, so that state locations tf-go reads directly (lock table
+// entries, S3 object versions) match the ones Terraform writes. It returns ""
+// when the environment uses the default workspace.
+func ResolveWorkspace(ctx context.Context, cfg *tfgoconfig.Config, env string, naming *Naming, backend Backend) (string, error) {
+	workspace, err := naming.Expand(ctx, cfg.ResolveWorkspace(env))
+	if err != nil {
+		return "", fmt.Errorf("resolving workspace: %w", err)
+	}
+	if workspace == DefaultWorkspace {
+		workspace = ""
+	}
+	if workspace == "" {
+		return "", nil
+	}
+
+	switch b := backend.(type) {
+	case *S3Backend:
+		b.Config.Workspace = workspace
+	case *LocalBackend:
+		b.Workspace = workspace
+	case *HTTPBackend:
+		return "", fmt.Errorf("the http backend does not support workspaces, but %s selects workspace %q", env, workspace)
+	}
+	return workspace, nil
+}
+
+// StateKey returns the object key the state is stored under in the selected
+// workspace. Non-default workspaces live under workspace_key_prefix.
+func (c S3BackendConfig) StateKey() string {
+	if c.Workspace == "" || c.Workspace == DefaultWorkspace {
+		return c.Key
+	}
+	prefix := defaultWorkspaceKeyPrefix
+	if p, ok := c.Options["workspace_key_prefix"].(string); ok && p != "" {
+		prefix = p
+	}
+	return path.Join(prefix, c.Workspace, c.Key)
+}
+
+// SetWorkspace makes Init select the named workspace, creating it when it
+// does not exist yet. An empty name keeps the default workspace.
+func (e *Executor) SetWorkspace(name string) {
+	e.workspace = name
+}
+
+// selectWorkspace switches the initialized working directory to e.workspace
+func (e *Executor) selectWorkspace(ctx context.Context) error {
+	workspaces, current, err := e.tf.WorkspaceList(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list workspaces: %w", err)
+	}
+	if current == e.workspace {
+		return nil
+	}
+
+	for _, workspace := range workspaces {
+		if workspace == e.workspace {
+			redact.Printf("[DEBUG] Selecting workspace %s\n", e.workspace)
+			if err := e.tf.WorkspaceSelect(ctx, e.workspace); err != nil {
+				return fmt.Errorf("failed to select workspace %s: %w", e.workspace, err)
+			}
+			return nil
+		}
+	}
+
+	redact.Printf("[DEBUG] Creating workspace %s\n", e.workspace)
+	if err := e.tf.WorkspaceNew(ctx, e.workspace); err != nil {
+		return fmt.Errorf("failed to create workspace %s: %w", e.workspace, err)
+	}
+	return nil
+}
+
+// Workspace returns the workspace that is active in the working directory
+func (e *Executor) Workspace(ctx context.Context) (string, error) {
+	if e.tf == nil {
+		return "", fmt.Errorf("terraform executor not set up")
+	}
+	return e.tf.WorkspaceShow(ctx)
+}
@@ -0,0 +1,68 @@
+package terraform
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	tfgoconfig "github.com/kingoftowns/tf-go/internal/config"
+)
+
+func TestS3StateKeyForWorkspace(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  S3BackendConfig
+		want string
+	}{
+		{"default", S3BackendConfig{Key: "web/terraform.tfstate"}, "web/terraform.tfstate"},
+		{"explicit default", S3BackendConfig{Key: "web/terraform.tfstate", Workspace: "default"}, "web/terraform.tfstate"},
+		{"named", S3BackendConfig{Key: "web/terraform.tfstate", Workspace: "staging"}, "env:/staging/web/terraform.tfstate"},
+		{"custom prefix", S3BackendConfig{
+			Key: "web/terraform.tfstate", Workspace: "staging",
+			Options: map[string]interface{}{"workspace_key_prefix": "workspaces"},
+		}, "workspaces/staging/web/terraform.tfstate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.StateKey(); got != tt.want {
+				t.Errorf("StateKey() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveWorkspace(t *testing.T) {
+	cfg := &tfgoconfig.Config{Environments: map[string]tfgoconfig.EnvironmentConfig{
+		"dev":  {Workspace: ":ENV-:STACK"},
+		"prod": {Workspace: "default"},
+	}}
+	naming := &Naming{Env: "dev", Stack: "web"}
+
+	s3Backend := &S3Backend{Config: S3BackendConfig{Bucket: "b", Key: "k", Region: "us-east-1"}}
+	workspace, err := ResolveWorkspace(context.Background(), cfg, "dev", naming, s3Backend)
+	if err != nil {
+		t.Fatalf("ResolveWorkspace failed: %v", err)
+	}
+	if workspace != "dev-web" || s3Backend.Describe() != "s3://b/env:/dev-web/k in us-east-1" {
+		t.Errorf("workspace = %q, backend = %s", workspace, s3Backend.Describe())
+	}
+
+	if workspace, err := ResolveWorkspace(context.Background(), cfg, "prod", naming, s3Backend); err != nil || workspace != "" {
+		t.Errorf("default workspace should resolve to \"\", got %q (%v)", workspace, err)
+	}
+
+	local := &LocalBackend{Path: filepath.Join("/state", "dev", "terraform.tfstate")}
+	if _, err := ResolveWorkspace(context.Background(), cfg, "dev", naming, local); err != nil {
+		t.Fatalf("ResolveWorkspace failed: %v", err)
+	}
+	if got := local.Settings()["workspace_dir"]; got != filepath.Join("/state", "dev", "terraform.tfstate.d") {
+		t.Errorf("workspace_dir = %v", got)
+	}
+
+	_, err = ResolveWorkspace(context.Background(), cfg, "dev", naming, &HTTPBackend{})
+	if err == nil || !strings.Contains(err.Error(), "does not support workspaces") {
+		t.Errorf("expected http backend error, got %v", err)
+	}
+}
@@ -0,0 +1,814 @@
+package testutil
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// DefaultAWSAccountID is the account reported by the fake STS endpoint
+const DefaultAWSAccountID = "123456789012"
+
+// s3Subresources are bucket-level configuration documents stored verbatim by
+// AWSServer. A PUT stores the request body and a GET returns it unchanged.
+var s3Subresources = map[string]string{
+	"versioning":        "",
+	"encryption":        "ServerSideEncryptionConfigurationNotFoundError",
+	"publicAccessBlock": "NoSuchPublicAccessBlockConfiguration",
+	"policy":            "NoSuchBucketPolicy",
+	"lifecycle":         "NoSuchLifecycleConfiguration",
+	"tagging":           "NoSuchTagSet",
+}
+
+// S3Object is a single stored version of an S3 object
+type S3Object struct {
+	VersionID    string
+	Data         []byte
+	LastModified time.Time
+	DeleteMarker bool
+}
+
+// S3Bucket is the in-memory state of a fake S3 bucket
+type S3Bucket struct {
+	Name    string
+	Config  map[string][]byte
+	Objects map[string][]*S3Object
+}
+
+// DynamoTable is the in-memory state of a fake DynamoDB table
+type DynamoTable struct {
+	Name                 string
+	HashKey              string
+	AttributeDefinitions []interface{}
+	KeySchema            []interface{}
+	Items                map[string]map[string]interface{}
+}
+
+// EKSCluster is a fake EKS cluster served by DescribeCluster
+type EKSCluster struct {
+	Name     string
+	Endpoint string
+	// CAData is the base64 encoded certificate authority, as EKS returns it
+	CAData string
+}
+
+// AWSServer is an in-process stand-in for the parts of S3, DynamoDB, STS,
+// EKS, SSM and Secrets Manager that tf-go uses. Point the AWS SDK at it with SetEnv.
+type AWSServer struct {
+	*httptest.Server
+
+	// AccountID is returned from sts:GetCallerIdentity
+	AccountID string
+
+	mu       sync.Mutex
+	buckets  map[string]*S3Bucket
+	tables   map[string]*DynamoTable
+	clusters map[string]*EKSCluster
+	params   map[string]ssmParameter
+	secrets  map[string]string
+	nextID   int
+	requests []string
+}
+
+// NewAWSServer starts a fake AWS endpoint that is shut down when the test ends
+func NewAWSServer(t testing.TB) *AWSServer {
+	t.Helper()
+
+	s := &AWSServer{
+		AccountID: DefaultAWSAccountID,
+		buckets:   make(map[string]*S3Bucket),
+		tables:    make(map[string]*DynamoTable),
+		clusters:  make(map[string]*EKSCluster),
+		params:    make(map[string]ssmParameter),
+		secrets:   make(map[string]string),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// SetEnv configures the AWS SDK environment so every client talks to this
+// server with static test credentials
+func (s *AWSServer) SetEnv(t testing.TB) {
+	t.Helper()
+	t.Setenv("AWS_ENDPOINT_URL", s.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIATESTTESTTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_CONFIG_FILE", "/dev/null")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/dev/null")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+}
+
+// Requests returns a short description of every request the server has seen,
+// for example "s3 PUT /bucket?versioning" or "dynamodb CreateTable"
+func (s *AWSServer) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// CreateBucket creates an empty bucket, as if it already existed in the account
+func (s *AWSServer) CreateBucket(name string) *S3Bucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.createBucket(name)
+}
+
+// Bucket returns the named bucket or nil
+func (s *AWSServer) Bucket(name string) *S3Bucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buckets[name]
+}
+
+// PutObject stores data at bucket/key, creating the bucket if needed, and
+// returns the new version ID
+func (s *AWSServer) PutObject(bucket, key string, data []byte) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[bucket]
+	if !ok {
+		b = s.createBucket(bucket)
+	}
+	return s.putObject(b, key, data).VersionID
+}
+
+// Object returns the current contents of bucket/key
+func (s *AWSServer) Object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[bucket]
+	if !ok {
+		return nil, false
+	}
+	obj := latestObject(b, key)
+	if obj == nil {
+		return nil, false
+	}
+	return obj.Data, true
+}
+
+// Table returns the named DynamoDB table or nil
+func (s *AWSServer) Table(name string) *DynamoTable {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tables[name]
+}
+
+// PutItem stores a raw DynamoDB item (attribute name -> {"S": ...}) in table
+func (s *AWSServer) PutItem(table string, item map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tables[table]
+	if !ok {
+		t = &DynamoTable{Name: table, HashKey: "LockID", Items: make(map[string]map[string]interface{})}
+		s.tables[table] = t
+	}
+	t.Items[dynamoKey(t, item)] = item
+}
+
+// PutCluster adds an EKS cluster
+func (s *AWSServer) PutCluster(cluster EKSCluster) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clusters[cluster.Name] = &cluster
+}
+
+type ssmParameter struct {
+	value  string
+	secure bool
+}
+
+// PutParameter stores an SSM parameter, as a SecureString when secure is set
+func (s *AWSServer) PutParameter(name, value string, secure bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.params[name] = ssmParameter{value: value, secure: secure}
+}
+
+// PutSecret stores a Secrets Manager string secret
+func (s *AWSServer) PutSecret(id, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.secrets[id] = value
+}
+
+func (s *AWSServer) handle(w http.ResponseWriter, r *http.Request) {
+	// EKS is a REST API like S3, so tell it apart by the signing scope
+	if strings.Contains(r.Header.Get("Authorization"), "/eks/aws4_request") {
+		s.handleEKS(w, r)
+		return
+	}
+
+	if target := r.Header.Get("X-Amz-Target"); strings.HasPrefix(target, "DynamoDB_20120810.") {
+		s.handleDynamoDB(w, r, strings.TrimPrefix(target, "DynamoDB_20120810."))
+		return
+	} else if target == "AmazonSSM.GetParameter" || target == "secretsmanager.GetSecretValue" {
+		s.handleJSON11(w, r, target)
+		return
+	}
+
+	if r.Method == http.MethodPost && r.URL.Path == "/" &&
+		strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		s.handleSTS(w, r)
+		return
+	}
+
+	s.handleS3(w, r)
+}
+
+func (s *AWSServer) record(format string, args ...interface{}) {
+	s.requests = append(s.requests, fmt.Sprintf(format, args...))
+}
+
+// --- STS ---
+
+func (s *AWSServer) handleSTS(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeS3Error(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	s.record("sts %s", r.Form.Get("Action"))
+	s.mu.Unlock()
+
+	switch r.Form.Get("Action") {
+	case "GetCallerIdentity":
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprintf(w, `<GetCallerIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <GetCallerIdentityResult>
+    <Arn>arn:aws:iam::%[1]s:user/tf-go-test</Arn>
+    <UserId>AIDATESTUSER</UserId>
+    <Account>%[1]s</Account>
+  </GetCallerIdentityResult>
+  <ResponseMetadata><RequestId>00000000-0000-0000-0000-000000000000</RequestId></ResponseMetadata>
+</GetCallerIdentityResponse>`, s.AccountID)
+	default:
+		writeS3Error(w, http.StatusBadRequest, "InvalidAction", "unsupported STS action "+r.Form.Get("Action"))
+	}
+}
+
+// --- EKS ---
+
+func (s *AWSServer) handleEKS(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record("eks %s %s", r.Method, r.URL.Path)
+
+	name := strings.TrimPrefix(r.URL.Path, "/clusters/")
+	cluster, ok := s.clusters[name]
+	if r.Method != http.MethodGet || name == r.URL.Path || !ok {
+		w.Header().Set("X-Amzn-Errortype", "ResourceNotFoundException")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"message": "No cluster found for name: %s."}`, name)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"cluster": map[string]interface{}{
+			"name":                 cluster.Name,
+			"arn":                  fmt.Sprintf("arn:aws:eks:us-east-1:%s:cluster/%s", s.AccountID, cluster.Name),
+			"endpoint":             cluster.Endpoint,
+			"status":               "ACTIVE",
+			"certificateAuthority": map[string]interface{}{"data": cluster.CAData},
+		},
+	})
+}
+
+// --- SSM and Secrets Manager ---
+
+func (s *AWSServer) handleJSON11(w http.ResponseWriter, r *http.Request, target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record("%s", target)
+
+	var req map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON11Error(w, "SerializationException", err.Error())
+		return
+	}
+
+	switch target {
+	case "AmazonSSM.GetParameter":
+		name, _ := req["Name"].(string)
+		param, ok := s.params[name]
+		if !ok {
+			writeJSON11Error(w, "ParameterNotFound", "parameter "+name+" not found")
+			return
+		}
+		paramType := "String"
+		if param.secure {
+			paramType = "SecureString"
+		}
+		writeJSON11(w, map[string]interface{}{
+			"Parameter": map[string]interface{}{"Name": name, "Type": paramType, "Value": param.value, "Version": 1},
+		})
+	case "secretsmanager.GetSecretValue":
+		id, _ := req["SecretId"].(string)
+		secret, ok := s.secrets[id]
+		if !ok {
+			writeJSON11Error(w, "ResourceNotFoundException", "Secrets Manager can't find the specified secret.")
+			return
+		}
+		writeJSON11(w, map[string]interface{}{"Name": id, "SecretString": secret})
+	}
+}
+
+func writeJSON11(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeJSON11Error(w http.ResponseWriter, code, message string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"__type": code, "message": message})
+}
+
+// --- S3 ---
+
+func (s *AWSServer) handleS3(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucketName, key, _ := strings.Cut(path, "/")
+	query := r.URL.Query()
+
+	subresource := ""
+	for name := range s3Subresources {
+		if _, ok := query[name]; ok {
+			subresource = name
+		}
+	}
+	if _, ok := query["versions"]; ok {
+		subresource = "versions"
+	}
+
+	desc := r.Method + " /" + path
+	if subresource != "" {
+		desc += "?" + subresource
+	}
+	s.record("s3 %s", desc)
+
+	if bucketName == "" {
+		writeS3Error(w, http.StatusBadRequest, "InvalidRequest", "bucket name required")
+		return
+	}
+
+	bucket, exists := s.buckets[bucketName]
+
+	if key == "" {
+		if r.Method == http.MethodPut && subresource == "" {
+			if exists {
+				writeS3Error(w, http.StatusConflict, "BucketAlreadyOwnedByYou", "bucket already exists")
+				return
+			}
+			s.createBucket(bucketName)
+			w.Header().Set("Location", "/"+bucketName)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if !exists {
+			writeS3Error(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		case subresource == "versions":
+			s.listObjectVersions(w, bucket, query.Get("prefix"))
+		case subresource != "":
+			s.bucketSubresource(w, r, bucket, subresource)
+		case r.Method == http.MethodGet:
+			s.listObjects(w, bucket, query.Get("prefix"))
+		case r.Method == http.MethodDelete:
+			delete(s.buckets, bucketName)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "unsupported bucket operation")
+		}
+		return
+	}
+
+	if !exists {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+
+	versionID := query.Get("versionId")
+
+	switch r.Method {
+	case http.MethodPut:
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			s.copyObject(w, bucket, key, source)
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		obj := s.putObject(bucket, key, data)
+		w.Header().Set("ETag", etag(obj.Data))
+		w.Header().Set("x-amz-version-id", obj.VersionID)
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodGet, http.MethodHead:
+		obj := findObject(bucket, key, versionID)
+		if obj == nil {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		w.Header().Set("ETag", etag(obj.Data))
+		w.Header().Set("x-amz-version-id", obj.VersionID)
+		w.Header().Set("Last-Modified", obj.LastModified.Format(http.TimeFormat))
+		w.Header().Set("Content-Length", fmt.Sprint(len(obj.Data)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(obj.Data)
+		}
+
+	case http.MethodDelete:
+		s.deleteObject(bucket, key, versionID)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "unsupported object operation")
+	}
+}
+
+func (s *AWSServer) createBucket(name string) *S3Bucket {
+	b := &S3Bucket{
+		Name:    name,
+		Config:  make(map[string][]byte),
+		Objects: make(map[string][]*S3Object),
+	}
+	s.buckets[name] = b
+	return b
+}
+
+func (s *AWSServer) newVersionID(b *S3Bucket) string {
+	if !b.VersioningEnabled() {
+		return "null"
+	}
+	s.nextID++
+	return fmt.Sprintf("v%06d", s.nextID)
+}
+
+func (s *AWSServer) putObject(b *S3Bucket, key string, data []byte) *S3Object {
+	obj := &S3Object{
+		VersionID:    s.newVersionID(b),
+		Data:         append([]byte(nil), data...),
+		LastModified: time.Now().UTC(),
+	}
+	if b.VersioningEnabled() {
+		b.Objects[key] = append(b.Objects[key], obj)
+	} else {
+		b.Objects[key] = []*S3Object{obj}
+	}
+	return obj
+}
+
+func (s *AWSServer) deleteObject(b *S3Bucket, key, versionID string) {
+	if versionID != "" {
+		versions := b.Objects[key]
+		for i, v := range versions {
+			if v.VersionID == versionID {
+				b.Objects[key] = append(versions[:i], versions[i+1:]...)
+				break
+			}
+		}
+		if len(b.Objects[key]) == 0 {
+			delete(b.Objects, key)
+		}
+		return
+	}
+
+	if !b.VersioningEnabled() {
+		delete(b.Objects, key)
+		return
+	}
+
+	b.Objects[key] = append(b.Objects[key], &S3Object{
+		VersionID:    s.newVersionID(b),
+		LastModified: time.Now().UTC(),
+		DeleteMarker: true,
+	})
+}
+
+func (s *AWSServer) copyObject(w http.ResponseWriter, dst *S3Bucket, key, source string) {
+	source, err := url.PathUnescape(source)
+	if err != nil {
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+	source, rawQuery, _ := strings.Cut(strings.TrimPrefix(source, "/"), "?")
+	srcBucketName, srcKey, _ := strings.Cut(source, "/")
+	values, _ := url.ParseQuery(rawQuery)
+
+	srcBucket, ok := s.buckets[srcBucketName]
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	srcObj := findObject(srcBucket, srcKey, values.Get("versionId"))
+	if srcObj == nil {
+		writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+
+	obj := s.putObject(dst, key, srcObj.Data)
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("x-amz-version-id", obj.VersionID)
+	fmt.Fprintf(w, `<CopyObjectResult><ETag>%s</ETag><LastModified>%s</LastModified></CopyObjectResult>`,
+		xmlEscape(etag(obj.Data)), obj.LastModified.Format(s3TimeFormat))
+}
+
+func (s *AWSServer) bucketSubresource(w http.ResponseWriter, r *http.Request, b *S3Bucket, name string) {
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		b.Config[name] = data
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		data, ok := b.Config[name]
+		if !ok {
+			if code := s3Subresources[name]; code != "" {
+				writeS3Error(w, http.StatusNotFound, code, "The "+name+" configuration does not exist")
+				return
+			}
+			// An unconfigured bucket reports empty versioning rather than an error
+			w.Header().Set("Content-Type", "application/xml")
+			fmt.Fprint(w, `<VersioningConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/"/>`)
+			return
+		}
+		if name == "policy" {
+			w.Header().Set("Content-Type", "application/json")
+		} else {
+			w.Header().Set("Content-Type", "application/xml")
+		}
+		w.Write(data)
+	case http.MethodDelete:
+		delete(b.Config, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "unsupported subresource operation")
+	}
+}
+
+const s3TimeFormat = "2006-01-02T15:04:05.000Z"
+
+func (s *AWSServer) listObjects(w http.ResponseWriter, b *S3Bucket, prefix string) {
+	var buf strings.Builder
+	count := 0
+	for _, key := range sortedKeys(b, prefix) {
+		obj := latestObject(b, key)
+		if obj == nil {
+			continue
+		}
+		count++
+		fmt.Fprintf(&buf, `<Contents><Key>%s</Key><LastModified>%s</LastModified><ETag>%s</ETag><Size>%d</Size><StorageClass>STANDARD</StorageClass></Contents>`,
+			xmlEscape(key), obj.LastModified.Format(s3TimeFormat), xmlEscape(etag(obj.Data)), len(obj.Data))
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, `<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>%s</Name><Prefix>%s</Prefix><KeyCount>%d</KeyCount><MaxKeys>1000</MaxKeys><IsTruncated>false</IsTruncated>%s</ListBucketResult>`,
+		xmlEscape(b.Name), xmlEscape(prefix), count, buf.String())
+}
+
+func (s *AWSServer) listObjectVersions(w http.ResponseWriter, b *S3Bucket, prefix string) {
+	var buf strings.Builder
+	for _, key := range sortedKeys(b, prefix) {
+		versions := b.Objects[key]
+		// S3 lists the newest version of each key first
+		for i := len(versions) - 1; i >= 0; i-- {
+			v := versions[i]
+			isLatest := i == len(versions)-1
+			if v.DeleteMarker {
+				fmt.Fprintf(&buf, `<DeleteMarker><Key>%s</Key><VersionId>%s</VersionId><IsLatest>%t</IsLatest><LastModified>%s</LastModified></DeleteMarker>`,
+					xmlEscape(key), v.VersionID, isLatest, v.LastModified.Format(s3TimeFormat))
+				continue
+			}
+			fmt.Fprintf(&buf, `<Version><Key>%s</Key><VersionId>%s</VersionId><IsLatest>%t</IsLatest><LastModified>%s</LastModified><ETag>%s</ETag><Size>%d</Size><StorageClass>STANDARD</StorageClass></Version>`,
+				xmlEscape(key), v.VersionID, isLatest, v.LastModified.Format(s3TimeFormat), xmlEscape(etag(v.Data)), len(v.Data))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, `<ListVersionsResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>%s</Name><Prefix>%s</Prefix><MaxKeys>1000</MaxKeys><IsTruncated>false</IsTruncated>%s</ListVersionsResult>`,
+		xmlEscape(b.Name), xmlEscape(prefix), buf.String())
+}
+
+// VersioningEnabled reports whether versioning has been turned on for the bucket
+func (b *S3Bucket) VersioningEnabled() bool {
+	return strings.Contains(string(b.Config["versioning"]), "<Status>Enabled</Status>")
+}
+
+func sortedKeys(b *S3Bucket, prefix string) []string {
+	var keys []string
+	for key := range b.Objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func latestObject(b *S3Bucket, key string) *S3Object {
+	versions := b.Objects[key]
+	if len(versions) == 0 || versions[len(versions)-1].DeleteMarker {
+		return nil
+	}
+	return versions[len(versions)-1]
+}
+
+func findObject(b *S3Bucket, key, versionID string) *S3Object {
+	if versionID == "" {
+		return latestObject(b, key)
+	}
+	for _, v := range b.Objects[key] {
+		if v.VersionID == versionID && !v.DeleteMarker {
+			return v
+		}
+	}
+	return nil
+}
+
+func etag(data []byte) string {
+	var sum uint32
+	for _, c := range data {
+		sum = sum*31 + uint32(c)
+	}
+	return fmt.Sprintf(`"%08x%d"`, sum, len(data))
+}
+
+func xmlEscape(s string) string {
+	var buf strings.Builder
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message><RequestId>test</RequestId></Error>`, code, xmlEscape(message))
+}
+
+// --- DynamoDB ---
+
+func (s *AWSServer) handleDynamoDB(w http.ResponseWriter, r *http.Request, op string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record("dynamodb %s", op)
+
+	var req map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeDynamoError(w, "SerializationException", err.Error())
+		return
+	}
+
+	tableName, _ := req["TableName"].(string)
+	table := s.tables[tableName]
+
+	if op != "CreateTable" && op != "ListTables" && table == nil {
+		writeDynamoError(w, "ResourceNotFoundException", "Requested resource not found: Table: "+tableName+" not found")
+		return
+	}
+
+	switch op {
+	case "CreateTable":
+		if table != nil {
+			writeDynamoError(w, "ResourceInUseException", "Table already exists: "+tableName)
+			return
+		}
+		table = &DynamoTable{
+			Name:  tableName,
+			Items: make(map[string]map[string]interface{}),
+		}
+		table.AttributeDefinitions, _ = req["AttributeDefinitions"].([]interface{})
+		table.KeySchema, _ = req["KeySchema"].([]interface{})
+		for _, k := range table.KeySchema {
+			if m, ok := k.(map[string]interface{}); ok && m["KeyType"] == "HASH" {
+				table.HashKey, _ = m["AttributeName"].(string)
+			}
+		}
+		s.tables[tableName] = table
+		writeDynamoJSON(w, map[string]interface{}{"TableDescription": describeTable(table)})
+
+	case "DescribeTable":
+		writeDynamoJSON(w, map[string]interface{}{"Table": describeTable(table)})
+
+	case "ListTables":
+		var names []string
+		for name := range s.tables {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		writeDynamoJSON(w, map[string]interface{}{"TableNames": names})
+
+	case "PutItem":
+		item, _ := req["Item"].(map[string]interface{})
+		key := dynamoKey(table, item)
+		if cond, _ := req["ConditionExpression"].(string); strings.Contains(cond, "attribute_not_exists") {
+			if _, exists := table.Items[key]; exists {
+				writeDynamoError(w, "ConditionalCheckFailedException", "The conditional request failed")
+				return
+			}
+		}
+		table.Items[key] = item
+		writeDynamoJSON(w, map[string]interface{}{})
+
+	case "GetItem":
+		keyAttrs, _ := req["Key"].(map[string]interface{})
+		if item, ok := table.Items[dynamoKey(table, keyAttrs)]; ok {
+			writeDynamoJSON(w, map[string]interface{}{"Item": item})
+			return
+		}
+		writeDynamoJSON(w, map[string]interface{}{})
+
+	case "DeleteItem":
+		keyAttrs, _ := req["Key"].(map[string]interface{})
+		delete(table.Items, dynamoKey(table, keyAttrs))
+		writeDynamoJSON(w, map[string]interface{}{})
+
+	case "Scan":
+		var keys []string
+		for k := range table.Items {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		items := make([]interface{}, 0, len(keys))
+		for _, k := range keys {
+			items = append(items, table.Items[k])
+		}
+		writeDynamoJSON(w, map[string]interface{}{"Items": items, "Count": len(items), "ScannedCount": len(items)})
+
+	default:
+		writeDynamoError(w, "UnknownOperationException", "unsupported operation "+op)
+	}
+}
+
+func describeTable(t *DynamoTable) map[string]interface{} {
+	return map[string]interface{}{
+		"TableName":            t.Name,
+		"TableStatus":          "ACTIVE",
+		"AttributeDefinitions": t.AttributeDefinitions,
+		"KeySchema":            t.KeySchema,
+		"ItemCount":            len(t.Items),
+		"BillingModeSummary":   map[string]interface{}{"BillingMode": "PAY_PER_REQUEST"},
+	}
+}
+
+func dynamoKey(t *DynamoTable, item map[string]interface{}) string {
+	hashKey := t.HashKey
+	if hashKey == "" {
+		hashKey = "LockID"
+	}
+	attr, _ := item[hashKey].(map[string]interface{})
+	for _, v := range attr {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+func writeDynamoJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeDynamoError(w http.ResponseWriter, code, message string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{
+		"__type":  "com.amazonaws.dynamodb.v20120810#" + code,
+		"message": message,
+	})
+}
@@ -0,0 +1,44 @@
+package testutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// WriteFiles creates each relative path in files under root with the given
+// contents, creating parent directories as needed
+func WriteFiles(t testing.TB, root string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to create directory for %s: %v", name, err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+}
+
+// Chdir changes the working directory to dir and restores it when the test ends.
+// config.LoadConfig finds the project from the working directory, so tests
+// that exercise it need to run from inside a fixture project. The user-level
+// config is pointed at an empty directory so the developer's own settings
+// don't leak in.
+func Chdir(t testing.TB, dir string) {
+	t.Helper()
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	prev, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get working directory: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("failed to change directory to %s: %v", dir, err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(prev)
+	})
+}
@@ -0,0 +1,254 @@
+package testutil
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// FakeTerraformVersion is the version reported by the fake terraform binary
+const FakeTerraformVersion = "1.6.6"
+
+// DefaultPlanJSON is a minimal `terraform show -json` plan with one resource
+// to create, used until a test provides its own with SetPlan
+const DefaultPlanJSON = `{
+  "format_version": "1.2",
+  "terraform_version": "` + FakeTerraformVersion + `",
+  "resource_changes": [
+    {
+      "address": "null_resource.example",
+      "mode": "managed",
+      "type": "null_resource",
+      "name": "example",
+      "provider_name": "registry.terraform.io/hashicorp/null",
+      "change": {"actions": ["create"], "before": null, "after": {"triggers": null}}
+    }
+  ]
+}`
+
+// DefaultStateJSON is an empty `terraform show -json` state
+const DefaultStateJSON = `{"format_version": "1.0", "terraform_version": "` + FakeTerraformVersion + `"}`
+
+// fakeTerraformScript is a POSIX shell implementation of just enough of the
+// terraform CLI for tfexec. Every invocation is appended to invocations.log as
+// a line of \037-separated arguments. Canned responses are read from files in
+// the same directory, and a fail_<subcommand> file makes that subcommand exit 1
+// with the file contents on stderr.
+const fakeTerraformScript = `#!/bin/sh
+dir="@DIR@"
+printf '%s\037' "$@" >> "$dir/invocations.log"
+printf '\n' >> "$dir/invocations.log"
+
+cmd="$1"
+if [ -f "$dir/fail_$cmd" ]; then
+  cat "$dir/fail_$cmd" >&2
+  exit 1
+fi
+
+case "$cmd" in
+  version)
+    if [ "$2" = "-json" ]; then
+      printf '{"terraform_version":"@VERSION@","platform":"linux_amd64","provider_selections":{},"terraform_outdated":false}\n'
+    else
+      printf 'Terraform v@VERSION@\non linux_amd64\n'
+    fi
+    ;;
+  init)
+    printf 'Terraform has been successfully initialized!\n'
+    ;;
+  plan)
+    for arg in "$@"; do
+      case "$arg" in
+        -out=*) cp "$dir/plan.json" "${arg#-out=}" ;;
+      esac
+    done
+    exit "$(cat "$dir/plan_exit")"
+    ;;
+  show)
+    last=""
+    for arg in "$@"; do last="$arg"; done
+    case "$last" in
+      -*) cat "$dir/state.json" ;;
+      *)
+        if [ -f "$last" ]; then cat "$dir/plan.json"; else cat "$dir/state.json"; fi
+        ;;
+    esac
+    ;;
+  output)
+    cat "$dir/outputs.json"
+    ;;
+  state)
+    case "$2" in
+      pull) cat "$dir/tfstate.json" ;;
+      push)
+        last=""
+        for arg in "$@"; do last="$arg"; done
+        cp "$last" "$dir/tfstate.json"
+        ;;
+    esac
+    ;;
+  workspace)
+    last=""
+    for arg in "$@"; do last="$arg"; done
+    current="$(cat "$dir/workspace")"
+    case "$2" in
+      show) echo "$current" ;;
+      list)
+        while read -r ws; do
+          if [ "$ws" = "$current" ]; then echo "* $ws"; else echo "  $ws"; fi
+        done < "$dir/workspaces"
+        ;;
+      new)
+        if grep -qx "$last" "$dir/workspaces"; then
+          echo "Workspace \"$last\" already exists" >&2
+          exit 1
+        fi
+        echo "$last" >> "$dir/workspaces"
+        printf '%s' "$last" > "$dir/workspace"
+        ;;
+      select)
+        if ! grep -qx "$last" "$dir/workspaces"; then
+          echo "Workspace \"$last\" doesn't exist." >&2
+          exit 1
+        fi
+        printf '%s' "$last" > "$dir/workspace"
+        ;;
+    esac
+    ;;
+esac
+exit 0
+`
+
+// FakeTerraform is a stand-in terraform executable installed on PATH
+type FakeTerraform struct {
+	// Dir holds the binary, its canned responses and the invocation log
+	Dir string
+}
+
+// InstallFakeTerraform writes a fake terraform binary into a temporary
+// directory and prepends that directory to PATH for the duration of the test
+func InstallFakeTerraform(t testing.TB) *FakeTerraform {
+	t.Helper()
+
+	dir := t.TempDir()
+	ft := &FakeTerraform{Dir: dir}
+
+	script := strings.ReplaceAll(fakeTerraformScript, "@DIR@", dir)
+	script = strings.ReplaceAll(script, "@VERSION@", FakeTerraformVersion)
+	if err := os.WriteFile(filepath.Join(dir, "terraform"), []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write fake terraform: %v", err)
+	}
+
+	ft.write(t, "plan.json", DefaultPlanJSON)
+	ft.write(t, "plan_exit", "2")
+	ft.write(t, "state.json", DefaultStateJSON)
+	ft.write(t, "outputs.json", "{}")
+	ft.write(t, "tfstate.json", `{"version": 4, "serial": 1, "lineage": "test-lineage", "resources": []}`)
+	ft.write(t, "workspace", "default")
+	ft.write(t, "workspaces", "default\n")
+	ft.write(t, "invocations.log", "")
+
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	return ft
+}
+
+// SetPlan sets the plan JSON returned by `terraform show -json <planfile>`
+func (ft *FakeTerraform) SetPlan(t testing.TB, planJSON string) {
+	t.Helper()
+	ft.write(t, "plan.json", planJSON)
+}
+
+// SetPlanExitCode sets the exit code of `terraform plan` (0 = no changes, 2 = changes)
+func (ft *FakeTerraform) SetPlanExitCode(t testing.TB, code string) {
+	t.Helper()
+	ft.write(t, "plan_exit", code)
+}
+
+// SetOutputs sets the JSON returned by `terraform output -json`
+func (ft *FakeTerraform) SetOutputs(t testing.TB, outputsJSON string) {
+	t.Helper()
+	ft.write(t, "outputs.json", outputsJSON)
+}
+
+// SetStatePull sets the raw state returned by `terraform state pull`
+func (ft *FakeTerraform) SetStatePull(t testing.TB, stateJSON string) {
+	t.Helper()
+	ft.write(t, "tfstate.json", stateJSON)
+}
+
+// State returns the state currently held by the fake, including any
+// state pushed with `terraform state push`
+func (ft *FakeTerraform) State(t testing.TB) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(ft.Dir, "tfstate.json"))
+	if err != nil {
+		t.Fatalf("failed to read fake state: %v", err)
+	}
+	return string(data)
+}
+
+// SetWorkspaces sets the workspaces that already exist besides default and
+// selects default, as in a freshly initialized working directory
+func (ft *FakeTerraform) SetWorkspaces(t testing.TB, names ...string) {
+	t.Helper()
+	ft.write(t, "workspace", "default")
+	ft.write(t, "workspaces", "default\n"+strings.Join(names, "\n")+"\n")
+}
+
+// Workspace returns the currently selected workspace
+func (ft *FakeTerraform) Workspace(t testing.TB) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(ft.Dir, "workspace"))
+	if err != nil {
+		t.Fatalf("failed to read fake workspace: %v", err)
+	}
+	return string(data)
+}
+
+// Fail makes the given subcommand exit non-zero with message on stderr
+func (ft *FakeTerraform) Fail(t testing.TB, subcommand, message string) {
+	t.Helper()
+	ft.write(t, "fail_"+subcommand, message)
+}
+
+// Invocations returns the arguments of every call made to the fake binary
+func (ft *FakeTerraform) Invocations(t testing.TB) [][]string {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join(ft.Dir, "invocations.log"))
+	if err != nil {
+		t.Fatalf("failed to read invocation log: %v", err)
+	}
+
+	var calls [][]string
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		calls = append(calls, strings.Split(strings.TrimSuffix(line, "\037"), "\037"))
+	}
+	return calls
+}
+
+// Subcommands returns the first argument of every invocation, skipping the
+// version probes tfexec makes on its own
+func (ft *FakeTerraform) Subcommands(t testing.TB) []string {
+	t.Helper()
+
+	var subcommands []string
+	for _, call := range ft.Invocations(t) {
+		if len(call) > 0 && call[0] != "version" {
+			subcommands = append(subcommands, call[0])
+		}
+	}
+	return subcommands
+}
+
+func (ft *FakeTerraform) write(t testing.TB, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(ft.Dir, name), []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+}
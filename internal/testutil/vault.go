@@ -0,0 +1,167 @@
+// Package testutil provides offline stand-ins for the external services tf-go
+// talks to (Vault, S3, DynamoDB, STS and the terraform binary) so that whole
+// deploy flows can run inside `go test` without network access.
+package testutil
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// DefaultVaultToken is the token accepted by a VaultServer unless overridden
+const DefaultVaultToken = "test-root-token"
+
+// VaultServer is an in-process fake of the Vault HTTP API. It serves KV v1 and
+// KV v2 reads plus the token, approle and kubernetes auth endpoints.
+type VaultServer struct {
+	*httptest.Server
+
+	// Token is the only token the server accepts in X-Vault-Token
+	Token string
+
+	mu       sync.Mutex
+	kv1      map[string]map[string]interface{}
+	kv2      map[string][]map[string]interface{}
+	requests []string
+}
+
+// NewVaultServer starts a fake Vault server that is shut down when the test ends
+func NewVaultServer(t testing.TB) *VaultServer {
+	t.Helper()
+
+	s := &VaultServer{
+		Token: DefaultVaultToken,
+		kv1:   make(map[string]map[string]interface{}),
+		kv2:   make(map[string][]map[string]interface{}),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// SetEnv points VAULT_ADDR and VAULT_TOKEN at this server for the duration of the test
+func (s *VaultServer) SetEnv(t testing.TB) {
+	t.Helper()
+	t.Setenv("VAULT_ADDR", s.URL)
+	t.Setenv("VAULT_TOKEN", s.Token)
+}
+
+// PutKV1 stores data at mount/path in a KV version 1 engine
+func (s *VaultServer) PutKV1(mount, path string, data map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kv1[joinVaultPath(mount, path)] = data
+}
+
+// PutKV2 stores a new version of data at mount/path in a KV version 2 engine
+func (s *VaultServer) PutKV2(mount, path string, data map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := joinVaultPath(mount, path)
+	s.kv2[key] = append(s.kv2[key], data)
+}
+
+// Requests returns the "METHOD /path" of every request the server has seen
+func (s *VaultServer) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func (s *VaultServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	s.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+
+	switch {
+	case path == "sys/health":
+		writeVaultJSON(w, http.StatusOK, map[string]interface{}{
+			"initialized": true,
+			"sealed":      false,
+			"standby":     false,
+		})
+		return
+	case strings.HasPrefix(path, "auth/") && strings.HasSuffix(path, "/login"):
+		// approle, kubernetes and friends all hand back the configured token
+		writeVaultJSON(w, http.StatusOK, map[string]interface{}{
+			"auth": map[string]interface{}{
+				"client_token":   s.Token,
+				"lease_duration": 3600,
+				"renewable":      true,
+			},
+		})
+		return
+	}
+
+	if r.Header.Get("X-Vault-Token") != s.Token {
+		writeVaultErrors(w, http.StatusForbidden, "permission denied")
+		return
+	}
+
+	if path == "auth/token/lookup-self" {
+		writeVaultJSON(w, http.StatusOK, map[string]interface{}{
+			"data": map[string]interface{}{
+				"id":       s.Token,
+				"policies": []string{"root"},
+				"ttl":      0,
+			},
+		})
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		writeVaultErrors(w, http.StatusMethodNotAllowed, "unsupported method")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// KV v2 reads look like <mount>/data/<path>
+	if parts := strings.SplitN(path, "/", 3); len(parts) == 3 && parts[1] == "data" {
+		if versions, ok := s.kv2[joinVaultPath(parts[0], parts[2])]; ok && len(versions) > 0 {
+			writeVaultJSON(w, http.StatusOK, map[string]interface{}{
+				"data": map[string]interface{}{
+					"data": versions[len(versions)-1],
+					"metadata": map[string]interface{}{
+						"version":       len(versions),
+						"deletion_time": "",
+						"destroyed":     false,
+					},
+				},
+			})
+			return
+		}
+	}
+
+	if data, ok := s.kv1[path]; ok {
+		writeVaultJSON(w, http.StatusOK, map[string]interface{}{"data": data})
+		return
+	}
+
+	writeVaultErrors(w, http.StatusNotFound)
+}
+
+func joinVaultPath(mount, path string) string {
+	return strings.Trim(mount, "/") + "/" + strings.Trim(path, "/")
+}
+
+func writeVaultJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeVaultErrors(w http.ResponseWriter, status int, errs ...string) {
+	if errs == nil {
+		errs = []string{}
+	}
+	writeVaultJSON(w, status, map[string]interface{}{"errors": errs})
+}
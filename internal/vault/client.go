@@ -8,9 +8,12 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	vaultapi "github.com/hashicorp/vault/api"
 	"github.com/kingoftowns/tf-go/internal/config"
+	"github.com/kingoftowns/tf-go/internal/redact"
 )
 
 func getKeys(m map[string]interface{}) []string {
@@ -45,7 +48,6 @@ func (c *Client) Authenticate(ctx context.Context, cfg *config.Config) error {
 	switch cfg.Vault.AuthMethod {
 	case "token":
 		token := os.Getenv("VAULT_TOKEN")
-		fmt.Printf("DEBUG: Token from env: %s\n", token)
 		if token == "" {
 			homeDir, err := os.UserHomeDir()
 			if err != nil {
@@ -58,7 +60,7 @@ func (c *Client) Authenticate(ctx context.Context, cfg *config.Config) error {
 				if err != nil {
 					return fmt.Errorf("failed to read token file: %w", err)
 				}
-				token = string(tokenData)
+				token = strings.TrimSpace(string(tokenData))
 			}
 		}
 
@@ -66,8 +68,8 @@ func (c *Client) Authenticate(ctx context.Context, cfg *config.Config) error {
 			return fmt.Errorf("no Vault token found")
 		}
 
+		redact.Register(token)
 		c.client.SetToken(token)
-		fmt.Printf("DEBUG: Token authentication successful\n")
 		return nil
 
 	default:
@@ -75,13 +77,61 @@ func (c *Client) Authenticate(ctx context.Context, cfg *config.Config) error {
 	}
 }
 
+// Address returns the address of the Vault server the client talks to
+func (c *Client) Address() string {
+	return c.client.Address()
+}
+
+// Token returns the token the client authenticated with
+func (c *Client) Token() string {
+	return c.client.Token()
+}
+
+// GetProviderConfig returns the provider configuration of env from the KV v2
+// document at path
 func (c *Client) GetProviderConfig(ctx context.Context, path, env string) (map[string]interface{}, error) {
-	vaultAddr := os.Getenv("VAULT_ADDR")
-	if vaultAddr == "" {
-		vaultAddr = "http://127.0.0.1:8200"
+	nestedData, err := c.readProviderDocument(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	envData, exists := nestedData[env]
+	if !exists {
+		return nil, fmt.Errorf("no configuration found for environment: %s", env)
+	}
+
+	if jsonStr, ok := envData.(string); ok {
+		var config map[string]interface{}
+		if err := json.Unmarshal([]byte(jsonStr), &config); err != nil {
+			return nil, fmt.Errorf("failed to parse JSON configuration for env %s: %w", env, err)
+		}
+		return config, nil
+	}
+
+	if configMap, ok := envData.(map[string]interface{}); ok {
+		return configMap, nil
+	}
+
+	return nil, fmt.Errorf("unexpected data type for environment %s", env)
+}
+
+// ProviderEnvironments returns the environments the KV v2 document at path
+// has provider configuration for, sorted
+func (c *Client) ProviderEnvironments(ctx context.Context, path string) ([]string, error) {
+	nestedData, err := c.readProviderDocument(ctx, path)
+	if err != nil {
+		return nil, err
 	}
+	envs := getKeys(nestedData)
+	sort.Strings(envs)
+	return envs, nil
+}
 
-	url := vaultAddr + "/v1/" + path
+// readProviderDocument reads the data of the KV v2 document at path, which
+// holds one provider configuration per environment
+func (c *Client) readProviderDocument(ctx context.Context, path string) (map[string]interface{}, error) {
+	// The client's address is VAULT_ADDR unless NewClient was given one
+	url := strings.TrimSuffix(c.client.Address(), "/") + "/v1/" + path
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
@@ -114,7 +164,7 @@ func (c *Client) GetProviderConfig(ctx context.Context, path, env string) (map[s
 		return nil, fmt.Errorf("failed to parse JSON response: %w", err)
 	}
 
-	// Navigate to data.data.{{env}}
+	// Navigate to data.data, which is keyed by environment
 	data, ok := vaultResponse["data"].(map[string]interface{})
 	if !ok {
 		return nil, fmt.Errorf("invalid response structure: no 'data' key")
@@ -124,23 +174,5 @@ func (c *Client) GetProviderConfig(ctx context.Context, path, env string) (map[s
 	if !ok {
 		return nil, fmt.Errorf("invalid response structure: no nested 'data' key")
 	}
-
-	envData, exists := nestedData[env]
-	if !exists {
-		return nil, fmt.Errorf("no configuration found for environment: %s", env)
-	}
-
-	if jsonStr, ok := envData.(string); ok {
-		var config map[string]interface{}
-		if err := json.Unmarshal([]byte(jsonStr), &config); err != nil {
-			return nil, fmt.Errorf("failed to parse JSON configuration for env %s: %w", env, err)
-		}
-		return config, nil
-	}
-
-	if configMap, ok := envData.(map[string]interface{}); ok {
-		return configMap, nil
-	}
-
-	return nil, fmt.Errorf("unexpected data type for environment %s", env)
+	return nestedData, nil
 }
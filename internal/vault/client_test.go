@@ -0,0 +1,134 @@
+package vault
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/kingoftowns/tf-go/internal/config"
+	"github.com/kingoftowns/tf-go/internal/redact"
+	"github.com/kingoftowns/tf-go/internal/testutil"
+)
+
+func TestGetProviderConfig(t *testing.T) {
+	server := testutil.NewVaultServer(t)
+	server.SetEnv(t)
+	server.PutKV2("terraform", "providers", map[string]interface{}{
+		"dev":   `{"aws": {"region": "us-east-1"}}`,
+		"stage": map[string]interface{}{"aws": map[string]interface{}{"region": "us-west-2"}},
+	})
+
+	client, err := NewClient(server.URL)
+	if err != nil {
+		t.Fatalf("NewClient returned error: %v", err)
+	}
+
+	tests := []struct {
+		env    string
+		region string
+	}{
+		{env: "dev", region: "us-east-1"},
+		{env: "stage", region: "us-west-2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			cfg, err := client.GetProviderConfig(context.Background(), "terraform/data/providers", tt.env)
+			if err != nil {
+				t.Fatalf("GetProviderConfig returned error: %v", err)
+			}
+			aws, _ := cfg["aws"].(map[string]interface{})
+			if aws["region"] != tt.region {
+				t.Errorf("aws.region = %v, want %s", aws["region"], tt.region)
+			}
+		})
+	}
+}
+
+func TestGetProviderConfigErrors(t *testing.T) {
+	server := testutil.NewVaultServer(t)
+	server.SetEnv(t)
+	server.PutKV2("terraform", "providers", map[string]interface{}{"dev": `{}`})
+
+	client, err := NewClient(server.URL)
+	if err != nil {
+		t.Fatalf("NewClient returned error: %v", err)
+	}
+
+	if _, err := client.GetProviderConfig(context.Background(), "terraform/data/providers", "prod"); err == nil ||
+		!strings.Contains(err.Error(), "no configuration found") {
+		t.Errorf("expected missing environment error, got %v", err)
+	}
+
+	t.Setenv("VAULT_TOKEN", "wrong-token")
+	if _, err := client.GetProviderConfig(context.Background(), "terraform/data/providers", "dev"); err == nil ||
+		!strings.Contains(err.Error(), "status 403") {
+		t.Errorf("expected permission error, got %v", err)
+	}
+}
+
+func TestGetProviderConfigUsesClientAddress(t *testing.T) {
+	server := testutil.NewVaultServer(t)
+	server.SetEnv(t)
+	server.PutKV2("terraform", "providers", map[string]interface{}{"dev": `{"aws": {"region": "us-east-1"}}`})
+	// As with -vault-addr, the token must go to the server the client was made for
+	t.Setenv("VAULT_ADDR", "http://127.0.0.1:1")
+
+	client, err := NewClient(server.URL)
+	if err != nil {
+		t.Fatalf("NewClient returned error: %v", err)
+	}
+	if _, err := client.GetProviderConfig(context.Background(), "terraform/data/providers", "dev"); err != nil {
+		t.Errorf("GetProviderConfig returned error: %v", err)
+	}
+	if got := server.Requests(); len(got) != 1 || got[0] != "GET /v1/terraform/data/providers" {
+		t.Errorf("unexpected requests: %v", got)
+	}
+}
+
+func TestProviderEnvironments(t *testing.T) {
+	server := testutil.NewVaultServer(t)
+	server.SetEnv(t)
+	server.PutKV2("terraform", "providers", map[string]interface{}{
+		"stage": `{}`,
+		"dev":   `{}`,
+		"prod":  map[string]interface{}{},
+	})
+
+	client, err := NewClient(server.URL)
+	if err != nil {
+		t.Fatalf("NewClient returned error: %v", err)
+	}
+
+	envs, err := client.ProviderEnvironments(context.Background(), "terraform/data/providers")
+	if err != nil {
+		t.Fatalf("ProviderEnvironments returned error: %v", err)
+	}
+	if strings.Join(envs, ",") != "dev,prod,stage" {
+		t.Errorf("ProviderEnvironments = %v", envs)
+	}
+}
+
+func TestAuthenticateWithTokenFile(t *testing.T) {
+	redact.Reset()
+	defer redact.Reset()
+
+	home := t.TempDir()
+	testutil.WriteFiles(t, home, map[string]string{".vault-token": "hvs.file-token\n"})
+	t.Setenv("HOME", home)
+	t.Setenv("VAULT_TOKEN", "")
+
+	client, err := NewClient("http://127.0.0.1:1")
+	if err != nil {
+		t.Fatalf("NewClient returned error: %v", err)
+	}
+	if err := client.Authenticate(context.Background(), &config.Config{Vault: config.VaultConfig{AuthMethod: "token"}}); err != nil {
+		t.Fatalf("Authenticate returned error: %v", err)
+	}
+	if client.Token() != "hvs.file-token" {
+		t.Errorf("Token() = %q, want the file's token without its newline", client.Token())
+	}
+	if got := redact.String("token hvs.file-token"); got != "token "+redact.Placeholder {
+		t.Errorf("the token file's token is not redacted: %q", got)
+	}
+}